@@ -0,0 +1,163 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"hash/crc32"
+	"math/rand"
+	"strings"
+	"time"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultAntiEntropySample is the default GroupOptions.AntiEntropySample.
+const defaultAntiEntropySample = 8
+
+// antiEntropy runs the checks of GroupOptions.AntiEntropyInterval on
+// a goroutine of its own.
+type antiEntropy struct {
+	cancel context.CancelFunc // stops the goroutine
+	done   chan struct{}      // closed once it has returned
+}
+
+func (g *Group) startAntiEntropy() {
+	ctx, cancel := context.WithCancel(context.Background())
+	ae := &antiEntropy{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(ae.done)
+		interval := g.opts.AntiEntropyInterval
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			// A check that takes longer than the interval is given up
+			// rather than letting checks pile up.
+			checkCtx, cancel := context.WithTimeout(ctx, interval)
+			g.syncHotCache(checkCtx, g.opts.AntiEntropySample)
+			cancel()
+		}
+	}()
+	g.antiEntropy = ae
+}
+
+// stop stops the checks, waiting for the one in progress to return.
+func (ae *antiEntropy) stop() {
+	ae.cancel()
+	<-ae.done
+}
+
+// syncHotCache compares the values of up to n keys picked at random
+// from the group's hot caches with those cached by their owners,
+// removing the copies that no longer match.
+func (g *Group) syncHotCache(ctx context.Context, n int) {
+	var keys []string
+	_, hots := g.allCaches()
+	for _, hot := range hots {
+		k, _ := hot.entries()
+		keys = append(keys, k...)
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if len(keys) > n {
+		rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		keys = keys[:n]
+	}
+
+	g.peersOnce.Do(g.initPeers)
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		// The storage key of an overlong key cannot be sent in its
+		// place, as the owner would digest it again.
+		if strings.HasPrefix(key, keyDigestPrefix) {
+			continue
+		}
+		g.syncHotKey(ctx, key)
+	}
+}
+
+// syncHotKey removes the hot cache copy of key, a storage key, if it
+// does not match the value cached by the owner of key.
+func (g *Group) syncHotKey(ctx context.Context, key string) {
+	_, hot, _ := g.caches(key)
+	value, ok := hot.peekValue(key)
+	if !ok {
+		return
+	}
+	if value, ok = g.cachedView(key, value); !ok {
+		return
+	}
+	peer, ok := g.peers.PickPeer(g.routingKey(key))
+	if !ok {
+		return
+	}
+	sum, held, err := peer.Checksum(ctx, &pb.GetRequest{Group: &g.name, Key: &key})
+	if err != nil {
+		if log := g.logger(); log != nil && ctx.Err() == nil {
+			log.WithFields(logrus.Fields{
+				"err":      err,
+				"key":      key,
+				"category": "groupcache",
+			}).Warnf("error checking hot cache copy against peer '%s'", peer.GetURL())
+		}
+		return
+	}
+	g.Stats.AntiEntropyChecks.Add(1)
+	if held && sum == viewChecksum(value) {
+		return
+	}
+	g.Stats.AntiEntropyInvalidations.Add(1)
+	g.loadGroup.Lock(func() {
+		hot.remove(key)
+	})
+}
+
+// mainChecksum returns the checksum of the value of key in the main
+// cache, as reported by ProtoGetter.Checksum, and whether it is there.
+// Unlike Get, it never loads the key.
+func (g *Group) mainChecksum(key string) (uint32, bool) {
+	if g.cacheLimit() <= 0 {
+		return 0, false
+	}
+	key = g.storageKey(key)
+	main, _, _ := g.caches(key)
+	value, ok := main.peekValue(key)
+	if !ok {
+		return 0, false
+	}
+	if value, ok = g.cachedView(key, value); !ok {
+		return 0, false
+	}
+	return viewChecksum(value), true
+}
+
+// viewChecksum returns the CRC-32 (IEEE) checksum of v's bytes.
+func viewChecksum(v ByteView) uint32 {
+	if v.b != nil {
+		return crc32.ChecksumIEEE(v.b)
+	}
+	return crc32.ChecksumIEEE([]byte(v.s))
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAntiEntropy(t *testing.T) {
+	peer := &fakePeer{}
+	g := newGroupOpts("TestAntiEntropy-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("local:"+key, time.Time{})
+	}), keyPeers{"current": peer, "diverged": peer}, &GroupOptions{
+		AntiEntropyInterval: 10 * time.Millisecond,
+	})
+	defer g.Close()
+
+	// The peer owning both keys now returns "got:diverged", which the
+	// copy of diverged missed.
+	g.populateCache("current", ByteView{s: "got:current"}, &g.hotCache)
+	g.populateCache("diverged", ByteView{s: "got:before-update"}, &g.hotCache)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for g.hotCache.peek("diverged") {
+		if time.Now().After(deadline) {
+			t.Fatal("diverged copy still cached after 5s of checks")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	g.Close()
+	if !g.hotCache.peek("current") {
+		t.Error("copy matching its owner's value was dropped")
+	}
+	if got := g.Stats.AntiEntropyInvalidations.Get(); got != 1 {
+		t.Errorf("AntiEntropyInvalidations = %d; want 1", got)
+	}
+	if got := g.Stats.AntiEntropyChecks.Get(); got < 2 {
+		t.Errorf("AntiEntropyChecks = %d; want at least 2", got)
+	}
+
+	// No checks run once the group is closed.
+	checks := g.Stats.AntiEntropyChecks.Get()
+	time.Sleep(50 * time.Millisecond)
+	if got := g.Stats.AntiEntropyChecks.Get(); got != checks {
+		t.Errorf("AntiEntropyChecks went from %d to %d after Close", checks, got)
+	}
+}
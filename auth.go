@@ -0,0 +1,147 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultHMACMaxSkew is the default maxSkew of NewHMACAuthenticator.
+const defaultHMACMaxSkew = 5 * time.Minute
+
+// timestampHeader carries the time at which an HMACAuthenticator
+// signed a request, in Unix seconds.
+const timestampHeader = "X-Groupcache-Timestamp"
+
+var (
+	errMissingAuth = errors.New("groupcache: request is not authenticated")
+	errBadAuth     = errors.New("groupcache: bad request authentication")
+	errStaleAuth   = errors.New("groupcache: request signed too long ago")
+)
+
+// A PeerAuthenticator authenticates the requests exchanged by the
+// peers of an HTTPPool, given as HTTPPoolOptions.Authenticator. Every
+// peer in the cluster must use the same authenticator, with the same
+// secret.
+type PeerAuthenticator interface {
+	// Sign adds the credentials of this process to req, a request to
+	// a peer, after the headers of RequestModifier.
+	Sign(req *http.Request)
+
+	// Verify returns an error unless req, a request from a peer,
+	// carries valid credentials.
+	Verify(req *http.Request) error
+}
+
+// NewBearerAuthenticator returns a PeerAuthenticator sending token in
+// the Authorization header of each request, and accepting only the
+// requests that carry it.
+func NewBearerAuthenticator(token string) PeerAuthenticator {
+	return bearerAuth{header: "Bearer " + token}
+}
+
+type bearerAuth struct {
+	header string
+}
+
+func (a bearerAuth) Sign(req *http.Request) {
+	req.Header.Set("Authorization", a.header)
+}
+
+func (a bearerAuth) Verify(req *http.Request) error {
+	got := req.Header.Get("Authorization")
+	if got == "" {
+		return errMissingAuth
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(a.header)) != 1 {
+		return errBadAuth
+	}
+	return nil
+}
+
+// NewHMACAuthenticator returns a PeerAuthenticator signing the method,
+// path and query of each request, with the time it was sent, by an
+// HMAC-SHA256 keyed with key. Unlike a bearer token, the signature of
+// an intercepted request cannot be used for another path or query. It
+// only accepts signatures made within maxSkew of the current time,
+// which bounds for how long an intercepted request can be replayed and
+// how far apart the clocks of peers may be.
+// If maxSkew is zero, it defaults to 5 minutes.
+//
+// The body and the other headers of a request are not signed: within
+// maxSkew, an intercepted request can be replayed with another body or
+// X-Groupcache-* headers, so that a captured Set of a key stores a
+// different value. Use TLS between peers to protect them.
+func NewHMACAuthenticator(key []byte, maxSkew time.Duration) PeerAuthenticator {
+	if maxSkew == 0 {
+		maxSkew = defaultHMACMaxSkew
+	}
+	return &hmacAuth{key: append([]byte(nil), key...), maxSkew: maxSkew, now: time.Now}
+}
+
+type hmacAuth struct {
+	key     []byte
+	maxSkew time.Duration
+	now     func() time.Time // for tests
+}
+
+const hmacAuthScheme = "Groupcache-HMAC-SHA256 "
+
+func (a *hmacAuth) sign(method, uri, timestamp string) []byte {
+	m := hmac.New(sha256.New, a.key)
+	m.Write([]byte(method + "\n" + uri + "\n" + timestamp))
+	return m.Sum(nil)
+}
+
+func (a *hmacAuth) Sign(req *http.Request) {
+	ts := strconv.FormatInt(a.now().Unix(), 10)
+	req.Header.Set(timestampHeader, ts)
+	req.Header.Set("Authorization", hmacAuthScheme+hex.EncodeToString(a.sign(req.Method, req.URL.RequestURI(), ts)))
+}
+
+func (a *hmacAuth) Verify(req *http.Request) error {
+	auth, ts := req.Header.Get("Authorization"), req.Header.Get(timestampHeader)
+	if auth == "" || ts == "" {
+		return errMissingAuth
+	}
+	if !strings.HasPrefix(auth, hmacAuthScheme) {
+		return errBadAuth
+	}
+	sum, err := hex.DecodeString(auth[len(hmacAuthScheme):])
+	if err != nil {
+		return errBadAuth
+	}
+	if !hmac.Equal(sum, a.sign(req.Method, req.URL.RequestURI(), ts)) {
+		return errBadAuth
+	}
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errBadAuth
+	}
+	if skew := a.now().Sub(time.Unix(secs, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return errStaleAuth
+	}
+	return nil
+}
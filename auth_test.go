@@ -0,0 +1,97 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestHTTPPoolAuthenticator(t *testing.T) {
+	owner := newGroup("TestHTTPPoolAuthenticator-owner", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	for _, tc := range []struct {
+		name         string
+		server, peer PeerAuthenticator
+	}{
+		{"bearer", NewBearerAuthenticator("secret"), NewBearerAuthenticator("other")},
+		{"hmac", NewHMACAuthenticator([]byte("secret"), 0), NewHMACAuthenticator([]byte("other"), 0)},
+	} {
+		p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{Authenticator: tc.server})
+		ts := httptest.NewServer(p)
+		defer ts.Close()
+
+		get := func(auth PeerAuthenticator) error {
+			h := &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}, auth: auth}
+			var res pb.GetResponse
+			err := h.Get(context.Background(), &pb.GetRequest{Group: proto.String(owner.Name()), Key: proto.String("key")}, &res)
+			if err == nil && string(res.Value) != "value:key" {
+				t.Errorf("%s: Get = %q; want %q", tc.name, res.Value, "value:key")
+			}
+			return err
+		}
+		if err := get(tc.server); err != nil {
+			t.Errorf("%s: authenticated Get: %v", tc.name, err)
+		}
+		for _, auth := range []PeerAuthenticator{nil, tc.peer} {
+			if err := get(auth); err == nil || !strings.Contains(err.Error(), "401") {
+				t.Errorf("%s: Get with authenticator %v = %v; want a 401 error", tc.name, auth, err)
+			}
+		}
+	}
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	now := time.Now()
+	auth := NewHMACAuthenticator([]byte("secret"), time.Minute).(*hmacAuth)
+	auth.now = func() time.Time { return now }
+
+	req := httptest.NewRequest(http.MethodGet, "/_groupcache/group/key", nil)
+	auth.Sign(req)
+	if err := auth.Verify(req); err != nil {
+		t.Fatalf("Verify of a signed request: %v", err)
+	}
+
+	// The signature covers the path and method.
+	other := httptest.NewRequest(http.MethodGet, "/_groupcache/group/other", nil)
+	other.Header = req.Header
+	if err := auth.Verify(other); err != errBadAuth {
+		t.Errorf("Verify of a request for another key = %v; want %v", err, errBadAuth)
+	}
+	other = httptest.NewRequest(http.MethodPut, "/_groupcache/group/key", nil)
+	other.Header = req.Header
+	if err := auth.Verify(other); err != errBadAuth {
+		t.Errorf("Verify of a request with another method = %v; want %v", err, errBadAuth)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := auth.Verify(req); err != errStaleAuth {
+		t.Errorf("Verify of a request signed too long ago = %v; want %v", err, errStaleAuth)
+	}
+	if err := auth.Verify(httptest.NewRequest(http.MethodGet, "/_groupcache/group/key", nil)); err != errMissingAuth {
+		t.Errorf("Verify of an unsigned request = %v; want %v", err, errMissingAuth)
+	}
+}
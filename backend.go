@@ -0,0 +1,304 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// A CacheBackend stores the bytes of the values of a cache outside of
+// the entries the cache keeps on the Go heap, for
+// GroupOptions.NewCacheBackend. The cache keeps its index, keys and
+// the other fields of its values itself, and refers to the bytes it
+// stored by the reference Store returned.
+//
+// The cache serializes calls of Store and Free with any other call,
+// but may call Load concurrently with itself. Each cache has a
+// backend of its own.
+type CacheBackend interface {
+	// Store copies value into the backend and returns a reference to
+	// the copy.
+	Store(value []byte) (ref uint64, err error)
+
+	// Load returns the bytes stored under ref. They may only be read,
+	// and only until the next call of Store or Free, which may move
+	// them: the cache copies them out before returning them.
+	Load(ref uint64) []byte
+
+	// Free releases the bytes stored under ref.
+	Free(ref uint64)
+}
+
+// backedView is the lru value of a cache entry whose bytes are stored
+// in the cache's backend.
+type backedView struct {
+	view ByteView // without its bytes
+	ref  uint64
+	n    int // length of the bytes
+}
+
+func (v backedView) size() int64 {
+	return int64(v.n) + v.view.size()
+}
+
+// storeLocked returns the lru value holding value, storing its bytes in
+// the cache's backend if it has one. Values the backend fails to store
+// are kept on the heap.
+func (c *cache) storeLocked(value ByteView) interface{} {
+	if c.backend == nil || value.Len() == 0 {
+		return value
+	}
+	b := value.b
+	if b == nil {
+		b = []byte(value.s)
+	}
+	ref, err := c.backend.Store(b)
+	if err != nil {
+		return value
+	}
+	n := len(b)
+	value.b, value.s = nil, ""
+	return backedView{view: value, ref: ref, n: n}
+}
+
+// storedView returns the view held by the lru value vi, without the
+// bytes of a backed entry, for checks not needing them.
+func storedView(vi interface{}) ByteView {
+	if v, ok := vi.(backedView); ok {
+		return v.view
+	}
+	return vi.(ByteView)
+}
+
+// loadLocked returns the view held by the lru value vi, copying the
+// bytes of a backed entry out of the backend.
+func (c *cache) loadLocked(vi interface{}) ByteView {
+	v, ok := vi.(backedView)
+	if !ok {
+		return vi.(ByteView)
+	}
+	view := v.view
+	view.b = cloneBytes(c.backend.Load(v.ref))
+	return view
+}
+
+// entrySize returns the bytes the lru value vi counts besides its key.
+func entrySize(vi interface{}) int64 {
+	if v, ok := vi.(backedView); ok {
+		return v.size()
+	}
+	return vi.(ByteView).size()
+}
+
+// withExpire returns the lru value vi with its view expiring at expire.
+func withExpire(vi interface{}, expire time.Time) interface{} {
+	if v, ok := vi.(backedView); ok {
+		v.view.e = expire
+		return v
+	}
+	v := vi.(ByteView)
+	v.e = expire
+	return v
+}
+
+// defaultMmapSegmentBytes is the default segment size of NewMmapBackend.
+const defaultMmapSegmentBytes = 64 << 20
+
+// MmapBackend is a CacheBackend storing values in memory mapped from
+// the operating system in segments, outside of the Go heap, so that
+// large caches add little to the heap the garbage collector paces
+// itself on. On platforms without mmap, segments are allocated on the
+// heap.
+//
+// Values are appended to the newest segment. A segment is unmapped
+// once it holds no live values, and compacted, by moving its live
+// values to the newest segment, once they take less than a quarter of
+// it. Values larger than a segment get a segment of their own.
+type MmapBackend struct {
+	mapped int64 // bytes mapped, accessed atomically; first for alignment
+
+	segmentBytes int
+	segments     []*mmapSegment // nil where unmapped
+	active       int            // index of the newest segment, or -1
+	slots        []mmapSlot
+	freeSlots    []uint64
+}
+
+type mmapSegment struct {
+	mem  []byte
+	used int      // bytes appended
+	live int      // bytes of the values not freed
+	refs []uint64 // of the values appended, freed ones included
+}
+
+// mmapSlot locates the bytes stored under a reference.
+type mmapSlot struct {
+	segment int // -1 once freed
+	off, n  int
+}
+
+// NewMmapBackend returns a backend mapping memory in segments of
+// segmentBytes, to be returned by GroupOptions.NewCacheBackend.
+// If segmentBytes is zero, it defaults to 64 MiB.
+func NewMmapBackend(segmentBytes int) *MmapBackend {
+	if segmentBytes <= 0 {
+		segmentBytes = defaultMmapSegmentBytes
+	}
+	m := &MmapBackend{segmentBytes: segmentBytes, active: -1}
+	// The segments are unmapped once no cache refers to the backend
+	// any more, as when its group is deregistered.
+	runtime.SetFinalizer(m, (*MmapBackend).unmapAll)
+	return m
+}
+
+func (m *MmapBackend) unmapAll() {
+	for _, s := range m.segments {
+		if s != nil {
+			unmapSegment(s.mem)
+		}
+	}
+}
+
+// MappedBytes returns the bytes of the segments currently mapped.
+func (m *MmapBackend) MappedBytes() int64 {
+	return atomic.LoadInt64(&m.mapped)
+}
+
+// Store implements CacheBackend.
+func (m *MmapBackend) Store(value []byte) (uint64, error) {
+	segment, off, err := m.place(len(value))
+	if err != nil {
+		return 0, err
+	}
+	var ref uint64
+	if n := len(m.freeSlots); n > 0 {
+		ref = m.freeSlots[n-1]
+		m.freeSlots = m.freeSlots[:n-1]
+	} else {
+		ref = uint64(len(m.slots))
+		m.slots = append(m.slots, mmapSlot{})
+	}
+	m.put(ref, segment, off, value)
+	return ref, nil
+}
+
+// place reserves n bytes, returning the segment and offset to put them
+// at.
+func (m *MmapBackend) place(n int) (segment, off int, err error) {
+	if n > m.segmentBytes {
+		segment, err = m.newSegment(n)
+		return segment, 0, err
+	}
+	if m.active < 0 || m.segments[m.active].used+n > len(m.segments[m.active].mem) {
+		active, err := m.newSegment(m.segmentBytes)
+		if err != nil {
+			return 0, 0, err
+		}
+		m.active = active
+	}
+	return m.active, m.segments[m.active].used, nil
+}
+
+// put copies value to off in segment, and records it under ref.
+func (m *MmapBackend) put(ref uint64, segment, off int, value []byte) {
+	s := m.segments[segment]
+	copy(s.mem[off:], value)
+	if end := off + len(value); end > s.used {
+		s.used = end
+	}
+	s.live += len(value)
+	s.refs = append(s.refs, ref)
+	m.slots[ref] = mmapSlot{segment: segment, off: off, n: len(value)}
+}
+
+func (m *MmapBackend) newSegment(n int) (int, error) {
+	mem, err := mapSegment(n)
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&m.mapped, int64(len(mem)))
+	s := &mmapSegment{mem: mem}
+	for i, old := range m.segments {
+		if old == nil {
+			m.segments[i] = s
+			return i, nil
+		}
+	}
+	m.segments = append(m.segments, s)
+	return len(m.segments) - 1, nil
+}
+
+// Load implements CacheBackend.
+func (m *MmapBackend) Load(ref uint64) []byte {
+	slot := m.slots[ref]
+	end := slot.off + slot.n
+	return m.segments[slot.segment].mem[slot.off:end:end]
+}
+
+// Free implements CacheBackend.
+func (m *MmapBackend) Free(ref uint64) {
+	slot := m.slots[ref]
+	m.slots[ref] = mmapSlot{segment: -1}
+	m.freeSlots = append(m.freeSlots, ref)
+	m.segments[slot.segment].live -= slot.n
+	m.maybeReclaim(slot.segment)
+}
+
+// maybeReclaim unmaps segment if it holds no live values, or compacts
+// it if they take less than a quarter of it. The newest segment is
+// only emptied, to be reused from its start.
+func (m *MmapBackend) maybeReclaim(segment int) {
+	s := m.segments[segment]
+	if segment == m.active {
+		if s.live == 0 {
+			s.used, s.refs = 0, s.refs[:0]
+		}
+		return
+	}
+	if s.live > 0 && s.live >= len(s.mem)/4 {
+		return
+	}
+	if s.live > 0 && !m.compact(segment) {
+		return
+	}
+	m.segments[segment] = nil
+	atomic.AddInt64(&m.mapped, -int64(len(s.mem)))
+	unmapSegment(s.mem)
+}
+
+// compact moves the live values of segment to the newest segment,
+// reporting whether it could move them all.
+func (m *MmapBackend) compact(segment int) bool {
+	s := m.segments[segment]
+	refs := s.refs
+	for i, ref := range refs {
+		slot := m.slots[ref]
+		if slot.segment != segment {
+			continue
+		}
+		to, off, err := m.place(slot.n)
+		if err != nil {
+			s.refs = refs[i:]
+			return false
+		}
+		m.put(ref, to, off, s.mem[slot.off:slot.off+slot.n])
+		s.live -= slot.n
+	}
+	return true
+}
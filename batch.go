@@ -0,0 +1,199 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/melojustme/groupcache/singleflight"
+)
+
+// Defaults for the GroupOptions.BatchGetter settings.
+const (
+	defaultMaxBatchSize  = 100
+	defaultMaxBatchDelay = 2 * time.Millisecond
+)
+
+// A BatchGetter loads the values of several keys in one call, for
+// GroupOptions.BatchGetter. Keys missing from the returned map have no
+// value. The values do not expire, and the group takes ownership of
+// them.
+type BatchGetter func(ctx context.Context, keys []string) (map[string][]byte, error)
+
+// batcher accumulates the keys loaded at once into batches for
+// GroupOptions.BatchGetter.
+type batcher struct {
+	get      BatchGetter
+	maxSize  int
+	maxDelay time.Duration
+	stats    *Stats
+
+	mu      sync.Mutex
+	pending *batch // accumulating keys, if any
+}
+
+type batch struct {
+	ctx     context.Context // cancelled once no load waits for the batch
+	cancel  context.CancelFunc
+	waiters int // loads waiting for the batch; guarded by batcher.mu
+	keys    []string
+	calls   map[string]*batchCall
+	timer   *time.Timer
+}
+
+// batchContext carries the values of the context of the load that
+// started a batch, but not its deadline or cancellation, so that the
+// batch outlives that load for the sake of the others.
+type batchContext struct{ parent context.Context }
+
+func (batchContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (batchContext) Done() <-chan struct{}               { return nil }
+func (batchContext) Err() error                          { return nil }
+func (c batchContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// batchCall is the load of a key by a batch.
+type batchCall struct {
+	done  chan struct{} // closed once value and err are set
+	value []byte
+	err   error
+}
+
+// add adds key to the pending batch, starting one if there is none,
+// and returns its call and batch. A key already pending shares its
+// call. The caller waits for the call until it calls leave.
+func (b *batcher) add(ctx context.Context, key string) (*batchCall, *batch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.pending
+	if p == nil {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		p = &batch{calls: make(map[string]*batchCall)}
+		p.ctx, p.cancel = context.WithCancel(batchContext{ctx})
+		p.timer = time.AfterFunc(b.maxDelay, func() { b.flush(p) })
+		b.pending = p
+	}
+	p.waiters++
+	if c := p.calls[key]; c != nil {
+		return c, p
+	}
+	c := &batchCall{done: make(chan struct{})}
+	p.calls[key] = c
+	p.keys = append(p.keys, key)
+	if len(p.keys) >= b.maxSize {
+		p.timer.Stop()
+		b.pending = nil
+		go b.dispatch(p)
+	}
+	return c, p
+}
+
+// leave records that a load gave up waiting for p. Once none waits,
+// the context of the BatchGetter call is cancelled, and a batch still
+// pending is dropped rather than loaded.
+func (b *batcher) leave(p *batch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p.waiters--
+	if p.waiters > 0 {
+		return
+	}
+	p.cancel()
+	if b.pending == p {
+		b.pending = nil
+		p.timer.Stop()
+		for _, c := range p.calls {
+			c.err = p.ctx.Err()
+			close(c.done)
+		}
+	}
+}
+
+// flush dispatches p once its delay elapsed, unless it was dispatched
+// already as it filled up.
+func (b *batcher) flush(p *batch) {
+	b.mu.Lock()
+	if b.pending != p {
+		b.mu.Unlock()
+		return
+	}
+	b.pending = nil
+	b.mu.Unlock()
+	b.dispatch(p)
+}
+
+// dispatch loads the keys of p with the BatchGetter, handing each call
+// its result.
+func (b *batcher) dispatch(p *batch) {
+	defer p.cancel()
+	b.stats.BatchLoads.Add(1)
+	b.stats.BatchedKeys.Add(int64(len(p.keys)))
+	values, err := b.call(p)
+	for _, key := range p.keys {
+		c := p.calls[key]
+		switch value, ok := values[key]; {
+		case err != nil:
+			c.err = err
+		case !ok:
+			c.err = fmt.Errorf("batch getter returned no value: %w", ErrNotFound)
+		default:
+			c.value = value
+		}
+		close(c.done)
+	}
+}
+
+// call calls the BatchGetter with the keys of p. It runs on a
+// goroutine of its own, away from the loads waiting for it, so a
+// panic is returned to them as a *singleflight.PanicError rather than
+// crashing the program.
+func (b *batcher) call(p *batch) (values map[string][]byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			values, err = nil, &singleflight.PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return b.get(p.ctx, p.keys)
+}
+
+// getBatched loads key into dest with the next batch, waiting for its
+// result at most until ctx is done.
+func (g *Group) getBatched(ctx context.Context, key string, dest Sink) (ByteView, error) {
+	c, p := g.batcher.add(ctx, key)
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	select {
+	case <-c.done:
+	case <-done:
+		g.batcher.leave(p)
+		return ByteView{}, &GetterError{Key: key, Err: ctx.Err()}
+	}
+	if c.err != nil {
+		return ByteView{}, &GetterError{Key: key, Err: c.err}
+	}
+	if err := dest.SetBytes(c.value, time.Time{}); err != nil {
+		return ByteView{}, err
+	}
+	return dest.view()
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/melojustme/groupcache/singleflight"
+)
+
+// newBatchGroup returns a group loading with a BatchGetter that
+// returns "value:"+key for every key but "missing", and records the
+// keys of each of its calls in batches.
+func newBatchGroup(name string, o *GroupOptions, mu *sync.Mutex, batches *[][]string) *Group {
+	o.BatchGetter = func(_ context.Context, keys []string) (map[string][]byte, error) {
+		mu.Lock()
+		*batches = append(*batches, append([]string(nil), keys...))
+		mu.Unlock()
+		values := make(map[string][]byte)
+		for _, key := range keys {
+			if key != "missing" {
+				values[key] = []byte("value:" + key)
+			}
+		}
+		return values, nil
+	}
+	return newGroupOpts(name, cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("getter called with a BatchGetter set")
+	}), NoPeers{}, o)
+}
+
+func TestBatchGetter(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches [][]string
+	)
+	g := newBatchGroup("TestBatchGetter-group", &GroupOptions{MaxBatchDelay: 50 * time.Millisecond}, &mu, &batches)
+	defer DeregisterGroup(g.Name())
+
+	// Concurrent misses, two per key, are loaded by one call.
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make([]error, 2*n)
+	got := make([]string, 2*n)
+	for i := 0; i < 2*n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = g.Get(dummyCtx, fmt.Sprintf("key-%d", i%n), StringSink(&got[i]), nil)
+		}(i)
+	}
+	wg.Wait()
+	for i := range got {
+		if want := fmt.Sprintf("value:key-%d", i%n); errs[i] != nil || got[i] != want {
+			t.Errorf("Get(key-%d) = %q, %v; want %q", i%n, got[i], errs[i], want)
+		}
+	}
+	if len(batches) != 1 {
+		t.Fatalf("BatchGetter calls = %v; want one", batches)
+	}
+	keys := append([]string(nil), batches[0]...)
+	sort.Strings(keys)
+	var want []string
+	for i := 0; i < n; i++ {
+		want = append(want, fmt.Sprintf("key-%d", i))
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("batched keys = %v; want %v, each once", keys, want)
+	}
+	if got := g.Stats.BatchedKeys.Get(); got != n {
+		t.Errorf("BatchedKeys = %d; want %d", got, n)
+	}
+
+	// Loaded keys are cached; a key missing from the results has no
+	// value.
+	var s string
+	if err := g.Get(dummyCtx, "key-0", StringSink(&s), nil); err != nil || len(batches) != 1 {
+		t.Errorf("Get of a loaded key = %v, %d calls; want a cache hit", err, len(batches))
+	}
+	if err := g.Get(dummyCtx, "missing", StringSink(&s), nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing) = %v; want ErrNotFound", err)
+	}
+}
+
+func TestBatchGetterMaxBatchSize(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches [][]string
+	)
+	g := newBatchGroup("TestBatchGetterMaxBatchSize-group", &GroupOptions{MaxBatchSize: 3, MaxBatchDelay: 20 * time.Millisecond}, &mu, &batches)
+	defer DeregisterGroup(g.Name())
+
+	const n = 7
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			var s string
+			if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil || s != "value:"+key {
+				t.Errorf("Get(%q) = %q, %v", key, s, err)
+			}
+		}(fmt.Sprintf("key-%d", i))
+	}
+	wg.Wait()
+	total := 0
+	for _, keys := range batches {
+		if len(keys) > 3 {
+			t.Errorf("batch %v exceeds MaxBatchSize 3", keys)
+		}
+		total += len(keys)
+	}
+	if total != n || len(batches) < 3 {
+		t.Errorf("BatchGetter calls = %v; want %d keys in at least 3 calls", batches, n)
+	}
+}
+
+func TestBatchGetterOutlivesFirstLoad(t *testing.T) {
+	release := make(chan struct{})
+	ctxErrs := make(chan error, 1)
+	g := newGroupOpts("TestBatchGetterOutlivesFirstLoad-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("getter called with a BatchGetter set")
+	}), NoPeers{}, &GroupOptions{
+		MaxBatchDelay: 20 * time.Millisecond,
+		BatchGetter: func(ctx context.Context, keys []string) (map[string][]byte, error) {
+			<-release
+			ctxErrs <- ctx.Err()
+			values := make(map[string][]byte)
+			for _, key := range keys {
+				values[key] = []byte("value:" + key)
+			}
+			return values, nil
+		},
+	})
+	defer DeregisterGroup(g.Name())
+
+	// The load starting the batch gives up long before it is loaded.
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	firstErr := make(chan error, 1)
+	go func() {
+		var s string
+		firstErr <- g.Get(short, "first", StringSink(&s), nil)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	secondErr := make(chan error, 1)
+	var second string
+	go func() {
+		secondErr <- g.Get(dummyCtx, "second", StringSink(&second), nil)
+	}()
+	if err := <-firstErr; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get(first) = %v; want its own deadline", err)
+	}
+	close(release)
+	if err := <-secondErr; err != nil || second != "value:second" {
+		t.Errorf("Get(second) = %q, %v; want value:second", second, err)
+	}
+	if err := <-ctxErrs; err != nil {
+		t.Errorf("BatchGetter context error = %v; want none while a load waits", err)
+	}
+}
+
+func TestBatchGetterCancelledOnceAllLeave(t *testing.T) {
+	started := make(chan struct{})
+	ctxErrs := make(chan error, 1)
+	g := newGroupOpts("TestBatchGetterCancelledOnceAllLeave-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("getter called with a BatchGetter set")
+	}), NoPeers{}, &GroupOptions{
+		MaxBatchSize: 1,
+		BatchGetter: func(ctx context.Context, keys []string) (map[string][]byte, error) {
+			close(started)
+			<-ctx.Done()
+			ctxErrs <- ctx.Err()
+			return nil, ctx.Err()
+		},
+	})
+	defer DeregisterGroup(g.Name())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		var s string
+		errs <- g.Get(ctx, "key", StringSink(&s), nil)
+	}()
+	<-started
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Get = %v; want context.Canceled", err)
+	}
+	select {
+	case err := <-ctxErrs:
+		if err != context.Canceled {
+			t.Errorf("BatchGetter context error = %v; want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BatchGetter context not cancelled once its only load left")
+	}
+}
+
+func TestBatchGetterPanic(t *testing.T) {
+	g := newGroupOpts("TestBatchGetterPanic-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("getter called with a BatchGetter set")
+	}), NoPeers{}, &GroupOptions{
+		MaxBatchDelay: time.Millisecond,
+		BatchGetter: func(ctx context.Context, keys []string) (map[string][]byte, error) {
+			panic("batch getter bug")
+		},
+	})
+	defer DeregisterGroup(g.Name())
+
+	var s string
+	err := g.Get(dummyCtx, "key", StringSink(&s), nil)
+	var panicked *singleflight.PanicError
+	if !errors.As(err, &panicked) || panicked.Value != "batch getter bug" {
+		t.Errorf("Get = %v; want a *singleflight.PanicError", err)
+	}
+}
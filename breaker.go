@@ -0,0 +1,197 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultBreakerCooldown is the default HTTPPoolOptions.BreakerCooldown.
+const defaultBreakerCooldown = 5 * time.Second
+
+// ErrCircuitOpen is returned by the fetches from a peer whose circuit
+// breaker is open under HTTPPoolOptions.BreakerFailures, without
+// sending them.
+var ErrCircuitOpen = errors.New("groupcache: peer circuit breaker is open")
+
+// A CircuitState is the state of a peer's circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets fetches from the peer through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects fetches from the peer with ErrCircuitOpen
+	// until its cooldown elapses.
+	CircuitOpen
+	// CircuitHalfOpen lets a single fetch through to probe the peer,
+	// rejecting the others until the probe's outcome closes or
+	// reopens the breaker.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// BreakerState describes a peer's circuit breaker, as reported by
+// HTTPPool.PeerBreakerState.
+type BreakerState struct {
+	State CircuitState
+
+	// Failures is the number of consecutive failed fetches from the
+	// peer.
+	Failures int
+
+	// OpenUntil is when an open breaker lets a probe through, or zero
+	// if the breaker is closed.
+	OpenUntil time.Time
+}
+
+// circuitBreaker stops fetches from a peer after failures consecutive
+// failed ones, for cooldown, then lets a single fetch through to probe
+// the peer.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	failed    int       // consecutive failed fetches
+	openUntil time.Time // zero while the breaker is closed
+	probing   bool      // a fetch is probing the peer
+}
+
+// allow reports whether a fetch may be sent to the peer, and whether
+// it is the probe, let through once the breaker's cooldown elapsed.
+// Each fetch allowed must be followed by a call of record. A nil
+// breaker allows every fetch.
+func (b *circuitBreaker) allow() (ok, probe bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true, false
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// isOpen reports whether the breaker rejects fetches, without making
+// the next one a probe.
+func (b *circuitBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero() && (b.probing || time.Now().Before(b.openUntil))
+}
+
+// state returns the current state of the breaker.
+func (b *circuitBreaker) state() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerState{Failures: b.failed, OpenUntil: b.openUntil}
+	switch {
+	case b.openUntil.IsZero():
+		s.State = CircuitClosed
+	case !b.probing && time.Now().Before(b.openUntil):
+		s.State = CircuitOpen
+	default:
+		s.State = CircuitHalfOpen
+	}
+	return s
+}
+
+// reset closes the breaker and forgets the peer's failures. A probe in
+// flight may still record its outcome.
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+// record records the outcome of a fetch allow let through: whether it
+// succeeded, unless the caller gave up on it, which says nothing of the
+// peer. A success closes the breaker, and a failed probe or too many
+// failures open it for another cooldown.
+func (b *circuitBreaker) record(probe, ok, counted bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case !counted:
+	case ok:
+		b.failed = 0
+		b.openUntil = time.Time{}
+	default:
+		b.failed++
+		if probe || b.failed >= b.failures {
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+	}
+}
+
+// PeerBreakerState returns the state of the circuit breaker of each of
+// the pool's peers, keyed by peer, or nil unless
+// HTTPPoolOptions.BreakerFailures is set.
+func (p *HTTPPool) PeerBreakerState() map[string]BreakerState {
+	if p.opts.BreakerFailures <= 0 {
+		return nil
+	}
+	ps := p.current()
+	res := make(map[string]BreakerState, len(ps.getters))
+	for peer, h := range ps.getters {
+		if h.breaker != nil {
+			res[peer] = h.breaker.state()
+		}
+	}
+	return res
+}
+
+// ResetPeerBreaker closes the circuit breaker of peer, letting fetches
+// from it through at once, such as after the cause of its failures was
+// fixed. It does nothing if peer is not one of the pool's peers or
+// HTTPPoolOptions.BreakerFailures is not set.
+func (p *HTTPPool) ResetPeerBreaker(peer string) {
+	if h := p.current().getters[peer]; h != nil && h.breaker != nil {
+		h.breaker.reset()
+	}
+}
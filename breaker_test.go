@@ -0,0 +1,194 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{failures: 2, cooldown: 20 * time.Millisecond}
+	fail := func() {
+		t.Helper()
+		ok, probe := b.allow()
+		if !ok {
+			t.Fatal("fetch not allowed")
+		}
+		b.record(probe, false, true)
+	}
+	fail()
+	if b.isOpen() {
+		t.Fatal("breaker open after 1 failure; want closed until 2")
+	}
+	// A caller giving up says nothing of the peer.
+	_, probe := b.allow()
+	b.record(probe, false, false)
+	fail()
+	if !b.isOpen() {
+		t.Fatal("breaker closed after 2 failures")
+	}
+	if ok, _ := b.allow(); ok {
+		t.Fatal("open breaker allowed a fetch")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	ok, probe := b.allow()
+	if !ok || !probe {
+		t.Fatalf("after cooldown, allow() = %v, %v; want a probe", ok, probe)
+	}
+	if ok, _ := b.allow(); ok {
+		t.Fatal("breaker allowed a fetch while probing")
+	}
+	b.record(probe, false, true)
+	if !b.isOpen() {
+		t.Fatal("breaker closed after a failed probe")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	_, probe = b.allow()
+	b.record(probe, true, true)
+	if b.isOpen() {
+		t.Fatal("breaker open after a successful probe")
+	}
+	if ok, probe := b.allow(); !ok || probe {
+		t.Fatalf("closed breaker: allow() = %v, %v; want true, false", ok, probe)
+	}
+}
+
+func TestHTTPPoolBreaker(t *testing.T) {
+	var requests AtomicInt
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{BreakerFailures: 2, BreakerCooldown: time.Hour})
+	p.Set(ts.URL)
+	peer, ok := p.PickPeer("remote-a")
+	if !ok {
+		t.Fatal("no peer picked")
+	}
+	var loads AtomicInt
+	g := newGroup("TestHTTPPoolBreaker", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("local:"+key, time.Time{})
+	}), prefixPeers{peer})
+	for i := 0; i < 5; i++ {
+		var s string
+		if err := g.Get(context.Background(), fmt.Sprintf("remote-%d", i), StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := requests.Get(); got != 2 {
+		t.Errorf("peer got %d requests; want 2", got)
+	}
+	if got := loads.Get(); got != 5 {
+		t.Errorf("%d local loads; want 5", got)
+	}
+	if got := g.Stats.PeerCircuitOpen.Get(); got != 3 {
+		t.Errorf("PeerCircuitOpen = %d; want 3", got)
+	}
+	if got := g.Stats.PeerErrors.Get(); got != 2 {
+		t.Errorf("PeerErrors = %d; want 2", got)
+	}
+}
+
+func TestCircuitBreakerState(t *testing.T) {
+	b := &circuitBreaker{failures: 1, cooldown: 20 * time.Millisecond}
+	if s := b.state(); s.State != CircuitClosed || s.Failures != 0 {
+		t.Fatalf("new breaker state = %+v; want closed", s)
+	}
+	_, probe := b.allow()
+	b.record(probe, false, true)
+	if s := b.state(); s.State != CircuitOpen || s.Failures != 1 || s.OpenUntil.IsZero() {
+		t.Fatalf("tripped breaker state = %+v; want open after 1 failure", s)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if s := b.state(); s.State != CircuitHalfOpen {
+		t.Fatalf("state after cooldown = %v; want half-open", s.State)
+	}
+	if _, probe := b.allow(); !probe {
+		t.Fatal("no probe after cooldown")
+	}
+	if s := b.state(); s.State != CircuitHalfOpen {
+		t.Fatalf("state while probing = %v; want half-open", s.State)
+	}
+	b.reset()
+	if s := b.state(); s != (BreakerState{State: CircuitClosed}) {
+		t.Fatalf("reset breaker state = %+v; want closed", s)
+	}
+	if ok, probe := b.allow(); !ok || probe {
+		t.Fatalf("reset breaker: allow() = %v, %v; want true, false", ok, probe)
+	}
+}
+
+func TestHTTPPoolResetPeerBreaker(t *testing.T) {
+	var requests AtomicInt
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	if got := newHTTPPool("http://127.0.0.1", nil).PeerBreakerState(); got != nil {
+		t.Errorf("PeerBreakerState without breakers = %v; want nil", got)
+	}
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{BreakerFailures: 1, BreakerCooldown: time.Hour})
+	p.Set(ts.URL)
+	peer, ok := p.PickPeer("remote-a")
+	if !ok {
+		t.Fatal("no peer picked")
+	}
+	get := func() error {
+		return peer.Get(context.Background(), &pb.GetRequest{Group: proto.String("g"), Key: proto.String("k")}, &pb.GetResponse{})
+	}
+	if s := p.PeerBreakerState()[ts.URL]; s.State != CircuitClosed {
+		t.Fatalf("state before failures = %v; want closed", s.State)
+	}
+	if err := get(); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("first Get error = %v; want the peer's", err)
+	}
+	if s := p.PeerBreakerState()[ts.URL]; s.State != CircuitOpen || s.Failures != 1 {
+		t.Fatalf("state after a failure = %+v; want open", s)
+	}
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Get from an open breaker error = %v; want ErrCircuitOpen", err)
+	}
+
+	p.ResetPeerBreaker(ts.URL)
+	p.ResetPeerBreaker("http://unknown")
+	if s := p.PeerBreakerState()[ts.URL]; s.State != CircuitClosed || s.Failures != 0 {
+		t.Fatalf("state after reset = %+v; want closed", s)
+	}
+	if err := get(); errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("Get after reset rejected by the breaker")
+	}
+	if got := requests.Get(); got != 2 {
+		t.Errorf("peer got %d requests; want 2", got)
+	}
+}
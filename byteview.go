@@ -21,6 +21,7 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,6 +36,39 @@ type ByteView struct {
 	b []byte
 	s string
 	e time.Time
+
+	// sum is a checksum of b recorded when the view was stored in a
+	// cache with immutability debugging enabled. It is only valid if
+	// hasSum is set. See Group.SetDebugImmutability.
+	sum    uint32
+	hasSum bool
+
+	// compressed is set on views stored in a cache with
+	// GroupOptions.CompressInMemory whose b holds the value
+	// compressed. Such views never leave the cache.
+	compressed bool
+
+	// stored is when the view was stored in a cache, in Unix
+	// nanoseconds, or 0 if it was not read from one.
+	stored int64
+
+	// gen is the generation of the group it was stored under. See
+	// Group.SetGeneration.
+	gen uint64
+
+	// meta is the metadata stored with the value by a GetterWithMeta,
+	// or nil. Like the value, it is never modified.
+	meta []byte
+
+	// tags are the tags the value was stored with by
+	// Group.SetWithTags, or nil. Like the value, they are never
+	// modified.
+	tags []string
+
+	// source is where a view returned by a load came from, if not
+	// from the getter. It is not meaningful for views read from a
+	// cache, which keep that of the view stored.
+	source ValueSource
 }
 
 // Returns the expire time associated with this view
@@ -42,6 +76,11 @@ func (v ByteView) Expire() time.Time {
 	return v.e
 }
 
+// expired reports whether the view has an expire time that has passed.
+func (v ByteView) expired() bool {
+	return !v.e.IsZero() && v.e.Before(time.Now())
+}
+
 // Len returns the view's length.
 func (v ByteView) Len() int {
 	if v.b != nil {
@@ -98,6 +137,16 @@ func (v ByteView) Copy(dest []byte) int {
 	return copy(dest, v.s)
 }
 
+// CopyTo copies b into dest starting at offset and returns the number
+// of bytes copied, which is less than v.Len() if dest is too short to
+// hold all of b there. An offset outside dest copies nothing.
+func (v ByteView) CopyTo(dest []byte, offset int) int {
+	if offset < 0 || offset > len(dest) {
+		return 0
+	}
+	return v.Copy(dest[offset:])
+}
+
 // Equal returns whether the bytes in b are the same as the bytes in
 // b2.
 func (v ByteView) Equal(b2 ByteView) bool {
@@ -166,13 +215,25 @@ func (v ByteView) ReadAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
-// WriteTo implements io.WriterTo on the bytes in v.
+// writeToChunkBytes is the size of the chunks in which WriteTo copies
+// large string-backed views to writers that cannot take strings.
+const writeToChunkBytes = 32 << 10
+
+// WriteTo implements io.WriterTo on the bytes in v, writing them in a
+// single call without copying, unless v holds a string of more than
+// 32KB and w is not an io.StringWriter: rather than being converted to
+// a []byte whole, such a string is copied in chunks through a pooled
+// buffer, as WriteChunked does.
 func (v ByteView) WriteTo(w io.Writer) (n int64, err error) {
 	var m int
 	if v.b != nil {
 		m, err = w.Write(v.b)
+	} else if sw, ok := w.(io.StringWriter); ok {
+		m, err = sw.WriteString(v.s)
+	} else if len(v.s) > writeToChunkBytes {
+		return v.WriteChunked(w, writeToChunkBytes)
 	} else {
-		m, err = io.WriteString(w, v.s)
+		m, err = w.Write([]byte(v.s))
 	}
 	if err == nil && m < v.Len() {
 		err = io.ErrShortWrite
@@ -180,3 +241,53 @@ func (v ByteView) WriteTo(w io.Writer) (n int64, err error) {
 	n = int64(m)
 	return
 }
+
+// chunkPool holds the buffers through which WriteChunked copies
+// string-backed views.
+var chunkPool sync.Pool
+
+// WriteChunked is like WriteTo but writes v to w in chunks of at most
+// chunkSize bytes, one Write each, so that a slow w is never handed the
+// whole value at once and the write can be abandoned between chunks.
+// Views holding bytes are written in place, as are views holding a
+// string if w is an io.StringWriter; other string views are copied
+// chunk by chunk into a pooled buffer. If chunkSize is not positive,
+// v is written as WriteTo does.
+func (v ByteView) WriteChunked(w io.Writer, chunkSize int) (n int64, err error) {
+	if chunkSize <= 0 || v.Len() <= chunkSize {
+		return v.WriteTo(w)
+	}
+	sw, _ := w.(io.StringWriter)
+	var buf []byte
+	if v.b == nil && sw == nil {
+		if bp, _ := chunkPool.Get().(*[]byte); bp != nil && cap(*bp) >= chunkSize {
+			buf = (*bp)[:chunkSize]
+		} else {
+			buf = make([]byte, chunkSize)
+		}
+		defer func() { chunkPool.Put(&buf) }()
+	}
+	for off := 0; off < v.Len(); off += chunkSize {
+		end := off + chunkSize
+		if end > v.Len() {
+			end = v.Len()
+		}
+		var m int
+		switch {
+		case v.b != nil:
+			m, err = w.Write(v.b[off:end])
+		case sw != nil:
+			m, err = sw.WriteString(v.s[off:end])
+		default:
+			m, err = w.Write(buf[:copy(buf, v.s[off:end])])
+		}
+		n += int64(m)
+		if err == nil && m < end-off {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -139,9 +140,130 @@ func TestByteViewSlice(t *testing.T) {
 	}
 }
 
+func TestByteViewCopyTo(t *testing.T) {
+	tests := []struct {
+		in     string
+		dest   string
+		offset int
+		want   string
+		n      int
+	}{
+		{in: "abc", dest: "xxxxx", offset: 0, want: "abcxx", n: 3},
+		{in: "abc", dest: "xxxxx", offset: 2, want: "xxabc", n: 3},
+		{in: "abc", dest: "xxxxx", offset: 4, want: "xxxxa", n: 1},
+		{in: "abc", dest: "xxxxx", offset: 5, want: "xxxxx", n: 0},
+		{in: "abc", dest: "xxxxx", offset: 6, want: "xxxxx", n: 0},
+		{in: "abc", dest: "xxxxx", offset: -1, want: "xxxxx", n: 0},
+		{in: "", dest: "xx", offset: 1, want: "xx", n: 0},
+	}
+	for i, tt := range tests {
+		for _, v := range []ByteView{of([]byte(tt.in)), of(tt.in)} {
+			name := fmt.Sprintf("test %d, view %+v", i, v)
+			dest := []byte(tt.dest)
+			if n := v.CopyTo(dest, tt.offset); n != tt.n {
+				t.Errorf("%s: CopyTo(%q, %d) = %d; want %d", name, tt.dest, tt.offset, n, tt.n)
+			}
+			if string(dest) != tt.want {
+				t.Errorf("%s: dest = %q; want %q", name, dest, tt.want)
+			}
+		}
+	}
+}
+
+// slowWriter accepts at most limit bytes per Write, recording the size
+// of each. It doesn't implement io.StringWriter.
+type slowWriter struct {
+	buf    bytes.Buffer
+	limit  int
+	writes []int
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	if w.limit > 0 && len(p) > w.limit {
+		p = p[:w.limit]
+	}
+	return w.buf.Write(p)
+}
+
+func TestByteViewWriteChunked(t *testing.T) {
+	const in = "abcdefghij"
+	tests := []struct {
+		chunk  int
+		writes []int
+	}{
+		{chunk: 0, writes: []int{10}},
+		{chunk: 3, writes: []int{3, 3, 3, 1}},
+		{chunk: 5, writes: []int{5, 5}},
+		{chunk: 10, writes: []int{10}},
+		{chunk: 64, writes: []int{10}},
+	}
+	for _, tt := range tests {
+		for _, v := range []ByteView{of([]byte(in)), of(in)} {
+			name := fmt.Sprintf("chunk %d, view %+v", tt.chunk, v)
+			w := new(slowWriter)
+			n, err := v.WriteChunked(w, tt.chunk)
+			if err != nil || n != int64(len(in)) {
+				t.Errorf("%s: WriteChunked = %d, %v; want %d, nil", name, n, err, len(in))
+			}
+			if got := w.buf.String(); got != in {
+				t.Errorf("%s: wrote %q; want %q", name, got, in)
+			}
+			if fmt.Sprint(w.writes) != fmt.Sprint(tt.writes) {
+				t.Errorf("%s: write sizes = %v; want %v", name, w.writes, tt.writes)
+			}
+		}
+
+		// A string view goes to an io.StringWriter without copying.
+		var sb bytes.Buffer
+		if n, err := of(in).WriteChunked(&sb, tt.chunk); err != nil || n != int64(len(in)) || sb.String() != in {
+			t.Errorf("chunk %d: WriteChunked to StringWriter = %d, %v, %q; want %d, nil, %q",
+				tt.chunk, n, err, sb.String(), len(in), in)
+		}
+	}
+
+	// A writer taking less than a chunk is a short write.
+	for _, v := range []ByteView{of([]byte(in)), of(in)} {
+		w := &slowWriter{limit: 2}
+		n, err := v.WriteChunked(w, 3)
+		if err != io.ErrShortWrite || n != 2 {
+			t.Errorf("view %+v: WriteChunked to short writer = %d, %v; want 2, %v", v, n, err, io.ErrShortWrite)
+		}
+	}
+}
+
+func benchmarkWriteChunked(b *testing.B, chunk int) {
+	v := of(string(bytes.Repeat([]byte("x"), 1<<20)))
+	w := ioutil.Discard
+	b.SetBytes(int64(v.Len()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := v.WriteChunked(struct{ io.Writer }{w}, chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkByteViewWriteSingleShot(b *testing.B) { benchmarkWriteChunked(b, 0) }
+func BenchmarkByteViewWriteChunked(b *testing.B)    { benchmarkWriteChunked(b, 32<<10) }
+
 func min(a, b int) int {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+func TestByteViewWriteToLargeString(t *testing.T) {
+	in := strings.Repeat("0123456789", 10000)
+	w := new(slowWriter)
+	n, err := of(in).WriteTo(w)
+	if err != nil || n != int64(len(in)) || w.buf.String() != in {
+		t.Fatalf("WriteTo = %d, %v; want %d, nil and the string", n, err, len(in))
+	}
+	for _, size := range w.writes {
+		if size > writeToChunkBytes {
+			t.Fatalf("write sizes = %v; want chunks of at most %d bytes", w.writes, writeToChunkBytes)
+		}
+	}
+}
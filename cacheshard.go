@@ -0,0 +1,79 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+// split makes c keep its entries in n shards configured like c, for
+// GroupOptions.CacheShards. newBackend, if non-nil, creates the
+// backend of each shard. split must be called before c is used.
+func (c *cache) split(n int, newBackend func() CacheBackend) {
+	c.shards = make([]*cache, n)
+	for i := range c.shards {
+		s := &cache{
+			onEvict:   c.onEvict,
+			onEvicted: c.onEvicted,
+			maxPinned: c.maxPinned / int64(n),
+			maxStale:  c.maxStale,
+			now:       c.now,
+			policy:    c.policy,
+			segmented: c.segmented,
+			gen:       c.gen,
+		}
+		if c.shared != nil {
+			s.shared = new(sharedReads)
+		}
+		if newBackend != nil {
+			s.backend = newBackend()
+		}
+		c.shards[i] = s
+	}
+}
+
+// shard returns the shard holding key.
+func (c *cache) shard(key string) *cache {
+	// FNV-1a, inlined so that hashing key allocates nothing.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// removeOldestShard is removeOldest for a sharded cache: it removes
+// the oldest unpinned entry of the shard holding the most bytes, or of
+// another shard if that one holds only pinned entries.
+func (c *cache) removeOldestShard() bool {
+	var largest *cache
+	var max int64
+	for _, s := range c.shards {
+		if n := s.bytes(); n > max {
+			largest, max = s, n
+		}
+	}
+	if largest == nil {
+		return false
+	}
+	if largest.removeOldest() {
+		return true
+	}
+	for _, s := range c.shards {
+		if s != largest && s.removeOldest() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheShards(t *testing.T) {
+	const cacheBytes = 1000
+	var loads AtomicInt
+	g := newGroupOpts("TestCacheShards-group", cacheBytes, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{CacheShards: 8, MaxPinnedBytes: cacheBytes})
+	get := func(key string) {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil || s != "value:"+key {
+			t.Errorf("Get(%q) = %q, %v", key, s, err)
+		}
+	}
+
+	if err := g.Pin("pinned"); err != nil {
+		t.Fatal(err)
+	}
+	get("pinned")
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				get(fmt.Sprintf("key-%d-%02d", w, i))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats := g.CacheStats(MainCache)
+	if stats.Bytes > cacheBytes || stats.Evictions == 0 {
+		t.Errorf("main cache holds %d bytes after %d evictions; want at most %d after some", stats.Bytes, stats.Evictions, cacheBytes)
+	}
+	// Each miss looks the key up again once it joined the flight.
+	keys, _ := g.mainCache.entries()
+	if stats.Gets != 2*201 || stats.Items != int64(len(keys)) {
+		t.Errorf("main cache stats = %+v; want 402 gets and its entries counted", stats)
+	}
+	used := 0
+	for _, s := range g.mainCache.shards {
+		if s.items() > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("keys went to %d shards; want several", used)
+	}
+	if which, ok := g.Contains("pinned"); !ok || which != MainCache {
+		t.Error("pinned key evicted from a sharded cache")
+	}
+
+	if err := g.Remove(dummyCtx, "pinned"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.Contains("pinned"); ok {
+		t.Error("key still cached after Remove")
+	}
+	loads.Store(0)
+	get("pinned")
+	get("pinned")
+	if n := loads.Get(); n != 1 {
+		t.Errorf("loads of a removed key got twice = %d; want 1", n)
+	}
+}
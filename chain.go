@@ -0,0 +1,103 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errNoGetters = errors.New("groupcache: ChainGetter has no getters")
+
+// ChainGetter returns a Getter that calls each of getters in turn until
+// one succeeds, returning the error of the last one if none does. It
+// moves on to the next getter on any error except that of a done
+// context, which is returned immediately.
+func ChainGetter(getters ...Getter) Getter {
+	return ChainGetterIf(func(err error) bool { return !isContextError(err) }, getters...)
+}
+
+// ChainGetterIf is like ChainGetter, but moves on to the next getter
+// only if fallback reports true for the error of the current one.
+// Otherwise, that error is returned immediately.
+func ChainGetterIf(fallback func(err error) bool, getters ...Getter) Getter {
+	return GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		err := errNoGetters
+		for _, getter := range getters {
+			err = getter.Get(ctx, key, dest, fixFunc)
+			if err == nil || !fallback(err) {
+				return err
+			}
+		}
+		return err
+	})
+}
+
+// fallbackMu serializes SetFallback calls, so that two of them cannot
+// complete a cycle together.
+var fallbackMu sync.Mutex
+
+// fallbackRef holds a group's fallback in Group.fallback.
+type fallbackRef struct{ g *Group }
+
+// SetFallback makes other the group consulted before the getter when g
+// loads a key: g gets the key from other, and only calls its own getter
+// if other fails, which it does for keys its getter reports ErrNotFound
+// for. The value other returns is cached by g like a loaded one. This
+// layers groups, such as a small group of hot reference data in front
+// of a large one loaded lazily from a slower origin. A nil other
+// removes the fallback.
+//
+// SetFallback panics if other falls back on g, directly or through
+// further fallbacks.
+func (g *Group) SetFallback(other *Group) {
+	fallbackMu.Lock()
+	defer fallbackMu.Unlock()
+	for fb := other; fb != nil; fb = fb.fallbackGroup() {
+		if fb == g {
+			panic("groupcache: fallback cycle through group " + g.name)
+		}
+	}
+	g.fallback.Store(fallbackRef{other})
+}
+
+// fallbackGroup returns the group set by SetFallback, or nil.
+func (g *Group) fallbackGroup() *Group {
+	ref, _ := g.fallback.Load().(fallbackRef)
+	return ref.g
+}
+
+// getFromFallback gets key from g's fallback group into dest,
+// reporting whether it did.
+func (g *Group) getFromFallback(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) (value ByteView, ok bool, err error) {
+	fb := g.fallbackGroup()
+	if fb == nil {
+		return ByteView{}, false, nil
+	}
+	info, err := fb.GetWithInfo(ctx, key, dest, fixFunc)
+	if err != nil {
+		if ctx != nil && ctx.Err() != nil {
+			return ByteView{}, false, err
+		}
+		return ByteView{}, false, nil
+	}
+	g.Stats.FallbackLoads.Add(1)
+	value, err = dest.view()
+	value.meta = info.Meta
+	return value, err == nil, err
+}
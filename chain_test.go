@@ -0,0 +1,148 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// originGetter is a Getter that records its calls and returns err, or
+// its name as the value if err is nil.
+type originGetter struct {
+	name  string
+	err   error
+	calls int
+}
+
+func (g *originGetter) Get(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+	g.calls++
+	if g.err != nil {
+		return g.err
+	}
+	return dest.SetString(g.name+":"+key, time.Time{})
+}
+
+func TestChainGetterFallback(t *testing.T) {
+	primary := &originGetter{name: "primary", err: errors.New("primary down")}
+	secondary := &originGetter{name: "secondary"}
+	tertiary := &originGetter{name: "tertiary"}
+
+	var s string
+	err := ChainGetter(primary, secondary, tertiary).Get(context.Background(), "key", StringSink(&s), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "secondary:key" {
+		t.Errorf("Get = %q; want %q", s, "secondary:key")
+	}
+	if primary.calls != 1 || secondary.calls != 1 || tertiary.calls != 0 {
+		t.Errorf("calls = %d, %d, %d; want 1, 1, 0", primary.calls, secondary.calls, tertiary.calls)
+	}
+}
+
+func TestChainGetterAllFail(t *testing.T) {
+	errLast := errors.New("secondary down")
+	primary := &originGetter{name: "primary", err: errors.New("primary down")}
+	secondary := &originGetter{name: "secondary", err: errLast}
+
+	var s string
+	err := ChainGetter(primary, secondary).Get(context.Background(), "key", StringSink(&s), nil)
+	if err != errLast {
+		t.Errorf("Get error = %v; want %v", err, errLast)
+	}
+
+	if err := ChainGetter().Get(context.Background(), "key", StringSink(&s), nil); err != errNoGetters {
+		t.Errorf("Get with no getters error = %v; want %v", err, errNoGetters)
+	}
+}
+
+func TestChainGetterIf(t *testing.T) {
+	errNotFound := errors.New("not found")
+	primary := &originGetter{name: "primary", err: errNotFound}
+	secondary := &originGetter{name: "secondary"}
+	getter := ChainGetterIf(func(err error) bool { return err != errNotFound }, primary, secondary)
+
+	var s string
+	if err := getter.Get(context.Background(), "key", StringSink(&s), nil); err != errNotFound {
+		t.Errorf("Get error = %v; want %v", err, errNotFound)
+	}
+	if secondary.calls != 0 {
+		t.Errorf("secondary called %d times; want 0", secondary.calls)
+	}
+}
+
+func TestSetFallback(t *testing.T) {
+	var refLoads int
+	ref := newGroup("TestSetFallback-ref", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		refLoads++
+		if !strings.HasPrefix(key, "ref-") {
+			return ErrNotFound
+		}
+		return dest.SetString("ref:"+key, time.Time{})
+	}), NoPeers{})
+	origin := &originGetter{name: "origin"}
+	g := newGroup("TestSetFallback-group", cacheSize, origin, NoPeers{})
+	g.SetFallback(ref)
+
+	for i := 0; i < 2; i++ {
+		var s string
+		if err := g.Get(dummyCtx, "ref-1", StringSink(&s), nil); err != nil || s != "ref:ref-1" {
+			t.Fatalf("Get(ref-1) #%d = %q, %v; want the fallback's ref:ref-1", i, s, err)
+		}
+	}
+	if origin.calls != 0 || refLoads != 1 {
+		t.Errorf("origin called %d times, fallback loaded %d keys; want 0 and 1", origin.calls, refLoads)
+	}
+	if n := g.Stats.FallbackLoads.Get(); n != 1 {
+		t.Errorf("FallbackLoads = %d; want 1", n)
+	}
+
+	var s string
+	if err := g.Get(dummyCtx, "other", StringSink(&s), nil); err != nil || s != "origin:other" {
+		t.Errorf("Get(other) = %q, %v; want the origin's value once the fallback misses", s, err)
+	}
+
+	g.SetFallback(nil)
+	if err := g.Get(dummyCtx, "ref-2", StringSink(&s), nil); err != nil || s != "origin:ref-2" {
+		t.Errorf("Get(ref-2) without fallback = %q, %v; want the origin's value", s, err)
+	}
+}
+
+func TestSetFallbackCycle(t *testing.T) {
+	a := newGroup("TestSetFallbackCycle-a", cacheSize, &originGetter{name: "a"}, NoPeers{})
+	b := newGroup("TestSetFallbackCycle-b", cacheSize, &originGetter{name: "b"}, NoPeers{})
+	c := newGroup("TestSetFallbackCycle-c", cacheSize, &originGetter{name: "c"}, NoPeers{})
+	a.SetFallback(b)
+	b.SetFallback(c)
+	for _, tc := range []struct{ g, fallback *Group }{{c, a}, {a, a}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s.SetFallback(%s) did not panic on a cycle", tc.g.Name(), tc.fallback.Name())
+				}
+			}()
+			tc.g.SetFallback(tc.fallback)
+		}()
+	}
+	if c.fallbackGroup() != nil {
+		t.Error("rejected fallback was set")
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// A ChunkGetter is a Getter producing the values it loads
+// incrementally, such as by rendering or transcoding them, which hands
+// them over a chunk at a time. Groups call GetChunks instead of Get to
+// load keys, assembling the chunks into the value they cache, and a
+// caller of Group.GetStreaming leading a load receives each chunk as
+// soon as it is emitted. A value is only cached once GetChunks returns
+// successfully: if it fails midway, the chunks it emitted are
+// discarded.
+type ChunkGetter interface {
+	Getter
+
+	// GetChunks loads the value identified by key by calling emit with
+	// each of its chunks in turn, and returns the time the value
+	// expires, or the zero time if it does not. emit copies chunk, so
+	// GetChunks may reuse it once emit returns. emit returns an error
+	// once ctx is done, upon which GetChunks should stop and return it.
+	GetChunks(ctx context.Context, key string, emit func(chunk []byte) error) (expire time.Time, err error)
+}
+
+// chunkStreamKey is the context key under which GetStreaming stores
+// the *chunkStream receiving the chunks of the value it loads.
+type chunkStreamKey struct{}
+
+// chunkStream passes the chunks emitted by a ChunkGetter on to the
+// writer given to GetStreaming.
+type chunkStream struct {
+	w       io.Writer
+	started bool  // whether chunks were written to w
+	err     error // first error writing to w
+	loadErr error // error of a load that failed after writing chunks
+}
+
+// streaming returns the chunk stream carried by ctx, or nil.
+func streaming(ctx context.Context) *chunkStream {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(chunkStreamKey{}).(*chunkStream)
+	return s
+}
+
+func (s *chunkStream) write(chunk []byte) {
+	s.started = true
+	if s.err == nil {
+		_, s.err = s.w.Write(chunk)
+	}
+}
+
+// GetStreaming is like Get but writes the value to w. If it leads the
+// load of the key from a ChunkGetter, it writes each chunk as the
+// getter emits it, so that w receives the start of the value before
+// the getter is done. Otherwise, say if the value is cached or loaded
+// by a peer or another caller, it writes the value whole.
+//
+// If a load fails midway, w may have received part of the value, and
+// GetStreaming returns the load's error. An error writing to w is
+// returned as well, but does not stop the load, whose value is still
+// cached for other callers. A slow w slows down the load for them.
+func (g *Group) GetStreaming(ctx context.Context, key string, w io.Writer) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	stream := &chunkStream{w: w}
+	var value ByteView
+	_, err := g.GetWithInfo(context.WithValue(ctx, chunkStreamKey{}, stream), key, ByteViewSink(&value), nil)
+	if err != nil {
+		return err
+	}
+	// A value served stale, after the load failed, does not continue
+	// the chunks already written.
+	if stream.loadErr != nil {
+		return stream.loadErr
+	}
+	if !stream.started {
+		_, err = value.WriteTo(w)
+		return err
+	}
+	return stream.err
+}
+
+// getChunks loads key from cg into dest, passing the chunks on to the
+// chunk stream of ctx, if any.
+func (g *Group) getChunks(ctx context.Context, cg ChunkGetter, key string, dest Sink) (ByteView, error) {
+	stream := streaming(ctx)
+	var buf []byte
+	expire, err := cg.GetChunks(ctx, key, func(chunk []byte) error {
+		if ctx != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		buf = append(buf, chunk...)
+		if stream != nil {
+			stream.write(chunk)
+		}
+		return nil
+	})
+	if err != nil {
+		err = &GetterError{Key: key, Err: err}
+		if stream != nil && stream.started {
+			stream.loadErr = err
+		}
+		return ByteView{}, err
+	}
+	// Do not let the cache hold on to the spare capacity of appending.
+	if cap(buf)-len(buf) > len(buf)/8 {
+		buf = cloneBytes(buf)
+	}
+	value := ByteView{b: buf, e: expire}
+	if err := setSinkView(dest, value); err != nil {
+		return ByteView{}, err
+	}
+	return value, nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkGetter emits its chunks, waiting on wait, if non-nil, after the
+// first one, and then fails with err if it is non-nil.
+type chunkGetter struct {
+	chunks []string
+	wait   chan struct{}
+	err    error
+	loads  AtomicInt
+}
+
+func (c *chunkGetter) Get(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+	return errors.New("Get called on a ChunkGetter")
+}
+
+func (c *chunkGetter) GetChunks(_ context.Context, key string, emit func(chunk []byte) error) (time.Time, error) {
+	c.loads.Add(1)
+	for i, chunk := range c.chunks {
+		if err := emit([]byte(chunk)); err != nil {
+			return time.Time{}, err
+		}
+		if i == 0 && c.wait != nil {
+			<-c.wait
+		}
+	}
+	return time.Time{}, c.err
+}
+
+// chunkWriter records the chunks written to it, signalling each on
+// written.
+type chunkWriter struct {
+	chunks  []string
+	written chan string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, string(p))
+	if w.written != nil {
+		w.written <- string(p)
+	}
+	return len(p), nil
+}
+
+func TestChunkGetter(t *testing.T) {
+	getter := &chunkGetter{chunks: []string{"ab", "cd", "ef"}, wait: make(chan struct{})}
+	g := newGroup("TestChunkGetter-group", cacheSize, getter, NoPeers{})
+
+	w := &chunkWriter{written: make(chan string, 3)}
+	done := make(chan error, 1)
+	go func() { done <- g.GetStreaming(context.Background(), "key", w) }()
+	// The first chunk reaches the caller while the getter is still
+	// producing the rest.
+	if got := <-w.written; got != "ab" {
+		t.Errorf("first chunk written = %q; want %q", got, "ab")
+	}
+	close(getter.wait)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(w.chunks, "|"); got != "ab|cd|ef" {
+		t.Errorf("GetStreaming wrote %q; want the chunks ab|cd|ef", got)
+	}
+
+	var s string
+	if err := g.Get(context.Background(), "key", StringSink(&s), nil); err != nil || s != "abcdef" {
+		t.Errorf("Get = %q, %v; want the assembled value abcdef", s, err)
+	}
+	// Served from the cache, the value is written whole.
+	w = &chunkWriter{}
+	if err := g.GetStreaming(context.Background(), "key", w); err != nil || strings.Join(w.chunks, "|") != "abcdef" {
+		t.Errorf("cached GetStreaming wrote %q, %v; want abcdef in one write", strings.Join(w.chunks, "|"), err)
+	}
+	if got := getter.loads.Get(); got != 1 {
+		t.Errorf("getter loads = %d; want 1", got)
+	}
+}
+
+func TestChunkGetterFailsMidStream(t *testing.T) {
+	errBroken := errors.New("transcoder crashed")
+	getter := &chunkGetter{chunks: []string{"ab", "cd"}, err: errBroken}
+	g := newGroup("TestChunkGetterFailsMidStream-group", cacheSize, getter, NoPeers{})
+
+	w := &chunkWriter{}
+	err := g.GetStreaming(context.Background(), "key", w)
+	if !errors.Is(err, errBroken) {
+		t.Errorf("GetStreaming error = %v; want %v", err, errBroken)
+	}
+	if got := strings.Join(w.chunks, "|"); got != "ab|cd" {
+		t.Errorf("GetStreaming wrote %q before failing; want ab|cd", got)
+	}
+	if which, ok := g.Contains("key"); ok {
+		t.Errorf("partial value cached in the %v cache", which)
+	}
+
+	var s string
+	if err := g.Get(context.Background(), "key", StringSink(&s), nil); !errors.Is(err, errBroken) {
+		t.Errorf("Get error = %v; want %v", err, errBroken)
+	}
+	if got := getter.loads.Get(); got != 2 {
+		t.Errorf("getter loads = %d; want 2, as the failed value was not cached", got)
+	}
+}
@@ -0,0 +1,438 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// codec.go defines how messages exchanged between peers are framed.
+
+package groupcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// A WireCodec encodes and decodes the messages exchanged between peers.
+//
+// Every peer in a cluster must use the same codec, since a peer cannot
+// tell which codec produced the bytes it receives.
+//
+// The Decode methods must not retain b, which is reused once they
+// return: decoded values are cached as they are, so they must be
+// copied out of b.
+type WireCodec interface {
+	// ContentType returns the MIME type of encoded messages.
+	ContentType() string
+
+	EncodeGetResponse(m *pb.GetResponse) ([]byte, error)
+	DecodeGetResponse(b []byte, m *pb.GetResponse) error
+
+	EncodeSetRequest(m *pb.SetRequest) ([]byte, error)
+	DecodeSetRequest(b []byte, m *pb.SetRequest) error
+}
+
+// ProtoCodec is a WireCodec that encodes messages as protocol buffers.
+// It is the default codec.
+type ProtoCodec struct{}
+
+func (ProtoCodec) ContentType() string { return "application/x-protobuf" }
+
+func (ProtoCodec) EncodeGetResponse(m *pb.GetResponse) ([]byte, error) { return proto.Marshal(m) }
+func (ProtoCodec) DecodeGetResponse(b []byte, m *pb.GetResponse) error { return proto.Unmarshal(b, m) }
+func (ProtoCodec) EncodeSetRequest(m *pb.SetRequest) ([]byte, error)   { return proto.Marshal(m) }
+func (ProtoCodec) DecodeSetRequest(b []byte, m *pb.SetRequest) error   { return proto.Unmarshal(b, m) }
+
+// RawCodec is a WireCodec using a simple length-prefixed binary framing
+// that requires no protobuf tooling to implement on the other end.
+//
+// Each message starts with a byte of flags recording which optional
+// fields are present. Strings and metadata are prefixed with their
+// length as a uvarint, lists of tags by their count then each tag,
+// integers and floats are 8 bytes big-endian, and a value, if
+// present, takes up the rest of the message.
+type RawCodec struct{}
+
+const (
+	rawHasValue = 1 << iota
+	rawHasExpire
+	rawHasMinuteQps
+	rawHasMeta
+	rawHasTags
+)
+
+var errRawShort = errors.New("groupcache: raw message too short")
+
+func (RawCodec) ContentType() string { return "application/octet-stream" }
+
+func (RawCodec) EncodeGetResponse(m *pb.GetResponse) ([]byte, error) {
+	var flags byte
+	b := []byte{0}
+	if m.MinuteQps != nil {
+		flags |= rawHasMinuteQps
+		b = appendUint64(b, math.Float64bits(*m.MinuteQps))
+	}
+	if m.Expire != nil {
+		flags |= rawHasExpire
+		b = appendUint64(b, uint64(*m.Expire))
+	}
+	if m.Meta != nil {
+		flags |= rawHasMeta
+		b = appendString(b, string(m.Meta))
+	}
+	if m.Tags != nil {
+		flags |= rawHasTags
+		b = appendStrings(b, m.Tags)
+	}
+	if m.Value != nil {
+		flags |= rawHasValue
+		b = append(b, m.Value...)
+	}
+	b[0] = flags
+	return b, nil
+}
+
+func (RawCodec) DecodeGetResponse(b []byte, m *pb.GetResponse) error {
+	d := rawDecoder{b: b}
+	flags := d.byte()
+	m.Reset()
+	if flags&rawHasMinuteQps != 0 {
+		qps := math.Float64frombits(d.uint64())
+		m.MinuteQps = &qps
+	}
+	if flags&rawHasExpire != 0 {
+		expire := int64(d.uint64())
+		m.Expire = &expire
+	}
+	if flags&rawHasMeta != 0 {
+		m.Meta = []byte(d.string())
+	}
+	if flags&rawHasTags != 0 {
+		m.Tags = d.strings()
+	}
+	if flags&rawHasValue != 0 {
+		m.Value = d.rest()
+	}
+	return d.err
+}
+
+func (RawCodec) EncodeSetRequest(m *pb.SetRequest) ([]byte, error) {
+	var flags byte
+	b := []byte{0}
+	b = appendString(b, m.GetGroup())
+	b = appendString(b, m.GetKey())
+	if m.Expire != nil {
+		flags |= rawHasExpire
+		b = appendUint64(b, uint64(*m.Expire))
+	}
+	if m.Tags != nil {
+		flags |= rawHasTags
+		b = appendStrings(b, m.Tags)
+	}
+	if m.Value != nil {
+		flags |= rawHasValue
+		b = append(b, m.Value...)
+	}
+	b[0] = flags
+	return b, nil
+}
+
+func (RawCodec) DecodeSetRequest(b []byte, m *pb.SetRequest) error {
+	d := rawDecoder{b: b}
+	flags := d.byte()
+	m.Reset()
+	group, key := d.string(), d.string()
+	m.Group, m.Key = &group, &key
+	if flags&rawHasExpire != 0 {
+		expire := int64(d.uint64())
+		m.Expire = &expire
+	}
+	if flags&rawHasTags != 0 {
+		m.Tags = d.strings()
+	}
+	if flags&rawHasValue != 0 {
+		m.Value = d.rest()
+	}
+	return d.err
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+func appendStrings(b []byte, ss []string) []byte {
+	b = appendUvarint(b, uint64(len(ss)))
+	for _, s := range ss {
+		b = appendString(b, s)
+	}
+	return b
+}
+
+// rawDecoder reads the fields of a RawCodec message, recording the
+// first error encountered.
+type rawDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *rawDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errRawShort
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *rawDecoder) byte() byte {
+	if v := d.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *rawDecoder) uint64() uint64 {
+	if v := d.next(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (d *rawDecoder) string() string {
+	if d.err != nil {
+		return ""
+	}
+	n, m := binary.Uvarint(d.b)
+	if m <= 0 || n > uint64(len(d.b)-m) {
+		d.err = errRawShort
+		return ""
+	}
+	d.b = d.b[m:]
+	return string(d.next(int(n)))
+}
+
+// count reads the count of a list whose items take at least a byte.
+func (d *rawDecoder) count() int {
+	if d.err != nil {
+		return 0
+	}
+	n, m := binary.Uvarint(d.b)
+	if m <= 0 || n > uint64(len(d.b)-m) {
+		d.err = errRawShort
+		return 0
+	}
+	d.b = d.b[m:]
+	return int(n)
+}
+
+func (d *rawDecoder) strings() []string {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = d.string()
+	}
+	return ss
+}
+
+func (d *rawDecoder) rest() []byte {
+	if d.err != nil {
+		return nil
+	}
+	return cloneBytes(d.next(len(d.b)))
+}
+
+// Protocol buffer wire format details for GetResponse, used to stream
+// large values without buffering the whole encoded message.
+const (
+	getResponseValueTag  = 1<<3 | 2 // field 1, length-delimited
+	getResponseExpireTag = 3<<3 | 0 // field 3, varint
+	getResponseMetaTag   = 4<<3 | 2 // field 4, length-delimited
+	getResponseTagsTag   = 6<<3 | 2 // field 6, length-delimited
+)
+
+// writeStreamedGetResponse writes a GetResponse holding value, its
+// metadata, tags and expire to w in protocol buffer format, copying the
+// value straight from the view. The other fields are written first, so
+// that a reader knows everything but the value once it reaches the
+// value's length.
+func writeStreamedGetResponse(w io.Writer, value ByteView, expire int64, chunkSize int) error {
+	if _, err := w.Write(streamedGetResponseHeader(value, expire)); err != nil {
+		return err
+	}
+	_, err := value.WriteChunked(w, chunkSize)
+	return err
+}
+
+// streamedGetResponseLen returns the number of bytes
+// writeStreamedGetResponse writes for value and expire.
+func streamedGetResponseLen(value ByteView, expire int64) int {
+	return len(streamedGetResponseHeader(value, expire)) + value.Len()
+}
+
+// streamedGetResponseHeader returns the fields of a streamed
+// GetResponse that precede the value bytes.
+func streamedGetResponseHeader(value ByteView, expire int64) []byte {
+	hdr := make([]byte, 0, 3+3*binary.MaxVarintLen64+len(value.meta))
+	hdr = appendUvarint(append(hdr, getResponseExpireTag), uint64(expire))
+	if value.meta != nil {
+		hdr = appendUvarint(append(hdr, getResponseMetaTag), uint64(len(value.meta)))
+		hdr = append(hdr, value.meta...)
+	}
+	for _, tag := range value.tags {
+		hdr = appendString(append(hdr, getResponseTagsTag), tag)
+	}
+	return appendUvarint(append(hdr, getResponseValueTag), uint64(value.Len()))
+}
+
+// streamedAllocChunk bounds the bytes readStreamedGetResponse
+// allocates for a field before receiving them, unless the length of
+// the response says they are all there.
+const streamedAllocChunk = 1 << 20
+
+// readStreamedGetResponse reads a GetResponse written by
+// writeStreamedGetResponse from r. If max is positive, a field longer
+// than max bytes is rejected with ErrResponseTooLarge before it is
+// allocated. Field lengths come off the wire, so a field is allocated
+// at once only if size, the length of the response or -1 if unknown,
+// covers it or it is short; longer fields grow as their bytes arrive,
+// and a peer cannot make the reader allocate more than it sends.
+func readStreamedGetResponse(r io.Reader, out *pb.GetResponse, max, size int64) error {
+	sr := &streamReader{br: bufio.NewReader(r), max: max, size: size}
+	out.Reset()
+	for {
+		tag, err := binary.ReadUvarint(sr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n, err := binary.ReadUvarint(sr)
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case getResponseExpireTag:
+			expire := int64(n)
+			out.Expire = &expire
+		case getResponseMetaTag:
+			if out.Meta, err = sr.field(n); err != nil {
+				return err
+			}
+		case getResponseTagsTag:
+			tag, err := sr.field(n)
+			if err != nil {
+				return err
+			}
+			out.Tags = append(out.Tags, string(tag))
+		case getResponseValueTag:
+			if out.Value, err = sr.field(n); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected field tag %d in streamed response", tag)
+		}
+	}
+}
+
+// streamReader reads the fields of a streamed GetResponse, counting
+// the bytes read to know how many of the response's size remain.
+type streamReader struct {
+	br   *bufio.Reader
+	n    int64
+	max  int64 // of a field; unlimited if not positive
+	size int64 // of the response; unknown if negative
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	n, err := r.br.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *streamReader) ReadByte() (byte, error) {
+	c, err := r.br.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return c, err
+}
+
+// field reads a field of n bytes.
+func (r *streamReader) field(n uint64) ([]byte, error) {
+	if r.max > 0 && n > uint64(r.max) {
+		return nil, ErrResponseTooLarge
+	}
+	if r.size >= 0 && n > uint64(r.size-r.n) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if n > uint64(maxInt) {
+		return nil, ErrResponseTooLarge
+	}
+	if r.size >= 0 || n <= streamedAllocChunk {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	b := make([]byte, 0, streamedAllocChunk)
+	for uint64(len(b)) < n {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+		end := cap(b)
+		if rest := n - uint64(len(b)); rest < uint64(end-len(b)) {
+			end = len(b) + int(rest)
+		}
+		m, err := io.ReadFull(r, b[len(b):end])
+		b = b[:len(b)+m]
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// maxInt is the largest int.
+const maxInt = int(^uint(0) >> 1)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
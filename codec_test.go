@@ -0,0 +1,167 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+)
+
+var codecs = []struct {
+	name  string
+	codec WireCodec
+}{
+	{"proto", ProtoCodec{}},
+	{"raw", RawCodec{}},
+}
+
+func TestCodecGetResponseRoundTrip(t *testing.T) {
+	responses := []*pb.GetResponse{
+		{},
+		{Value: []byte{}},
+		{Value: []byte("some value"), Expire: proto.Int64(time.Now().UnixNano())},
+		{Value: []byte{0, 1, 2}, MinuteQps: proto.Float64(12.5), Expire: proto.Int64(0)},
+		{Value: []byte("with meta"), Meta: []byte("last-modified=yesterday")},
+		{Meta: []byte{}},
+		{Value: []byte("tagged"), Tags: []string{"user:1", ""}},
+	}
+	for _, tc := range codecs {
+		for _, in := range responses {
+			b, err := tc.codec.EncodeGetResponse(in)
+			if err != nil {
+				t.Fatalf("%s: encode %v: %v", tc.name, in, err)
+			}
+			out := &pb.GetResponse{}
+			if err := tc.codec.DecodeGetResponse(b, out); err != nil {
+				t.Fatalf("%s: decode %v: %v", tc.name, in, err)
+			}
+			if !proto.Equal(in, out) {
+				t.Errorf("%s: round trip of %v = %v", tc.name, in, out)
+			}
+		}
+	}
+}
+
+func TestCodecSetRequestRoundTrip(t *testing.T) {
+	requests := []*pb.SetRequest{
+		{Group: proto.String("group"), Key: proto.String("")},
+		{Group: proto.String("group"), Key: proto.String("key\x00with/odd bytes"), Value: []byte("value")},
+		{Group: proto.String(""), Key: proto.String("key"), Value: []byte{}, Expire: proto.Int64(42)},
+		{Group: proto.String("group"), Key: proto.String("key"), Value: []byte("value"), Tags: []string{"a", "b"}},
+	}
+	for _, tc := range codecs {
+		for _, in := range requests {
+			b, err := tc.codec.EncodeSetRequest(in)
+			if err != nil {
+				t.Fatalf("%s: encode %v: %v", tc.name, in, err)
+			}
+			out := &pb.SetRequest{}
+			if err := tc.codec.DecodeSetRequest(b, out); err != nil {
+				t.Fatalf("%s: decode %v: %v", tc.name, in, err)
+			}
+			if !proto.Equal(in, out) {
+				t.Errorf("%s: round trip of %v = %v", tc.name, in, out)
+			}
+		}
+	}
+}
+
+func TestRawCodecTruncated(t *testing.T) {
+	b, err := RawCodec{}.EncodeSetRequest(&pb.SetRequest{
+		Group:  proto.String("group"),
+		Key:    proto.String("key"),
+		Expire: proto.Int64(42),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(b); n++ {
+		if err := (RawCodec{}).DecodeSetRequest(b[:n], &pb.SetRequest{}); err == nil {
+			t.Errorf("decoding %d of %d bytes succeeded; want error", n, len(b))
+		}
+	}
+}
+
+func TestStreamedGetResponseBogusLength(t *testing.T) {
+	for _, field := range []byte{getResponseMetaTag, getResponseTagsTag, getResponseValueTag} {
+		for _, n := range []uint64{1<<64 - 1, 1 << 40, streamedAllocChunk + 1} {
+			b := appendUvarint([]byte{field}, n)
+			b = append(b, "short"...)
+			for _, size := range []int64{-1, int64(len(b))} {
+				err := readStreamedGetResponse(bytes.NewReader(b), &pb.GetResponse{}, 0, size)
+				if err == nil {
+					t.Errorf("reading field %d of claimed length %d with size %d succeeded; want error", field>>3, n, size)
+				}
+			}
+		}
+	}
+}
+
+func TestStreamedGetResponseLongValue(t *testing.T) {
+	value := bytes.Repeat([]byte("x"), 3*streamedAllocChunk+1)
+	var buf bytes.Buffer
+	if err := writeStreamedGetResponse(&buf, ByteView{b: value}, 42, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{-1, int64(buf.Len())} {
+		var out pb.GetResponse
+		if err := readStreamedGetResponse(bytes.NewReader(buf.Bytes()), &out, 0, size); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(out.Value, value) || out.GetExpire() != 42 {
+			t.Errorf("size %d: read %d bytes expiring at %d; want %d expiring at 42", size, len(out.Value), out.GetExpire(), len(value))
+		}
+	}
+}
+
+func TestHTTPPoolRawCodec(t *testing.T) {
+	// A misconfigured self address sends every request through the
+	// server, exercising both ends of the codec.
+	p := newHTTPPool("http://misconfigured-self", &HTTPPoolOptions{Codec: RawCodec{}})
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	p.Set(ts.URL)
+
+	g := newGroup("TestHTTPPoolRawCodec-group", 1<<20, GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("raw:"+key, time.Now().Add(time.Hour))
+	}), p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	var value string
+	if err := g.Get(ctx, "key", StringSink(&value), nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "raw:key"; value != want {
+		t.Errorf("Get = %q; want %q", value, want)
+	}
+
+	if err := g.Set(ctx, "set-key", []byte("set value"), time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := g.mainCache.get("set-key"); !ok || v.String() != "set value" {
+		t.Errorf("main cache has %q, %v after Set; want %q", v.String(), ok, "set value")
+	}
+}
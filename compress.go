@@ -0,0 +1,73 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// defaultCompressMinBytes is the default GroupOptions.CompressMinBytes.
+const defaultCompressMinBytes = 256
+
+var errCompressedView = errors.New("groupcache: corrupt compressed value")
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// compressView returns v compressed for storage in a cache, and
+// whether compressing it saved any space. A compressed view holds the
+// uvarint length of the value followed by its deflated bytes, and must
+// be passed to decompressView before use.
+func compressView(v ByteView) (ByteView, bool) {
+	var buf bytes.Buffer
+	buf.Write(appendUvarint(nil, uint64(v.Len())))
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := v.WriteTo(w); err != nil {
+		return v, false
+	}
+	if err := w.Close(); err != nil || buf.Len() >= v.Len() {
+		return v, false
+	}
+	return ByteView{b: buf.Bytes(), e: v.e, compressed: true, meta: v.meta, tags: v.tags}, true
+}
+
+// decompressView returns the value held by a view returned by
+// compressView.
+func decompressView(v ByteView) (ByteView, error) {
+	n, m := binary.Uvarint(v.b)
+	if m <= 0 {
+		return ByteView{}, errCompressedView
+	}
+	b := make([]byte, n)
+	r := flate.NewReader(bytes.NewReader(v.b[m:]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, b); err != nil {
+		return ByteView{}, errCompressedView
+	}
+	return ByteView{b: b, e: v.e, stored: v.stored, gen: v.gen, meta: v.meta, tags: v.tags}, nil
+}
@@ -19,46 +19,205 @@ package consistenthash
 
 import (
 	"hash/crc32"
+	"hash/fnv"
+	"math"
 	"sort"
 	"strconv"
+	"time"
 )
 
 type Hash func(data []byte) uint32
 
+// Hash64 is a 64-bit hash function for the ring. A 64-bit ring makes
+// collisions between hash points practically impossible, even with
+// thousands of nodes each having many replicas.
+type Hash64 func(data []byte) uint64
+
 type Map struct {
-	hash     Hash
+	// LoadFactor is the factor c by which GetBounded lets the load of
+	// an item exceed the average load of the items.
+	// If zero, it defaults to 1.25. Values below 1 are treated as 1.
+	LoadFactor float64
+
+	hash     Hash64
 	replicas int
-	keys     []int // Sorted
-	hashMap  map[int]string
+	keys     []uint64 // Sorted
+	hashMap  map[uint64]string
+	items    map[string]bool // the keys added, each once
+
+	// loads holds the load of each item tracked by Inc and Done, for
+	// GetLeast.
+	loads map[string]int
+
+	// leases holds the expiry time of each key added by AddWithLease.
+	leases map[string]time.Time
+	now    func() time.Time // for testing; time.Now if nil
 }
 
 func New(replicas int, fn Hash) *Map {
+	if fn == nil {
+		fn = crc32.ChecksumIEEE
+	}
+	return New64(replicas, func(data []byte) uint64 { return uint64(fn(data)) })
+}
+
+// New64 creates a Map whose ring is hashed with a 64-bit hash function.
+// If fn is nil, it defaults to 64-bit FNV-1a.
+//
+// Migration note: the ring built by New64 orders nodes differently
+// from the 32-bit ring built by New, so switching a cluster from one
+// to the other reassigns most keys to new owners. All peers must be
+// switched at the same time, and caches will refill after the switch.
+func New64(replicas int, fn Hash64) *Map {
 	m := &Map{
 		replicas: replicas,
 		hash:     fn,
-		hashMap:  make(map[int]string),
+		hashMap:  make(map[uint64]string),
+		items:    make(map[string]bool),
 	}
 	if m.hash == nil {
-		m.hash = crc32.ChecksumIEEE
+		m.hash = fnv64a
 	}
 	return m
 }
 
+func fnv64a(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
 // IsEmpty returns true if there are no items available.
 func (m *Map) IsEmpty() bool {
 	return len(m.keys) == 0
 }
 
-// Add adds some keys to the hash.
+// Add adds some keys to the hash. Keys already in the hash are
+// skipped, so that adding the same set of keys again, as on every
+// heartbeat of a static cluster, leaves the ring unchanged.
 func (m *Map) Add(keys ...string) {
+	m.AddWithWeight(1, keys...)
+}
+
+// AddWithWeight adds some keys to the hash, each with weight times as
+// many replicas as Add gives it, so that it owns a proportionally
+// larger share of the ring. A weight below 1 is treated as 1. Keys
+// already in the hash are skipped; Remove them first to change their
+// weight.
+func (m *Map) AddWithWeight(weight int, keys ...string) {
+	if weight < 1 {
+		weight = 1
+	}
 	for _, key := range keys {
-		for i := 0; i < m.replicas; i++ {
-			hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+		if m.items[key] {
+			continue
+		}
+		for i := 0; i < m.replicas*weight; i++ {
+			hash := m.hash([]byte(strconv.Itoa(i) + key))
 			m.keys = append(m.keys, hash)
 			m.hashMap[hash] = key
 		}
+		m.items[key] = true
+	}
+	sort.Slice(m.keys, func(i, j int) bool { return m.keys[i] < m.keys[j] })
+}
+
+// Remove removes some keys and all their replicas from the hash. Keys
+// not in the hash are ignored.
+func (m *Map) Remove(keys ...string) {
+	removed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if m.items[key] {
+			removed[key] = true
+			delete(m.items, key)
+			delete(m.leases, key)
+			delete(m.loads, key)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	live := m.keys[:0]
+	for _, hash := range m.keys {
+		if key, ok := m.hashMap[hash]; ok && removed[key] {
+			delete(m.hashMap, hash)
+			continue
+		}
+		live = append(live, hash)
+	}
+	m.keys = live
+}
+
+// AddWithLease adds some keys to the hash that expire after ttl unless
+// they are added again before then, which extends their lease. This
+// lets membership be driven by periodic heartbeats.
+//
+// Get skips keys whose lease has elapsed. Their hash points are pruned
+// by the next call to AddWithLease.
+func (m *Map) AddWithLease(ttl time.Duration, keys ...string) {
+	if m.leases == nil {
+		m.leases = make(map[string]time.Time)
+	}
+	now := m.clock()
+	m.prune(now)
+	var added []string
+	for _, key := range keys {
+		if _, ok := m.leases[key]; !ok {
+			added = append(added, key)
+		}
+		m.leases[key] = now.Add(ttl)
+	}
+	if len(added) > 0 {
+		m.Add(added...)
+	}
+}
+
+func (m *Map) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// expired reports whether key was added with a lease that has elapsed.
+func (m *Map) expired(key string, now time.Time) bool {
+	lease, ok := m.leases[key]
+	return ok && !now.Before(lease)
+}
+
+// prune removes the hash points of keys whose lease has elapsed.
+func (m *Map) prune(now time.Time) {
+	var dead bool
+	for key := range m.leases {
+		if m.expired(key, now) {
+			dead = true
+			break
+		}
+	}
+	if !dead {
+		return
+	}
+	live := m.keys[:0]
+	for _, hash := range m.keys {
+		if key := m.hashMap[hash]; m.expired(key, now) {
+			delete(m.hashMap, hash)
+			continue
+		}
+		live = append(live, hash)
+	}
+	m.keys = live
+	for key := range m.leases {
+		if m.expired(key, now) {
+			delete(m.leases, key)
+			delete(m.items, key)
+		}
 	}
-	sort.Ints(m.keys)
+}
+
+// KeyHash returns the hash of key on the ring, which determines the
+// item Get returns for it.
+func (m *Map) KeyHash(key string) uint64 {
+	return m.hash([]byte(key))
 }
 
 // Get gets the closest item in the hash to the provided key.
@@ -67,7 +226,7 @@ func (m *Map) Get(key string) string {
 		return ""
 	}
 
-	hash := int(m.hash([]byte(key)))
+	hash := m.hash([]byte(key))
 
 	// Binary search for appropriate replica.
 	idx := sort.Search(len(m.keys), func(i int) bool { return m.keys[i] >= hash })
@@ -77,5 +236,275 @@ func (m *Map) Get(key string) string {
 		idx = 0
 	}
 
-	return m.hashMap[m.keys[idx]]
+	if len(m.leases) == 0 {
+		return m.hashMap[m.keys[idx]]
+	}
+
+	// Skip over the replicas of keys whose lease has elapsed.
+	now := m.clock()
+	for i := 0; i < len(m.keys); i++ {
+		key := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if !m.expired(key, now) {
+			return key
+		}
+	}
+	return ""
+}
+
+// GetN returns up to n distinct items in the hash, in order of
+// closeness to the provided key. The first one is the item Get returns.
+func (m *Map) GetN(key string, n int) []string {
+	if m.IsEmpty() || n <= 0 {
+		return nil
+	}
+
+	hash := m.hash([]byte(key))
+	idx := sort.Search(len(m.keys), func(i int) bool { return m.keys[i] >= hash })
+
+	now := m.clock()
+	var items []string
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(m.keys) && len(items) < n; i++ {
+		key := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if seen[key] || m.expired(key, now) {
+			continue
+		}
+		seen[key] = true
+		items = append(items, key)
+	}
+	return items
+}
+
+// defaultLoadFactor is the default Map.LoadFactor.
+const defaultLoadFactor = 1.25
+
+// GetBounded implements consistent hashing with bounded loads: it
+// returns the closest item in the hash to the provided key, like Get,
+// skipping the items already at capacity given their current loads.
+// An item is at capacity once its load reaches LoadFactor times the
+// average load of the items, counting the request being placed, so no
+// item's load exceeds that bound.
+//
+// The caller maintains loads, typically incrementing the load of the
+// returned item while it serves the request and decrementing it
+// afterwards. Items missing from loads have no load.
+func (m *Map) GetBounded(key string, loads map[string]int) string {
+	if m.IsEmpty() {
+		return ""
+	}
+
+	now := m.clock()
+	n := len(m.items)
+	for item := range m.leases {
+		if m.expired(item, now) {
+			n--
+		}
+	}
+	if n <= 0 {
+		return ""
+	}
+	total := 1 // the request being placed
+	for item, load := range loads {
+		if m.items[item] && !m.expired(item, now) {
+			total += load
+		}
+	}
+	c := m.LoadFactor
+	if c == 0 {
+		c = defaultLoadFactor
+	} else if c < 1 {
+		c = 1
+	}
+	capacity := int(math.Ceil(c * float64(total) / float64(n)))
+
+	hash := m.hash([]byte(key))
+	idx := sort.Search(len(m.keys), func(i int) bool { return m.keys[i] >= hash })
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(m.keys) && len(seen) < n; i++ {
+		item := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if seen[item] || m.expired(item, now) {
+			continue
+		}
+		seen[item] = true
+		if loads[item] < capacity {
+			return item
+		}
+	}
+	// Not reached: the loads of the n items add up to less than
+	// n times capacity.
+	return m.Get(key)
+}
+
+// GetLeast is like GetBounded but uses the loads the Map tracks
+// itself: the caller calls Inc with the returned item when it starts
+// serving the request, and Done once it has finished.
+func (m *Map) GetLeast(key string) string {
+	return m.GetBounded(key, m.loads)
+}
+
+// Inc adds a request being served to the load of item, as seen by
+// GetLeast.
+func (m *Map) Inc(item string) {
+	if m.loads == nil {
+		m.loads = make(map[string]int)
+	}
+	m.loads[item]++
+}
+
+// Done removes a request served by item from its load, as seen by
+// GetLeast.
+func (m *Map) Done(item string) {
+	if m.loads[item] <= 1 {
+		delete(m.loads, item)
+		return
+	}
+	m.loads[item]--
+}
+
+// A RingPoint is a hash point on the ring and the key that owns it.
+type RingPoint struct {
+	Hash uint64
+	Key  string
+}
+
+// A RingSnapshot is a copy of the hash points of a Map, in ascending
+// hash order. A key hashing to h belongs to the first point whose Hash
+// is at least h, wrapping around to the first point.
+type RingSnapshot []RingPoint
+
+// Snapshot returns the current hash points of the ring. Points of keys
+// whose lease has elapsed are left out, as Get would skip them.
+func (m *Map) Snapshot() RingSnapshot {
+	now := m.clock()
+	snap := make(RingSnapshot, 0, len(m.keys))
+	for _, hash := range m.keys {
+		key := m.hashMap[hash]
+		if m.expired(key, now) {
+			continue
+		}
+		if n := len(snap); n > 0 && snap[n-1].Hash == hash {
+			continue
+		}
+		snap = append(snap, RingPoint{Hash: hash, Key: key})
+	}
+	return snap
+}
+
+// A KeyShare is the part of a ring a key owns.
+type KeyShare struct {
+	Key    string
+	Points int     // hash points, or virtual nodes, of the key
+	Share  float64 // fraction of the ring's hashes the key owns
+}
+
+// Shares returns the part of the ring each key of s owns, sorted by
+// key. The ring's hashes are below 1<<bits: 32 for a Map made by New,
+// and 64 for one made by New64.
+func (s RingSnapshot) Shares(bits uint) []KeyShare {
+	if len(s) == 0 {
+		return nil
+	}
+	size := math.Ldexp(1, int(bits))
+	byKey := make(map[string]*KeyShare)
+	for i, p := range s {
+		// The point owns the hashes from the previous point exclusive,
+		// the first one wrapping around from the last.
+		var arc float64
+		if i == 0 {
+			arc = float64(p.Hash) + size - float64(s[len(s)-1].Hash)
+		} else {
+			arc = float64(p.Hash - s[i-1].Hash)
+		}
+		ks := byKey[p.Key]
+		if ks == nil {
+			ks = &KeyShare{Key: p.Key}
+			byKey[p.Key] = ks
+		}
+		ks.Points++
+		ks.Share += arc / size
+	}
+	shares := make([]KeyShare, 0, len(byKey))
+	for _, ks := range byKey {
+		shares = append(shares, *ks)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Key < shares[j].Key })
+	return shares
+}
+
+// owner returns the key owning hash, or "" if the ring is empty.
+func (s RingSnapshot) owner(hash uint64) string {
+	if len(s) == 0 {
+		return ""
+	}
+	idx := sort.Search(len(s), func(i int) bool { return s[i].Hash >= hash })
+	if idx == len(s) {
+		idx = 0
+	}
+	return s[idx].Key
+}
+
+// A RangeMove is an arc of the ring whose owner changed. It covers the
+// hashes h with Start < h <= End, wrapping past the largest hash when
+// Start >= End; if Start == End it covers the whole ring.
+type RangeMove struct {
+	Start, End uint64
+	From, To   string // "" if the ring was or became empty
+}
+
+// Contains reports whether the arc covers hash.
+func (r RangeMove) Contains(hash uint64) bool {
+	switch {
+	case r.Start == r.End:
+		return true
+	case r.Start < r.End:
+		return r.Start < hash && hash <= r.End
+	default:
+		return r.Start < hash || hash <= r.End
+	}
+}
+
+// Diff returns the arcs of the ring that are owned by a different key
+// in new than in old, in ascending order of End. Adjacent arcs moving
+// between the same pair of keys are merged.
+func Diff(old, new RingSnapshot) []RangeMove {
+	bounds := make([]uint64, 0, len(old)+len(new))
+	for _, p := range old {
+		bounds = append(bounds, p.Hash)
+	}
+	for _, p := range new {
+		bounds = append(bounds, p.Hash)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	uniq := bounds[:0]
+	for i, b := range bounds {
+		if i == 0 || b != bounds[i-1] {
+			uniq = append(uniq, b)
+		}
+	}
+	bounds = uniq
+
+	var moves []RangeMove
+	for i, end := range bounds {
+		from, to := old.owner(end), new.owner(end)
+		if from == to {
+			continue
+		}
+		start := bounds[(i+len(bounds)-1)%len(bounds)]
+		if n := len(moves); n > 0 && moves[n-1].End == start &&
+			moves[n-1].From == from && moves[n-1].To == to {
+			moves[n-1].End = end
+			continue
+		}
+		moves = append(moves, RangeMove{Start: start, End: end, From: from, To: to})
+	}
+
+	// The first and last moves may be two halves of an arc that wraps.
+	if n := len(moves); n > 1 {
+		first, last := moves[0], moves[n-1]
+		if last.End == first.Start && last.From == first.From && last.To == first.To {
+			moves[0].Start = last.Start
+			moves = moves[:n-1]
+		}
+	}
+	return moves
 }
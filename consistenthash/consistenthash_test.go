@@ -18,8 +18,12 @@ package consistenthash
 
 import (
 	"fmt"
+	"hash/crc32"
+	"math"
+	"reflect"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestHashing(t *testing.T) {
@@ -86,6 +90,265 @@ func TestConsistency(t *testing.T) {
 
 }
 
+func TestHashPointCollisions(t *testing.T) {
+	// Some 400,000 points on a 32-bit ring are expected to collide
+	// about 18 times.
+	const nodes, replicas = 1000, 400
+	collisions := func(m *Map) int {
+		var peers []string
+		for i := 0; i < nodes; i++ {
+			peers = append(peers, fmt.Sprintf("http://10.0.%d.%d:8080", i/256, i%256))
+		}
+		m.Add(peers...)
+		return len(m.keys) - len(m.hashMap)
+	}
+
+	// The 32-bit ring is hashed with the upper half of the 64-bit
+	// ring's hash, so that only the width differs. CRC-32 hardly ever
+	// collides on inputs as alike as these peer URLs.
+	c32 := collisions(New(replicas, func(data []byte) uint32 { return uint32(fnv64a(data) >> 32) }))
+	c64 := collisions(New64(replicas, nil))
+	if testing.Verbose() {
+		t.Logf("hash point collisions with %d nodes x %d replicas: 32-bit=%d 64-bit=%d", nodes, replicas, c32, c64)
+	}
+	if c32 == 0 {
+		t.Errorf("32-bit ring has no hash point collisions; want some")
+	}
+	if c64 != 0 {
+		t.Errorf("64-bit ring has %d hash point collisions; want 0", c64)
+	}
+}
+
+func TestConsistency64(t *testing.T) {
+	hash1 := New64(1, nil)
+	hash2 := New64(1, nil)
+
+	hash1.Add("Bill", "Bob", "Bonny")
+	hash2.Add("Bob", "Bonny", "Bill")
+
+	if hash1.Get("Ben") != hash2.Get("Ben") {
+		t.Errorf("Fetching 'Ben' from both hashes should be the same")
+	}
+}
+
+func TestLease(t *testing.T) {
+	now := time.Unix(0, 0)
+	hash := New(3, func(key []byte) uint32 {
+		i, err := strconv.Atoi(string(key))
+		if err != nil {
+			panic(err)
+		}
+		return uint32(i)
+	})
+	hash.now = func() time.Time { return now }
+
+	// Replicas: 2, 4, 12, 14, 22, 24
+	hash.Add("2")
+	hash.AddWithLease(time.Minute, "4")
+
+	if got := hash.Get("3"); got != "4" {
+		t.Fatalf("Get(3) = %q; want 4", got)
+	}
+
+	// Renewing the lease keeps the key in the ring.
+	now = now.Add(50 * time.Second)
+	hash.AddWithLease(time.Minute, "4")
+	now = now.Add(50 * time.Second)
+	if got := hash.Get("3"); got != "4" {
+		t.Fatalf("Get(3) after renewal = %q; want 4", got)
+	}
+	if len(hash.keys) != 6 {
+		t.Errorf("ring has %d hash points after renewal; want 6", len(hash.keys))
+	}
+
+	// Once the lease elapses the key is skipped, then pruned.
+	now = now.Add(time.Minute)
+	if got := hash.Get("3"); got != "2" {
+		t.Fatalf("Get(3) after expiry = %q; want 2", got)
+	}
+	hash.AddWithLease(time.Minute)
+	if len(hash.keys) != 3 || len(hash.hashMap) != 3 {
+		t.Errorf("ring has %d hash points after pruning; want 3", len(hash.keys))
+	}
+	if got := hash.Get("3"); got != "2" {
+		t.Fatalf("Get(3) after pruning = %q; want 2", got)
+	}
+
+	// A pruned key can rejoin.
+	hash.AddWithLease(time.Minute, "4")
+	if got := hash.Get("3"); got != "4" {
+		t.Fatalf("Get(3) after rejoining = %q; want 4", got)
+	}
+}
+
+func TestGetN(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, err := strconv.Atoi(string(key))
+		if err != nil {
+			panic(err)
+		}
+		return uint32(i)
+	})
+
+	// Hashes 2, 4, 6, 12, 14, 16, 22, 24, 26.
+	hash.Add("6", "4", "2")
+
+	testCases := []struct {
+		key  string
+		n    int
+		want []string
+	}{
+		{"3", 2, []string{"4", "6"}},
+		{"5", 3, []string{"6", "2", "4"}},
+		{"27", 5, []string{"2", "4", "6"}},
+		{"11", 0, nil},
+	}
+	for _, tc := range testCases {
+		if got := hash.GetN(tc.key, tc.n); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("GetN(%s, %d) = %q; want %q", tc.key, tc.n, got, tc.want)
+		}
+		if len(tc.want) > 0 && tc.want[0] != hash.Get(tc.key) {
+			t.Errorf("GetN(%s) starts with %s; Get returns %s", tc.key, tc.want[0], hash.Get(tc.key))
+		}
+	}
+}
+
+func TestGetBounded(t *testing.T) {
+	hash := New(50, nil)
+	hash.LoadFactor = 1.25
+	nodes := []string{"a", "b", "c", "d", "e"}
+	hash.Add(nodes...)
+
+	// With no load, keys go to their usual owner.
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if got, want := hash.GetBounded(key, nil), hash.Get(key); got != want {
+			t.Fatalf("GetBounded(%s) without load = %s; want %s", key, got, want)
+		}
+	}
+
+	// Place requests skewed towards a few hot keys, which plain
+	// consistent hashing would all send to the same nodes.
+	loads := make(map[string]int)
+	var total int
+	for i := 0; i < 1000; i++ {
+		key := "hot-" + strconv.Itoa(i%3)
+		if i%4 == 0 {
+			key = "cold-" + strconv.Itoa(i)
+		}
+		node := hash.GetBounded(key, loads)
+		loads[node]++
+		total++
+		bound := int(math.Ceil(1.25 * float64(total) / float64(len(nodes))))
+		for _, n := range nodes {
+			if loads[n] > bound {
+				t.Fatalf("after %d requests, node %s has load %d; want at most %d", total, n, loads[n], bound)
+			}
+		}
+	}
+	for _, n := range nodes {
+		if loads[n] == 0 {
+			t.Errorf("node %s got no requests", n)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	newRing := func(keys ...string) *Map {
+		m := New(3, func(key []byte) uint32 {
+			i, err := strconv.Atoi(string(key))
+			if err != nil {
+				panic(err)
+			}
+			return uint32(i)
+		})
+		m.Add(keys...)
+		return m
+	}
+
+	// Hashes 2, 4, 6, 12, 14, 16, 22, 24, 26, then 8, 18, 28 for "8".
+	before := newRing("6", "4", "2").Snapshot()
+	after := newRing("6", "4", "2", "8").Snapshot()
+
+	if len(before) != 9 || before[0] != (RingPoint{Hash: 2, Key: "2"}) {
+		t.Fatalf("Snapshot = %v", before)
+	}
+
+	want := []RangeMove{
+		{Start: 6, End: 8, From: "2", To: "8"},
+		{Start: 16, End: 18, From: "2", To: "8"},
+		{Start: 26, End: 28, From: "2", To: "8"},
+	}
+	if got := Diff(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff on add = %v; want %v", got, want)
+	}
+
+	for i := range want {
+		want[i].From, want[i].To = want[i].To, want[i].From
+	}
+	if got := Diff(after, before); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff on remove = %v; want %v", got, want)
+	}
+
+	if got := Diff(before, before); len(got) != 0 {
+		t.Errorf("Diff of identical rings = %v; want none", got)
+	}
+
+	// Moving every arc yields a single move covering the whole ring.
+	got := Diff(newRing("5").Snapshot(), newRing("7").Snapshot())
+	if len(got) != 1 || got[0].Start != got[0].End {
+		t.Errorf("Diff on replace = %v; want one whole-ring move", got)
+	}
+}
+
+func TestShares(t *testing.T) {
+	snap := RingSnapshot{{Hash: 1 << 30, Key: "a"}, {Hash: 2 << 30, Key: "b"}, {Hash: 3 << 30, Key: "a"}}
+	// The first point of "a" owns the quarter of the ring before it and
+	// the one after the last point.
+	want := []KeyShare{{Key: "a", Points: 2, Share: 0.75}, {Key: "b", Points: 1, Share: 0.25}}
+	if got := snap.Shares(32); !reflect.DeepEqual(got, want) {
+		t.Errorf("Shares(32) = %v; want %v", got, want)
+	}
+	want = []KeyShare{{Key: "a", Points: 1, Share: 1}}
+	if got := (RingSnapshot{{Hash: 7, Key: "a"}}).Shares(64); !reflect.DeepEqual(got, want) {
+		t.Errorf("Shares of a single point = %v; want %v", got, want)
+	}
+	if got := RingSnapshot(nil).Shares(32); got != nil {
+		t.Errorf("Shares of an empty ring = %v; want nil", got)
+	}
+}
+
+func TestRangeMoveContains(t *testing.T) {
+	tests := []struct {
+		r    RangeMove
+		hash uint64
+		want bool
+	}{
+		{RangeMove{Start: 6, End: 8}, 6, false},
+		{RangeMove{Start: 6, End: 8}, 7, true},
+		{RangeMove{Start: 6, End: 8}, 8, true},
+		{RangeMove{Start: 6, End: 8}, 9, false},
+		// An arc wrapping past the largest hash.
+		{RangeMove{Start: 26, End: 2}, 27, true},
+		{RangeMove{Start: 26, End: 2}, 0, true},
+		{RangeMove{Start: 26, End: 2}, 2, true},
+		{RangeMove{Start: 26, End: 2}, 3, false},
+		{RangeMove{Start: 26, End: 2}, 26, false},
+		// The whole ring.
+		{RangeMove{Start: 5, End: 5}, 1, true},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Contains(tt.hash); got != tt.want {
+			t.Errorf("%+v.Contains(%d) = %v; want %v", tt.r, tt.hash, got, tt.want)
+		}
+	}
+
+	m := New(1, nil)
+	if got, want := m.KeyHash("key"), uint64(crc32.ChecksumIEEE([]byte("key"))); got != want {
+		t.Errorf("KeyHash(key) = %d; want %d", got, want)
+	}
+}
+
 func BenchmarkGet8(b *testing.B)   { benchmarkGet(b, 8) }
 func BenchmarkGet32(b *testing.B)  { benchmarkGet(b, 32) }
 func BenchmarkGet128(b *testing.B) { benchmarkGet(b, 128) }
@@ -108,3 +371,112 @@ func benchmarkGet(b *testing.B, shards int) {
 		hash.Get(buckets[i&(shards-1)])
 	}
 }
+
+func TestAddIdempotent(t *testing.T) {
+	hash := New(3, nil)
+	hash.Add("a")
+	hash.Add("a")
+	hash.Add("b", "a", "b")
+	if len(hash.keys) != 6 || len(hash.hashMap) != 6 {
+		t.Fatalf("ring has %d points for a and b; want 3 each", len(hash.keys))
+	}
+	count := map[string]int{}
+	for _, h := range hash.keys {
+		count[hash.hashMap[h]]++
+	}
+	if count["a"] != 3 || count["b"] != 3 {
+		t.Errorf("replicas per key = %v; want 3 each", count)
+	}
+	for i := 1; i < len(hash.keys); i++ {
+		if hash.keys[i] == hash.keys[i-1] {
+			t.Errorf("duplicate point %d on the ring", hash.keys[i])
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, err := strconv.Atoi(string(key))
+		if err != nil {
+			panic(err)
+		}
+		return uint32(i)
+	})
+	// Replicas with "hashes" 2, 4, 6, 12, 14, 16, 22, 24, 26.
+	hash.Add("6", "4", "2")
+	hash.Remove("4", "missing")
+
+	// 23 moves from 24 to 26; the keys of the others stay put.
+	for k, v := range map[string]string{"2": "2", "11": "2", "23": "6", "27": "2"} {
+		if got := hash.Get(k); got != v {
+			t.Errorf("Get(%s) after Remove = %s; want %s", k, got, v)
+		}
+	}
+	if len(hash.keys) != 6 || len(hash.hashMap) != 6 {
+		t.Errorf("ring has %d points after Remove; want 6", len(hash.keys))
+	}
+
+	// A removed key can be added again.
+	hash.Add("4")
+	if got := hash.Get("23"); got != "4" {
+		t.Errorf("Get(23) after adding 4 again = %s; want 4", got)
+	}
+
+	hash.Remove("2", "4", "6")
+	if !hash.IsEmpty() || hash.Get("23") != "" {
+		t.Errorf("ring not empty after removing every key")
+	}
+}
+
+func TestAddWithWeight(t *testing.T) {
+	hash := New64(200, nil)
+	hash.AddWithWeight(3, "big")
+	hash.Add("small")
+	if len(hash.keys) != 800 {
+		t.Fatalf("ring has %d points; want 600 for big and 200 for small", len(hash.keys))
+	}
+
+	const keys = 10000
+	owned := map[string]int{}
+	for i := 0; i < keys; i++ {
+		owned[hash.Get(strconv.Itoa(i))]++
+	}
+	if share := float64(owned["big"]) / keys; share < 0.65 || share > 0.85 {
+		t.Errorf("big owns %.2f of the keys; want about 0.75", share)
+	}
+
+	hash.Remove("big")
+	if len(hash.keys) != 200 || hash.Get("1") != "small" {
+		t.Errorf("ring has %d points after removing big; want small's 200", len(hash.keys))
+	}
+}
+
+func TestGetLeast(t *testing.T) {
+	hash := New(50, nil)
+	nodes := []string{"a", "b", "c", "d"}
+	hash.Add(nodes...)
+
+	// Requests for one hot key spread over the nodes instead of piling
+	// onto its owner.
+	var placed []string
+	for i := 0; i < 100; i++ {
+		node := hash.GetLeast("hot")
+		hash.Inc(node)
+		placed = append(placed, node)
+		bound := int(math.Ceil(defaultLoadFactor * float64(i+1) / float64(len(nodes))))
+		if hash.loads[node] > bound {
+			t.Fatalf("after %d requests, node %s has load %d; want at most %d", i+1, node, hash.loads[node], bound)
+		}
+	}
+
+	// Once they are done, the key goes back to its owner.
+	for _, node := range placed {
+		hash.Done(node)
+	}
+	if len(hash.loads) != 0 {
+		t.Errorf("loads = %v after every request is done; want none", hash.loads)
+	}
+	if got, want := hash.GetLeast("hot"), hash.Get("hot"); got != want {
+		t.Errorf("GetLeast(hot) without load = %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+)
+
+// handoffPath is the first path element, in place of a group name, of
+// the requests sent by Drain.
+const handoffPath = "_handoff"
+
+// defaultHandoffEntries is the default HTTPPoolOptions.HandoffEntries.
+const defaultHandoffEntries = 10000
+
+// States of HTTPPool.draining.
+const (
+	poolServing = iota
+	poolLeaving // Drain is handing off entries
+	poolDrained // Drain returned: requests are refused
+)
+
+var errPoolDrained = errors.New("groupcache: peer is leaving the pool")
+
+// Drain prepares the process to leave the pool, as in a rolling
+// restart, so that the keys it owns are not all loaded again by the
+// peers taking them over. It first marks the pool as leaving, so that
+// it answers the pings of HTTPPoolOptions.KeepWarmInterval with 503
+// Service Unavailable. It then sends, for each registered group, the
+// HTTPPoolOptions.HandoffEntries most recently used entries it owns
+// in its main cache to the peers that own them once the process has
+// left the consistent hash: for each key, the peer following this one
+// on the hash. Last, it stops serving, answering every request but
+// those of other peers' Drain with 503 Service Unavailable, so that
+// peers still routing keys to this process fetch them from their
+// successor if their HTTPPoolOptions.BackupPeers is set, or load them
+// themselves.
+//
+// The process should be removed from the peers' lists once Drain
+// returns. Drain stops handing off entries once ctx is done, and
+// returns the first error it met handing off a group, if any; the
+// pool stops serving even then.
+func (p *HTTPPool) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&p.draining, poolLeaving)
+	defer atomic.StoreInt32(&p.draining, poolDrained)
+	if p.client {
+		return nil
+	}
+
+	ps := p.current()
+	peers := make([]string, 0, len(ps.getters))
+	for peer := range ps.getters {
+		if peer != p.self {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+
+	var first error
+	for _, g := range GetGroups() {
+		for _, peer := range peers {
+			err := p.handoffGroup(ctx, ps, peer, g)
+			if err != nil && first == nil {
+				first = fmt.Errorf("groupcache: handing off group %q to %s: %w", g.Name(), peer, err)
+			}
+		}
+	}
+	return first
+}
+
+// handoffGroup sends peer the entries of g it takes over from this
+// process, out of the HTTPPoolOptions.HandoffEntries most recently
+// used ones this process owns.
+func (p *HTTPPool) handoffGroup(ctx context.Context, ps *peerSet, peer string, g *Group) error {
+	var owned int
+	keep := func(key string) bool {
+		names := ps.ring.GetN(g.routingKey(key), 2)
+		if len(names) < 2 || names[0] != p.self {
+			return false
+		}
+		owned++
+		return owned <= p.opts.HandoffEntries && names[1] == peer
+	}
+
+	h := ps.getters[peer]
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(g.exportGzip(ctx, pw, false, keep, p.opts.MaxPrewarmBytes))
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.baseURL+handoffPath+"/"+url.PathEscape(g.Name()), pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	h.modify(ctx, req)
+	res, err := h.transport(ctx).RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	return nil
+}
+
+// serveHandoff stores the entries of groupName sent by a peer's Drain.
+func (p *HTTPPool) serveHandoff(w http.ResponseWriter, r *http.Request, groupName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "handoffs must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	group := GetGroup(groupName)
+	if group == nil {
+		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		return
+	}
+	n, err := p.fillPrewarmed(group, r.Body)
+	group.Stats.HandoffEntries.Add(int64(n))
+	if errors.Is(err, errPrewarmTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
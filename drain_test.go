@@ -0,0 +1,159 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrainHandoff(t *testing.T) {
+	g := newGroup("TestDrainHandoff-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	for i := 0; i < 40; i++ {
+		var s string
+		if err := g.Get(dummyCtx, fmt.Sprintf("%02d", i), StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != defaultBasePath+handoffPath+"/"+g.Name() {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		snap, err := ReadSnapshot(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range snap.Entries {
+			if string(e.Value) != "value:"+e.Key {
+				t.Errorf("handed off %q = %q; want its value", e.Key, e.Value)
+			}
+			received = append(received, e.Key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	const handoffEntries = 5
+	p := newHTTPPool("http://self", &HTTPPoolOptions{HandoffEntries: handoffEntries})
+	p.Set("http://self", ts.URL)
+	ps := p.current()
+
+	// The most recently used keys the process owns, all taken over by
+	// the only other peer.
+	keys, _ := g.mainCache.entries()
+	var want []string
+	for _, key := range keys {
+		if ps.ring.Get(key) == "http://self" && len(want) < handoffEntries {
+			want = append(want, key)
+		}
+	}
+	if len(want) < handoffEntries {
+		t.Fatalf("process owns %d keys; want more than HandoffEntries", len(want))
+	}
+
+	if err := p.handoffGroup(context.Background(), ps, ts.URL, g); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(received, ",") != strings.Join(want, ",") {
+		t.Errorf("handed off %q; want %q", received, want)
+	}
+}
+
+func TestServeHandoff(t *testing.T) {
+	src := newGroup("TestServeHandoff-source", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	for _, key := range []string{"a", "b", "c"} {
+		var s string
+		if err := src.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var snap bytes.Buffer
+	if err := src.SaveSnapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	dst := newGroup("TestServeHandoff-dest", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected load")
+	}), NoPeers{})
+
+	p := newHTTPPool("http://successor", nil)
+	path := defaultBasePath + handoffPath + "/" + dst.Name()
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, &snap))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("handoff status = %d; want %d", w.Code, http.StatusNoContent)
+	}
+	if got := dst.mainCache.items(); got != 3 {
+		t.Errorf("successor holds %d keys; want 3", got)
+	}
+	if got := dst.Stats.HandoffEntries.Get(); got != 3 {
+		t.Errorf("HandoffEntries = %d; want 3", got)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader("not a snapshot")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("corrupt handoff status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	p := newHTTPPool("http://self", nil)
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultBasePath+path, nil))
+		return w.Code
+	}
+	if code := serve(pingPath + "/"); code != http.StatusNoContent {
+		t.Errorf("ping before Drain: status %d; want %d", code, http.StatusNoContent)
+	}
+	if err := p.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(pingPath + "/"); code != http.StatusServiceUnavailable {
+		t.Errorf("ping after Drain: status %d; want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := serve("TestDrain-group/key"); code != http.StatusServiceUnavailable {
+		t.Errorf("Get after Drain: status %d; want %d", code, http.StatusServiceUnavailable)
+	}
+	// Other peers may still hand off their entries.
+	if code := serve(handoffPath + "/TestDrain-group"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET of a handoff after Drain: status %d; want %d", code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultCompressResponseBytes is the default
+// HTTPPoolOptions.CompressMinBytes.
+const defaultCompressResponseBytes = 1024
+
+// A WireCompression compresses the bodies of the responses an HTTPPool
+// sends its peers, as an HTTP content coding. A peer asks for it in
+// the Accept-Encoding header of its requests, so peers with different
+// compressions, or none, still understand each other.
+type WireCompression interface {
+	// Encoding returns the name of the content coding, such as
+	// "gzip", in the Accept-Encoding and Content-Encoding headers.
+	Encoding() string
+
+	// NewWriter returns a writer compressing to w. Closing it writes
+	// any buffered data, but does not close w.
+	NewWriter(w io.Writer) io.WriteCloser
+
+	// NewReader returns a reader of the data compressed in r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCompression is a WireCompression using gzip at Level, such as
+// gzip.BestSpeed.
+// If Level is zero, it defaults to gzip.DefaultCompression.
+type GzipCompression struct {
+	Level int
+}
+
+// gzipWriters pools the writers of GzipCompression, by level from
+// gzip.HuffmanOnly to gzip.BestCompression.
+var gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+func (GzipCompression) Encoding() string { return "gzip" }
+
+func (c GzipCompression) NewWriter(w io.Writer) io.WriteCloser {
+	level := c.Level
+	if level == 0 || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		level = gzip.DefaultCompression
+	}
+	pool := &gzipWriters[level-gzip.HuffmanOnly]
+	zw, _ := pool.Get().(*gzip.Writer)
+	if zw == nil {
+		zw, _ = gzip.NewWriterLevel(w, level)
+	} else {
+		zw.Reset(w)
+	}
+	return &pooledGzipWriter{Writer: zw, pool: pool}
+}
+
+func (GzipCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// pooledGzipWriter returns its gzip.Writer to the pool once closed.
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w *pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// compressedBody returns a writer compressing the body of the response
+// to r, of about n bytes before compression, with
+// HTTPPoolOptions.Compression, setting the response's headers to match,
+// if r accepts it and n reaches CompressMinBytes. Otherwise it returns
+// nil, and the body is written to w as it is. The caller must close the
+// writer once the body is written.
+func (p *HTTPPool) compressedBody(w http.ResponseWriter, r *http.Request, n int) io.WriteCloser {
+	c := p.opts.Compression
+	if c == nil || n < p.opts.CompressMinBytes || !acceptsEncoding(r.Header.Get("Accept-Encoding"), c.Encoding()) {
+		return nil
+	}
+	h := w.Header()
+	h.Set("Content-Encoding", c.Encoding())
+	h.Add("Vary", "Accept-Encoding")
+	return c.NewWriter(w)
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header lists the
+// content coding name, without a quality of zero.
+func acceptsEncoding(header, name string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params := part, ""
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			coding, params = part[:i], part[i+1:]
+		}
+		if !strings.EqualFold(strings.TrimSpace(coding), name) {
+			continue
+		}
+		q := strings.TrimSpace(params)
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// responseBody returns a reader of the body of res, decompressing it
+// if the peer compressed it, and bounded by MaxResponseBytes after
+// decompression. The caller must close it as well as res.Body.
+func (h *httpGetter) responseBody(res *http.Response) (io.ReadCloser, error) {
+	var body io.ReadCloser = ioutil.NopCloser(res.Body)
+	if enc := res.Header.Get("Content-Encoding"); enc != "" {
+		if h.compression == nil || !strings.EqualFold(enc, h.compression.Encoding()) {
+			return nil, fmt.Errorf("unexpected Content-Encoding %q", enc)
+		}
+		zr, err := h.compression.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading compressed response body: %w", err)
+		}
+		body = zr
+	}
+	if h.maxBytes > 0 {
+		return limitedReadCloser{&limitedBody{r: body, left: h.maxBytes}, body}, nil
+	}
+	return body, nil
+}
+
+// limitedReadCloser closes the reader bounded by its limitedBody.
+type limitedReadCloser struct {
+	*limitedBody
+	io.Closer
+}
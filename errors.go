@@ -0,0 +1,93 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import "fmt"
+
+// A PeerError is returned by Group.Get when fetching a key from a peer
+// failed and the key could not be loaded otherwise, for example
+// because the context was done by then.
+type PeerError struct {
+	Peer ProtoGetter
+	Err  error
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("groupcache: fetching from peer %s: %v", e.Peer.GetURL(), e.Err)
+}
+
+func (e *PeerError) Unwrap() error { return e.Err }
+
+// A GetterError is returned by Group.Get when the group's Getter
+// failed to load a key.
+type GetterError struct {
+	Key string
+	Err error
+}
+
+func (e *GetterError) Error() string {
+	return fmt.Sprintf("groupcache: loading key %q: %v", e.Key, e.Err)
+}
+
+func (e *GetterError) Unwrap() error { return e.Err }
+
+// A DecodeError is returned when a value or a peer's response cannot be
+// decoded, for example by a ProtoSink given bytes that are not the
+// encoding of its message.
+type DecodeError struct {
+	What string // what was being decoded, e.g. "response body"
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("groupcache: decoding %s: %v", e.What, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// A MultiError is returned by Group.GetMulti when it failed to get some
+// of its keys. It holds an error per key, nil for the keys it got.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	n, first := 0, error(nil)
+	for _, err := range e {
+		if err != nil {
+			if n == 0 {
+				first = err
+			}
+			n++
+		}
+	}
+	if n == 1 {
+		return first.Error()
+	}
+	return fmt.Sprintf("%v (and %d other errors)", first, n-1)
+}
+
+// ownerUnavailableError wraps the error of the last peer asked for a
+// key that may only be loaded by its owner, matching
+// ErrOwnerUnavailable too.
+type ownerUnavailableError struct {
+	err error
+}
+
+func (e *ownerUnavailableError) Error() string { return e.err.Error() }
+
+func (e *ownerUnavailableError) Unwrap() error { return e.err }
+
+func (e *ownerUnavailableError) Is(target error) bool { return target == ErrOwnerUnavailable }
@@ -0,0 +1,107 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+	"github.com/melojustme/groupcache/testpb"
+)
+
+func TestGetterError(t *testing.T) {
+	errOrigin := errors.New("origin unavailable")
+	g := newGroup("TestGetterError-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errOrigin
+	}), NoPeers{})
+
+	var s string
+	err := g.Get(dummyCtx, "key", StringSink(&s), nil)
+	var ge *GetterError
+	if !errors.As(err, &ge) || ge.Key != "key" {
+		t.Fatalf("Get error = %v (%T); want a *GetterError for key", err, err)
+	}
+	if !errors.Is(err, errOrigin) {
+		t.Errorf("Get error = %v; want it to wrap %v", err, errOrigin)
+	}
+}
+
+// cancellingPeer fails every request after cancelling the caller's
+// context, as if the caller gave up while the request was in flight.
+type cancellingPeer struct {
+	fakePeer
+	cancel context.CancelFunc
+}
+
+func (p *cancellingPeer) Get(_ context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	p.cancel()
+	return errors.New("connection reset")
+}
+
+func TestPeerError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peer := &cancellingPeer{cancel: cancel}
+	g := newGroup("TestPeerError-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), fakePeers{peer})
+
+	var s string
+	err := g.Get(ctx, "key", StringSink(&s), nil)
+	var pe *PeerError
+	if !errors.As(err, &pe) || pe.Peer != peer {
+		t.Fatalf("Get error = %v (%T); want a *PeerError for the peer", err, err)
+	}
+	if errors.As(err, new(*GetterError)) {
+		t.Errorf("Get error = %v; want no *GetterError", err)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	g := newGroup("TestDecodeError-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("\xff not a proto", time.Time{})
+	}), NoPeers{})
+
+	// The value is cached through a StringSink, then served from the
+	// cache into a ProtoSink that cannot decode it.
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	err := g.Get(dummyCtx, "key", ProtoSink(new(testpb.TestMessage)), nil)
+	var de *DecodeError
+	if !errors.As(err, &de) {
+		t.Errorf("Get into a ProtoSink error = %v (%T); want a *DecodeError", err, err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\xff not a proto"))
+	}))
+	defer ts.Close()
+	getter := &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}
+	err = getter.Get(context.Background(), &pb.GetRequest{Group: proto.String("group"), Key: proto.String("key")}, &pb.GetResponse{})
+	if !errors.As(err, &de) || de.What != "response body" {
+		t.Errorf("httpGetter.Get of a garbled response error = %v (%T); want a *DecodeError", err, err)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+)
+
+// ETag returns the entity tag of value as used by Group.GetIfChanged:
+// a digest of its bytes, so that equal values have equal tags in
+// every process without storing them.
+func ETag(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:16])
+}
+
+// etag returns the entity tag of the view's bytes.
+func (v ByteView) etag() string {
+	if v.b != nil {
+		return ETag(v.b)
+	}
+	return ETag([]byte(v.s))
+}
+
+// GetIfChanged is like Get for a caller already holding a value of
+// key whose ETag is etag. If the current value has the same tag, it
+// returns changed false and leaves dest alone; otherwise it populates
+// dest with the value and returns changed true.
+//
+// Keys this process has not cached are asked of their owner with the
+// tag, and the value is only transferred if it differs. An owner that
+// has not cached the key either loads it from its getter first, as for
+// Get, and compares the fresh value. If the owner fails, GetIfChanged
+// falls back to Get.
+func (g *Group) GetIfChanged(ctx context.Context, key, etag string, dest Sink) (changed bool, err error) {
+	g.peersOnce.Do(g.initPeers)
+	if dest == nil {
+		return false, errors.New("groupcache: nil dest Sink")
+	}
+	if _, cacheHit := g.lookupCache(key); !cacheHit {
+		if peer, ok := g.pickPeer(key); ok {
+			value, changed, err := g.getIfChangedFromPeer(ctx, peer, key, etag)
+			if err == nil {
+				g.Stats.Gets.Add(1)
+				g.Stats.PeerLoads.Add(1)
+				return g.setIfChanged(value, changed, etag, dest)
+			}
+			if errors.Is(err, context.Canceled) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrReadOnly) {
+				return false, err
+			}
+			g.Stats.PeerErrors.Add(1)
+		}
+	}
+	var value ByteView
+	info, err := g.GetWithInfo(ctx, key, ByteViewSink(&value), nil)
+	if err != nil {
+		return false, err
+	}
+	value.meta = info.Meta
+	return g.setIfChanged(value, true, etag, dest)
+}
+
+// setIfChanged populates dest with value if changed and value's tag
+// is not etag, and reports whether it did.
+func (g *Group) setIfChanged(value ByteView, changed bool, etag string, dest Sink) (bool, error) {
+	if !changed || value.etag() == etag {
+		g.Stats.NotModified.Add(1)
+		return false, nil
+	}
+	return true, setSinkView(dest, value)
+}
+
+// getIfChangedFromPeer asks peer for key unless its value's tag is
+// etag. changed is false if the peer reported the same tag, and value
+// is then empty. Peers that do not support tags always send the value.
+func (g *Group) getIfChangedFromPeer(ctx context.Context, peer ProtoGetter, key, etag string) (value ByteView, changed bool, err error) {
+	req := &pb.GetRequest{
+		Group:      &g.name,
+		Key:        &key,
+		Etag:       &etag,
+		Generation: g.peerGeneration(),
+	}
+	res := &pb.GetResponse{}
+	if err := peer.Get(ctx, req, res); err != nil {
+		return ByteView{}, false, &PeerError{Peer: peer, Err: err}
+	}
+	if res.GetNotModified() {
+		return ByteView{}, false, nil
+	}
+	var expire time.Time
+	if res.Expire != nil && *res.Expire != 0 {
+		expire = time.Unix(*res.Expire/int64(time.Second), *res.Expire%int64(time.Second))
+		if time.Now().After(expire) {
+			return ByteView{}, false, &PeerError{Peer: peer, Err: errors.New("peer returned expired value")}
+		}
+	}
+	return ByteView{b: res.Value, e: expire, meta: res.Meta, tags: res.Tags}, true, nil
+}
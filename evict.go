@@ -0,0 +1,116 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultEvictionQueuePerWorker is the default GroupOptions.EvictionQueueSize
+// per eviction worker.
+const defaultEvictionQueuePerWorker = 64
+
+// evictedEntry is an entry detached from a cache whose
+// GroupOptions.OnEvicted call is pending.
+type evictedEntry struct {
+	key     string
+	value   ByteView
+	removed bool // by Remove rather than evicted to make room
+}
+
+// evictionPool runs GroupOptions.OnEvicted on the goroutines set by
+// GroupOptions.EvictionWorkers.
+type evictionPool struct {
+	work chan []evictedEntry
+	wg   sync.WaitGroup
+
+	mu     sync.RWMutex // held for reading while sending on work
+	closed bool
+}
+
+func (g *Group) startEvictionWorkers() {
+	p := &evictionPool{work: make(chan []evictedEntry, g.opts.EvictionQueueSize)}
+	p.wg.Add(g.opts.EvictionWorkers)
+	for i := 0; i < g.opts.EvictionWorkers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for entries := range p.work {
+				g.callOnEvicted(entries)
+			}
+		}()
+	}
+	g.evictPool = p
+}
+
+// dispatchEvicted hands entries, evicted by a cache operation once it
+// released the cache lock, to the eviction workers if there are any,
+// and otherwise calls OnEvicted for them right away.
+func (g *Group) dispatchEvicted(entries []evictedEntry) {
+	if p := g.evictPool; p != nil {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		if !p.closed {
+			select {
+			case p.work <- entries:
+			default:
+				if log := g.logger(); log != nil {
+					log.WithFields(logrus.Fields{
+						"group":    g.name,
+						"category": "groupcache",
+					}).Warnf("eviction queue is full; waiting for OnEvicted calls to catch up")
+				}
+				p.work <- entries
+			}
+			return
+		}
+	}
+	g.callOnEvicted(entries)
+}
+
+func (g *Group) callOnEvicted(entries []evictedEntry) {
+	for _, e := range entries {
+		if value, ok := g.cachedView(e.key, e.value); ok {
+			g.opts.OnEvicted(e.key, value)
+		}
+	}
+}
+
+// Close stops the background work of the group. It stops the checks
+// of GroupOptions.AntiEntropyInterval, and waits for the
+// GroupOptions.OnEvicted calls of the entries evicted so far to return
+// before stopping the GroupOptions.EvictionWorkers. The group remains
+// usable; entries it evicts later have OnEvicted called on the
+// evicting goroutine. Close does nothing for groups without background
+// work.
+func (g *Group) Close() {
+	if ae := g.antiEntropy; ae != nil {
+		ae.stop()
+	}
+	p := g.evictPool
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.work)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
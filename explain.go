@@ -0,0 +1,93 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"time"
+)
+
+// An ExplainResult describes the steps Group.Explain took to get a key.
+type ExplainResult struct {
+	Key string
+
+	// CacheHit is the cache of this process the value was found in, or
+	// 0 if it was not cached here.
+	CacheHit CacheType
+
+	// Shared is set if the Get joined a load of the key already under
+	// way for another caller, or by another group sharing the
+	// GroupOptions.SharedLoadGroup. The steps of that load are not
+	// recorded.
+	Shared bool
+
+	// PeerFetches lists the peers asked for the key, in order.
+	PeerFetches []ExplainPeerFetch
+
+	// Origin is set if the value was loaded from the group's getter,
+	// which took OriginLatency.
+	Origin        bool
+	OriginLatency time.Duration
+
+	// Stale and PossiblyStale are those of the GetInfo of the Get.
+	Stale         bool
+	PossiblyStale bool
+
+	// Duration is how long the whole Get took.
+	Duration time.Duration
+}
+
+// An ExplainPeerFetch describes a peer asked for a key by Group.Explain.
+type ExplainPeerFetch struct {
+	Peer    string // the peer's URL
+	Replica bool   // the peer was asked as a read replica
+	Err     error  // why the fetch failed, or nil
+}
+
+// explainKey is the context key carrying the ExplainResult that
+// Group.Explain fills in.
+type explainKey struct{}
+
+// explaining returns the ExplainResult of the Explain call ctx was
+// made for, or nil.
+func explaining(ctx context.Context) *ExplainResult {
+	if ctx == nil {
+		return nil
+	}
+	res, _ := ctx.Value(explainKey{}).(*ExplainResult)
+	return res
+}
+
+// Explain gets key like Get, discarding the value, and reports how it
+// was obtained: from which cache, peer or the getter, and how long that
+// took. It is meant for debugging why a key was slow or stale. The Get
+// is counted in the group's Stats like any other, and populates the
+// caches alike; Stats.Explains counts the calls to Explain. The result
+// describes the Get even if it failed.
+func (g *Group) Explain(ctx context.Context, key string) (ExplainResult, error) {
+	g.Stats.Explains.Add(1)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	res := &ExplainResult{Key: key}
+	start := time.Now()
+	var value ByteView
+	info, err := g.GetWithInfo(context.WithValue(ctx, explainKey{}, res), key, ByteViewSink(&value), nil)
+	res.Duration = time.Since(start)
+	res.Stale, res.PossiblyStale = info.Stale, info.PossiblyStale
+	return *res, err
+}
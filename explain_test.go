@@ -0,0 +1,70 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExplain(t *testing.T) {
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("local:"+key, time.Time{})
+	})
+	peer := &fakePeer{}
+	g := newGroup("TestExplain-group", cacheSize, getter, prefixPeers{peer})
+
+	explain := func(key string) ExplainResult {
+		t.Helper()
+		res, err := g.Explain(dummyCtx, key)
+		if err != nil {
+			t.Fatalf("Explain(%q): %v", key, err)
+		}
+		if res.Key != key || res.Shared || res.Duration <= 0 {
+			t.Errorf("Explain(%q) = %+v; want the key, not shared, and a duration", key, res)
+		}
+		return res
+	}
+
+	if res := explain("key"); res.CacheHit != 0 || !res.Origin || len(res.PeerFetches) != 0 {
+		t.Errorf("Explain of an owned key = %+v; want an origin load", res)
+	}
+	if res := explain("key"); res.CacheHit != MainCache || res.Origin || res.OriginLatency != 0 {
+		t.Errorf("Explain of a cached key = %+v; want a main cache hit", res)
+	}
+	res := explain("remote-key")
+	if res.CacheHit != 0 || res.Origin || len(res.PeerFetches) != 1 || res.PeerFetches[0].Peer != peer.GetURL() || res.PeerFetches[0].Err != nil {
+		t.Errorf("Explain of a remote key = %+v; want a fetch from %s", res, peer.GetURL())
+	}
+	if res := explain("remote-key"); res.CacheHit != HotCache || len(res.PeerFetches) != 0 {
+		t.Errorf("Explain of a mirrored key = %+v; want a hot cache hit", res)
+	}
+
+	peer.fail = true
+	res = explain("remote-other")
+	if !res.Origin || len(res.PeerFetches) != 1 || res.PeerFetches[0].Err == nil {
+		t.Errorf("Explain with the owner failing = %+v; want a failed fetch, then an origin load", res)
+	}
+
+	if n := g.Stats.Explains.Get(); n != 5 {
+		t.Errorf("Explains = %d; want 5", n)
+	}
+	if n := g.Stats.Gets.Get(); n != 5 {
+		t.Errorf("Gets = %d; want Explain counted as a Get", n)
+	}
+}
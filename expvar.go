@@ -0,0 +1,40 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import "expvar"
+
+// PublishExpvar publishes the stats of the registered groups as the
+// expvar variable name, served with the others at /debug/vars by the
+// expvar package's handler. The variable maps the name of each group
+// to its Stats and the CacheStats of its main and hot caches, read
+// anew each time it is served. Like expvar.Publish, PublishExpvar
+// panics if name is already published.
+func PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		res := make(map[string]groupStats)
+		for _, g := range GetGroups() {
+			res[g.Name()] = groupStats{
+				Name:      g.Name(),
+				Stats:     &g.Stats,
+				MainCache: g.CacheStats(MainCache),
+				HotCache:  g.CacheStats(HotCache),
+			}
+		}
+		return res
+	}))
+}
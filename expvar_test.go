@@ -0,0 +1,55 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	g := newGroup("TestPublishExpvar-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	PublishExpvar("TestPublishExpvar")
+
+	read := func() groupStats {
+		var vars map[string]groupStats
+		if err := json.Unmarshal([]byte(expvar.Get("TestPublishExpvar").String()), &vars); err != nil {
+			t.Fatal(err)
+		}
+		return vars[g.Name()]
+	}
+	if got := read(); got.Name != g.Name() || got.Stats.Gets != 0 {
+		t.Fatalf("published stats = %+v; want those of %s, with no gets", got, g.Name())
+	}
+	for i := 0; i < 2; i++ {
+		var s string
+		if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The variable reflects the stats when read.
+	got := read()
+	if got.Stats.Gets != 2 || got.Stats.CacheHits != 1 || got.MainCache.Items != 1 {
+		t.Errorf("published stats = %+v, %+v; want 2 gets, 1 hit and 1 item", got.Stats, got.MainCache)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// globalCacheLimit is the limit set by SetGlobalCacheLimit.
+	// Accessed atomically.
+	globalCacheLimit int64
+
+	// globalCachedBytes is the number of bytes held by the caches of
+	// all groups, so that adding to them only takes globalEvictMu once
+	// they exceed globalCacheLimit. Accessed atomically.
+	globalCachedBytes int64
+
+	// globalEvictMu serializes evictions across groups.
+	globalEvictMu sync.Mutex
+)
+
+// SetGlobalCacheLimit bounds the bytes held by the caches of all
+// groups of the process together, on top of each group's own cache
+// size. If zero, the default, there is no global limit.
+//
+// Whenever a value cached by any group takes the total above the
+// limit, entries are evicted across groups: each group is entitled to
+// a share of the limit in proportion to its GroupOptions.GlobalWeight,
+// or else its own cache size, and the group furthest above its share
+// evicts entries, its least recently used first, until the total fits
+// again. A group that only holds pinned entries is passed over.
+//
+// Groups sized by the global limit alone can be given weights and an
+// own cache size no smaller than the limit, such as math.MaxInt64.
+//
+// Lowering the limit evicts entries at once.
+func SetGlobalCacheLimit(bytes int64) {
+	atomic.StoreInt64(&globalCacheLimit, bytes)
+	evictGlobal()
+}
+
+// evictGlobal evicts entries from the caches of all groups until their
+// combined size fits within the limit set by SetGlobalCacheLimit. It
+// returns how many entries it evicted.
+func evictGlobal() (evicted int) {
+	limit := atomic.LoadInt64(&globalCacheLimit)
+	if limit <= 0 || atomic.LoadInt64(&globalCachedBytes) <= limit {
+		return 0
+	}
+	globalEvictMu.Lock()
+	defer globalEvictMu.Unlock()
+
+	var groups []*Group
+	for _, g := range GetGroups() {
+		if g.cacheLimit() > 0 {
+			groups = append(groups, g)
+		}
+	}
+	// pinned holds the groups found to hold only pinned entries. Their
+	// bytes still count towards the total, but the others' shares are
+	// then taken from the weights of the others alone.
+	pinned := make(map[*Group]bool)
+	for {
+		var total, worst int64
+		var sum float64
+		for _, g := range groups {
+			if !pinned[g] {
+				sum += g.globalWeight()
+			}
+		}
+		var victim *Group
+		for _, g := range groups {
+			n := g.cachedBytes()
+			total += n
+			if pinned[g] {
+				continue
+			}
+			over := n - int64(float64(limit)*g.globalWeight()/sum)
+			if victim == nil || over > worst {
+				victim, worst = g, over
+			}
+		}
+		if total <= limit || victim == nil {
+			return evicted
+		}
+		if n := victim.evictLargestPair(); n > 0 {
+			victim.Stats.GlobalEvictions.Add(int64(n))
+			evicted += n
+			continue
+		}
+		pinned[victim] = true
+	}
+}
+
+// globalWeight returns the weight of g's share of the global limit.
+func (g *Group) globalWeight() float64 {
+	if w := g.opts.GlobalWeight; w > 0 {
+		return w
+	}
+	return float64(g.cacheLimit())
+}
+
+// cachedBytes returns the bytes held by all the caches of g.
+func (g *Group) cachedBytes() int64 {
+	mains, hots := g.allCaches()
+	var n int64
+	for i := range mains {
+		n += mains[i].bytes() + hots[i].bytes()
+	}
+	return n
+}
+
+// evictLargestPair evicts an entry from the main and hot caches of g
+// sharing a budget that hold the most bytes, and returns how many
+// entries it evicted: none if they only hold pinned entries.
+func (g *Group) evictLargestPair() int {
+	mains, hots := g.allCaches()
+	var most int64
+	var main, hot *cache
+	for i := range mains {
+		if n := mains[i].bytes() + hots[i].bytes(); n > most {
+			most, main, hot = n, mains[i], hots[i]
+		}
+	}
+	if main == nil {
+		return 0
+	}
+	return g.evictOverflow(main, hot, most-1)
+}
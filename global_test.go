@@ -0,0 +1,177 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobalCacheLimit(t *testing.T) {
+	// Leave the groups of other tests out of the global limit.
+	mu.Lock()
+	saved := groups
+	groups = make(map[string]*Group)
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		groups = saved
+		mu.Unlock()
+	}()
+
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(strings.Repeat("x", 100), time.Time{})
+	})
+	small := newGroup("TestGlobalCacheLimit-small", 1<<20, getter, NoPeers{})
+	large := newGroup("TestGlobalCacheLimit-large", 3<<20, getter, NoPeers{})
+
+	const limit = 2000
+	SetGlobalCacheLimit(limit)
+	defer SetGlobalCacheLimit(0)
+
+	var s string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		if err := small.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if total := small.cachedBytes() + large.cachedBytes(); total > limit {
+			t.Fatalf("after %d Gets, groups hold %d bytes; want at most %d", i+1, total, limit)
+		}
+	}
+	if small.Stats.GlobalEvictions.Get() == 0 {
+		t.Error("small group evicted nothing to honor the global limit")
+	}
+	// The large group is entitled to three quarters of the limit, so
+	// filling it makes room at the expense of the small one.
+	for i := 0; i < 30; i++ {
+		if err := large.Get(dummyCtx, fmt.Sprintf("key-%02d", i), StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if total := small.cachedBytes() + large.cachedBytes(); total > limit {
+			t.Fatalf("after %d Gets of the large group, groups hold %d bytes; want at most %d", i+1, total, limit)
+		}
+	}
+	if got, share := small.cachedBytes(), int64(limit/4); got > share {
+		t.Errorf("small group holds %d bytes; want at most its share of %d", got, share)
+	}
+	if got := large.cachedBytes(); got < limit/2 {
+		t.Errorf("large group holds %d bytes; want most of the limit", got)
+	}
+
+	// Lifting the limit lets the groups grow again.
+	SetGlobalCacheLimit(0)
+	if err := small.Get(dummyCtx, "extra", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := small.cachedBytes() + large.cachedBytes(); got <= limit {
+		t.Errorf("without a global limit, groups hold %d bytes; want more than %d", got, limit)
+	}
+}
+
+func TestGlobalWeight(t *testing.T) {
+	mu.Lock()
+	saved := groups
+	groups = make(map[string]*Group)
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		groups = saved
+		mu.Unlock()
+	}()
+
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(strings.Repeat("x", 100), time.Time{})
+	})
+	// Both groups leave their size to the global limit.
+	light := newGroupOpts("TestGlobalWeight-light", math.MaxInt64, getter, NoPeers{}, &GroupOptions{GlobalWeight: 1})
+	heavy := newGroupOpts("TestGlobalWeight-heavy", math.MaxInt64, getter, NoPeers{}, &GroupOptions{GlobalWeight: 3})
+
+	const limit = 4000
+	SetGlobalCacheLimit(limit)
+	defer SetGlobalCacheLimit(0)
+
+	var s string
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		for _, g := range []*Group{light, heavy} {
+			if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if total := light.cachedBytes() + heavy.cachedBytes(); total > limit {
+			t.Fatalf("after %d Gets, groups hold %d bytes; want at most %d", i+1, total, limit)
+		}
+	}
+	if got, share := light.cachedBytes(), int64(limit/4); got > share {
+		t.Errorf("light group holds %d bytes; want at most its share of %d", got, share)
+	}
+	if got := heavy.cachedBytes(); got < limit/2 {
+		t.Errorf("heavy group holds %d bytes; want most of the limit", got)
+	}
+}
+
+func TestGlobalCacheLimitPinnedVictim(t *testing.T) {
+	mu.Lock()
+	saved := groups
+	groups = make(map[string]*Group)
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		groups = saved
+		mu.Unlock()
+	}()
+
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(strings.Repeat("x", 100), time.Time{})
+	})
+	pinned := newGroupOpts("TestGlobalCacheLimitPinnedVictim-pinned", 1<<20, getter, NoPeers{}, &GroupOptions{GlobalWeight: 1})
+	other := newGroupOpts("TestGlobalCacheLimitPinnedVictim-other", 1<<20, getter, NoPeers{}, &GroupOptions{GlobalWeight: 1})
+
+	var s string
+	for i := 0; i < 15; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		if err := pinned.Pin(key); err != nil {
+			t.Fatal(err)
+		}
+		if err := pinned.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := other.Get(dummyCtx, fmt.Sprintf("key-%02d", i), StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The pinned group is furthest above its half of the limit, but
+	// can evict nothing: the other must make up for it.
+	const limit = 2000
+	before := pinned.cachedBytes()
+	SetGlobalCacheLimit(limit)
+	defer SetGlobalCacheLimit(0)
+	if got := pinned.cachedBytes(); got != before {
+		t.Errorf("pinned group holds %d bytes; want its %d pinned bytes kept", got, before)
+	}
+	if total := pinned.cachedBytes() + other.cachedBytes(); total > limit {
+		t.Errorf("groups hold %d bytes; want at most %d", total, limit)
+	}
+}
@@ -26,7 +26,13 @@ package groupcache
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -41,6 +47,10 @@ import (
 
 var logger *logrus.Entry
 
+// SetLogger sets the logger reporting the errors of the groups and
+// pools without one of their own in GroupOptions.Logger or
+// HTTPPoolOptions.Logger, such as failed peer fetches. By default
+// errors are not logged.
 func SetLogger(log *logrus.Entry) {
 	logger = log
 }
@@ -56,6 +66,21 @@ type Getter interface {
 	Get(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error
 }
 
+// A GetterWithMeta is a Getter that may also return metadata about the
+// values it loads, such as when they were last modified, to be stored
+// alongside them. Groups call GetWithMeta instead of Get to load keys,
+// and Group.GetWithMeta returns the metadata with the value, from the
+// cache or from the key's owner. Metadata counts towards the cache
+// size, and should be small. It is not saved in snapshots, nor sent
+// by PrewarmFrom.
+type GetterWithMeta interface {
+	Getter
+
+	// GetWithMeta is like Get but also returns the value's metadata,
+	// which may be nil. The group takes ownership of meta.
+	GetWithMeta(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) (meta []byte, err error)
+}
+
 // A GetterFunc implements Getter with a function.
 type GetterFunc func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error
 
@@ -63,6 +88,66 @@ func (f GetterFunc) Get(ctx context.Context, key string, dest Sink, fixFunc func
 	return f(ctx, key, dest, fixFunc)
 }
 
+// ErrNotFound is returned by a Getter, possibly wrapped, when the key
+// has no value. It is passed on to peers that ask for the key, so that
+// Group.Get returns an error wrapping ErrNotFound whichever process
+// owns the key.
+var ErrNotFound = errors.New("groupcache: key not found")
+
+// An ExistenceFilter reports which keys may have a value, such as a
+// bloom filter of the keys known to the origin.
+type ExistenceFilter interface {
+	// MightContain returns false if key definitely has no value, and
+	// true if it may have one. False positives are allowed: a key the
+	// filter wrongly reports is still loaded from the getter.
+	MightContain(key string) bool
+}
+
+// A PromotionPolicy decides which values fetched from peers are
+// mirrored in the hot cache, for GroupOptions.HotCachePromotion.
+type PromotionPolicy interface {
+	// Promote is called each time value is fetched for key from the
+	// peer owning it, and reports whether to mirror it in the hot
+	// cache. It may be called concurrently.
+	Promote(key string, value ByteView) bool
+}
+
+// A DistributedLocker provides locks shared by every process of the
+// cluster, such as ones backed by Redis or etcd, for
+// GroupOptions.DistributedLocker.
+type DistributedLocker interface {
+	// Acquire waits until it holds the lock named key, and returns a
+	// function releasing it. It returns an error if ctx is done
+	// first or the lock cannot be taken.
+	Acquire(ctx context.Context, key string) (release func(), err error)
+}
+
+// ErrLoadThrottled is returned by Group.Get when the caller's context
+// deadline passes while the load waits for one of the
+// GroupOptions.MaxConcurrentLoads, MaxInFlightLoads or
+// MaxLoadsPerShard slots.
+var ErrLoadThrottled = errors.New("groupcache: deadline exceeded waiting for a load slot")
+
+// ErrReadOnly is returned, possibly wrapped, by Group.Get for a key
+// that is not cached while the group is read-only, whether the key is
+// owned by this process or by a peer whose group is read-only. See
+// Group.SetReadOnly.
+var ErrReadOnly = errors.New("groupcache: group is read-only")
+
+// ErrValueTooLarge is returned, possibly wrapped, by Group.Get for a
+// key whose value exceeds GroupOptions.MaxValueBytes when
+// GroupOptions.RejectOversizedValues is set, or exceeds the
+// HTTPPoolOptions.MaxServedValueBytes of the peer owning it.
+var ErrValueTooLarge = errors.New("groupcache: value too large")
+
+// ErrOwnerUnavailable is matched, with errors.Is, by the errors of
+// Group.Get for keys it may only get from their owner, under
+// GroupOptions.StrictOwnership or PeerRetryPolicy.NoLocalLoad, when the
+// owner and any backup peers failed. The error is a *PeerError of the
+// last peer asked, unless the Get was forwarded by a peer for a key
+// owned by another.
+var ErrOwnerUnavailable = errors.New("groupcache: key owner unavailable")
+
 var (
 	mu     sync.RWMutex
 	groups = make(map[string]*Group)
@@ -80,6 +165,19 @@ func GetGroup(name string) *Group {
 	return g
 }
 
+// GetGroups returns all the groups previously created with NewGroup,
+// sorted by name.
+func GetGroups() []*Group {
+	mu.RLock()
+	res := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		res = append(res, g)
+	}
+	mu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res
+}
+
 // NewGroup creates a coordinated group-aware Getter from a Getter.
 //
 // The returned Getter tries (but does not guarantee) to run only one
@@ -93,15 +191,709 @@ func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
 	return newGroup(name, cacheBytes, getter, nil)
 }
 
-// DeregisterGroup removes group from group pool
+// GroupOptions are the configurations of a Group.
+type GroupOptions struct {
+	// HotCacheMinPeerFetches specifies how many times a key must be
+	// fetched from a peer within HotCacheWindow before its value is
+	// mirrored in the hot cache. This keeps keys that are only rarely
+	// requested from polluting the hot cache. Promotion involves no
+	// randomness: it depends only on which keys were fetched, and when.
+	// If zero, every value fetched from a peer is mirrored.
+	HotCacheMinPeerFetches int
+
+	// HotCacheWindow specifies the window over which peer fetches are
+	// counted for HotCacheMinPeerFetches.
+	// If zero, it defaults to one minute.
+	HotCacheWindow time.Duration
+
+	// HotCachePromotion optionally specifies which values fetched from
+	// peers are mirrored in the hot cache, taking precedence over
+	// HotCacheMinPeerFetches. NewFrequencyPromotion returns the policy
+	// HotCacheMinPeerFetches uses, for wrapping in a policy of one's
+	// own.
+	// If nil, values are mirrored as set by HotCacheMinPeerFetches.
+	HotCachePromotion PromotionPolicy
+
+	// HotKeyThreshold, if positive, makes the group replicate the keys
+	// it owns that peers fetch from it at least that many times within
+	// HotKeyWindow into the hot cache of every peer, pushing their
+	// values to each, so that a very popular key stops bottlenecking
+	// on its owner. Fetches are counted in a small count-min sketch,
+	// which may overcount keys that collide in it but never
+	// undercounts. A key is pushed at most once per HotKeyWindow.
+	// If zero, values are only mirrored as peers fetch them.
+	HotKeyThreshold int
+
+	// HotKeyWindow specifies the window over which fetches are counted
+	// for HotKeyThreshold.
+	// If zero, it defaults to one minute.
+	HotKeyWindow time.Duration
+
+	// HotKeyMaxBytes bounds the bytes of the values replicated under
+	// HotKeyThreshold within each HotKeyWindow, counting each value
+	// once however many peers it is pushed to.
+	// If zero, it defaults to an eighth of cacheBytes.
+	HotKeyMaxBytes int64
+
+	// HotCacheClock makes the hot cache evict with the CLOCK algorithm,
+	// an approximation of LRU, instead of exact LRU. Hits then only
+	// set a bit on their entry, atomically, so that concurrent Gets
+	// hitting the hot cache share its lock rather than serializing on
+	// it to reorder its entries. This speeds up read-heavy loads on
+	// many cores, at the cost of evicting entries in a less exact
+	// order of recency. The hot cache remains bounded as usual.
+	// HotCacheClock takes precedence over EvictionPolicy for the hot
+	// cache.
+	HotCacheClock bool
+
+	// EvictionPolicy selects the entries the main and hot caches evict
+	// first to stay within the cache size. Whichever policy is used,
+	// the caches are bounded in bytes as usual and report the entries
+	// they evict to OnEvicted and Group.EvictionEvents.
+	// If zero, it defaults to EvictLRU.
+	EvictionPolicy EvictionPolicy
+
+	// MaxCacheEntries bounds the number of entries the main and hot
+	// caches hold together, besides their size in bytes, so that
+	// many tiny values do not exhaust memory in per-entry overhead.
+	// Each tenant partition of TenantBudgets is bounded likewise.
+	// If zero, the caches are only bounded in bytes.
+	MaxCacheEntries int
+
+	// MaxValueBytes specifies the largest value the caches hold.
+	// Larger values are still returned to callers, and loaded again
+	// the next time they are requested; a larger value given to Set
+	// is dropped.
+	// If zero, values of any size are cached.
+	MaxValueBytes int64
+
+	// RejectOversizedValues, if true, makes a load of a value larger
+	// than MaxValueBytes from the getter fail with ErrValueTooLarge
+	// instead of returning the value uncached, so that callers do not
+	// keep loading it. Peers owning such keys answer them with the
+	// error too.
+	RejectOversizedValues bool
+
+	// SpillStore optionally specifies a second tier, typically on
+	// local disk, keeping the values evicted from the main cache to
+	// make room for others. A load consults it before asking a peer
+	// or the getter, moving the value found back into the main cache.
+	// Values stored with tags are not spilled, and Set, Remove and
+	// SetGeneration apply to spilled values too. NewFileSpillStore
+	// returns a SpillStore keeping values in files.
+	SpillStore SpillStore
+
+	// CacheShards splits the main and hot caches each into this many
+	// shards, each locked on its own, so that Gets of different keys
+	// contend less for a lock on many cores. Keys go to a shard by
+	// their hash. To stay within the cache size, the shard holding
+	// the most bytes evicts its oldest entry, which approximates the
+	// global order of EvictionPolicy; each shard holds an equal part
+	// of MaxPinnedBytes. NewCacheBackend is called for each shard.
+	// If zero or one, the caches are not sharded.
+	CacheShards int
+
+	// NewCacheBackend, if non-nil, is called for each cache of the
+	// group, such as the main and hot caches, to create the backend
+	// storing the bytes of its values, for example NewMmapBackend to
+	// keep them off the Go heap. The caches keep their index and keys
+	// on the heap, and count the bytes of their values against the
+	// cache size as usual. Values read from a backend are copied out
+	// of it, so that no ByteView refers to its memory once the entry
+	// is evicted; GetBorrow copies too. Values added with Append stay
+	// on the heap.
+	NewCacheBackend func() CacheBackend
+
+	// MaxKeyLength specifies the length above which keys are replaced
+	// by a fixed-length digest to store them in the cache and pick the
+	// peer owning them. The getter still receives the original key,
+	// which is also what is sent to peers. This bounds the memory used
+	// by very long keys, such as URLs, at the cost of hashing them on
+	// every access. Two distinct keys sharing a digest would share a
+	// cache entry, but with a 128-bit digest that is astronomically
+	// unlikely. Every peer must use the same MaxKeyLength.
+	// If zero, keys are used as is.
+	MaxKeyLength int
+
+	// RoutingKey optionally maps keys to the key by which the peer
+	// owning them is picked, so that related keys, such as those
+	// sharing a prefix, land on the same peer and make better use of
+	// its cache. Keys are still stored, loaded and requested from that
+	// peer under their own name. It is called with the key as stored,
+	// which for keys replaced by a digest under MaxKeyLength is the
+	// digest. Every peer must use the same function, or peers
+	// disagree on which of them owns a key.
+	// If nil, keys are routed by themselves.
+	RoutingKey func(key string) string
+
+	// LoadFlightGroup optionally specifies the implementation used to
+	// deduplicate concurrent loads of the same key, e.g. one that keeps
+	// results for a while after the call completes.
+	// If nil, a singleflight.Group is used.
+	LoadFlightGroup FlightGroup
+
+	// NoSingleflight optionally reports whether concurrent loads of
+	// key must not be coalesced, so that every caller missing the
+	// cache invokes the getter itself. This is for getters with
+	// per-caller side effects, such as passing the caller's
+	// credentials on to the origin, where a shared load would hand
+	// one caller's result to another. Each such caller still stores
+	// its result in the cache, replacing the one stored before it.
+	// If nil, concurrent loads of the same key are always coalesced.
+	NoSingleflight func(key string) bool
+
+	// EvictionEventBuffer, if positive, enables the channel returned by
+	// Group.EvictionEvents, buffering that many events.
+	EvictionEventBuffer int
+
+	// EvictionOverflow specifies what happens to an eviction event
+	// when the channel's buffer is full.
+	EvictionOverflow OverflowPolicy
+
+	// OnEvicted optionally specifies a function called with the
+	// storage key and value of each entry leaving the group's caches,
+	// for the same reasons as the events of Group.EvictionEvents.
+	// Values added with Group.Append are not reported. Unlike the
+	// events, it is called once the cache lock is released, so a slow
+	// OnEvicted does not stall other gets, and it may call into the
+	// group. It runs on the goroutine that evicted the entry, unless
+	// EvictionWorkers is set.
+	OnEvicted func(key string, value ByteView)
+
+	// EvictionWorkers, if positive, makes that many goroutines call
+	// OnEvicted, so that the operation evicting entries returns
+	// without waiting for the calls. The entries wait in a queue of
+	// EvictionQueueSize batches, one batch per cache operation, and an
+	// evicting goroutine only waits while the queue is full; queued
+	// values count towards memory use but not the cache size. Calls are
+	// best-effort ordered: they run concurrently and in no particular
+	// order, even for entries of the same key. Group.Close waits for
+	// the pending calls.
+	EvictionWorkers int
+
+	// EvictionQueueSize bounds the batches of evicted entries waiting
+	// for EvictionWorkers.
+	// If zero, it defaults to 64 per worker.
+	EvictionQueueSize int
+
+	// AntiEntropyInterval, if positive, makes the group check this
+	// often that the copies of other peers' keys in its hot cache still
+	// match the value cached by their owner, invalidating those that
+	// do not: a copy drifts if it missed an update, say because the
+	// Remove or Set of the key failed to reach this peer. Each check
+	// samples AntiEntropySample keys and asks the owner of each for
+	// the checksum of its value, dropping the copy if it does not match
+	// or if the owner no longer holds the key, so that the next Get
+	// fetches it afresh. Group.Close stops the checks.
+	AntiEntropyInterval time.Duration
+
+	// AntiEntropySample is how many hot cache keys each
+	// AntiEntropyInterval check samples.
+	// If zero, it defaults to 8.
+	AntiEntropySample int
+
+	// LargeObjectChunkSize, if positive, enables Group.GetLargeObject,
+	// which stores values larger than this many bytes in chunks of
+	// this size, each a cache entry of its own. Keys ending in
+	// "#manifest" or in "#" and a decimal number are then reserved
+	// for the entries of large objects.
+	LargeObjectChunkSize int
+
+	// LargeObjectParallelism is how many chunks of a large object
+	// GetLargeObject fetches at a time.
+	// If zero, it defaults to 4.
+	LargeObjectParallelism int
+
+	// RecordLoadLatency enables recording how long the getter takes to
+	// load each key, as reported by Group.LoadLatency.
+	RecordLoadLatency bool
+
+	// RecordLatency enables recording histograms of how long the
+	// group's Gets, fetches from peers, overall and per peer, and
+	// loads from the getter take, as reported by Group.Latency and
+	// Group.PeerLatencies. It implies RecordLoadLatency.
+	RecordLatency bool
+
+	// MaxPinnedBytes specifies how many bytes of the main cache may be
+	// held by keys pinned with Group.Pin. Pinned bytes count towards
+	// the group's cache size like any others.
+	// If zero, it defaults to a quarter of the cache size.
+	MaxPinnedBytes int64
+
+	// CompressInMemory stores cached values compressed, decompressing
+	// them on every cache hit. The cache size then bounds the
+	// compressed size of the values, trading CPU for holding more of
+	// them. Values that do not shrink are stored as is.
+	CompressInMemory bool
+
+	// CompressMinBytes specifies the size below which values are not
+	// compressed by CompressInMemory.
+	// If zero, it defaults to 256 bytes.
+	CompressMinBytes int
+
+	// MaxConcurrentLoads, if positive, bounds how many keys the group
+	// may load from its getter at once, protecting an origin that
+	// tolerates only so many concurrent queries. Further loads wait
+	// for a slot, at most until their context is done.
+	MaxConcurrentLoads int
+
+	// MaxInFlightLoads, if positive, bounds how many distinct keys
+	// the group may be loading at once, whether from a peer or from
+	// its getter, as reported by Stats.InFlightLoads. Each such load
+	// is led by the goroutine of the Get that started it, which others
+	// asking for the key wait on; a load of a further key waits for a
+	// slot, at most until the context of its Get is done. This bounds
+	// the goroutines tied up in loads when an incident makes them all
+	// slow. Loads of keys requested by peers are exempt: counting them
+	// could leave two peers each waiting on loads that need a slot of
+	// the other.
+	MaxInFlightLoads int
+
+	// LoadShardKey, with MaxLoadsPerShard, maps each key to the shard
+	// of a sharded origin holding it, such as a database partition.
+	// The number of distinct shards should be small: the group keeps
+	// the slots of each shard it has seen.
+	LoadShardKey func(key string) string
+
+	// MaxLoadsPerShard, if positive and LoadShardKey is set, bounds how
+	// many keys of each shard the group may load from its getter at
+	// once, independently of the other shards. Further loads of a
+	// shard wait for a slot, at most until their context is done,
+	// before any MaxConcurrentLoads slot. Group.ShardInFlightLoads
+	// reports the loads in progress per shard.
+	MaxLoadsPerShard int
+
+	// DefaultTTL, if positive, makes the values the group loads from
+	// its getter without an expire time expire DefaultTTL after they
+	// were loaded. Expired values are misses in the main and hot
+	// caches alike, and peers receive the expire time along with the
+	// value, so that their hot cache copies expire at the same time.
+	DefaultTTL time.Duration
+
+	// NegativeTTL, if positive, makes the group remember for NegativeTTL
+	// that a key was not found, by the getter or by the peer owning
+	// it, and answer Gets of the key with the same error meanwhile
+	// rather than loading it again. Set and Remove forget the error,
+	// and so does a Get made with a context returned by
+	// WithForceRefresh, which loads the key anyway.
+	NegativeTTL time.Duration
+
+	// ErrorTTL is like NegativeTTL for the other errors keys fail to
+	// load with, except those of canceled loads, ErrLoadThrottled and
+	// ErrReadOnly, which are never remembered.
+	ErrorTTL time.Duration
+
+	// NegativeCacheEntries bounds how many keys NegativeTTL and
+	// ErrorTTL remember errors for, evicting the least recently used.
+	// If zero, it defaults to 10000.
+	NegativeCacheEntries int
+
+	// RefreshAhead, if positive, makes a hit in the main cache on a
+	// value with less than RefreshAhead of its lifetime left, from
+	// when it was cached to when it expires, return the value as usual
+	// and reload the key in the background, as a Get made with a
+	// context returned by WithForceRefresh would, so that hot keys do
+	// not miss once they expire. Concurrent hits start a single
+	// reload. For instance, 0.2 reloads values in the last fifth of
+	// their lifetime. Values without an expire time are never
+	// reloaded.
+	RefreshAhead float64
+
+	// HedgeDelay, if positive, makes a fetch of a key from the peer
+	// owning it also ask a backup peer for the key if the owner did not
+	// answer within HedgeDelay, using whichever answer comes first.
+	// This cuts the latency of Gets when the owner stalls, such as in
+	// a GC pause. Backup peers are picked by the PeerPicker if it is a
+	// BackupPeerPicker, such as an HTTPPool with
+	// HTTPPoolOptions.BackupPeers set. A backup peer serves the key
+	// from its caches, or else loads it from its getter, as when the
+	// owner fails.
+	HedgeDelay time.Duration
+
+	// PeerRetry, if non-nil, sets what a load does once fetching a key
+	// from the peer owning it failed, such as while peers restart one
+	// after another: how many backup peers to ask, how long to wait
+	// before each, and whether to load the key locally if they fail
+	// too. If nil, a load asks a single backup peer, if the PeerPicker
+	// nominates one, and then loads the key locally.
+	PeerRetry *PeerRetryPolicy
+
+	// StrictOwnership, if true, makes the group never load keys owned
+	// by a peer from its getter, so that each key is only loaded by its
+	// owner, deduplicated there however many peers miss it at once.
+	// Once the owner, and the backup peers PeerRetry asks, fail, Gets
+	// fail with an error matching ErrOwnerUnavailable, as under
+	// PeerRetryPolicy.NoLocalLoad. Gets forwarded by peers for keys
+	// this process believes another peer owns, such as while their
+	// peer lists disagree, fail the same way instead of being loaded
+	// here, and so do those of keys whose owners under Replication all
+	// failed. Cached values are still served, and stale ones under
+	// ServeStaleOnError.
+	StrictOwnership bool
+
+	// Tracer, if non-nil, records spans of the group's Gets. See
+	// Tracer for the spans recorded.
+	Tracer Tracer
+
+	// BatchGetter, if non-nil, loads the keys the group would load
+	// from its getter instead, in batches: the keys loaded at once
+	// within MaxBatchDelay of the first are loaded by one call. Its
+	// context carries the values of the first load's context, and is
+	// cancelled only once every load waiting for the batch gave up,
+	// so that one caller's deadline does not fail the others' keys.
+	// Concurrent Gets of a key share its load as usual, so that a key
+	// pending in a batch or being loaded by one is not added to
+	// another. A load waits for its batch at most until its context is
+	// done, while holding any MaxConcurrentLoads slot it took. If the
+	// call panics, the loads waiting for it fail with a
+	// *singleflight.PanicError.
+	BatchGetter BatchGetter
+
+	// MaxBatchSize bounds the keys of a BatchGetter call. A batch is
+	// loaded as soon as it is full.
+	// If zero, it defaults to 100.
+	MaxBatchSize int
+
+	// MaxBatchDelay bounds how long a BatchGetter batch accumulates
+	// keys once started.
+	// If zero, it defaults to 2ms.
+	MaxBatchDelay time.Duration
+
+	// ReadReplicas, if greater than one, spreads reads of a key owned
+	// by another peer over the first ReadReplicas peers for the key,
+	// the owner among them, when the group's PeerPicker is a
+	// ReplicaPeerPicker. A replica other than the owner fetches the key
+	// from the owner, which alone loads it from the getter, and keeps
+	// it in its hot cache to serve later reads. Reads served by a
+	// replica can therefore be stale for as long as the value stays in
+	// its hot cache after the owner's value changed, unless the change
+	// was made with Group.Remove, which clears every peer's caches.
+	ReadReplicas int
+
+	// Replication, if greater than one, makes each key owned by the
+	// first Replication peers for it, when the group's PeerPicker is
+	// an OwnersPeerPicker, so that a peer restarting with empty caches
+	// does not send the whole of its keyspace to the getter. A Get
+	// missing the key tries the owners in order, moving on to the next
+	// one when fetching from one fails. An owner missing the key asks
+	// the other owners for their cached copy first, keeping the copy
+	// it gets in its main cache, and only loads the key from the
+	// getter when none holds it, storing the loaded value on the other
+	// owners with Set. ReadReplicas is ignored for replicated keys.
+	Replication int
+
+	// ExistenceFilter optionally specifies a filter consulted before
+	// loading a key from the getter. Keys it reports as definitely
+	// absent are not loaded; Get returns ErrNotFound for them instead.
+	// The filter is supplied and kept up to date by the user.
+	ExistenceFilter ExistenceFilter
+
+	// DistributedLocker optionally specifies locks held around each
+	// call of the getter, named by the group's name and the key joined
+	// by a slash, so that processes of the cluster load a key from
+	// the origin one at a time. Only its owner loads a key, but while
+	// peers join or leave they may disagree on who that is; the lock
+	// then protects the origin. It serializes loads rather than
+	// sharing them: a process that waited still calls its getter.
+	// If acquiring the lock fails, so does the load.
+	DistributedLocker DistributedLocker
+
+	// ServeStaleOnError keeps values in the cache for up to MaxStale
+	// after they expire, and makes Get return such a stale value when
+	// loading the key afresh fails, instead of the error. The failed
+	// load is still logged and counted. GetWithInfo reports whether
+	// the value was stale. Stale values are only served to local
+	// callers, not to peers, nor when the key's owner or getter
+	// reported ErrNotFound.
+	ServeStaleOnError bool
+
+	// SharedLoadGroup optionally specifies a singleflight.Group shared
+	// with other groups that load keys from the same origin, so that
+	// concurrent getter calls for a key by any of the groups with the
+	// same SharedLoadNamespace are coalesced into a single call of one
+	// group's getter. Each group still caches the value itself.
+	//
+	// The groups must therefore load the same value for a given key,
+	// in the same encoding: whichever group calls its getter first
+	// serves the others, and only its MaxConcurrentLoads limit
+	// applies. Keys are shared as passed to Get, before any
+	// MaxKeyLength digest.
+	SharedLoadGroup *singleflight.Group
+
+	// SharedLoadNamespace names the set of groups whose loads are
+	// coalesced through SharedLoadGroup. Groups with different
+	// namespaces never share a load, even for identical keys.
+	// If empty, it defaults to the group's name, sharing nothing.
+	SharedLoadNamespace string
+
+	// MaxStale bounds how long after it expired a value may be served
+	// by ServeStaleOnError or PreferWarmLocal.
+	// If zero, it defaults to 5 minutes.
+	MaxStale time.Duration
+
+	// PreferWarmLocal keeps values mirrored in the hot cache for up to
+	// MaxStale after they expire, and makes Get return such an expired
+	// copy of a key owned by another peer right away, instead of
+	// asking the owner for a fresh value. A warm key thus stays
+	// available while its owner restarts or is unreachable. The price
+	// is that the copy is served as is until MaxStale runs out, even
+	// once the owner is back, and may be up to MaxStale older than the
+	// owner's value; GetWithInfo reports such values as PossiblyStale.
+	// Unexpired hot cache copies are always served without asking the
+	// owner. Keys this process owns are unaffected.
+	PreferWarmLocal bool
+
+	// ThrashThreshold, if positive, makes the group detect the main
+	// cache thrashing on a flood of distinct keys slightly more than
+	// it holds, where each value loaded evicts another one loaded
+	// just before, and stop caching the values it loads for
+	// ThrashCooldown. This preserves the entries already cached, and
+	// their hits, while the flood is served from the getter. The
+	// cache counts as thrashing when, over the last ThrashWindow
+	// values loaded into it, it evicted at least ThrashThreshold
+	// entries per value while serving fewer hits than it took values.
+	// Episodes are logged and counted in Stats.ThrashEpisodes.
+	ThrashThreshold float64
+
+	// ThrashWindow specifies over how many loaded values thrashing is
+	// measured.
+	// If zero, it defaults to 1000.
+	ThrashWindow int
+
+	// ThrashCooldown specifies how long the main cache stops caching
+	// loaded values once it is found thrashing.
+	// If zero, it defaults to 10 seconds.
+	ThrashCooldown time.Duration
+
+	// HotCacheFraction specifies the fraction of the cache size the
+	// hot cache may hold once the caches are full, before it is
+	// evicted from ahead of the main cache. AdaptiveCacheSplit, when
+	// set, adjusts this fraction as the workload changes instead.
+	// If zero, the hot cache is kept to an eighth of the main cache.
+	HotCacheFraction float64
+
+	// AdaptiveCacheSplit lets the group shift its cache bytes between
+	// the main and hot caches as the workload changes, instead of
+	// keeping the hot cache to an eighth of the main cache. Every
+	// AdaptiveSplitInterval gets, the hot cache's share moves by
+	// AdaptiveSplitStep towards whichever cache served more hits per
+	// byte it holds, staying between AdaptiveSplitMinHot and
+	// AdaptiveSplitMaxHot. Group.HotCacheLimit reports the result.
+	AdaptiveCacheSplit bool
+
+	// AdaptiveSplitInterval specifies how many gets pass between
+	// adjustments of the split.
+	// If zero, it defaults to 1000.
+	AdaptiveSplitInterval int
+
+	// AdaptiveSplitStep specifies the fraction of the cache size by
+	// which each adjustment moves the split.
+	// If zero, it defaults to 1/32.
+	AdaptiveSplitStep float64
+
+	// AdaptiveSplitMinHot and AdaptiveSplitMaxHot bound the fraction
+	// of the cache size the hot cache may be given.
+	// If zero, they default to 1/64 and 1/2.
+	AdaptiveSplitMinHot float64
+	AdaptiveSplitMaxHot float64
+
+	// KeyTenant optionally returns the tenant key belongs to, such as
+	// a prefix of it, for TenantBudgets. It is called with the key as
+	// stored, which for keys replaced by a digest under MaxKeyLength
+	// is the digest.
+	KeyTenant func(key string) string
+
+	// TenantBudgets gives the tenants returned by KeyTenant that it
+	// lists a partition of their own: main and hot caches which hold
+	// at most the tenant's number of bytes, evicting only the
+	// tenant's own entries to stay within them. The keys of other
+	// tenants, or of no tenant, share the bytes of the cache size
+	// left over. The cache size divides the same way on every peer,
+	// so a tenant's budget applies to the keys of the tenant each peer
+	// holds. Group.TenantCacheStats reports on a tenant's caches,
+	// while Group.CacheStats adds up those of the whole group.
+	// AdaptiveCacheSplit only adjusts the shared caches.
+	TenantBudgets map[string]int64
+
+	// Clock optionally specifies the function telling the group the
+	// current time, which decides when values expire, for tests.
+	// If nil, time.Now is used.
+	Clock func() time.Time
+
+	// GlobalWeight specifies the weight of the group's share of the
+	// limit set by SetGlobalCacheLimit, relative to those of the other
+	// groups. Groups given the same weight are entitled to the same
+	// share of the limit, whatever their own cache sizes.
+	// If zero, it defaults to the group's cache size in bytes.
+	GlobalWeight float64
+
+	// RestoreSnapshot optionally specifies a snapshot of the group,
+	// as written by Group.SaveSnapshot, typically to a file before the
+	// previous run of the process exited. The main cache is filled
+	// with its entries before the group is returned, leaving out those
+	// that have expired since. A snapshot that cannot be read is
+	// logged, keeping the entries read before the error.
+	RestoreSnapshot io.Reader
+
+	// Logger optionally specifies the logger reporting the group's
+	// errors, such as failed peer fetches, loads that panicked in
+	// another Get, or OnEvicted calls falling behind evictions.
+	// If nil, the logger set by SetLogger is used.
+	Logger *logrus.Entry
+}
+
+// An OverflowPolicy specifies what happens to an eviction event that
+// does not fit in the channel's buffer.
+type OverflowPolicy int
+
+const (
+	// DropOnOverflow discards the event, counting it in
+	// Stats.EvictionEventsDropped. Evictions never wait for the
+	// consumer.
+	DropOnOverflow OverflowPolicy = iota
+
+	// BlockOnOverflow makes the eviction wait until the consumer has
+	// made room for the event. Accesses to the cache the entry was
+	// evicted from wait as well, so the consumer must not call into
+	// the Group while events are pending.
+	BlockOnOverflow
+)
+
+// An EvictionPolicy selects the entries a cache evicts first when full.
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently used entries.
+	EvictLRU EvictionPolicy = iota
+
+	// EvictLFU evicts the least frequently used entries, and the least
+	// recently used of those hit as often. It suits workloads whose
+	// popular keys stay popular whenever they were last accessed, and
+	// resists scans over many keys. Use counts never decay, though, so
+	// keys that cool down keep their place until newer ones are hit
+	// as often.
+	EvictLFU
+
+	// EvictFIFO evicts the entries cached first, whether they are hit
+	// or not. Hits then cost no reordering.
+	EvictFIFO
+
+	// EvictSLRU is segmented LRU: entries hit again after being cached
+	// move to a protected segment holding up to 80% of the entries,
+	// and the least recently used entries of the other segment are
+	// evicted first. A scan over many keys hit once thus only evicts
+	// others hit once.
+	EvictSLRU
+
+	// EvictARC is the adaptive replacement policy. Like EvictSLRU, it
+	// keeps the entries hit again apart from those hit once, but it
+	// adapts the share of each to the workload, growing the share of
+	// the kind of entries whose keys are missed soon after their
+	// eviction. It remembers as many evicted keys as the caches hold
+	// entries.
+	EvictARC
+)
+
+func (p EvictionPolicy) lruPolicy() lru.Policy {
+	switch p {
+	case EvictLFU:
+		return lru.LFU
+	case EvictFIFO:
+		return lru.FIFO
+	case EvictARC:
+		return lru.ARC
+	default:
+		return lru.LRU
+	}
+}
+
+// An EvictionEvent reports an entry leaving one of a Group's caches,
+// whether to make room, because it expired, or because it was removed.
+// Replacing the value of a key is not reported.
+type EvictionEvent struct {
+	Key   string
+	Bytes int64 // size of the key and value
+	Cache CacheType
+}
+
+const defaultHotCacheWindow = time.Minute
+
+// NewGroupOpts is like NewGroup, but configures the group with the
+// given options.
+func NewGroupOpts(name string, cacheBytes int64, getter Getter, o *GroupOptions) *Group {
+	return newGroupOpts(name, cacheBytes, getter, nil, o)
+}
+
+// DeregisterGroup removes the group named name from the registered
+// groups, so that GetGroup no longer returns it and a group of that
+// name can be created again, and releases it: its caches are emptied
+// and its background work is stopped, as by Close. Callers holding the
+// group should stop using it.
 func DeregisterGroup(name string) {
 	mu.Lock()
+	g := groups[name]
 	delete(groups, name)
 	mu.Unlock()
+	if g != nil {
+		g.release()
+	}
+}
+
+// release empties the caches of a deregistered group and stops its
+// background work. Its entries are reported to OnEvicted as removed,
+// and none are spilled.
+func (g *Group) release() {
+	g.Close()
+	mains, hots := g.allCaches()
+	for i := range mains {
+		mains[i].clear()
+		hots[i].clear()
+	}
+}
+
+// cacheLimit returns the number of bytes the group's caches may hold
+// together, as set by SetCacheBytes.
+func (g *Group) cacheLimit() int64 {
+	return atomic.LoadInt64(&g.cacheBytes)
+}
+
+// SetCacheBytes changes the number of bytes the group's caches may
+// hold together, its cacheBytes, evicting entries right away if they
+// hold more. The TenantBudgets in the group's options come out of the
+// new size as they did out of the old one. The settings derived from
+// the size when the group was created, such as the default
+// MaxPinnedBytes and the range of AdaptiveCacheSplit, are unchanged.
+// If bytes is zero or less, the group stops caching values and evicts
+// those it holds, except pinned ones.
+func (g *Group) SetCacheBytes(bytes int64) {
+	atomic.StoreInt64(&g.cacheBytes, bytes)
+	g.evictOverflow(&g.mainCache, &g.hotCache, g.sharedBytes())
+	for _, t := range g.tenants {
+		budget := t.budget
+		if bytes <= 0 {
+			budget = 0
+		}
+		g.evictOverflow(&t.main, &t.hot, budget)
+	}
 }
 
 // If peers is nil, the peerPicker is called via a sync.Once to initialize it.
 func newGroup(name string, cacheBytes int64, getter Getter, peers PeerPicker) *Group {
+	return newGroupOpts(name, cacheBytes, getter, peers, nil)
+}
+
+func newGroupOpts(name string, cacheBytes int64, getter Getter, peers PeerPicker, o *GroupOptions) *Group {
+	g := registerGroup(name, cacheBytes, getter, peers, o)
+	// The snapshot is restored once mu is released, as filling the
+	// cache may evict from every group under SetGlobalCacheLimit.
+	if r := g.opts.RestoreSnapshot; r != nil {
+		g.restoreSnapshot(r)
+	}
+	return g
+}
+
+// registerGroup creates the group and adds it to the groups.
+func registerGroup(name string, cacheBytes int64, getter Getter, peers PeerPicker, o *GroupOptions) *Group {
 	if getter == nil {
 		panic("nil Getter")
 	}
@@ -112,13 +904,129 @@ func newGroup(name string, cacheBytes int64, getter Getter, peers PeerPicker) *G
 		panic("duplicate registration of group " + name)
 	}
 	g := &Group{
-		name:        name,
-		getter:      getter,
-		peers:       peers,
-		cacheBytes:  cacheBytes,
-		loadGroup:   &singleflight.Group{},
-		setGroup:    &singleflight.Group{},
-		removeGroup: &singleflight.Group{},
+		name:         name,
+		getter:       getter,
+		peers:        peers,
+		cacheBytes:   cacheBytes,
+		loadGroup:    &singleflight.Group{},
+		loopGroup:    &singleflight.Group{},
+		refreshGroup: &singleflight.Group{},
+		setGroup:     &singleflight.Group{},
+		removeGroup:  &singleflight.Group{},
+	}
+	g.releaseBorrow = func() { g.Stats.BorrowedViews.Add(-1) }
+	if o != nil {
+		g.opts = *o
+	}
+	if g.opts.LoadFlightGroup != nil {
+		g.loadGroup = g.opts.LoadFlightGroup
+	}
+	if g.opts.HotCacheWindow == 0 {
+		g.opts.HotCacheWindow = defaultHotCacheWindow
+	}
+	if g.opts.Clock != nil {
+		g.now = g.opts.Clock
+	}
+	if g.opts.HotCacheMinPeerFetches > 1 {
+		g.hotFetches = newFreqSketch(g.opts.HotCacheWindow)
+		g.hotFetches.now = g.opts.Clock
+	}
+	if g.opts.CompressMinBytes == 0 {
+		g.opts.CompressMinBytes = defaultCompressMinBytes
+	}
+	if g.opts.MaxPinnedBytes == 0 {
+		g.opts.MaxPinnedBytes = cacheBytes / 4
+	}
+	if g.opts.HotKeyMaxBytes == 0 {
+		g.opts.HotKeyMaxBytes = cacheBytes / 8
+	}
+	if g.opts.SharedLoadNamespace == "" {
+		g.opts.SharedLoadNamespace = g.name
+	}
+	if g.opts.ServeStaleOnError || g.opts.PreferWarmLocal {
+		if g.opts.MaxStale == 0 {
+			g.opts.MaxStale = defaultMaxStale
+		}
+	}
+	if g.opts.RecordLoadLatency || g.opts.RecordLatency {
+		g.loadLatency = new(latencyHistogram)
+	}
+	if g.opts.RecordLatency {
+		g.getLatency = new(latencyHistogram)
+		g.peerLatency = new(latencyHistogram)
+	}
+	if g.opts.AdaptiveCacheSplit {
+		if g.opts.AdaptiveSplitInterval == 0 {
+			g.opts.AdaptiveSplitInterval = defaultAdaptiveSplitInterval
+		}
+		if g.opts.AdaptiveSplitStep == 0 {
+			g.opts.AdaptiveSplitStep = defaultAdaptiveSplitStep
+		}
+		if g.opts.AdaptiveSplitMinHot == 0 {
+			g.opts.AdaptiveSplitMinHot = defaultAdaptiveSplitMinHot
+		}
+		if g.opts.AdaptiveSplitMaxHot == 0 {
+			g.opts.AdaptiveSplitMaxHot = defaultAdaptiveSplitMaxHot
+		}
+	}
+	if g.opts.ThrashThreshold > 0 {
+		if g.opts.ThrashWindow == 0 {
+			g.opts.ThrashWindow = defaultThrashWindow
+		}
+		if g.opts.ThrashCooldown == 0 {
+			g.opts.ThrashCooldown = defaultThrashCooldown
+		}
+		g.thrash = &thrashGuard{window: int64(g.opts.ThrashWindow)}
+	}
+	g.peerRetry = newPeerRetry(g.opts.PeerRetry)
+	if g.opts.MaxConcurrentLoads > 0 {
+		g.loadSlots = make(chan struct{}, g.opts.MaxConcurrentLoads)
+	}
+	if g.opts.LoadShardKey != nil && g.opts.MaxLoadsPerShard > 0 {
+		g.shardLimiter = &shardLimiter{max: g.opts.MaxLoadsPerShard}
+	}
+	if g.opts.BatchGetter != nil {
+		if g.opts.MaxBatchSize == 0 {
+			g.opts.MaxBatchSize = defaultMaxBatchSize
+		}
+		if g.opts.MaxBatchDelay == 0 {
+			g.opts.MaxBatchDelay = defaultMaxBatchDelay
+		}
+		g.batcher = &batcher{get: g.opts.BatchGetter, maxSize: g.opts.MaxBatchSize, maxDelay: g.opts.MaxBatchDelay, stats: &g.Stats}
+	}
+	if g.opts.NegativeTTL > 0 || g.opts.ErrorTTL > 0 {
+		if g.opts.NegativeCacheEntries == 0 {
+			g.opts.NegativeCacheEntries = defaultNegativeCacheEntries
+		}
+		g.negative = newNegativeCache(&g.opts)
+	}
+	if g.opts.MaxInFlightLoads > 0 {
+		g.flightSlots = make(chan struct{}, g.opts.MaxInFlightLoads)
+	}
+	if g.opts.EvictionEventBuffer > 0 {
+		g.evictions = make(chan EvictionEvent, g.opts.EvictionEventBuffer)
+	}
+	if g.opts.LargeObjectParallelism == 0 {
+		g.opts.LargeObjectParallelism = defaultLargeObjectParallelism
+	}
+	if g.opts.OnEvicted != nil && g.opts.EvictionWorkers > 0 {
+		if g.opts.EvictionQueueSize == 0 {
+			g.opts.EvictionQueueSize = defaultEvictionQueuePerWorker * g.opts.EvictionWorkers
+		}
+		g.startEvictionWorkers()
+	}
+	g.initCaches(&g.mainCache, &g.hotCache)
+	g.initTenants()
+	g.initHotKeys()
+	if g.opts.AdaptiveCacheSplit {
+		g.split = newCacheSplit(g.sharedBytes(), &g.opts)
+	}
+	// The caches are set up before the anti-entropy goroutine reads them.
+	if g.opts.AntiEntropyInterval > 0 {
+		if g.opts.AntiEntropySample == 0 {
+			g.opts.AntiEntropySample = defaultAntiEntropySample
+		}
+		g.startAntiEntropy()
 	}
 	if fn := newGroupHook; fn != nil {
 		fn(g)
@@ -127,6 +1035,48 @@ func newGroup(name string, cacheBytes int64, getter Getter, peers PeerPicker) *G
 	return g
 }
 
+// initCaches configures a main cache and the hot cache sharing its
+// budget as the group's options require.
+func (g *Group) initCaches(main, hot *cache) {
+	main.gen, hot.gen = &g.generation, &g.generation
+	main.now, hot.now = g.now, g.now
+	main.maxPinned = g.opts.MaxPinnedBytes
+	if g.opts.ServeStaleOnError {
+		main.maxStale = g.opts.MaxStale
+	}
+	if g.opts.ServeStaleOnError || g.opts.PreferWarmLocal {
+		hot.maxStale = g.opts.MaxStale
+	}
+	policy := g.opts.EvictionPolicy.lruPolicy()
+	main.policy, hot.policy = policy, policy
+	segmented := g.opts.EvictionPolicy == EvictSLRU
+	main.segmented, hot.segmented = segmented, segmented
+	if g.opts.NewCacheBackend != nil && g.opts.CacheShards <= 1 {
+		main.backend, hot.backend = g.opts.NewCacheBackend(), g.opts.NewCacheBackend()
+	}
+	if g.opts.HotCacheClock {
+		hot.shared = new(sharedReads)
+	}
+	if g.opts.OnEvicted != nil {
+		main.onEvicted, hot.onEvicted = g.dispatchEvicted, g.dispatchEvicted
+	}
+	if g.opts.SpillStore != nil {
+		main.onEvicted = g.spillEvicted
+	}
+	if g.evictions != nil {
+		main.onEvict = func(key string, bytes int64) {
+			g.sendEviction(EvictionEvent{Key: key, Bytes: bytes, Cache: MainCache})
+		}
+		hot.onEvict = func(key string, bytes int64) {
+			g.sendEviction(EvictionEvent{Key: key, Bytes: bytes, Cache: HotCache})
+		}
+	}
+	if n := g.opts.CacheShards; n > 1 {
+		main.split(n, g.opts.NewCacheBackend)
+		hot.split(n, g.opts.NewCacheBackend)
+	}
+}
+
 // newGroupHook, if non-nil, is called right after a new group is created.
 var newGroupHook func(*Group)
 
@@ -157,11 +1107,47 @@ func callInitPeerServer() {
 // A Group is a cache namespace and associated data loaded spread over
 // a group of 1 or more machines.
 type Group struct {
-	name       string
-	getter     Getter
-	peersOnce  sync.Once
-	peers      PeerPicker
-	cacheBytes int64 // limit for sum of mainCache and hotCache size
+	// Stats are statistics on the group. They come first so that
+	// they are 8-byte aligned, as 64-bit atomic operations require,
+	// on 32-bit platforms too.
+	Stats Stats
+
+	// generation is set by SetGeneration. It follows Stats to be
+	// 8-byte aligned too.
+	generation uint64
+
+	// cacheBytes is the limit for the sum of the sizes of the caches,
+	// set by SetCacheBytes. It follows generation to be 8-byte aligned
+	// too.
+	cacheBytes int64
+
+	name      string
+	getter    Getter
+	fallback  atomic.Value // of fallbackRef, set by SetFallback
+	peersOnce sync.Once
+	peers     PeerPicker
+	opts      GroupOptions
+
+	// hotFetches counts peer fetches of each key when values must be
+	// fetched several times before being mirrored in hotCache. It is
+	// nil if every value fetched from a peer is mirrored.
+	hotFetches *freqSketch
+
+	// hotKeys tracks the owned keys peers fetch most often under
+	// GroupOptions.HotKeyThreshold; nil if keys are not replicated.
+	hotKeys *hotKeys
+
+	// split sets the hot cache's share of cacheBytes if
+	// GroupOptions.AdaptiveCacheSplit is set, and is nil otherwise.
+	split *cacheSplit
+
+	// thrash detects the main cache thrashing if
+	// GroupOptions.ThrashThreshold is set, and is nil otherwise.
+	thrash *thrashGuard
+
+	// peerRetry is the policy of loads whose peer fetch failed, from
+	// GroupOptions.PeerRetry.
+	peerRetry PeerRetryPolicy
 
 	// mainCache is a cache of the keys for which this process
 	// (amongst its peers) is authoritative. That is, this cache
@@ -179,30 +1165,121 @@ type Group struct {
 	// of key/value pairs that can be stored globally.
 	hotCache cache
 
+	// tenants holds the caches of the tenants with a budget in
+	// GroupOptions.TenantBudgets, which mainCache and hotCache never
+	// hold keys of. It is nil if there are none.
+	tenants map[string]*tenantCache
+
+	// tenantBytes is the part of cacheBytes given to tenants, the
+	// rest being left to mainCache and hotCache.
+	tenantBytes int64
+
 	// loadGroup ensures that each key is only fetched once
 	// (either locally or remotely), regardless of the number of
 	// concurrent callers.
-	loadGroup flightGroup
+	loadGroup FlightGroup
+
+	// releaseBorrow is the release func returned by GetBorrow, made
+	// once so that handing it out allocates nothing.
+	releaseBorrow func()
+
+	// loopGroup deduplicates local loads forced by peer requests that
+	// would otherwise have been forwarded again. See load.
+	loopGroup FlightGroup
+
+	// refreshGroup deduplicates loads forced by WithForceRefresh, so
+	// that they never join, and return the result of, a regular load
+	// that may have been satisfied by the stale cached value.
+	refreshGroup FlightGroup
+
+	// evictions receives eviction events if
+	// GroupOptions.EvictionEventBuffer is positive.
+	evictions chan EvictionEvent
+
+	// evictPool runs GroupOptions.OnEvicted if EvictionWorkers is set.
+	evictPool *evictionPool
+
+	// antiEntropy runs the checks of GroupOptions.AntiEntropyInterval.
+	antiEntropy *antiEntropy
+
+	// loadLatency records getter durations if
+	// GroupOptions.RecordLoadLatency is set.
+	loadLatency *latencyHistogram
+	now         func() time.Time // for testing; time.Now if nil
+
+	// getLatency and peerLatency record the durations of Gets and
+	// peer fetches, and peerLatencies those of the fetches from each
+	// peer, by URL to *latencyHistogram, if GroupOptions.RecordLatency
+	// is set. Otherwise they are nil and empty.
+	getLatency    *latencyHistogram
+	peerLatency   *latencyHistogram
+	peerLatencies sync.Map
+
+	// loadSlots holds a token for each getter call in progress if
+	// GroupOptions.MaxConcurrentLoads is positive.
+	loadSlots chan struct{}
+
+	// flightSlots holds a token for each load led by a local caller
+	// if GroupOptions.MaxInFlightLoads is positive.
+	flightSlots chan struct{}
+
+	// shardLimiter holds the slots of each origin shard if
+	// GroupOptions.MaxLoadsPerShard is set.
+	shardLimiter *shardLimiter
 
 	// setGroup ensures that each added key is only added
 	// remotely once regardless of the number of concurrent callers.
-	setGroup flightGroup
+	setGroup FlightGroup
 
 	// removeGroup ensures that each removed key is only removed
 	// remotely once regardless of the number of concurrent callers.
-	removeGroup flightGroup
+	removeGroup FlightGroup
 
-	_ int32 // force Stats to be 8-byte aligned on 32-bit platforms
+	// debugImmutable is non-zero if cached values are checksummed on
+	// store and verified on read. Accessed atomically.
+	debugImmutable int32
 
-	// Stats are statistics on the group.
-	Stats Stats
+	// readOnly is non-zero while the group rejects loads from its
+	// getter. Accessed atomically.
+	readOnly int32
+
+	// batcher batches loads when GroupOptions.BatchGetter is set.
+	batcher *batcher
+
+	// negative caches load errors when GroupOptions.NegativeTTL or
+	// ErrorTTL is set.
+	negative *negativeCache
+
+	// refreshing holds the keys being reloaded under
+	// GroupOptions.RefreshAhead.
+	refreshing sync.Map
 }
 
-// flightGroup is defined as an interface which flightgroup.Group
-// satisfies.  We define this so that we may test with an alternate
-// implementation.
-type flightGroup interface {
+// FlightGroup is the interface used to deduplicate concurrent loads
+// of the same key. singleflight.Group satisfies it, and is used unless
+// GroupOptions.LoadFlightGroup specifies an alternate implementation.
+//
+// Loads call Do, so that a panicking getter panics in the Get that ran
+// it, and Remove calls Forget. DoChan lets an implementation wrapping
+// another, e.g. one giving up on calls once a deadline passes, build
+// on the inner group's channel. Lock, beyond the singleflight
+// interface, serializes the cache updates of local Sets and Removes
+// with loads.
+type FlightGroup interface {
+	// Do executes fn, unless a call of fn for the same key is already
+	// in flight, in which case it waits for that call and returns its
+	// results.
 	Do(key string, fn func() (interface{}, error)) (interface{}, error)
+
+	// DoChan is like Do but returns a channel that receives the
+	// results once they are ready.
+	DoChan(key string, fn func() (interface{}, error)) <-chan singleflight.Result
+
+	// Forget makes later calls for key run fn afresh instead of
+	// joining the call in flight, if any.
+	Forget(key string)
+
+	// Lock executes fn while no call may start or join one in flight.
 	Lock(fn func())
 }
 
@@ -215,9 +1292,66 @@ type Stats struct {
 	PeerErrors               AtomicInt
 	Loads                    AtomicInt // (gets - cacheHits)
 	LoadsDeduped             AtomicInt // after singleflight
+	LoadsShared              AtomicInt // loads that waited on another caller's in-flight load
+	InFlightLoads            AtomicInt // deduped loads currently fetching from a peer or the getter
 	LocalLoads               AtomicInt // total good local loads
 	LocalLoadErrs            AtomicInt // total bad local loads
 	ServerRequests           AtomicInt // gets that came over the network from peers
+	BytesServedToPeers       AtomicInt // value bytes returned to peers
+	BytesServedLocal         AtomicInt // value bytes returned to local callers of Get
+	BorrowedViews            AtomicInt // views handed out by GetBorrow and not yet released
+	EvictionEventsDropped    AtomicInt // eviction events discarded under DropOnOverflow
+	LoadsQueued              AtomicInt // loads currently waiting for a MaxConcurrentLoads slot
+	InFlightLoadsQueued      AtomicInt // loads currently waiting for a MaxInFlightLoads slot
+	ShardLoadsQueued         AtomicInt // loads currently waiting for a MaxLoadsPerShard slot
+	FilteredLoads            AtomicInt // loads answered ErrNotFound by the ExistenceFilter
+	StaleServed              AtomicInt // expired values returned by ServeStaleOnError
+	WarmLocalServed          AtomicInt // expired hot cache copies returned by PreferWarmLocal
+	LargeChunkRefetches      AtomicInt // large object chunks fetched again as they did not match their manifest
+	Explains                 AtomicInt // calls to Explain, whose gets are counted as usual too
+	FallbackLoads            AtomicInt // loads answered by the group set by SetFallback
+	ReadOnlyRejects          AtomicInt // loads answered ErrReadOnly instead of calling the getter
+	NotModified              AtomicInt // GetIfChanged calls answered without the value as its ETag matched
+	GlobalEvictions          AtomicInt // entries evicted to honor SetGlobalCacheLimit
+	TagInvalidations         AtomicInt // entries removed by InvalidateTag, here or asked by a peer
+	AntiEntropyChecks        AtomicInt // hot cache copies compared with their owner's by AntiEntropyInterval
+	AntiEntropyInvalidations AtomicInt // hot cache copies dropped as they no longer matched their owner's
+	ThrashEpisodes           AtomicInt // times the main cache stopped admitting loads under ThrashThreshold
+	ThrashSkippedAdds        AtomicInt // loaded values not cached during thrash episodes
+	BatchLoads               AtomicInt // calls to the BatchGetter
+	BatchedKeys              AtomicInt // keys loaded by calls to the BatchGetter
+	OwnerLoads               AtomicInt // keys fetched from another of their owners under Replication
+	OwnerPushes              AtomicInt // loaded values stored on the other owners of their keys under Replication
+	NegativeHits             AtomicInt // loads answered by an error remembered under NegativeTTL or ErrorTTL
+	RefreshAheads            AtomicInt // background reloads of keys nearing expiry under RefreshAhead
+	MultiPeerRequests        AtomicInt // GetMulti requests sent to peers, each for all the keys they own
+	HedgedRequests           AtomicInt // backup peers asked for a key as its owner was slow, under HedgeDelay
+	HedgeWins                AtomicInt // hedged fetches answered by the backup peer first
+	OversizedValues          AtomicInt // values not cached as they exceeded MaxValueBytes
+	Spills                   AtomicInt // values evicted from the main cache kept by the SpillStore
+	SpillHits                AtomicInt // loads answered by the SpillStore
+	PeerRetries              AtomicInt // backup peers asked for a key after a failed peer fetch
+	PeerRetryLoads           AtomicInt // loads answered by a backup peer after a failed peer fetch
+	PeerFallbackLoads        AtomicInt // local loads of keys whose peer fetches all failed
+	PeerFallbackRejects      AtomicInt // loads failed as their peer fetches did, under PeerRetryPolicy.NoLocalLoad or StrictOwnership
+	ServerConcurrencyShed    AtomicInt // requests from peers rejected under HTTPPoolOptions.MaxConcurrentRequests
+	ServerRateShed           AtomicInt // requests from peers rejected under HTTPPoolOptions.MaxPeerQPS
+	PeerGenerations          AtomicInt // generations adopted from peers' requests, see SetGeneration
+	PeerPopulates            AtomicInt // keys Prefetch asked their owners to load
+	HandoffEntries           AtomicInt // entries received from peers leaving the pool, see HTTPPool.Drain
+	PeerCircuitOpen          AtomicInt // peer fetches skipped as the peer's circuit breaker was open
+	HotKeysReplicated        AtomicInt // keys pushed to the hot cache of every peer under HotKeyThreshold
+	HotKeyPushes             AtomicInt // values of those keys stored by a peer
+	MisroutedRejects         AtomicInt // peer requests for keys owned by another peer, failed under StrictOwnership
+}
+
+// logger returns the logger reporting the group's errors, or nil if
+// they are not logged.
+func (g *Group) logger() *logrus.Entry {
+	if g.opts.Logger != nil {
+		return g.opts.Logger
+	}
+	return logger
 }
 
 // Name returns the name of the group.
@@ -231,17 +1365,183 @@ func (g *Group) initPeers() {
 	}
 }
 
+// SetPeerPicker makes the group pick the peers owning its keys with
+// peers, instead of the PeerPicker registered with RegisterPeerPicker
+// or RegisterPerGroupPeerPicker. This is an advanced hook, mainly for
+// tests, which can route specific keys to stub ProtoGetters regardless
+// of how keys hash. It must be called before the group is first used,
+// and panics otherwise.
+func (g *Group) SetPeerPicker(peers PeerPicker) {
+	set := false
+	g.peersOnce.Do(func() {
+		g.peers, set = peers, true
+	})
+	if !set {
+		panic("groupcache: SetPeerPicker called after group " + g.name + " was used")
+	}
+}
+
+// forceRefreshKey is the context key marking a Get as a forced refresh.
+type forceRefreshKey struct{}
+
+// WithForceRefresh returns a copy of ctx that makes Get ignore any
+// cached value for the key and load it afresh from its owner, which
+// loads it from the getter and caches the new value. Keys owned by a
+// peer are still fetched from that peer, which is asked to refresh
+// them in turn.
+func WithForceRefresh(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, forceRefreshKey{}, true)
+}
+
+// forceRefresh reports whether ctx was returned by WithForceRefresh.
+func forceRefresh(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	refresh, _ := ctx.Value(forceRefreshKey{}).(bool)
+	return refresh
+}
+
 func (g *Group) Get(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+	_, err := g.GetWithInfo(ctx, key, dest, fixFunc)
+	return err
+}
+
+// GetInfo describes the value returned by GetWithInfo.
+type GetInfo struct {
+	// Stale is set if the value had expired and was served because
+	// loading it afresh failed. See GroupOptions.ServeStaleOnError.
+	Stale bool
+
+	// PossiblyStale is set if the value was an expired hot cache copy
+	// of a key owned by another peer, served without asking the owner.
+	// See GroupOptions.PreferWarmLocal.
+	PossiblyStale bool
+
+	// Meta is the metadata returned with the value by a
+	// GetterWithMeta, or nil. It is shared with the cache and must not
+	// be modified.
+	Meta []byte
+
+	// Source is where the value came from.
+	Source ValueSource
+
+	// Age is how long ago the value was stored in this process's
+	// cache, or zero if it was loaded from a peer or the getter for
+	// this Get.
+	Age time.Duration
+
+	// Bytes is the length of the value.
+	Bytes int
+}
+
+// A ValueSource is where a value returned by GetWithInfo came from.
+type ValueSource int
+
+const (
+	// SourceMainCache and SourceHotCache are this process's caches.
+	SourceMainCache ValueSource = iota + 1
+	SourceHotCache
+
+	// SourcePeer is the peer owning the key, or one of its replicas.
+	SourcePeer
+
+	// SourceOrigin is the group's getter, called by this process.
+	SourceOrigin
+
+	// SourceSpill is the group's GroupOptions.SpillStore.
+	SourceSpill
+)
+
+// String returns a short name of s, such as "main" or "peer", as for an
+// X-Cache header.
+func (s ValueSource) String() string {
+	switch s {
+	case SourceMainCache:
+		return "main"
+	case SourceHotCache:
+		return "hot"
+	case SourcePeer:
+		return "peer"
+	case SourceOrigin:
+		return "origin"
+	case SourceSpill:
+		return "spill"
+	}
+	return "unknown"
+}
+
+// cacheSource returns the ValueSource of the cache which.
+func cacheSource(which CacheType) ValueSource {
+	if which == HotCache {
+		return SourceHotCache
+	}
+	return SourceMainCache
+}
+
+// getInfo returns the GetInfo of value, found in source.
+func (g *Group) getInfo(value ByteView, source ValueSource) GetInfo {
+	info := GetInfo{Meta: value.meta, Source: source, Bytes: value.Len()}
+	if value.stored != 0 {
+		info.Age = g.clock().Sub(time.Unix(0, value.stored))
+	}
+	return info
+}
+
+// GetWithInfo is like Get but also describes the value it returned.
+func (g *Group) GetWithInfo(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) (GetInfo, error) {
+	if g.getLatency != nil {
+		start := g.clock()
+		defer func() { g.getLatency.record(g.clock().Sub(start)) }()
+	}
+	if g.opts.Tracer != nil {
+		ctx, span := g.startSpan(ctx, "groupcache.Get", key)
+		info, err := g.getWithInfo(ctx, key, dest, fixFunc)
+		span.End(err)
+		return info, err
+	}
+	return g.getWithInfo(ctx, key, dest, fixFunc)
+}
+
+func (g *Group) getWithInfo(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) (GetInfo, error) {
 	g.peersOnce.Do(g.initPeers)
 	g.Stats.Gets.Add(1)
+	g.observeGet()
 	if dest == nil {
-		return errors.New("groupcache: nil dest Sink")
+		return GetInfo{}, errors.New("groupcache: nil dest Sink")
 	}
-	value, cacheHit := g.lookupCache(key)
-
-	if cacheHit {
-		g.Stats.CacheHits.Add(1)
-		return setSinkView(dest, value)
+	// A reused sink must not hand the previous value to a getter that
+	// sets none.
+	dest.Reset()
+	if !forceRefresh(ctx) {
+		_, span := g.startSpan(ctx, "groupcache.lookupCache", key)
+		value, which, cacheHit := g.lookupCacheIn(key)
+		if span != nil {
+			span.SetAttribute("groupcache.cache", spanCacheName(which))
+			span.End(nil)
+		}
+		if cacheHit {
+			if e := explaining(ctx); e != nil {
+				e.CacheHit = which
+			}
+			g.Stats.CacheHits.Add(1)
+			g.countServedLocal(ctx, value)
+			if which == MainCache {
+				g.refreshAhead(key, value)
+				g.observeHotKey(ctx, key, value)
+			}
+			return g.getInfo(value, cacheSource(which)), setSinkView(dest, value)
+		}
+		if warm, ok := g.lookupWarm(ctx, key); ok {
+			g.Stats.WarmLocalServed.Add(1)
+			g.countServedLocal(ctx, warm)
+			info := g.getInfo(warm, SourceHotCache)
+			info.PossiblyStale = true
+			return info, setSinkView(dest, warm)
+		}
 	}
 
 	// Optimization to avoid double unmarshalling or copying: keep
@@ -251,15 +1551,127 @@ func (g *Group) Get(ctx context.Context, key string, dest Sink, fixFunc func() i
 	destPopulated := false
 	value, destPopulated, err := g.load(ctx, key, dest, fixFunc)
 	if err != nil {
-		return err
+		if peerHops(ctx) > 0 || errors.Is(err, ErrNotFound) {
+			return GetInfo{}, err
+		}
+		stale, ok := g.lookupStale(key)
+		if !ok {
+			return GetInfo{}, err
+		}
+		if log := g.logger(); log != nil {
+			log.WithFields(logrus.Fields{
+				"err":      err,
+				"key":      key,
+				"category": "groupcache",
+			}).Warnf("serving stale value after failing to load key")
+		}
+		g.Stats.StaleServed.Add(1)
+		g.countServedLocal(ctx, stale)
+		info := g.getInfo(stale, stale.source)
+		info.Stale = true
+		return info, setSinkView(dest, stale)
+	}
+	g.countServedLocal(ctx, value)
+	source := value.source
+	if source == 0 {
+		source = SourceOrigin
 	}
 	if destPopulated {
-		return nil
+		return g.getInfo(value, source), nil
+	}
+	return g.getInfo(value, source), setSinkView(dest, value)
+}
+
+// GetWithMeta is like Get but also returns the metadata stored with
+// the value by the getter, if it is a GetterWithMeta, or nil.
+func (g *Group) GetWithMeta(ctx context.Context, key string, dest Sink) (meta []byte, err error) {
+	info, err := g.GetWithInfo(ctx, key, dest, nil)
+	if err != nil || info.Meta == nil {
+		return nil, err
+	}
+	return cloneBytes(info.Meta), nil
+}
+
+// countServedLocal records value as served to a local caller, unless
+// the Get was made on behalf of a peer, in which case ServeHTTP
+// accounts for it.
+func (g *Group) countServedLocal(ctx context.Context, value ByteView) {
+	if peerHops(ctx) == 0 {
+		g.Stats.BytesServedLocal.Add(int64(value.Len()))
+	}
+}
+
+// GetBorrow is like Get but hands the caller the cached ByteView
+// itself rather than copying its bytes into a Sink, so that a cache
+// hit copies and allocates nothing for the value.
+//
+// Cached values are never modified in place, and values read from a
+// CacheBackend are copied out of it, so the bytes of the view stay
+// valid even if the entry is evicted; eviction only drops the cache's
+// reference to them. The borrow is counted in Stats.BorrowedViews
+// until release is called. The caller must not mutate the view (for
+// example through unsafe conversions), must not retain it or any
+// slice of it past release, and must call release exactly once:
+// calling it again miscounts BorrowedViews.
+func (g *Group) GetBorrow(ctx context.Context, key string) (value ByteView, release func(), err error) {
+	if err := g.Get(ctx, key, ByteViewSink(&value), nil); err != nil {
+		return ByteView{}, nil, err
+	}
+	g.Stats.BorrowedViews.Add(1)
+	return value, g.releaseBorrow, nil
+}
+
+// GetReader is like GetBorrow but returns a reader over the value, for
+// callers streaming large values on, such as to an HTTP response. The
+// reader reads the cached bytes in place. Like a borrowed view, they
+// stay valid even if the entry is evicted while the reader is open, and
+// the reader holds the borrow until it is closed, which the caller must
+// do; it must not be read from afterwards. The reader also implements
+// io.Seeker, io.ReaderAt and io.WriterTo.
+//
+// Values held by a peer are still fetched whole before GetReader
+// returns, since they may be mirrored in the hot cache. Large ones are
+// streamed by the peer, though, so neither side buffers them twice.
+func (g *Group) GetReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	value, release, err := g.GetBorrow(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &viewReader{ReadSeeker: value.Reader(), release: release}, nil
+}
+
+// viewReader is the reader returned by GetReader. Its ReadSeeker is
+// the *bytes.Reader or *strings.Reader of ByteView.Reader.
+type viewReader struct {
+	io.ReadSeeker
+	release func()
+}
+
+func (r *viewReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.ReadSeeker.(io.ReaderAt).ReadAt(p, off)
+}
+
+func (r *viewReader) WriteTo(w io.Writer) (int64, error) {
+	return r.ReadSeeker.(io.WriterTo).WriteTo(w)
+}
+
+func (r *viewReader) Close() error {
+	if r.release != nil {
+		r.release()
+		r.release = nil
 	}
-	return setSinkView(dest, value)
+	return nil
 }
 
+// Set stores value under key in the cache of the peer owning key, and
+// also in this process's hot cache if hotCache is set and key belongs
+// to another peer. The caller retains ownership of value.
 func (g *Group) Set(ctx context.Context, key string, value []byte, expire time.Time, hotCache bool) error {
+	return g.set(ctx, key, value, expire, hotCache, nil)
+}
+
+// set is Set, storing value with tags.
+func (g *Group) set(ctx context.Context, key string, value []byte, expire time.Time, hotCache bool, tags []string) error {
 	g.peersOnce.Do(g.initPeers)
 
 	if key == "" {
@@ -268,25 +1680,50 @@ func (g *Group) Set(ctx context.Context, key string, value []byte, expire time.T
 
 	_, err := g.setGroup.Do(key, func() (interface{}, error) {
 		// If remote peer owns this key
-		owner, ok := g.peers.PickPeer(key)
+		owner, ok := g.pickPeer(key)
 		if ok {
-			if err := g.setFromPeer(ctx, owner, key, value, expire); err != nil {
+			if err := g.setFromPeer(ctx, owner, key, value, expire, tags); err != nil {
 				return nil, err
 			}
 			// TODO(thrawn01): Not sure if this is useful outside of tests...
 			//  maybe we should ALWAYS update the local cache?
 			if hotCache {
-				g.localSet(key, value, expire, &g.hotCache)
+				g.localSetTagged(key, cloneBytes(value), expire, tags, &g.hotCache)
 			}
 			return nil, nil
 		}
 		// We own this key
-		g.localSet(key, value, expire, &g.mainCache)
+		g.localSetTagged(key, cloneBytes(value), expire, tags, &g.mainCache)
 		return nil, nil
 	})
 	return err
 }
 
+// ExistsAnywhere reports whether key is held in this process's caches
+// or, failing that, in those of the peer owning key. Unlike Get, it
+// never loads the key, neither from the getter nor from the owner, and
+// populates no cache. Other peers may still hold the key in their hot
+// caches when it returns false.
+func (g *Group) ExistsAnywhere(ctx context.Context, key string) (bool, error) {
+	g.peersOnce.Do(g.initPeers)
+	if _, ok := g.Contains(key); ok {
+		return true, nil
+	}
+	owner, ok := g.pickPeer(key)
+	if !ok {
+		return false, nil
+	}
+	req := &pb.GetRequest{
+		Group: &g.name,
+		Key:   &key,
+	}
+	found, err := owner.Exists(ctx, req)
+	if err != nil {
+		return false, &PeerError{Peer: owner, Err: err}
+	}
+	return found, nil
+}
+
 // Remove clears the key from our cache then forwards the remove
 // request to all peers.
 func (g *Group) Remove(ctx context.Context, key string) error {
@@ -295,7 +1732,7 @@ func (g *Group) Remove(ctx context.Context, key string) error {
 	_, err := g.removeGroup.Do(key, func() (interface{}, error) {
 
 		// Remove from key owner first
-		owner, ok := g.peers.PickPeer(key)
+		owner, ok := g.pickPeer(key)
 		if ok {
 			if err := g.removeFromPeer(ctx, owner, key); err != nil {
 				return nil, err
@@ -336,45 +1773,308 @@ func (g *Group) Remove(ctx context.Context, key string) error {
 	return err
 }
 
-// load loads key either by invoking the getter locally or by sending it to another machine.
-func (g *Group) load(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) (value ByteView, destPopulated bool, err error) {
-	g.Stats.Loads.Add(1)
-	viewi, err := g.loadGroup.Do(key, func() (interface{}, error) {
-		// Check the cache again because singleflight can only dedup calls
-		// that overlap concurrently.  It's possible for 2 concurrent
-		// requests to miss the cache, resulting in 2 load() calls.  An
-		// unfortunate goroutine scheduling would result in this callback
-		// being run twice, serially.  If we don't check the cache again,
-		// cache.nbytes would be incremented below even though there will
-		// be only one entry for this key.
-		//
-		// Consider the following serialized event ordering for two
-		// goroutines in which this callback gets called twice for the
-		// same key:
-		// 1: Get("key")
-		// 2: Get("key")
-		// 1: lookupCache("key")
-		// 2: lookupCache("key")
-		// 1: load("key")
-		// 2: load("key")
-		// 1: loadGroup.Do("key", fn)
-		// 1: fn()
-		// 2: loadGroup.Do("key", fn)
-		// 2: fn()
-		if value, cacheHit := g.lookupCache(key); cacheHit {
-			g.Stats.CacheHits.Add(1)
-			return value, nil
-		}
-		g.Stats.LoadsDeduped.Add(1)
-		var value ByteView
+// Append adds value to the end of the list of values stored for key,
+// for keys that map to a set of values growing over time.
+//
+// Multi-value entries are held in this process's main cache, separately
+// from any single value loaded for the same key by Get, and are not
+// forwarded to peers. They count against the group's cache size; when
+// space is needed an entry is evicted as a whole, never partially.
+func (g *Group) Append(ctx context.Context, key string, value []byte) error {
+	if key == "" {
+		return errors.New("empty Append() key not allowed")
+	}
+	if g.cacheLimit() <= 0 {
+		return errors.New("groupcache: Append requires a group with a non-zero cache size")
+	}
+	key = g.storageKey(key)
+	main, hot, limit := g.caches(key)
+	main.appendValue(key, ByteView{b: cloneBytes(value)})
+	g.evictOverflow(main, hot, limit)
+	return nil
+}
+
+// GetAll returns the values added to key by Append, in the order they
+// were appended. It returns no values if there are none, or if they
+// have been evicted or removed.
+func (g *Group) GetAll(ctx context.Context, key string) ([]ByteView, error) {
+	g.Stats.Gets.Add(1)
+	if g.cacheLimit() <= 0 {
+		return nil, nil
+	}
+	key = g.storageKey(key)
+	main, _, _ := g.caches(key)
+	values, ok := main.getMulti(key)
+	if ok {
+		g.Stats.CacheHits.Add(1)
+	}
+	return values, nil
+}
+
+// Warm loads each of keys through the normal Get path, so peer routing
+// and duplicate suppression apply, using at most concurrency concurrent
+// loads. It is meant for priming a cache at startup.
+//
+// Warm stops starting new loads once ctx is done and then returns
+// ctx.Err(). Otherwise, if any keys fail to load, it returns a
+// *WarmError describing every failure.
+func (g *Group) Warm(ctx context.Context, keys []string, concurrency int) error {
+	return g.WarmWithProgress(ctx, keys, concurrency, nil)
+}
+
+// WarmWithProgress is like Warm, but calls progress, if non-nil, after
+// each key has been loaded or has failed to load. done is the number of
+// keys processed so far, out of total. progress may be called
+// concurrently from multiple goroutines.
+func (g *Group) WarmWithProgress(ctx context.Context, keys []string, concurrency int, progress func(done, total int)) error {
+	return g.forKeys(ctx, keys, concurrency, nil, progress, func(ctx context.Context, key string) error {
+		var value ByteView
+		return g.Get(ctx, key, ByteViewSink(&value), nil)
+	})
+}
+
+// forKeys calls load for each of keys as WarmWithProgress loads them,
+// starting no more calls than limiter allows if it is non-nil.
+func (g *Group) forKeys(ctx context.Context, keys []string, concurrency int, limiter *rateLimiter, progress func(done, total int), load func(ctx context.Context, key string) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var (
+		wg      sync.WaitGroup
+		errMu   sync.Mutex
+		errs    map[string]error
+		done    AtomicInt
+		workers = make(chan struct{}, concurrency)
+	)
+	for _, key := range keys {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+		}
+		for limiter != nil && ctx.Err() == nil {
+			ok, wait := limiter.allow("")
+			if ok {
+				break
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(key string) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			if err := load(ctx, key); err != nil {
+				errMu.Lock()
+				if errs == nil {
+					errs = make(map[string]error)
+				}
+				errs[key] = err
+				errMu.Unlock()
+			}
+			done.Add(1)
+			if progress != nil {
+				progress(int(done.Get()), len(keys))
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &WarmError{Total: len(keys), Errors: errs}
+	}
+	return nil
+}
+
+// A WarmError is returned by Warm and Prefetch when some keys failed
+// to load.
+type WarmError struct {
+	// Total is the number of keys Warm was asked to load.
+	Total int
+
+	// Errors holds the error for each key that failed to load.
+	Errors map[string]error
+}
+
+func (e *WarmError) Error() string {
+	keys := make([]string, 0, len(e.Errors))
+	for key := range e.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("groupcache: failed to warm %d of %d keys; key %q: %v",
+		len(keys), e.Total, keys[0], e.Errors[keys[0]])
+}
+
+// load loads key either by invoking the getter locally or by sending it to another machine.
+//
+// Peer fetches run inside the flight group like getter calls, so
+// concurrent loads of a key send a single request to its owner. The
+// exceptions are keys matched by GroupOptions.NoSingleflight and
+// forced refreshes, which never join a regular load.
+func (g *Group) load(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) (value ByteView, destPopulated bool, err error) {
+	g.Stats.Loads.Add(1)
+
+	if ownerFetch(ctx) {
+		// Another owner of the key only asks for our cached copy,
+		// which we lack; see loadFromOwners.
+		return ByteView{}, false, fmt.Errorf("key not held by this owner: %w", ErrNotFound)
+	}
+	refresh := forceRefresh(ctx)
+	if g.negative != nil && !refresh {
+		if err := g.negative.get(g.storageKey(key)); err != nil {
+			g.Stats.NegativeHits.Add(1)
+			return ByteView{}, false, err
+		}
+	}
+	owners, selfOwner := g.pickOwners(key)
+
+	flight, forceLocal := g.loadGroup, false
+	// A replica read is forwarded to us by a peer although we do not
+	// own the key; we fetch it from the owner and mirror it ourselves.
+	serveReplica := peerHops(ctx) > 0 && replicaRead(ctx)
+	if serveReplica {
+		ctx = withReplicaRead(ctx, false)
+	} else if peerHops(ctx) > 0 && (!selfOwner || refresh) {
+		if peer, ok := g.pickPeer(key); ok {
+			// This request was forwarded to us by a peer that believes
+			// we own the key, yet our own peer list disagrees. Forwarding
+			// again could bounce the request around forever, so break the
+			// loop and load the key here instead. The forwarder may be
+			// this very process, blocked in loadGroup waiting on us, so
+			// the load must not join its flight.
+			if g.opts.StrictOwnership {
+				g.Stats.MisroutedRejects.Add(1)
+				return ByteView{}, false, fmt.Errorf("groupcache: key owned by peer '%s': %w", peer.GetURL(), ErrOwnerUnavailable)
+			}
+			if log := g.logger(); log != nil {
+				log.WithFields(logrus.Fields{
+					"key":      key,
+					"category": "groupcache",
+				}).Warnf("peer request would be re-forwarded to '%s'; loading locally", peer.GetURL())
+			}
+			flight, forceLocal = g.loopGroup, true
+		}
+	}
+	if refresh && !forceLocal {
+		flight = g.refreshGroup
+	}
+
+	leader := false
+	fn := func() (interface{}, error) {
+		leader = true
+		// Check the cache again because singleflight can only dedup calls
+		// that overlap concurrently.  It's possible for 2 concurrent
+		// requests to miss the cache, resulting in 2 load() calls.  An
+		// unfortunate goroutine scheduling would result in this callback
+		// being run twice, serially.  If we don't check the cache again,
+		// cache.nbytes would be incremented below even though there will
+		// be only one entry for this key.
+		//
+		// Consider the following serialized event ordering for two
+		// goroutines in which this callback gets called twice for the
+		// same key:
+		// 1: Get("key")
+		// 2: Get("key")
+		// 1: lookupCache("key")
+		// 2: lookupCache("key")
+		// 1: load("key")
+		// 2: load("key")
+		// 1: loadGroup.Do("key", fn)
+		// 1: fn()
+		// 2: loadGroup.Do("key", fn)
+		// 2: fn()
+		if !refresh {
+			if value, which, cacheHit := g.lookupCacheIn(key); cacheHit {
+				if e := explaining(ctx); e != nil {
+					e.CacheHit = which
+				}
+				g.Stats.CacheHits.Add(1)
+				value.source = cacheSource(which)
+				return value, nil
+			}
+		}
+		g.Stats.LoadsDeduped.Add(1)
+		if !refresh {
+			if value, ok := g.loadSpilled(key); ok {
+				value.source = SourceSpill
+				return value, nil
+			}
+		}
+		if peerHops(ctx) == 0 {
+			if err := acquireSlot(ctx, g.flightSlots, &g.Stats.InFlightLoadsQueued); err != nil {
+				return nil, err
+			}
+			defer releaseSlot(g.flightSlots)
+		}
+		g.Stats.InFlightLoads.Add(1)
+		defer g.Stats.InFlightLoads.Add(-1)
+		var value ByteView
 		var err error
-		if peer, ok := g.peers.PickPeer(key); ok {
+		peer, ok := g.pickPeer(key)
+		if ok && refresh {
+			// The fresh value may not be mirrored if the key is not
+			// hot enough; the stale one must not outlive it.
+			sk := g.storageKey(key)
+			_, hot, _ := g.caches(sk)
+			hot.remove(sk)
+		}
+		if owners != nil && !refresh && !forceLocal {
+			value, done, err := g.loadFromOwners(ctx, key, owners, selfOwner)
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return value, nil
+			}
+			ok = false
+		}
+		if ok && owners == nil && !refresh && !forceLocal && g.opts.ReadReplicas > 1 && peerHops(ctx) == 0 {
+			if replica, rok := g.pickReplicaPeer(key, peer); rok {
+				value, err = g.getFromPeer(withReplicaRead(ctx, true), replica, key, false)
+				if err == nil {
+					g.Stats.PeerLoads.Add(1)
+					return value, nil
+				} else if errors.Is(err, context.Canceled) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrReadOnly) || errors.Is(err, ErrValueTooLarge) {
+					return nil, err
+				}
+				// Fall back to the owner.
+				if log := g.logger(); log != nil {
+					log.WithFields(logrus.Fields{
+						"err":      err,
+						"key":      key,
+						"category": "groupcache",
+					}).Errorf("error retrieving key from replica '%s'", replica.GetURL())
+				}
+				g.Stats.PeerErrors.Add(1)
+			}
+		}
+		peerFailed := false
+		for tries := 0; ok && !forceLocal; tries++ {
+			if tries > 0 {
+				g.Stats.PeerRetries.Add(1)
+			}
 
 			// metrics duration start
 			start := time.Now()
 
 			// get value from peers
-			value, err = g.getFromPeer(ctx, peer, key)
+			value, err = g.getFromPeerHedged(ctx, peer, key, serveReplica)
 
 			// metrics duration compute
 			duration := int64(time.Since(start)) / int64(time.Millisecond)
@@ -386,21 +2086,38 @@ func (g *Group) load(ctx context.Context, key string, dest Sink, fixFunc func()
 
 			if err == nil {
 				g.Stats.PeerLoads.Add(1)
+				if tries > 0 {
+					g.Stats.PeerRetryLoads.Add(1)
+				}
 				return value, nil
 			} else if errors.Is(err, context.Canceled) {
 				// do not count context cancellation as a peer error
 				return nil, err
+			} else if errors.Is(err, ErrNotFound) {
+				// the owner found no value; neither will we
+				return nil, err
+			} else if errors.Is(err, ErrReadOnly) {
+				// the owner protects the origin; so do we
+				return nil, err
+			} else if errors.Is(err, ErrValueTooLarge) {
+				// loading the value locally would not make it smaller
+				return nil, err
 			}
 
-			if logger != nil {
-				logger.WithFields(logrus.Fields{
-					"err":      err,
-					"key":      key,
-					"category": "groupcache",
-				}).Errorf("error retrieving key from peer '%s'", peer.GetURL())
+			if errors.Is(err, ErrCircuitOpen) {
+				// the peer failed lately and was not asked
+				g.Stats.PeerCircuitOpen.Add(1)
+			} else {
+				if log := g.logger(); log != nil {
+					log.WithFields(logrus.Fields{
+						"err":      err,
+						"key":      key,
+						"category": "groupcache",
+					}).Errorf("error retrieving key from peer '%s'", peer.GetURL())
+				}
+				g.Stats.PeerErrors.Add(1)
 			}
-
-			g.Stats.PeerErrors.Add(1)
+			peerFailed = true
 			if ctx != nil && ctx.Err() != nil {
 				// Return here without attempting to get locally
 				// since the context is no longer valid
@@ -410,58 +2127,375 @@ func (g *Group) load(ctx context.Context, key string, dest Sink, fixFunc func()
 			// log of the past few for /groupcachez?  It's
 			// probably boring (normal task movement), so not
 			// worth logging I imagine.
+
+			// Give backup peers, if the peer picker nominates
+			// them, the chances set by the retry policy before
+			// loading locally.
+			if tries >= g.peerRetry.Retries {
+				break
+			}
+			if g.peerRetry.Backoff != nil {
+				if !waitRetry(ctx, g.peerRetry.Backoff(tries+1)) {
+					break
+				}
+				if ctx != nil && ctx.Err() != nil {
+					return nil, err
+				}
+			}
+			peer, ok = g.pickBackupPeer(key, peer)
+		}
+		if peerFailed {
+			if g.peerRetry.NoLocalLoad || g.opts.StrictOwnership {
+				g.Stats.PeerFallbackRejects.Add(1)
+				return nil, &ownerUnavailableError{err}
+			}
+			g.Stats.PeerFallbackLoads.Add(1)
+		}
+		if g.ReadOnly() {
+			g.Stats.ReadOnlyRejects.Add(1)
+			return nil, ErrReadOnly
 		}
-		value, err = g.getLocally(ctx, key, dest, fixFunc)
+		if f := g.opts.ExistenceFilter; f != nil && !f.MightContain(key) {
+			g.Stats.FilteredLoads.Add(1)
+			return nil, ErrNotFound
+		}
+		var populated bool
+		value, populated, err = g.getLocallyShared(ctx, key, dest, fixFunc)
 		if err != nil {
 			g.Stats.LocalLoadErrs.Add(1)
 			return nil, err
 		}
 		g.Stats.LocalLoads.Add(1)
-		destPopulated = true // only one caller of load gets this return value
-		g.populateCache(key, value, &g.mainCache)
+		if g.opts.RejectOversizedValues && g.oversized(value) {
+			g.Stats.OversizedValues.Add(1)
+			return nil, ErrValueTooLarge
+		}
+		destPopulated = populated // only one caller of load gets this return value
+		switch {
+		case g.isClient():
+			// A client owns no keys to cache.
+		case g.thrash.admitting(g.clock()):
+			g.observeAdd(g.populateCache(key, value, &g.mainCache))
+		default:
+			g.Stats.ThrashSkippedAdds.Add(1)
+		}
+		if selfOwner {
+			g.pushToOwners(key, value, owners)
+		}
 		return value, nil
-	})
+	}
+	var viewi interface{}
+	if g.opts.NoSingleflight != nil && g.opts.NoSingleflight(key) {
+		viewi, err = fn()
+	} else {
+		viewi, err = flight.Do(key, fn)
+	}
+	var panicked *singleflight.PanicError
+	if log := g.logger(); log != nil && !leader && errors.As(err, &panicked) {
+		// The Get that ran the load panics on its own goroutine;
+		// the others only get an error for it.
+		log.WithFields(logrus.Fields{
+			"err":      err,
+			"key":      key,
+			"group":    g.name,
+			"category": "groupcache",
+		}).Errorf("load of key panicked in another Get")
+	}
+	if !leader {
+		g.Stats.LoadsShared.Add(1)
+		if e := explaining(ctx); e != nil {
+			e.Shared = true
+		}
+	}
+	if g.negative != nil && leader {
+		if err != nil {
+			g.negative.add(g.storageKey(key), err)
+		} else if refresh {
+			g.negative.remove(g.storageKey(key))
+		}
+	}
 	if err == nil {
 		value = viewi.(ByteView)
 	}
 	return
 }
 
+// acquireLoadSlot waits for one of the MaxConcurrentLoads slots to
+// call the getter, if the group limits them.
+func (g *Group) acquireLoadSlot(ctx context.Context) error {
+	return acquireSlot(ctx, g.loadSlots, &g.Stats.LoadsQueued)
+}
+
+func (g *Group) releaseLoadSlot() {
+	releaseSlot(g.loadSlots)
+}
+
+// acquireSlot waits for a free slot in slots, if non-nil, counting
+// the wait in queued.
+func acquireSlot(ctx context.Context, slots chan struct{}, queued *AtomicInt) error {
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	queued.Add(1)
+	defer queued.Add(-1)
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-done:
+		if err := ctx.Err(); err != context.DeadlineExceeded {
+			return err
+		}
+		return ErrLoadThrottled
+	}
+}
+
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// getLocallyShared loads key from the getter, joining a load of the
+// same key by another group if they share a GroupOptions.SharedLoadGroup.
+// populated reports whether dest was populated, which it is not when
+// the result of another group's load was returned.
+func (g *Group) getLocallyShared(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) (value ByteView, populated bool, err error) {
+	load := func() (interface{}, error) {
+		populated = true
+		releaseShard, err := g.acquireShardSlot(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		defer releaseShard()
+		if err := g.acquireLoadSlot(ctx); err != nil {
+			return nil, err
+		}
+		defer g.releaseLoadSlot()
+		if l := g.opts.DistributedLocker; l != nil {
+			release, err := l.Acquire(ctx, g.name+"/"+key)
+			if err != nil {
+				return nil, fmt.Errorf("groupcache: acquiring distributed lock: %w", err)
+			}
+			defer release()
+		}
+		explain := explaining(ctx)
+		var start time.Time
+		if g.loadLatency != nil || explain != nil {
+			start = g.clock()
+		}
+		getterCtx, span := g.startSpan(ctx, "groupcache.getter", key)
+		value, err := g.getLocally(getterCtx, key, dest, fixFunc)
+		endSpan(span, err)
+		if g.loadLatency != nil {
+			g.loadLatency.record(g.clock().Sub(start))
+		}
+		if explain != nil {
+			explain.Origin, explain.OriginLatency = true, g.clock().Sub(start)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+	var viewi interface{}
+	if g.opts.SharedLoadGroup != nil {
+		viewi, err = g.opts.SharedLoadGroup.DoNS(g.opts.SharedLoadNamespace, key, load)
+	} else {
+		viewi, err = load()
+	}
+	if e := explaining(ctx); e != nil && !populated {
+		e.Shared = true
+	}
+	if err != nil {
+		return ByteView{}, false, err
+	}
+	return viewi.(ByteView), populated, nil
+}
+
 func (g *Group) getLocally(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) (ByteView, error) {
-	err := g.getter.Get(ctx, key, dest, fixFunc)
+	if g.opts.LargeObjectChunkSize > 0 {
+		if object, chunk, ok := parseLargeKey(key); ok {
+			return g.getLargePart(ctx, object, chunk, dest, fixFunc)
+		}
+	}
+	return g.callGetter(ctx, key, dest, fixFunc)
+}
+
+// callGetter loads key from the fallback group, the BatchGetter or the
+// getter into dest.
+func (g *Group) callGetter(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) (ByteView, error) {
+	if value, ok, err := g.getFromFallback(ctx, key, dest, fixFunc); ok || err != nil {
+		return value, err
+	}
+	if g.opts.DefaultTTL > 0 {
+		dest = &ttlSink{Sink: dest, ttl: g.opts.DefaultTTL}
+	}
+	if g.batcher != nil {
+		return g.getBatched(ctx, key, dest)
+	}
+	if cg, ok := g.getter.(ChunkGetter); ok {
+		return g.getChunks(ctx, cg, key, dest)
+	}
+	mg, ok := g.getter.(GetterWithMeta)
+	if !ok {
+		err := g.getter.Get(ctx, key, dest, fixFunc)
+		if err != nil {
+			return ByteView{}, &GetterError{Key: key, Err: err}
+		}
+		return dest.view()
+	}
+	meta, err := mg.GetWithMeta(ctx, key, dest, fixFunc)
+	if err != nil {
+		return ByteView{}, &GetterError{Key: key, Err: err}
+	}
+	value, err := dest.view()
+	value.meta = meta
+	return value, err
+}
+
+// getFromPeer fetches key from peer, mirroring the value in the hot
+// cache if the key is hot enough, or always if mirror is set.
+func (g *Group) getFromPeer(ctx context.Context, peer ProtoGetter, key string, mirror bool) (ByteView, error) {
+	value, err := g.fetchFromPeer(ctx, peer, key)
 	if err != nil {
 		return ByteView{}, err
 	}
-	return dest.view()
+	g.mirrorPeerValue(key, value, mirror)
+	return value, nil
 }
 
-func (g *Group) getFromPeer(ctx context.Context, peer ProtoGetter, key string) (ByteView, error) {
+// mirrorPeerValue keeps value, fetched from the peer owning key, in
+// the hot cache if mirror is set or the key is hot enough.
+func (g *Group) mirrorPeerValue(key string, value ByteView, mirror bool) {
+	switch {
+	case mirror:
+	case g.opts.HotCachePromotion != nil:
+		if !g.opts.HotCachePromotion.Promote(key, value) {
+			return
+		}
+	case g.hotFetches != nil && g.hotFetches.increment(key) < g.opts.HotCacheMinPeerFetches:
+		return
+	}
+	g.populateCache(key, value, &g.hotCache)
+}
+
+// fetchFromPeer is getFromPeer without mirroring the value.
+func (g *Group) fetchFromPeer(ctx context.Context, peer ProtoGetter, key string) (ByteView, error) {
 	req := &pb.GetRequest{
-		Group: &g.name,
-		Key:   &key,
+		Group:      &g.name,
+		Key:        &key,
+		Generation: g.peerGeneration(),
 	}
 	res := &pb.GetResponse{}
+	ctx, span := g.startSpan(ctx, "groupcache.getFromPeer", key)
+	if span != nil {
+		span.SetAttribute("groupcache.peer", peer.GetURL())
+	}
+	var start time.Time
+	if g.peerLatency != nil {
+		start = g.clock()
+	}
 	err := peer.Get(ctx, req, res)
+	endSpan(span, err)
+	if g.peerLatency != nil {
+		g.recordPeerLatency(peer, g.clock().Sub(start))
+	}
+	if e := explaining(ctx); e != nil {
+		e.PeerFetches = append(e.PeerFetches, ExplainPeerFetch{Peer: peer.GetURL(), Replica: replicaRead(ctx), Err: err})
+	}
 	if err != nil {
-		return ByteView{}, err
+		return ByteView{}, &PeerError{Peer: peer, Err: err}
 	}
+	return peerView(peer, res)
+}
 
+// peerView returns the value of res, received from peer.
+func peerView(peer ProtoGetter, res *pb.GetResponse) (ByteView, error) {
 	var expire time.Time
 	if res.Expire != nil && *res.Expire != 0 {
 		expire = time.Unix(*res.Expire/int64(time.Second), *res.Expire%int64(time.Second))
 		if time.Now().After(expire) {
-			return ByteView{}, errors.New("peer returned expired value")
+			return ByteView{}, &PeerError{Peer: peer, Err: errors.New("peer returned expired value")}
 		}
 	}
+	return ByteView{b: res.Value, e: expire, meta: res.Meta, tags: res.Tags, source: SourcePeer}, nil
+}
 
-	value := ByteView{b: res.Value, e: expire}
+// GetOrSet populates dest with the value cached for key if there is
+// one, and otherwise stores value under key in the cache of the peer
+// owning key, like Set, and populates dest with it. The first value
+// stored wins: concurrent calls for a key, from any process, store
+// only one of their values, which they all return, and a call made
+// while the owner is loading the key returns the loaded value. Unlike
+// Get, GetOrSet never loads the key from the getter. The value does
+// not expire. The caller retains ownership of value.
+func (g *Group) GetOrSet(ctx context.Context, key string, dest Sink, value []byte) error {
+	g.peersOnce.Do(g.initPeers)
+	if key == "" {
+		return errors.New("empty GetOrSet() key not allowed")
+	}
+	if dest == nil {
+		return errors.New("groupcache: nil dest Sink")
+	}
+	dest.Reset()
+	g.Stats.Gets.Add(1)
+	if v, cacheHit := g.lookupCache(key); cacheHit {
+		g.Stats.CacheHits.Add(1)
+		return setSinkView(dest, v)
+	}
+	owner, ok := g.pickPeer(key)
+	if !ok {
+		return setSinkView(dest, g.getOrSetLocally(key, value, time.Time{}))
+	}
+	viewi, err := g.loadGroup.Do(key, func() (interface{}, error) {
+		req := &pb.SetRequest{Group: &g.name, Key: &key, Value: value}
+		res := &pb.GetResponse{}
+		if err := owner.GetOrSet(ctx, req, res); err != nil {
+			return nil, &PeerError{Peer: owner, Err: err}
+		}
+		var expire time.Time
+		if res.Expire != nil && *res.Expire != 0 {
+			expire = time.Unix(*res.Expire/int64(time.Second), *res.Expire%int64(time.Second))
+		}
+		return ByteView{b: res.Value, e: expire, meta: res.Meta}, nil
+	})
+	if err != nil {
+		return err
+	}
+	return setSinkView(dest, viewi.(ByteView))
+}
 
-	// Always populate the hot cache
-	g.populateCache(key, value, &g.hotCache)
-	return value, nil
+// getOrSetLocally returns the value of key in this process's cache,
+// first storing a copy of value, which expires at expire, in the main
+// cache if there is none. A load of key in progress is waited for,
+// and its value returned, instead.
+func (g *Group) getOrSetLocally(key string, value []byte, expire time.Time) ByteView {
+	for {
+		viewi, err := g.loadGroup.Do(key, func() (interface{}, error) {
+			if v, cacheHit := g.lookupCache(key); cacheHit {
+				return v, nil
+			}
+			v := ByteView{b: cloneBytes(value), e: expire}
+			g.populateCache(key, v, &g.mainCache)
+			return v, nil
+		})
+		if err == nil {
+			return viewi.(ByteView)
+		}
+		// The load waited for found no value, so store ours.
+	}
 }
 
-func (g *Group) setFromPeer(ctx context.Context, peer ProtoGetter, k string, v []byte, e time.Time) error {
+func (g *Group) setFromPeer(ctx context.Context, peer ProtoGetter, k string, v []byte, e time.Time, tags []string) error {
 	var expire int64
 	if !e.IsZero() {
 		expire = e.UnixNano()
@@ -471,38 +2505,230 @@ func (g *Group) setFromPeer(ctx context.Context, peer ProtoGetter, k string, v [
 		Group:  &g.name,
 		Key:    &k,
 		Value:  v,
+		Tags:   tags,
+	}
+	return peer.Set(ctx, req)
+}
+
+func (g *Group) removeFromPeer(ctx context.Context, peer ProtoGetter, key string) error {
+	req := &pb.GetRequest{
+		Group: &g.name,
+		Key:   &key,
+	}
+	return peer.Remove(ctx, req)
+}
+
+// keyDigestPrefix starts the storage keys of keys longer than
+// GroupOptions.MaxKeyLength.
+const keyDigestPrefix = "groupcache-digest:"
+
+// storageKey returns the key under which key is stored and routed.
+func (g *Group) storageKey(key string) string {
+	if g.opts.MaxKeyLength <= 0 || len(key) <= g.opts.MaxKeyLength {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return keyDigestPrefix + hex.EncodeToString(sum[:16])
+}
+
+// pickPeer returns the peer owning key, as PeerPicker.PickPeer does.
+func (g *Group) pickPeer(key string) (ProtoGetter, bool) {
+	return g.peers.PickPeer(g.routingKey(g.storageKey(key)))
+}
+
+// routingKey returns the key by which to pick the peer owning the
+// storage key key.
+func (g *Group) routingKey(key string) string {
+	if fn := g.opts.RoutingKey; fn != nil {
+		return fn(key)
+	}
+	return key
+}
+
+// pickBackupPeer returns a peer to fetch key from after fetching it
+// from failed did not succeed, if g.peers is a BackupPeerPicker.
+func (g *Group) pickBackupPeer(key string, failed ProtoGetter) (ProtoGetter, bool) {
+	if bp, ok := g.peers.(BackupPeerPicker); ok {
+		return bp.PickBackupPeer(g.routingKey(g.storageKey(key)), failed)
+	}
+	return nil, false
+}
+
+// pickReplicaPeer returns a replica of key other than owner to read key
+// from, if reads are spread over replicas.
+func (g *Group) pickReplicaPeer(key string, owner ProtoGetter) (ProtoGetter, bool) {
+	rp, ok := g.peers.(ReplicaPeerPicker)
+	if !ok {
+		return nil, false
+	}
+	peer, ok := rp.PickReplicaPeer(g.routingKey(g.storageKey(key)), g.opts.ReadReplicas)
+	if !ok || peer == owner {
+		return nil, false
+	}
+	return peer, true
+}
+
+func (g *Group) lookupCache(key string) (value ByteView, ok bool) {
+	value, _, ok = g.lookupCacheIn(key)
+	return value, ok
+}
+
+// lookupCacheIn is like lookupCache but also returns which cache held
+// the value.
+func (g *Group) lookupCacheIn(key string) (value ByteView, which CacheType, ok bool) {
+	if g.cacheLimit() <= 0 {
+		return
+	}
+	key = g.storageKey(key)
+	main, hot, _ := g.caches(key)
+	which = MainCache
+	value, ok = main.get(key)
+	if !ok {
+		which = HotCache
+		value, ok = hot.get(key)
+	}
+	if !ok {
+		return ByteView{}, 0, false
+	}
+	value, ok = g.cachedView(key, value)
+	if !ok {
+		return ByteView{}, 0, false
+	}
+	return value, which, true
+}
+
+// lookupStale returns the expired value of key kept in the cache for
+// GroupOptions.ServeStaleOnError, if any.
+func (g *Group) lookupStale(key string) (value ByteView, ok bool) {
+	if g.cacheLimit() <= 0 || !g.opts.ServeStaleOnError {
+		return
+	}
+	key = g.storageKey(key)
+	main, hot, _ := g.caches(key)
+	source := SourceMainCache
+	value, ok = main.getStale(key)
+	if !ok {
+		source = SourceHotCache
+		value, ok = hot.getStale(key)
+	}
+	if !ok {
+		return
+	}
+	value, ok = g.cachedView(key, value)
+	value.source = source
+	return value, ok
+}
+
+// lookupWarm returns the expired copy of key kept in the hot cache for
+// GroupOptions.PreferWarmLocal, if any, provided another peer owns
+// key. Peers asking us for the key never get such a copy.
+func (g *Group) lookupWarm(ctx context.Context, key string) (value ByteView, ok bool) {
+	if g.cacheLimit() <= 0 || !g.opts.PreferWarmLocal || peerHops(ctx) > 0 {
+		return
+	}
+	if _, remote := g.pickPeer(key); !remote {
+		return
+	}
+	key = g.storageKey(key)
+	_, hot, _ := g.caches(key)
+	if value, ok = hot.getStale(key); !ok {
+		return
+	}
+	return g.cachedView(key, value)
+}
+
+// cachedView returns the value of the view stored in a cache for key.
+func (g *Group) cachedView(key string, value ByteView) (ByteView, bool) {
+	if value.hasSum && atomic.LoadInt32(&g.debugImmutable) != 0 {
+		g.verifyImmutable(key, value)
+	}
+	if value.compressed {
+		var err error
+		if value, err = decompressView(value); err != nil {
+			if log := g.logger(); log != nil {
+				log.WithFields(logrus.Fields{
+					"err":      err,
+					"key":      key,
+					"category": "groupcache",
+				}).Errorf("error decompressing cached value")
+			}
+			return ByteView{}, false
+		}
 	}
-	return peer.Set(ctx, req)
+	return value, true
 }
 
-func (g *Group) removeFromPeer(ctx context.Context, peer ProtoGetter, key string) error {
-	req := &pb.GetRequest{
-		Group: &g.name,
-		Key:   &key,
+// SetDebugImmutability enables or disables checksumming of cached
+// values. When enabled, each value's bytes are checksummed as it is
+// stored and verified every time it is read back from the cache,
+// panicking if they have changed. This catches bugs where a caller
+// mutates memory shared with the cache, corrupting the value for every
+// other reader.
+//
+// It is a development aid: verification hashes the whole value on
+// every cache hit, so it should be left off in production.
+func (g *Group) SetDebugImmutability(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
 	}
-	return peer.Remove(ctx, req)
+	atomic.StoreInt32(&g.debugImmutable, v)
 }
 
-func (g *Group) lookupCache(key string) (value ByteView, ok bool) {
-	if g.cacheBytes <= 0 {
-		return
+// SetReadOnly makes the group stop calling its getter, or resume if
+// enabled is false. While it is read-only, cache hits are served as
+// usual, but keys that miss fail with ErrReadOnly instead of being
+// loaded, shielding the origin during maintenance. Keys owned by a
+// peer are still fetched from it, and fail if the peer's group is
+// read-only too, rather than being loaded locally.
+func (g *Group) SetReadOnly(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
 	}
-	value, ok = g.mainCache.get(key)
-	if ok {
+	atomic.StoreInt32(&g.readOnly, v)
+}
+
+// ReadOnly reports whether the group was made read-only by
+// SetReadOnly.
+func (g *Group) ReadOnly() bool {
+	return atomic.LoadInt32(&g.readOnly) != 0
+}
+
+// verifyImmutable panics if the bytes of value no longer match the
+// checksum recorded when it was cached.
+func (g *Group) verifyImmutable(key string, value ByteView) {
+	if crc32.ChecksumIEEE(value.b) == value.sum {
 		return
 	}
-	value, ok = g.hotCache.get(key)
-	return
+	msg := fmt.Sprintf("groupcache: cached value for key %q in group %q was mutated after being stored", key, g.name)
+	if log := g.logger(); log != nil {
+		log.WithFields(logrus.Fields{
+			"key":      key,
+			"category": "groupcache",
+		}).Error(msg)
+	}
+	panic(msg)
 }
 
+// localSet stores value under key in cache, taking ownership of value:
+// the caller must not modify it afterwards.
 func (g *Group) localSet(key string, value []byte, expire time.Time, cache *cache) {
-	if g.cacheBytes <= 0 {
+	g.localSetTagged(key, value, expire, nil, cache)
+}
+
+// localSetTagged is localSet, storing value with tags.
+func (g *Group) localSetTagged(key string, value []byte, expire time.Time, tags []string, cache *cache) {
+	g.forgetError(key)
+	g.forgetSpilled(key)
+	if g.cacheLimit() <= 0 {
 		return
 	}
 
 	bv := ByteView{
-		b: value,
-		e: expire,
+		b:    value,
+		e:    expire,
+		tags: tags,
 	}
 
 	// Ensure no requests are in flight
@@ -512,43 +2738,203 @@ func (g *Group) localSet(key string, value []byte, expire time.Time, cache *cach
 }
 
 func (g *Group) localRemove(key string) {
+	g.forgetError(key)
+	g.forgetSpilled(key)
+	// A load in flight may have read the value before it was removed.
+	g.loadGroup.Forget(key)
 	// Clear key from our local cache
-	if g.cacheBytes <= 0 {
+	if g.cacheLimit() <= 0 {
 		return
 	}
 
+	key = g.storageKey(key)
+	main, hot, _ := g.caches(key)
+
 	// Ensure no requests are in flight
 	g.loadGroup.Lock(func() {
-		g.hotCache.remove(key)
-		g.mainCache.remove(key)
+		hot.remove(key)
+		main.remove(key)
 	})
 }
 
-func (g *Group) populateCache(key string, value ByteView, cache *cache) {
-	if g.cacheBytes <= 0 {
-		return
+// populateCache stores value under key in cache, returning how many
+// entries were evicted to make room for it.
+func (g *Group) populateCache(key string, value ByteView, cache *cache) (evicted int) {
+	if g.cacheLimit() <= 0 {
+		return 0
+	}
+	return g.populateStorageKey(g.storageKey(key), value, cache)
+}
+
+// oversized reports whether value exceeds GroupOptions.MaxValueBytes.
+func (g *Group) oversized(value ByteView) bool {
+	return g.opts.MaxValueBytes > 0 && int64(value.Len()) > g.opts.MaxValueBytes
+}
+
+// populateStorageKey is like populateCache for a key already turned
+// into its storage key. cache, the group's mainCache or hotCache,
+// selects which of the key's caches to populate: with TenantBudgets,
+// the key's tenant may have caches of its own.
+func (g *Group) populateStorageKey(key string, value ByteView, cache *cache) (evicted int) {
+	if g.oversized(value) {
+		g.Stats.OversizedValues.Add(1)
+		return 0
+	}
+	if g.opts.CompressInMemory && value.Len() >= g.opts.CompressMinBytes {
+		value, _ = compressView(value)
+	}
+	value.stored = g.clock().UnixNano()
+	value.gen = atomic.LoadUint64(&g.generation)
+
+	// Only byte slices can be mutated; strings are immutable.
+	if value.b != nil && atomic.LoadInt32(&g.debugImmutable) != 0 {
+		value.sum, value.hasSum = crc32.ChecksumIEEE(value.b), true
+	}
+	main, hot, limit := g.caches(key)
+	if cache == &g.hotCache {
+		cache = hot
+	} else {
+		cache = main
 	}
 	cache.add(key, value)
+	evicted = g.evictOverflow(main, hot, limit)
+	evictGlobal()
+	return evicted
+}
 
-	// Evict items from cache(s) if necessary.
-	for {
-		mainBytes := g.mainCache.bytes()
-		hotBytes := g.hotCache.bytes()
-		if mainBytes+hotBytes <= g.cacheBytes {
-			return
+// isClient reports whether g's PeerPicker is a ClientPeerPicker for a
+// process owning no keys.
+func (g *Group) isClient() bool {
+	cp, ok := g.peers.(ClientPeerPicker)
+	return ok && cp.IsClient()
+}
+
+// errPinLimit is returned by Pin when pinning a key would exceed
+// GroupOptions.MaxPinnedBytes.
+var errPinLimit = errors.New("groupcache: pinning key would exceed MaxPinnedBytes")
+
+// Pin keeps key in the main cache: it is no longer evicted to make
+// room for other keys, although it still expires and can be removed.
+// The pin outlives the value, so that when key is loaded again, for
+// example after it expired, the new value is pinned too. Pin can be
+// called before key is loaded.
+//
+// Pin returns an error if the cached value would take the pinned
+// bytes above GroupOptions.MaxPinnedBytes. A value loaded later that
+// does not fit is cached unpinned.
+//
+// Only the main cache, holding the keys this process owns, honors
+// pins; values mirrored in the hot cache are evicted as usual.
+func (g *Group) Pin(key string) error {
+	key = g.storageKey(key)
+	main, _, _ := g.caches(key)
+	return main.pin(key)
+}
+
+// Unpin undoes Pin, making key evictable again.
+func (g *Group) Unpin(key string) {
+	key = g.storageKey(key)
+	main, _, _ := g.caches(key)
+	main.unpin(key)
+}
+
+// evictOverflow evicts items from main and hot, caches sharing a
+// budget, until their combined size fits within limit. It returns how
+// many items it evicted.
+func (g *Group) evictOverflow(main, hot *cache, limit int64) (evicted int) {
+	for ; ; evicted++ {
+		mainBytes := main.bytes()
+		hotBytes := hot.bytes()
+		if mainBytes+hotBytes <= limit && !g.tooManyEntries(main, hot) {
+			return evicted
 		}
 
 		// TODO(bradfitz): this is good-enough-for-now logic.
 		// It should be something based on measurements and/or
 		// respecting the costs of different resources.
-		victim := &g.mainCache
-		if hotBytes > mainBytes/8 {
-			victim = &g.hotCache
+		victim, other := main, hot
+		if g.split != nil && main == &g.mainCache {
+			if hotBytes > g.split.limit() {
+				victim, other = other, victim
+			}
+		} else if f := g.opts.HotCacheFraction; f > 0 {
+			if hotBytes > int64(f*float64(limit)) {
+				victim, other = other, victim
+			}
+		} else if hotBytes > mainBytes/8 {
+			victim, other = other, victim
+		}
+		// A cache may hold nothing but pinned entries.
+		if !victim.removeOldest() && !other.removeOldest() {
+			return evicted
 		}
-		victim.removeOldest()
 	}
 }
 
+// tooManyEntries reports whether main and hot together hold more
+// entries than GroupOptions.MaxCacheEntries.
+func (g *Group) tooManyEntries(main, hot *cache) bool {
+	max := int64(g.opts.MaxCacheEntries)
+	return max > 0 && main.items()+hot.items() > max
+}
+
+// multiKey is the lru key under which the values appended to a key by
+// Group.Append are stored, keeping them apart from regular entries for
+// the same key.
+type multiKey string
+
+// multiValue is the cache entry holding the values appended to a key,
+// in the order they were appended.
+type multiValue []ByteView
+
+func (m multiValue) size() int64 {
+	var n int64
+	for _, v := range m {
+		n += int64(v.Len())
+	}
+	return n
+}
+
+// EvictionEvents returns the channel on which an event is sent for
+// each entry evicted from the group's caches, or nil unless
+// GroupOptions.EvictionEventBuffer is positive. Events of each cache
+// are sent in the order of eviction, while events of the main and hot
+// caches may interleave in any order. The channel is never closed.
+func (g *Group) EvictionEvents() <-chan EvictionEvent {
+	return g.evictions
+}
+
+// sendEviction sends ev on g.evictions according to the group's
+// OverflowPolicy. It is called with the evicting cache locked.
+func (g *Group) sendEviction(ev EvictionEvent) {
+	if g.opts.EvictionOverflow == BlockOnOverflow {
+		g.evictions <- ev
+		return
+	}
+	select {
+	case g.evictions <- ev:
+	default:
+		g.Stats.EvictionEventsDropped.Add(1)
+	}
+}
+
+// LoadLatency summarizes how long the getter took to load keys, over
+// all keys and since the group was created. It is empty unless
+// GroupOptions.RecordLoadLatency is set.
+func (g *Group) LoadLatency() LatencyStats {
+	if g.loadLatency == nil {
+		return LatencyStats{}
+	}
+	return g.loadLatency.stats()
+}
+
+func (g *Group) clock() time.Time {
+	if g.now != nil {
+		return g.now()
+	}
+	return time.Now()
+}
+
 // CacheType represents a type of cache.
 type CacheType int
 
@@ -563,16 +2949,147 @@ const (
 	HotCache
 )
 
-// CacheStats returns stats about the provided cache within the group.
+// Contains reports whether key is currently held in this process's
+// main or hot cache, and which. It never loads the key, neither from
+// the getter nor from a peer, and does not affect the key's recency or
+// the cache statistics.
+func (g *Group) Contains(key string) (which CacheType, ok bool) {
+	if g.cacheLimit() <= 0 {
+		return 0, false
+	}
+	key = g.storageKey(key)
+	main, hot, _ := g.caches(key)
+	if main.peek(key) {
+		return MainCache, true
+	}
+	if hot.peek(key) {
+		return HotCache, true
+	}
+	return 0, false
+}
+
+// Scan calls f with the key and value of each entry of this process's
+// main and hot caches whose key match reports true for, until f
+// returns false. Keys are storage keys: a key longer than
+// GroupOptions.MaxKeyLength is seen as its digest. Scan never loads
+// keys, and does not affect the recency of entries or the cache
+// statistics. Values appended with Group.Append are skipped.
+//
+// Each cache is locked while match is called for its keys, so match
+// must be quick and must not call into the group. f is called once a
+// cache's matching entries have been collected, with no lock held: it
+// may call into the group, but entries added meanwhile are not
+// visited, and ones removed meanwhile still are.
+func (g *Group) Scan(match func(key string) bool, f func(key string, v ByteView) bool) {
+	if g.cacheLimit() <= 0 {
+		return
+	}
+	mains, hots := g.allCaches()
+	for _, c := range append(mains, hots...) {
+		keys, values := c.matching(match)
+		for i, key := range keys {
+			value, ok := g.cachedView(key, values[i])
+			if !ok {
+				continue
+			}
+			if !f(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// SetGeneration sets the generation under which the group caches
+// values from now on. Values cached under an older generation become
+// misses at once, so bumping the generation, for example on deploy,
+// invalidates the whole cache without iterating over it: Gets load
+// the keys afresh. The old entries still take up memory until they
+// are looked up, which removes them, or evicted as the least recently
+// used. Values appended with Group.Append are not versioned.
+//
+// The group sends its generation to peers with its fetches, and a
+// peer asked under a later generation than its own adopts it before
+// answering, so that bumping the generation of one process, for
+// example after reprocessing a dataset, keeps it from getting values
+// cached under an older one. Other processes only adopt it as they are
+// asked for keys: to invalidate their caches at once, bump it on every
+// peer. The generation starts at 0, and values cached under a later
+// generation than gen stay valid.
+func (g *Group) SetGeneration(gen uint64) {
+	atomic.StoreUint64(&g.generation, gen)
+}
+
+// adoptGeneration raises the group's generation to gen, that of a
+// peer's request, if it is older.
+func (g *Group) adoptGeneration(gen uint64) {
+	for {
+		cur := atomic.LoadUint64(&g.generation)
+		if gen <= cur {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&g.generation, cur, gen) {
+			g.Stats.PeerGenerations.Add(1)
+			return
+		}
+	}
+}
+
+// peerGeneration returns the generation to send peers with requests,
+// or nil while it is 0, as peers assume of requests without one.
+func (g *Group) peerGeneration() *uint64 {
+	if gen := g.Generation(); gen != 0 {
+		return &gen
+	}
+	return nil
+}
+
+// Generation returns the generation set by SetGeneration.
+func (g *Group) Generation() uint64 {
+	return atomic.LoadUint64(&g.generation)
+}
+
+// Touch marks key as recently used in this process's main or hot
+// cache, as a Get would, and if extendTTL is positive makes an entry
+// with an expire time live at least extendTTL from now. Entries
+// without an expire time keep none. It reports whether key was
+// present. Like Contains, it never loads the key, and Touch does not
+// count in the cache statistics.
+func (g *Group) Touch(key string, extendTTL time.Duration) bool {
+	if g.cacheLimit() <= 0 {
+		return false
+	}
+	key = g.storageKey(key)
+	var expire time.Time
+	if extendTTL > 0 {
+		expire = g.clock().Add(extendTTL)
+	}
+	main, hot, _ := g.caches(key)
+	return main.touch(key, expire) || hot.touch(key, expire)
+}
+
+// CacheStats returns stats about the provided cache within the group,
+// adding up those of every tenant's partition with GroupOptions.TenantBudgets.
 func (g *Group) CacheStats(which CacheType) CacheStats {
+	var caches []*cache
 	switch which {
 	case MainCache:
-		return g.mainCache.stats()
+		caches, _ = g.allCaches()
 	case HotCache:
-		return g.hotCache.stats()
+		_, caches = g.allCaches()
 	default:
 		return CacheStats{}
 	}
+	var sum CacheStats
+	for _, c := range caches {
+		cs := c.stats()
+		sum.Bytes += cs.Bytes
+		sum.Items += cs.Items
+		sum.Gets += cs.Gets
+		sum.Hits += cs.Hits
+		sum.Evictions += cs.Evictions
+		sum.PinnedBytes += cs.PinnedBytes
+	}
+	return sum
 }
 
 // cache is a wrapper around an *lru.Cache that adds synchronization,
@@ -584,39 +3101,283 @@ type cache struct {
 	lru        *lru.Cache
 	nhit, nget int64
 	nevict     int64 // number of evictions
+
+	// onEvict, if non-nil, is called with the key and size of each
+	// evicted entry, with mu held.
+	onEvict func(key string, bytes int64)
+
+	// onEvicted, if non-nil, is called with the entries evicted by an
+	// operation after it released mu. Until then they are kept in
+	// detached.
+	onEvicted func(entries []evictedEntry)
+	detached  []evictedEntry
+
+	// replacing is set while add drops the entry it replaces, which
+	// is not an eviction.
+	replacing bool
+
+	// removing is set while remove drops the entries of a key.
+	removing bool
+
+	// pins holds the pinned keys and the bytes of their pinned entry,
+	// which is 0 while the key is not cached or its entry did not fit
+	// within maxPinned.
+	pins        map[string]int64
+	pinnedBytes int64
+	maxPinned   int64
+
+	// maxStale is how long entries are kept after they expire, for
+	// GroupOptions.ServeStaleOnError. Such entries are misses for get
+	// and peek, and only returned by getStale.
+	maxStale time.Duration
+
+	// now, if non-nil, tells the current time entries expire by, for
+	// GroupOptions.Clock.
+	now func() time.Time
+
+	// shared, if non-nil, makes the cache use lru's Clock mode, in
+	// which get only holds mu for reading, and counts its gets and
+	// hits instead of nget and nhit.
+	shared *sharedReads
+
+	// policy selects the entries evicted first, for
+	// GroupOptions.EvictionPolicy. shared takes precedence.
+	policy    lru.Policy
+	segmented bool
+
+	// gen, if non-nil, points to the group's generation. Entries stored
+	// under an older one are misses, which get removes.
+	gen *uint64
+
+	// tagged indexes the keys of the entries stored with tags by
+	// Group.SetWithTags, by tag. See tags.go.
+	tagged map[string]map[string]struct{}
+
+	// backend, if non-nil, stores the bytes of the ByteView entries,
+	// for GroupOptions.NewCacheBackend. See backend.go.
+	backend CacheBackend
+
+	// shards, if non-nil, hold the entries of the cache, which then
+	// keeps none itself, for GroupOptions.CacheShards. See
+	// cacheshard.go.
+	shards []*cache
+}
+
+// current reports whether value was stored under the group's current
+// generation or a later one.
+func (c *cache) current(value ByteView) bool {
+	return c.gen == nil || value.gen >= atomic.LoadUint64(c.gen)
+}
+
+// defaultMaxStale is the default GroupOptions.MaxStale.
+const defaultMaxStale = 5 * time.Minute
+
+// size returns the bytes a cache entry holding v counts besides its
+// key.
+func (v ByteView) size() int64 {
+	n := int64(v.Len()) + int64(len(v.meta))
+	for _, tag := range v.tags {
+		n += int64(len(tag))
+	}
+	return n
 }
 
 func (c *cache) stats() CacheStats {
+	if c.shards != nil {
+		var sum CacheStats
+		for _, s := range c.shards {
+			st := s.stats()
+			sum.Bytes += st.Bytes
+			sum.Items += st.Items
+			sum.Gets += st.Gets
+			sum.Hits += st.Hits
+			sum.Evictions += st.Evictions
+			sum.PinnedBytes += st.PinnedBytes
+		}
+		return sum
+	}
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return CacheStats{
-		Bytes:     c.nbytes,
-		Items:     c.itemsLocked(),
-		Gets:      c.nget,
-		Hits:      c.nhit,
-		Evictions: c.nevict,
+		Bytes:       c.nbytes,
+		Items:       c.itemsLocked(),
+		Gets:        c.nget + c.shared.getsCount(),
+		Hits:        c.nhit + c.shared.hitsCount(),
+		Evictions:   c.nevict,
+		PinnedBytes: c.pinnedBytes,
+	}
+}
+
+// sharedReads counts the gets and hits of a cache in Clock mode,
+// atomically since they hold its lock for reading only.
+type sharedReads struct {
+	gets, hits int64
+}
+
+func (r *sharedReads) getsCount() int64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&r.gets)
+}
+
+func (r *sharedReads) hitsCount() int64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&r.hits)
+}
+
+// unlock releases mu, held for writing, then hands the entries evicted
+// meanwhile to onEvicted.
+func (c *cache) unlock() {
+	detached := c.detached
+	c.detached = nil
+	c.mu.Unlock()
+	if len(detached) > 0 {
+		c.onEvicted(detached)
 	}
 }
 
 func (c *cache) add(key string, value ByteView) {
+	if c.shards != nil {
+		c.shard(key).add(key, value)
+		return
+	}
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
+	c.initLocked()
+	// Drop any entry already stored under key so that its bytes are
+	// not counted twice.
+	c.replacing = true
+	c.lru.Remove(key)
+	c.replacing = false
+	expire := value.Expire()
+	if !expire.IsZero() && c.maxStale > 0 {
+		expire = expire.Add(c.maxStale)
+	}
+	c.lru.Add(key, c.storeLocked(value), expire)
+	c.tagLocked(key, value.tags)
+	bytes := int64(len(key)) + value.size()
+	c.addBytesLocked(bytes)
+	if _, ok := c.pins[key]; ok {
+		c.pinLocked(key, bytes)
+	}
+}
+
+// pin pins key, and its entry if it is cached.
+func (c *cache) pin(key string) error {
+	if c.shards != nil {
+		return c.shard(key).pin(key)
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	c.initLocked()
+	if c.pins == nil {
+		c.pins = make(map[string]int64)
+	}
+	if c.pins[key] > 0 {
+		return nil
+	}
+	if vi, ok := c.lru.Peek(key); ok {
+		if !c.pinLocked(key, int64(len(key))+entrySize(vi)) {
+			return errPinLimit
+		}
+		return nil
+	}
+	c.pins[key] = 0
+	return nil
+}
+
+// pinLocked pins the entry for key, of the given size, if it fits
+// within maxPinned.
+func (c *cache) pinLocked(key string, bytes int64) bool {
+	if c.pinnedBytes+bytes > c.maxPinned {
+		return false
+	}
+	c.lru.Pin(key)
+	c.pins[key] = bytes
+	c.pinnedBytes += bytes
+	return true
+}
+
+func (c *cache) unpin(key string) {
+	if c.shards != nil {
+		c.shard(key).unpin(key)
+		return
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	bytes, ok := c.pins[key]
+	if !ok {
+		return
+	}
+	c.pinnedBytes -= bytes
+	delete(c.pins, key)
+	c.lru.Unpin(key)
+}
+
+func (c *cache) initLocked() {
 	if c.lru == nil {
 		c.lru = &lru.Cache{
+			Clock:     c.shared != nil,
+			Policy:    c.policy,
+			Segmented: c.segmented,
+			Now:       c.now,
 			OnEvicted: func(key lru.Key, value interface{}) {
-				val := value.(ByteView)
-				c.nbytes -= int64(len(key.(string))) + int64(val.Len())
+				var k string
+				var bytes int64
+				var view ByteView
+				isView := false
+				switch val := value.(type) {
+				case ByteView:
+					k = key.(string)
+					bytes = int64(len(k)) + val.size()
+					view, isView = val, true
+				case backedView:
+					k = key.(string)
+					bytes = int64(len(k)) + val.size()
+					view, isView = val.view, true
+					if !c.replacing && c.onEvicted != nil {
+						view = c.loadLocked(val)
+					}
+					c.backend.Free(val.ref)
+				case multiValue:
+					k = string(key.(multiKey))
+					bytes = int64(len(k)) + val.size()
+				}
+				c.addBytesLocked(-bytes)
+				if isView {
+					c.untagLocked(k, view.tags)
+				}
+				if pinned := c.pins[k]; pinned > 0 {
+					c.pinnedBytes -= pinned
+					c.pins[k] = 0
+				}
+				if c.replacing {
+					return
+				}
 				c.nevict++
+				if c.onEvict != nil {
+					c.onEvict(k, bytes)
+				}
+				if isView && c.onEvicted != nil {
+					c.detached = append(c.detached, evictedEntry{key: k, value: view, removed: c.removing})
+				}
 			},
 		}
 	}
-	c.lru.Add(key, value, value.Expire())
-	c.nbytes += int64(len(key)) + int64(value.Len())
 }
 
 func (c *cache) get(key string) (value ByteView, ok bool) {
+	if c.shards != nil {
+		return c.shard(key).get(key)
+	}
+	if c.shared != nil {
+		return c.getShared(key)
+	}
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 	c.nget++
 	if c.lru == nil {
 		return
@@ -625,34 +3386,274 @@ func (c *cache) get(key string) (value ByteView, ok bool) {
 	if !ok {
 		return
 	}
+	value = storedView(vi)
+	if !c.current(value) {
+		c.lru.Remove(key)
+		return ByteView{}, false
+	}
+	if c.maxStale > 0 && c.expired(value) {
+		return ByteView{}, false
+	}
+	c.nhit++
+	return c.loadLocked(vi), true
+}
+
+// expired reports whether value has an expire time that has passed.
+func (c *cache) expired(value ByteView) bool {
+	if c.now == nil {
+		return value.expired()
+	}
+	return !value.e.IsZero() && value.e.Before(c.now())
+}
+
+// getShared is get for caches in Clock mode. Entries of an older
+// generation are left for eviction to reclaim, since removing them
+// would take mu for writing.
+func (c *cache) getShared(key string) (value ByteView, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	atomic.AddInt64(&c.shared.gets, 1)
+	if c.lru == nil {
+		return
+	}
+	vi, ok := c.lru.Get(key)
+	if !ok {
+		return
+	}
+	value = storedView(vi)
+	if !c.current(value) || c.maxStale > 0 && c.expired(value) {
+		return ByteView{}, false
+	}
+	atomic.AddInt64(&c.shared.hits, 1)
+	return c.loadLocked(vi), true
+}
+
+// getStale returns the entry for key even if it expired, as long as it
+// is kept for maxStale.
+func (c *cache) getStale(key string) (value ByteView, ok bool) {
+	if c.shards != nil {
+		return c.shard(key).getStale(key)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lru == nil {
+		return
+	}
+	vi, ok := c.lru.Peek(key)
+	if !ok || !c.current(storedView(vi)) {
+		return
+	}
+	return c.loadLocked(vi), true
+}
+
+// peek reports whether key is present, without promoting it.
+func (c *cache) peek(key string) bool {
+	_, ok := c.peekValue(key)
+	return ok
+}
+
+// peekValue is like peek but also returns the value, as stored.
+func (c *cache) peekValue(key string) (ByteView, bool) {
+	if c.shards != nil {
+		return c.shard(key).peekValue(key)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lru == nil {
+		return ByteView{}, false
+	}
+	vi, ok := c.lru.Peek(key)
+	if !ok || !c.current(storedView(vi)) {
+		return ByteView{}, false
+	}
+	if c.maxStale > 0 && c.expired(storedView(vi)) {
+		return ByteView{}, false
+	}
+	return c.loadLocked(vi), true
+}
+
+// touch promotes the entry for key like a hit, without counting it in
+// the stats, and pushes its expire time back to expire if that is
+// later. It reports whether key was present.
+func (c *cache) touch(key string, expire time.Time) bool {
+	if c.shards != nil {
+		return c.shard(key).touch(key, expire)
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	if c.lru == nil {
+		return false
+	}
+	vi, ok := c.lru.Peek(key)
+	if !ok {
+		return false
+	}
+	value := storedView(vi)
+	if !c.current(value) || c.maxStale > 0 && c.expired(value) {
+		return false
+	}
+	c.lru.Get(key)
+	if value.e.IsZero() || !expire.After(value.e) {
+		return true
+	}
+	vi = withExpire(vi, expire)
+	if c.maxStale > 0 {
+		expire = expire.Add(c.maxStale)
+	}
+	c.lru.Add(key, vi, expire)
+	c.lru.SetExpire(key, expire)
+	return true
+}
+
+// entries returns the unexpired keys and values of the current
+// generation in the cache, most recently used first.
+func (c *cache) entries() (keys []string, values []ByteView) {
+	return c.matching(nil)
+}
+
+// matching is like entries but only returns the keys for which match,
+// if non-nil, returns true. match is called with the cache locked.
+func (c *cache) matching(match func(key string) bool) (keys []string, values []ByteView) {
+	if c.shards != nil {
+		for _, s := range c.shards {
+			k, v := s.matching(match)
+			keys, values = append(keys, k...), append(values, v...)
+		}
+		return keys, values
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	if c.lru == nil {
+		return nil, nil
+	}
+	c.lru.Range(func(key lru.Key, value interface{}) bool {
+		k, ok := key.(string)
+		if ok && (match == nil || match(k)) && c.current(storedView(value)) {
+			keys = append(keys, k)
+			values = append(values, c.loadLocked(value))
+		}
+		return true
+	})
+	return keys, values
+}
+
+// appendValue adds value to the end of the multi-value entry for key,
+// creating the entry if necessary.
+func (c *cache) appendValue(key string, value ByteView) {
+	if c.shards != nil {
+		c.shard(key).appendValue(key, value)
+		return
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	c.initLocked()
+	var values multiValue
+	if vi, ok := c.lru.Get(multiKey(key)); ok {
+		values = vi.(multiValue)
+	} else {
+		c.addBytesLocked(int64(len(key)))
+	}
+	c.lru.Add(multiKey(key), append(values, value), time.Time{})
+	c.addBytesLocked(int64(value.Len()))
+}
+
+// getMulti returns a copy of the values of the multi-value entry for key.
+func (c *cache) getMulti(key string) (values []ByteView, ok bool) {
+	if c.shards != nil {
+		return c.shard(key).getMulti(key)
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	c.nget++
+	if c.lru == nil {
+		return
+	}
+	vi, ok := c.lru.Get(multiKey(key))
+	if !ok {
+		return
+	}
 	c.nhit++
-	return vi.(ByteView), true
+	return append([]ByteView(nil), vi.(multiValue)...), true
 }
 
 func (c *cache) remove(key string) {
+	if c.shards != nil {
+		c.shard(key).remove(key)
+		return
+	}
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 	if c.lru == nil {
 		return
 	}
+	c.removing = true
 	c.lru.Remove(key)
+	c.lru.Remove(multiKey(key))
+	c.removing = false
+}
+
+// clear removes every entry, pinned ones included, as remove does.
+func (c *cache) clear() {
+	if c.shards != nil {
+		for _, s := range c.shards {
+			s.clear()
+		}
+		return
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	if c.lru == nil {
+		return
+	}
+	c.removing = true
+	c.lru.Clear()
+	c.removing = false
 }
 
-func (c *cache) removeOldest() {
+// removeOldest removes the oldest unpinned entry, reporting whether
+// there was one.
+func (c *cache) removeOldest() bool {
+	if c.shards != nil {
+		return c.removeOldestShard()
+	}
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.lru != nil {
-		c.lru.RemoveOldest()
+	defer c.unlock()
+	if c.lru == nil {
+		return false
 	}
+	n := c.lru.Len()
+	c.lru.RemoveOldest()
+	return c.lru.Len() < n
+}
+
+// addBytesLocked adds n to the bytes held by c, and by the caches of
+// all groups for SetGlobalCacheLimit.
+func (c *cache) addBytesLocked(n int64) {
+	c.nbytes += n
+	atomic.AddInt64(&globalCachedBytes, n)
 }
 
 func (c *cache) bytes() int64 {
+	if c.shards != nil {
+		var n int64
+		for _, s := range c.shards {
+			n += s.bytes()
+		}
+		return n
+	}
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return c.nbytes
 }
 
 func (c *cache) items() int64 {
+	if c.shards != nil {
+		var n int64
+		for _, s := range c.shards {
+			n += s.items()
+		}
+		return n
+	}
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return c.itemsLocked()
@@ -687,11 +3688,17 @@ func (i *AtomicInt) String() string {
 	return strconv.FormatInt(i.Get(), 10)
 }
 
+// MarshalJSON atomically encodes the value of i as a JSON number.
+func (i *AtomicInt) MarshalJSON() ([]byte, error) {
+	return strconv.AppendInt(nil, i.Get(), 10), nil
+}
+
 // CacheStats are returned by stats accessors on Group.
 type CacheStats struct {
-	Bytes     int64
-	Items     int64
-	Gets      int64
-	Hits      int64
-	Evictions int64
+	Bytes       int64
+	Items       int64
+	Gets        int64
+	Hits        int64
+	Evictions   int64
+	PinnedBytes int64
 }
@@ -19,11 +19,17 @@ limitations under the License.
 package groupcache
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -32,8 +38,11 @@ import (
 	"github.com/golang/protobuf/proto"
 
 	pb "github.com/melojustme/groupcache/groupcachepb"
+	"github.com/melojustme/groupcache/singleflight"
 
 	testpb "github.com/melojustme/groupcache/testpb"
+
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -210,6 +219,42 @@ func TestCachingExpire(t *testing.T) {
 	}
 }
 
+func TestDefaultTTL(t *testing.T) {
+	var loads int
+	g := newGroupOpts("TestDefaultTTL-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads++
+		if key == "expiring" {
+			return dest.SetString("value", time.Now().Add(time.Hour))
+		}
+		return dest.SetString("value", time.Time{})
+	}), NoPeers{}, &GroupOptions{DefaultTTL: 100 * time.Millisecond})
+
+	var v ByteView
+	start := time.Now()
+	if err := g.Get(dummyCtx, "key", ByteViewSink(&v), nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := v.Expire(); e.Before(start.Add(100*time.Millisecond)) || e.After(time.Now().Add(100*time.Millisecond)) {
+		t.Errorf("Expire = %v; want 100ms after the load", e)
+	}
+	if err := g.Get(dummyCtx, "expiring", ByteViewSink(&v), nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := v.Expire(); e.Before(start.Add(time.Hour)) {
+		t.Errorf("Expire of a value with its own = %v; want it kept", e)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	for _, key := range []string{"key", "expiring"} {
+		if err := g.Get(dummyCtx, key, ByteViewSink(&v), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != 3 {
+		t.Errorf("loads = %d; want 3, the expired value loaded again", loads)
+	}
+}
+
 func TestCacheEviction(t *testing.T) {
 	once.Do(testSetup)
 	testKey := "TestCacheEviction-key"
@@ -272,6 +317,16 @@ func (p *fakePeer) Set(_ context.Context, in *pb.SetRequest) error {
 	return nil
 }
 
+// GetOrSet reports the value Get returns, as if the peer held it.
+func (p *fakePeer) GetOrSet(_ context.Context, in *pb.SetRequest, out *pb.GetResponse) error {
+	p.hits++
+	if p.fail {
+		return errors.New("simulated error from peer")
+	}
+	out.Value = []byte("got:" + in.GetKey())
+	return nil
+}
+
 func (p *fakePeer) Remove(_ context.Context, in *pb.GetRequest) error {
 	p.hits++
 	if p.fail {
@@ -280,6 +335,43 @@ func (p *fakePeer) Remove(_ context.Context, in *pb.GetRequest) error {
 	return nil
 }
 
+func (p *fakePeer) RemoveTag(_ context.Context, in *pb.GetRequest) error {
+	p.hits++
+	if p.fail {
+		return errors.New("simulated error from peer")
+	}
+	return nil
+}
+
+func (p *fakePeer) Exists(_ context.Context, in *pb.GetRequest) (bool, error) {
+	p.hits++
+	if p.fail {
+		return false, errors.New("simulated error from peer")
+	}
+	return false, nil
+}
+
+// Checksum reports the checksum of the value Get returns.
+func (p *fakePeer) Checksum(_ context.Context, in *pb.GetRequest) (uint32, bool, error) {
+	p.hits++
+	if p.fail {
+		return 0, false, errors.New("simulated error from peer")
+	}
+	return crc32.ChecksumIEEE([]byte("got:" + in.GetKey())), true, nil
+}
+
+// GetMulti reports the values Get returns, counting a single hit.
+func (p *fakePeer) GetMulti(_ context.Context, in *pb.GetMultiRequest, out *pb.GetMultiResponse) error {
+	p.hits++
+	if p.fail {
+		return errors.New("simulated error from peer")
+	}
+	for _, key := range in.Keys {
+		out.Values = append(out.Values, &pb.GetResponse{Value: []byte("got:" + key)})
+	}
+	return nil
+}
+
 func (p *fakePeer) GetURL() string {
 	return "fakePeer"
 }
@@ -298,6 +390,104 @@ func (p fakePeers) GetAll() []ProtoGetter {
 	return p
 }
 
+// keyPeers routes each of its keys to its peer, and the others to none.
+type keyPeers map[string]ProtoGetter
+
+func (p keyPeers) PickPeer(key string) (ProtoGetter, bool) {
+	peer, ok := p[key]
+	return peer, ok
+}
+
+func (p keyPeers) GetAll() []ProtoGetter {
+	var all []ProtoGetter
+	for _, peer := range p {
+		all = append(all, peer)
+	}
+	return all
+}
+
+func TestGetOrSet(t *testing.T) {
+	var loads AtomicInt
+	peer := &fakePeer{}
+	g := newGroup("TestGetOrSet-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("loaded:"+key, time.Time{})
+	}), keyPeers{"remote": peer})
+
+	var s string
+	if err := g.Get(dummyCtx, "cached", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.GetOrSet(dummyCtx, "cached", StringSink(&s), []byte("supplied")); err != nil || s != "loaded:cached" {
+		t.Errorf("GetOrSet(cached) = %q, %v; want the cached loaded:cached", s, err)
+	}
+	if err := g.GetOrSet(dummyCtx, "missing", StringSink(&s), []byte("supplied")); err != nil || s != "supplied" {
+		t.Errorf("GetOrSet(missing) = %q, %v; want the supplied value", s, err)
+	}
+	if err := g.Get(dummyCtx, "missing", StringSink(&s), nil); err != nil || s != "supplied" {
+		t.Errorf("Get after GetOrSet = %q, %v; want the supplied value", s, err)
+	}
+	if got := loads.Get(); got != 1 {
+		t.Errorf("getter loads = %d; want 1, for the first Get only", got)
+	}
+	if err := g.GetOrSet(dummyCtx, "remote", StringSink(&s), []byte("supplied")); err != nil || s != "got:remote" || peer.hits != 1 {
+		t.Errorf("GetOrSet(remote) = %q, %v after %d peer hits; want the owner's got:remote", s, err, peer.hits)
+	}
+
+	// Concurrent misses all return the one value that was stored.
+	const n = 10
+	results := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var s string
+			if err := g.GetOrSet(dummyCtx, "contended", StringSink(&s), []byte(fmt.Sprint("value-", i))); err != nil {
+				t.Error(err)
+			}
+			results <- s
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	if err := g.Get(dummyCtx, "contended", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	for got := range results {
+		if got != s {
+			t.Errorf("concurrent GetOrSet returned %q; want the stored %q", got, s)
+		}
+	}
+	if !strings.HasPrefix(s, "value-") {
+		t.Errorf("stored value %q is not one of the supplied ones", s)
+	}
+}
+
+func TestSetPeerPicker(t *testing.T) {
+	once.Do(testSetup)
+	peer := &fakePeer{}
+	g := NewGroup("TestSetPeerPicker-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("local:"+key, time.Time{})
+	}))
+	g.SetPeerPicker(keyPeers{"routed": peer})
+
+	var s string
+	if err := g.Get(dummyCtx, "routed", StringSink(&s), nil); err != nil || s != "got:routed" || peer.hits != 1 {
+		t.Errorf("Get(routed) = %q, %v, after %d peer hits; want the peer's got:routed", s, err, peer.hits)
+	}
+	if err := g.Get(dummyCtx, "local", StringSink(&s), nil); err != nil || s != "local:local" || peer.hits != 1 {
+		t.Errorf("Get(local) = %q, %v; want a local load", s, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("SetPeerPicker after the group was used did not panic")
+		}
+	}()
+	g.SetPeerPicker(NoPeers{})
+}
+
 // tests that peers (virtual, in-process) are hit, and how much.
 func TestPeers(t *testing.T) {
 	once.Do(testSetup)
@@ -388,6 +578,141 @@ func TestTruncatingByteSliceTarget(t *testing.T) {
 	}
 }
 
+func TestSinkReuse(t *testing.T) {
+	once.Do(testSetup)
+	var s string
+	var view ByteView
+	alloc, trunc := []byte(nil), make([]byte, 12)
+	sinks := []struct {
+		sink Sink
+		got  func() string
+		max  int // bytes the sink keeps, if positive
+	}{
+		{StringSink(&s), func() string { return s }, 0},
+		{ByteViewSink(&view), func() string { return view.String() }, 0},
+		{AllocatingByteSliceSink(&alloc), func() string { return string(alloc) }, 0},
+		{TruncatingByteSliceSink(&trunc), func() string { return string(trunc) }, len(trunc)},
+	}
+	// The keys get shorter, then longer again, so that a truncating
+	// sink would cut the last one short if it were not reset.
+	for _, key := range []string{"reuse-long", "r", "reuse"} {
+		for i, tt := range sinks {
+			if err := stringGroup.Get(dummyCtx, key, tt.sink, nil); err != nil {
+				t.Fatal(err)
+			}
+			want := "ECHO:" + key
+			if tt.max > 0 && len(want) > tt.max {
+				want = want[:tt.max]
+			}
+			if tt.got() != want {
+				t.Errorf("sink %d: Get(%q) = %q; want %q", i, key, tt.got(), want)
+			}
+		}
+	}
+
+	// A getter that sets nothing must not cache the value the sink
+	// held for the previous Get.
+	g := newGroup("TestSinkReuse-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return nil
+	}), NoPeers{})
+	sink := StringSink(&s)
+	if err := stringGroup.Get(dummyCtx, "reuse", sink, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Get(dummyCtx, "unset", sink, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Get(dummyCtx, "unset", ByteViewSink(&view), nil); err != nil || view.Len() != 0 {
+		t.Errorf("value cached for a getter setting none = %q, %v; want empty", view.String(), err)
+	}
+}
+
+func TestChecksumSink(t *testing.T) {
+	once.Do(testSetup)
+	want := func(v string) []byte {
+		sum := sha256.Sum256([]byte(v))
+		return sum[:]
+	}
+
+	// Loaded by the getter, then served from the cache through setView.
+	for i := 0; i < 2; i++ {
+		var s string
+		sink := ChecksumSink(StringSink(&s), sha256.New())
+		if err := stringGroup.Get(dummyCtx, "checksum", sink, nil); err != nil {
+			t.Fatal(err)
+		}
+		if s != "ECHO:checksum" {
+			t.Errorf("inner sink got %q; want %q", s, "ECHO:checksum")
+		}
+		if got := sink.Sum(); !bytes.Equal(got, want(s)) {
+			t.Errorf("Get %d: Sum = %x; want %x", i, got, want(s))
+		}
+	}
+
+	var dst []byte
+	sink := ChecksumSink(AllocatingByteSliceSink(&dst), sha256.New())
+	sink.SetBytes([]byte("first"), time.Time{})
+	if err := sink.SetString("second", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if string(dst) != "second" {
+		t.Errorf("inner sink got %q; want %q", dst, "second")
+	}
+	if got := sink.Sum(); !bytes.Equal(got, want("second")) {
+		t.Errorf("Sum after a second Set = %x; want the hash of that value only", got)
+	}
+
+	m := &testpb.TestMessage{Name: proto.String("checksum")}
+	enc, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got testpb.TestMessage
+	sink = ChecksumSink(ProtoSink(&got), sha256.New())
+	if err := sink.SetProto(m, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got.GetName() != "checksum" {
+		t.Errorf("inner proto sink got name %q; want %q", got.GetName(), "checksum")
+	}
+	if sum := sink.Sum(); !bytes.Equal(sum, want(string(enc))) {
+		t.Errorf("SetProto: Sum = %x; want the hash of the encoding, %x", sum, want(string(enc)))
+	}
+}
+
+func TestReaderSink(t *testing.T) {
+	once.Do(testSetup)
+	// Loaded by the getter, then served from the cache through setView.
+	for i := 0; i < 2; i++ {
+		var r io.Reader
+		if err := stringGroup.Get(dummyCtx, "reader", ReaderSink(&r), nil); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := r.(io.WriterTo).WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != "ECHO:reader" {
+			t.Errorf("Get %d read %q; want %q", i, got, "ECHO:reader")
+		}
+	}
+
+	var r io.Reader
+	sink := ReaderSink(&r)
+	b := []byte("bytes")
+	if err := sink.SetBytes(b, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	b[0] = 'X'
+	if got, _ := ioutil.ReadAll(r); string(got) != "bytes" {
+		t.Errorf("read %q after modifying the bytes set; want %q", got, "bytes")
+	}
+	sink.Reset()
+	if r != nil {
+		t.Errorf("reader after Reset = %v; want nil", r)
+	}
+}
+
 func TestAllocatingByteSliceTarget(t *testing.T) {
 	var dst []byte
 	sink := AllocatingByteSliceSink(&dst)
@@ -419,7 +744,7 @@ type orderedFlightGroup struct {
 	mu     sync.Mutex
 	stage1 chan bool
 	stage2 chan bool
-	orig   flightGroup
+	orig   FlightGroup
 }
 
 func (g *orderedFlightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
@@ -430,6 +755,14 @@ func (g *orderedFlightGroup) Do(key string, fn func() (interface{}, error)) (int
 	return g.orig.Do(key, fn)
 }
 
+func (g *orderedFlightGroup) DoChan(key string, fn func() (interface{}, error)) <-chan singleflight.Result {
+	return g.orig.DoChan(key, fn)
+}
+
+func (g *orderedFlightGroup) Forget(key string) {
+	g.orig.Forget(key)
+}
+
 func (g *orderedFlightGroup) Lock(fn func()) {
 	fn()
 }
@@ -536,3 +869,2577 @@ func TestContextDeadlineOnPeer(t *testing.T) {
 		}
 	}
 }
+
+func TestGetBorrowConcurrentEviction(t *testing.T) {
+	g := newGroup("TestGetBorrow-group", 1<<10, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetBytes([]byte("borrowed:"+key), time.Time{})
+	}), NoPeers{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("key-%d-%d", i, j%20)
+				view, release, err := g.GetBorrow(dummyCtx, key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// Flood the small cache so the borrowed entry is evicted
+				// while the view is still held.
+				for k := 0; k < 10; k++ {
+					var s string
+					g.Get(dummyCtx, fmt.Sprintf("flood-%d-%d-%d", i, j, k), StringSink(&s), nil)
+				}
+				if want := "borrowed:" + key; !view.EqualString(want) {
+					t.Errorf("borrowed view = %q; want %q", view.String(), want)
+				}
+				release()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := g.Stats.BorrowedViews.Get(); n != 0 {
+		t.Errorf("BorrowedViews = %d after all releases; want 0", n)
+	}
+}
+
+func TestGetReader(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789abcdef"), 256<<10) // 4MB
+	g := newGroup("TestGetReader-group", 5<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		if key == "missing" {
+			return ErrNotFound
+		}
+		return dest.SetBytes(value, time.Time{})
+	}), NoPeers{})
+
+	r, err := g.GetReader(dummyCtx, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := g.Stats.BorrowedViews.Get(); n != 1 {
+		t.Errorf("BorrowedViews with a reader open = %d; want 1", n)
+	}
+	// Evicting the entry leaves the reader's bytes intact.
+	g.localRemove("big")
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(r, head); err != nil || !bytes.Equal(head, value[:10]) {
+		t.Fatalf("first read = %q, %v; want %q", head, err, value[:10])
+	}
+	var rest bytes.Buffer
+	if n, err := io.Copy(&rest, r); err != nil || n != int64(len(value)-10) {
+		t.Fatalf("io.Copy = %d, %v; want %d, nil", n, err, len(value)-10)
+	}
+	if !bytes.Equal(rest.Bytes(), value[10:]) {
+		t.Error("streamed value differs from the loaded value")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := g.Stats.BorrowedViews.Get(); n != 0 {
+		t.Errorf("BorrowedViews after Close = %d; want 0", n)
+	}
+
+	if r, err := g.GetReader(dummyCtx, "missing"); !errors.Is(err, ErrNotFound) || r != nil {
+		t.Errorf("GetReader of a missing key = %v, %v; want nil, ErrNotFound", r, err)
+	}
+}
+
+func BenchmarkGetAllocatingSink(b *testing.B) {
+	g := newGroup("BenchmarkGetAllocatingSink-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetBytes(make([]byte, 4096), time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var buf []byte
+		if err := g.Get(dummyCtx, "key", AllocatingByteSliceSink(&buf), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetBorrow(b *testing.B) {
+	g := newGroup("BenchmarkGetBorrow-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetBytes(make([]byte, 4096), time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, release, err := g.GetBorrow(dummyCtx, "key")
+		if err != nil {
+			b.Fatal(err)
+		}
+		release()
+	}
+}
+
+func newCacheHitGroup(name string) *Group {
+	return newGroupOpts(name, cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), prefixPeers{&fakePeer{}}, &GroupOptions{HotCacheMinPeerFetches: 1})
+}
+
+// TestGetCacheHitAllocs guards the cache hit path of Get, which must
+// return before load builds its closure or joins a singleflight call.
+// Measured when the test was added: 0 allocations for hits in either
+// cache, before and after.
+func TestGetCacheHitAllocs(t *testing.T) {
+	g := newCacheHitGroup("TestGetCacheHitAllocs-group")
+	var v ByteView
+	sink := ByteViewSink(&v)
+	for _, key := range []string{"local", "remote-key"} {
+		if err := g.Get(dummyCtx, key, sink, nil); err != nil {
+			t.Fatal(err)
+		}
+		which, _ := g.Contains(key)
+		loads := g.Stats.Loads.Get()
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := g.Get(dummyCtx, key, sink, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("Get of %s, a %v hit, allocates %v times; want 0", key, which, allocs)
+		}
+		if got := g.Stats.Loads.Get(); got != loads {
+			t.Errorf("Get of %s, a %v hit, loaded %d times", key, which, got-loads)
+		}
+	}
+}
+
+func benchmarkGetCacheHit(b *testing.B, key string) {
+	g := newCacheHitGroup("BenchmarkGetCacheHit-" + key + "-group")
+	defer DeregisterGroup(g.Name())
+	var v ByteView
+	sink := ByteViewSink(&v)
+	if err := g.Get(dummyCtx, key, sink, nil); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := g.Get(dummyCtx, key, sink, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetMainCacheHit(b *testing.B) { benchmarkGetCacheHit(b, "local") }
+func BenchmarkGetHotCacheHit(b *testing.B)  { benchmarkGetCacheHit(b, "remote-key") }
+
+func TestWarm(t *testing.T) {
+	const concurrency = 3
+	var active, maxActive AtomicInt
+	var mu sync.Mutex
+	g := newGroup("TestWarm-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		mu.Lock()
+		active.Add(1)
+		if n := active.Get(); n > maxActive.Get() {
+			maxActive.Store(n)
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		active.Add(-1)
+		if strings.HasPrefix(key, "bad") {
+			return errors.New("no such key")
+		}
+		return dest.SetString("warm:"+key, time.Time{})
+	}), NoPeers{})
+
+	keys := []string{"a", "b", "bad1", "c", "d", "bad2", "e", "f", "g", "h"}
+	var calls AtomicInt
+	err := g.WarmWithProgress(context.Background(), keys, concurrency, func(done, total int) {
+		calls.Add(1)
+		if total != len(keys) {
+			t.Errorf("progress total = %d; want %d", total, len(keys))
+		}
+	})
+
+	werr, ok := err.(*WarmError)
+	if !ok {
+		t.Fatalf("Warm error = %v; want *WarmError", err)
+	}
+	if len(werr.Errors) != 2 || werr.Errors["bad1"] == nil || werr.Errors["bad2"] == nil {
+		t.Errorf("Warm errors = %v; want errors for bad1 and bad2", werr.Errors)
+	}
+	if got := maxActive.Get(); got > concurrency {
+		t.Errorf("max concurrent loads = %d; want at most %d", got, concurrency)
+	}
+	if got := calls.Get(); got != int64(len(keys)) {
+		t.Errorf("progress called %d times; want %d", got, len(keys))
+	}
+	if _, ok := g.mainCache.get("h"); !ok {
+		t.Error("warmed key not in main cache")
+	}
+}
+
+func TestWarmCancel(t *testing.T) {
+	g := newGroup("TestWarmCancel-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		time.Sleep(20 * time.Millisecond)
+		return dest.SetString("warm:"+key, time.Time{})
+	}), NoPeers{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := g.Warm(ctx, testKeys(100), 1); err != context.DeadlineExceeded {
+		t.Errorf("Warm error = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if n := g.mainCache.items(); n >= 100 {
+		t.Errorf("warmed %d keys after cancellation; want fewer", n)
+	}
+}
+
+func TestDebugImmutability(t *testing.T) {
+	g := newGroup("TestDebugImmutability-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetBytes([]byte("immutable:"+key), time.Time{})
+	}), NoPeers{})
+	g.SetDebugImmutability(true)
+
+	view, release, err := g.GetBorrow(dummyCtx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reads of an unchanged value pass verification.
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a caller scribbling over memory shared with the cache.
+	view.b[0] = 'X'
+	release()
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("mutation of cached value went undetected")
+		}
+		if msg, _ := r.(string); !strings.Contains(msg, "mutated") {
+			t.Errorf("panic = %v; want mutation report", r)
+		}
+	}()
+	g.Get(dummyCtx, "key", StringSink(&s), nil)
+}
+
+func TestAppend(t *testing.T) {
+	g := newGroup("TestAppend-group", 64, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("single:"+key, time.Time{})
+	}), NoPeers{})
+
+	for _, v := range []string{"one", "two", "three"} {
+		if err := g.Append(dummyCtx, "set", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values, err := g.GetAll(dummyCtx, "set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range values {
+		got = append(got, v.String())
+	}
+	if want := []string{"one", "two", "three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetAll = %q; want %q", got, want)
+	}
+	if want := int64(len("set") + len("onetwothree")); g.mainCache.bytes() != want {
+		t.Errorf("cache has %d bytes; want %d", g.mainCache.bytes(), want)
+	}
+
+	// A single value for the same key lives alongside the list.
+	var s string
+	if err := g.Get(dummyCtx, "set", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s != "single:set" {
+		t.Errorf("Get = %q; want %q", s, "single:set")
+	}
+
+	// Growing another list past the budget evicts the whole oldest entry.
+	for i := 0; i < 10; i++ {
+		if err := g.Append(dummyCtx, "other", []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.mainCache.bytes() > 64 {
+		t.Errorf("cache has %d bytes; want at most 64", g.mainCache.bytes())
+	}
+	if values, _ := g.GetAll(dummyCtx, "set"); len(values) != 0 {
+		t.Errorf("GetAll after eviction = %d values; want 0", len(values))
+	}
+}
+
+func TestContains(t *testing.T) {
+	var loads int
+	g := newGroup("TestContains-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads++
+		return dest.SetString("contains:"+key, time.Time{})
+	}), NoPeers{})
+
+	g.populateCache("main-key", ByteView{s: "main"}, &g.mainCache)
+	g.populateCache("hot-key", ByteView{s: "hot"}, &g.hotCache)
+
+	tests := []struct {
+		key   string
+		which CacheType
+		ok    bool
+	}{
+		{"main-key", MainCache, true},
+		{"hot-key", HotCache, true},
+		{"absent-key", 0, false},
+	}
+	for _, tt := range tests {
+		which, ok := g.Contains(tt.key)
+		if which != tt.which || ok != tt.ok {
+			t.Errorf("Contains(%q) = %v, %v; want %v, %v", tt.key, which, ok, tt.which, tt.ok)
+		}
+	}
+	if loads != 0 {
+		t.Errorf("Contains triggered %d loads; want 0", loads)
+	}
+	if gets := g.mainCache.stats().Gets; gets != 0 {
+		t.Errorf("Contains counted %d cache gets; want 0", gets)
+	}
+}
+
+func TestScan(t *testing.T) {
+	g := newGroup("TestScan-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("scan:"+key, time.Time{})
+	}), NoPeers{})
+	g.populateCache("user:1", ByteView{s: "one"}, &g.mainCache)
+	g.populateCache("user:2", ByteView{s: "two"}, &g.mainCache)
+	g.populateCache("user:3", ByteView{s: "three"}, &g.hotCache)
+	g.populateCache("order:1", ByteView{s: "order"}, &g.mainCache)
+	// The oldest entry is the first to go, unless Scan promoted it.
+	oldest, _ := g.mainCache.entries()
+
+	isUser := func(key string) bool { return strings.HasPrefix(key, "user:") }
+	visited := map[string]string{}
+	g.Scan(isUser, func(key string, v ByteView) bool {
+		visited[key] = v.String()
+		return true
+	})
+	want := map[string]string{"user:1": "one", "user:2": "two", "user:3": "three"}
+	if fmt.Sprint(visited) != fmt.Sprint(want) {
+		t.Errorf("Scan visited %v; want %v", visited, want)
+	}
+	if after, _ := g.mainCache.entries(); fmt.Sprint(after) != fmt.Sprint(oldest) {
+		t.Errorf("main cache order after Scan = %v; want it unchanged from %v", after, oldest)
+	}
+	if gets := g.mainCache.stats().Gets + g.hotCache.stats().Gets; gets != 0 {
+		t.Errorf("Scan counted %d cache gets; want 0", gets)
+	}
+
+	n := 0
+	g.Scan(isUser, func(key string, v ByteView) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Scan called f %d times after it returned false; want 1", n)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	var loads int
+	g := newGroup("TestTouch-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads++
+		return dest.SetString("touch:"+key, time.Time{})
+	}), NoPeers{})
+
+	soon := time.Now().Add(50 * time.Millisecond)
+	g.populateCache("a", ByteView{s: "a", e: soon}, &g.mainCache)
+	g.populateCache("b", ByteView{s: "b", e: soon}, &g.mainCache)
+	g.populateCache("hot", ByteView{s: "hot"}, &g.hotCache)
+
+	if !g.Touch("a", 0) {
+		t.Error("Touch(a) = false; want true")
+	}
+	if keys, _ := g.mainCache.entries(); fmt.Sprint(keys) != "[a b]" {
+		t.Errorf("main cache keys after Touch(a) = %v; want [a b]", keys)
+	}
+	if !g.Touch("hot", time.Hour) {
+		t.Error("Touch(hot) = false; want true")
+	}
+	if v, _ := g.hotCache.get("hot"); !v.Expire().IsZero() {
+		t.Errorf("Touch gave an entry without expiry an expire time of %v", v.Expire())
+	}
+	if g.Touch("absent", time.Hour) {
+		t.Error("Touch(absent) = true; want false")
+	}
+	if _, ok := g.Contains("absent"); ok {
+		t.Error("Touch cached an absent key")
+	}
+
+	// Extending "a" keeps it past its original expiry, unlike "b".
+	if !g.Touch("a", time.Hour) {
+		t.Error("Touch(a, time.Hour) = false; want true")
+	}
+	if v, _ := g.mainCache.get("a"); !v.Expire().After(soon) {
+		t.Errorf("expire time after Touch(a, time.Hour) = %v; want after %v", v.Expire(), soon)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := g.Contains("a"); !ok {
+		t.Error("extended entry expired")
+	}
+	if _, ok := g.Contains("b"); ok {
+		t.Error("unextended entry did not expire")
+	}
+	if g.Touch("b", time.Hour) {
+		t.Error("Touch revived an expired entry")
+	}
+	if loads != 0 {
+		t.Errorf("Touch triggered %d loads; want 0", loads)
+	}
+}
+
+func TestReusedBuffersDoNotCorruptCache(t *testing.T) {
+	// The getter and the caller of Set both reuse buf once they are
+	// done with it.
+	buf := []byte("original")
+	g := newGroup("TestReusedBuffersDoNotCorruptCache-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		copy(buf, "original")
+		return dest.SetBytes(buf, time.Time{})
+	}), NoPeers{})
+
+	var s string
+	var bv ByteView
+	var alloc []byte
+	trunc := make([]byte, 16)
+	sinks := map[string]Sink{
+		"StringSink":              StringSink(&s),
+		"ByteViewSink":            ByteViewSink(&bv),
+		"AllocatingByteSliceSink": AllocatingByteSliceSink(&alloc),
+		"TruncatingByteSliceSink": TruncatingByteSliceSink(&trunc),
+	}
+	for name, sink := range sinks {
+		if err := g.Get(dummyCtx, "get-"+name, sink, nil); err != nil {
+			t.Fatal(err)
+		}
+		copy(buf, "CLOBBERD")
+		if v, ok := g.mainCache.get("get-" + name); !ok || !v.EqualString("original") {
+			t.Errorf("%s: cached value after the getter reused its buffer = %q, %v; want %q", name, v.String(), ok, "original")
+		}
+	}
+
+	copy(buf, "original")
+	if err := g.Set(dummyCtx, "set", buf, time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	copy(buf, "CLOBBERD")
+	if v, ok := g.mainCache.get("set"); !ok || !v.EqualString("original") {
+		t.Errorf("cached value after the caller of Set reused its buffer = %q, %v; want %q", v.String(), ok, "original")
+	}
+}
+
+func TestThrashGuard(t *testing.T) {
+	var loads int
+	value := strings.Repeat("x", 90)
+	g := newGroupOpts("TestThrashGuard-group", 1000, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads++
+		return dest.SetString(value, time.Time{})
+	}), NoPeers{}, &GroupOptions{
+		ThrashThreshold: 0.8,
+		ThrashWindow:    10,
+		ThrashCooldown:  time.Minute,
+	})
+	now := time.Now()
+	g.now = func() time.Time { return now }
+	get := func(key string) {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A working set that fits, hit often, is not thrashing.
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10; j++ {
+			get(fmt.Sprintf("warm-%d", j))
+		}
+	}
+	if n := g.Stats.ThrashEpisodes.Get(); n != 0 {
+		t.Fatalf("ThrashEpisodes after a fitting working set = %d; want 0", n)
+	}
+
+	// A flood of distinct keys evicts an entry per load and misses.
+	var flood int
+	for ; flood < 30 && g.Stats.ThrashEpisodes.Get() == 0; flood++ {
+		get(fmt.Sprintf("flood-%d", flood))
+	}
+	if n := g.Stats.ThrashEpisodes.Get(); n != 1 {
+		t.Fatalf("ThrashEpisodes after flooding %d keys = %d; want 1", flood, n)
+	}
+	before, _ := g.mainCache.entries()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("flood-%d", flood+i)
+		get(key)
+		if _, ok := g.Contains(key); ok {
+			t.Errorf("%q cached during a thrash episode", key)
+		}
+	}
+	if n := g.Stats.ThrashSkippedAdds.Get(); n != 20 {
+		t.Errorf("ThrashSkippedAdds = %d; want 20", n)
+	}
+	if after, _ := g.mainCache.entries(); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("cache changed during a thrash episode from %v to %v", before, after)
+	}
+
+	// Once the cooldown has passed, loaded values are cached again.
+	now = now.Add(time.Minute)
+	get("after")
+	if _, ok := g.Contains("after"); !ok {
+		t.Error("loaded value not cached after the cooldown")
+	}
+}
+
+func TestSetGeneration(t *testing.T) {
+	var loads int
+	g := newGroup("TestSetGeneration-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads++
+		return dest.SetString(fmt.Sprintf("%s@%d", key, loads), time.Time{})
+	}), NoPeers{})
+	get := func(key string) string {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if got := get("a"); got != "a@1" {
+		t.Fatalf("first Get = %q; want a@1", got)
+	}
+	g.populateCache("hot", ByteView{s: "hot"}, &g.hotCache)
+	if got := get("a"); got != "a@1" || loads != 1 {
+		t.Fatalf("second Get = %q after %d loads; want the cached a@1", got, loads)
+	}
+
+	g.SetGeneration(1)
+	if gen := g.Generation(); gen != 1 {
+		t.Errorf("Generation() = %d; want 1", gen)
+	}
+	for _, key := range []string{"a", "hot"} {
+		if _, ok := g.Contains(key); ok {
+			t.Errorf("%q still cached after a generation bump", key)
+		}
+	}
+	if got := get("a"); got != "a@2" || loads != 2 {
+		t.Errorf("Get after a generation bump = %q after %d loads; want a reload giving a@2", got, loads)
+	}
+	if got := get("a"); got != "a@2" || loads != 2 {
+		t.Errorf("Get of the reloaded key = %q after %d loads; want the cached a@2", got, loads)
+	}
+	// The old entry of "a" was replaced, and that of "hot" remains
+	// until it is looked up or evicted.
+	if items := g.CacheStats(HotCache).Items; items != 1 {
+		t.Errorf("hot cache holds %d items before its old entry is looked up; want 1", items)
+	}
+	if _, ok := g.lookupCache("hot"); ok {
+		t.Error("lookupCache returned an entry of an older generation")
+	}
+	if items := g.CacheStats(HotCache).Items; items != 0 {
+		t.Errorf("hot cache holds %d items after looking up its old entry; want 0", items)
+	}
+}
+
+// metaGetter is a GetterWithMeta returning "value:"+key with the
+// metadata "meta:"+key, counting its calls.
+type metaGetter struct {
+	loads AtomicInt
+	value func(key string) string // "value:"+key if nil
+}
+
+func (g *metaGetter) Get(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+	_, err := g.GetWithMeta(ctx, key, dest, fixFunc)
+	return err
+}
+
+func (g *metaGetter) GetWithMeta(_ context.Context, key string, dest Sink, _ func() interface{}) ([]byte, error) {
+	g.loads.Add(1)
+	value := "value:" + key
+	if g.value != nil {
+		value = g.value(key)
+	}
+	return []byte("meta:" + key), dest.SetString(value, time.Time{})
+}
+
+func TestGetWithMeta(t *testing.T) {
+	getter := &metaGetter{}
+	g := newGroup("TestGetWithMeta-group", cacheSize, getter, NoPeers{})
+
+	for i, wantLoads := range []int64{1, 1} {
+		var s string
+		meta, err := g.GetWithMeta(dummyCtx, "key", StringSink(&s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(meta) != "meta:key" || s != "value:key" {
+			t.Errorf("GetWithMeta #%d = %q, %q; want %q, %q", i, meta, s, "meta:key", "value:key")
+		}
+		if n := getter.loads.Get(); n != wantLoads {
+			t.Errorf("after GetWithMeta #%d, %d loads; want %d", i, n, wantLoads)
+		}
+		meta[0] = 'X' // the caller owns its copy
+	}
+	if got, want := g.CacheStats(MainCache).Bytes, int64(len("key")+len("value:key")+len("meta:key")); got != want {
+		t.Errorf("cache holds %d bytes; want %d, counting the metadata", got, want)
+	}
+
+	// The metadata is loaded again with its value once evicted.
+	g.localRemove("key")
+	var s string
+	if info, err := g.GetWithInfo(dummyCtx, "key", StringSink(&s), nil); err != nil || string(info.Meta) != "meta:key" {
+		t.Errorf("GetWithInfo after eviction = %q, %v; want %q", info.Meta, err, "meta:key")
+	}
+	if n := getter.loads.Get(); n != 2 {
+		t.Errorf("%d loads after eviction; want 2", n)
+	}
+
+	plain := newGroup("TestGetWithMeta-plain", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("plain", time.Time{})
+	}), NoPeers{})
+	if meta, err := plain.GetWithMeta(dummyCtx, "key", StringSink(&s)); err != nil || meta != nil {
+		t.Errorf("GetWithMeta with a plain getter = %q, %v; want nil, nil", meta, err)
+	}
+}
+
+func TestHotCachePromotion(t *testing.T) {
+	peer := &fakePeer{}
+	var promoted []string
+	g := newGroupOpts("TestHotCachePromotion-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		t.Errorf("getter called for %q", key)
+		return nil
+	}), fakePeers{peer}, &GroupOptions{
+		HotCacheMinPeerFetches: 100,
+		HotCachePromotion: promotionFunc(func(key string, value ByteView) bool {
+			promoted = append(promoted, key)
+			return strings.HasPrefix(key, "hot-")
+		}),
+	})
+
+	for _, key := range []string{"hot-a", "cold-b"} {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(promoted, []string{"hot-a", "cold-b"}) {
+		t.Errorf("policy asked about %q; want hot-a and cold-b", promoted)
+	}
+	if which, ok := g.Contains("hot-a"); !ok || which != HotCache {
+		t.Error("key the policy promoted was not mirrored in the hot cache")
+	}
+	if _, ok := g.Contains("cold-b"); ok {
+		t.Error("key the policy refused was mirrored in the hot cache")
+	}
+
+	p := NewFrequencyPromotion(2, time.Minute)
+	if p.Promote("k", ByteView{}) || !p.Promote("k", ByteView{}) {
+		t.Error("NewFrequencyPromotion(2, ...) did not promote a key on its second fetch only")
+	}
+}
+
+// promotionFunc adapts a function to a PromotionPolicy.
+type promotionFunc func(key string, value ByteView) bool
+
+func (f promotionFunc) Promote(key string, value ByteView) bool { return f(key, value) }
+
+func TestGroupCacheTuning(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var loads AtomicInt
+	g := newGroupOpts("TestGroupCacheTuning-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		if key == "big" {
+			return dest.SetString(strings.Repeat("x", 100), time.Time{})
+		}
+		return dest.SetString("value", now.Add(time.Minute))
+	}), NoPeers{}, &GroupOptions{
+		MaxCacheEntries: 3,
+		MaxValueBytes:   50,
+		Clock:           func() time.Time { return now },
+	})
+	get := func(key string) string {
+		t.Helper()
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// Oversized values are returned, but loaded anew each time.
+	for i := 0; i < 2; i++ {
+		if s := get("big"); len(s) != 100 {
+			t.Fatalf("Get(big) = %d bytes; want 100", len(s))
+		}
+	}
+	if loads.Get() != 2 || g.Stats.OversizedValues.Get() != 2 {
+		t.Errorf("loads, OversizedValues = %d, %d; want 2, 2", loads.Get(), g.Stats.OversizedValues.Get())
+	}
+
+	for i := 0; i < 5; i++ {
+		get(fmt.Sprintf("key-%d", i))
+	}
+	if n := g.CacheStats(MainCache).Items; n != 3 {
+		t.Errorf("main cache holds %d entries; want MaxCacheEntries, 3", n)
+	}
+
+	// Values expire by the group's clock.
+	loads.Store(0)
+	get("key-4")
+	now = now.Add(2 * time.Minute)
+	get("key-4")
+	if n := loads.Get(); n != 1 {
+		t.Errorf("loads of a value before and after it expired by the clock = %d; want 1", n)
+	}
+}
+
+func TestGroupLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := logrus.New()
+	log.Out = &buf
+	peer := &fakePeer{fail: true}
+	g := newGroupOpts("TestGroupLogger-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("local", time.Time{})
+	}), prefixPeers{peer}, &GroupOptions{Logger: logrus.NewEntry(log)})
+	var s string
+	if err := g.Get(dummyCtx, "remote-key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "error retrieving key from peer") || !strings.Contains(got, "remote-key") {
+		t.Errorf("group's log = %q; want the failed peer fetch of remote-key", got)
+	}
+}
+
+func TestRejectOversizedValues(t *testing.T) {
+	var loads AtomicInt
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString(strings.Repeat("x", 100), time.Time{})
+	})
+	g := newGroupOpts("TestRejectOversizedValues-group", 1<<20, getter, NoPeers{}, &GroupOptions{
+		MaxValueBytes:         50,
+		RejectOversizedValues: true,
+	})
+	var s string
+	if err := g.Get(dummyCtx, "big", StringSink(&s), nil); err != ErrValueTooLarge {
+		t.Fatalf("Get(big) error = %v; want ErrValueTooLarge", err)
+	}
+	if n := g.Stats.OversizedValues.Get(); n != 1 {
+		t.Errorf("OversizedValues = %d; want 1", n)
+	}
+
+	// A peer refusing the value is not worked around.
+	peer := &fakePeer{}
+	g2 := newGroupOpts("TestRejectOversizedValues-peer", 1<<20, getter, keyPeers{"big": tooLargePeer{peer}}, &GroupOptions{})
+	if err := g2.Get(dummyCtx, "big", StringSink(&s), nil); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Get(big) from a refusing peer error = %v; want ErrValueTooLarge", err)
+	}
+	if n := loads.Get(); n != 1 {
+		t.Errorf("loads = %d; want 1, the refused value not loaded locally", n)
+	}
+}
+
+// tooLargePeer refuses every value as too large.
+type tooLargePeer struct{ *fakePeer }
+
+func (p tooLargePeer) Get(_ context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	return ErrValueTooLarge
+}
+
+func TestHotCacheFraction(t *testing.T) {
+	const cacheBytes = 1000
+	g := newGroupOpts("TestHotCacheFraction-group", cacheBytes, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return nil
+	}), NoPeers{}, &GroupOptions{HotCacheFraction: 0.5})
+
+	// Fill the hot cache to under half the cache size, then overflow
+	// the main cache: only main cache entries are evicted.
+	value := ByteView{s: strings.Repeat("x", 96)} // 100 bytes with its key
+	for i := 0; i < 4; i++ {
+		g.populateCache(fmt.Sprintf("hot%d", i), value, &g.hotCache)
+	}
+	for i := 0; i < 8; i++ {
+		g.populateCache(fmt.Sprintf("mai%d", i), value, &g.mainCache)
+	}
+	if hot, main := g.CacheStats(HotCache).Items, g.CacheStats(MainCache).Items; hot != 4 || main != 6 {
+		t.Errorf("hot and main caches hold %d and %d entries; want 4 and 6", hot, main)
+	}
+}
+
+func TestHotCacheMinPeerFetches(t *testing.T) {
+	peer := &fakePeer{}
+	g := newGroupOpts("TestHotCacheMinPeerFetches-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		t.Errorf("getter called for %q", key)
+		return nil
+	}), fakePeers{peer}, &GroupOptions{HotCacheMinPeerFetches: 3})
+
+	get := func(key string) {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get("once")
+	if _, ok := g.Contains("once"); ok {
+		t.Error("key fetched once was mirrored in the hot cache")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, ok := g.Contains("often"); ok {
+			t.Fatalf("key mirrored after %d fetches; want 3", i)
+		}
+		get("often")
+	}
+	if which, ok := g.Contains("often"); !ok || which != HotCache {
+		t.Error("key fetched 3 times was not mirrored in the hot cache")
+	}
+	get("often")
+	if peer.hits != 4 {
+		t.Errorf("peer hits = %d; want 4", peer.hits)
+	}
+}
+
+func TestHotCacheMinPeerFetchesAbove255(t *testing.T) {
+	g := newGroupOpts("TestHotCacheMinPeerFetchesAbove255-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		t.Errorf("getter called for %q", key)
+		return nil
+	}), fakePeers{&fakePeer{}}, &GroupOptions{HotCacheMinPeerFetches: 300})
+
+	for i := 0; i < 300; i++ {
+		if _, ok := g.Contains("often"); ok {
+			t.Fatalf("key mirrored after %d fetches; want 300", i)
+		}
+		var s string
+		if err := g.Get(dummyCtx, "often", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if which, ok := g.Contains("often"); !ok || which != HotCache {
+		t.Error("key fetched 300 times was not mirrored in the hot cache")
+	}
+}
+
+func TestFreqSketchWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newFreqSketch(time.Minute)
+	s.now = func() time.Time { return now }
+
+	for i := 1; i <= 3; i++ {
+		if got := s.increment("key"); got != i {
+			t.Errorf("increment #%d = %d; want %d", i, got, i)
+		}
+	}
+	now = now.Add(time.Minute)
+	if got := s.increment("key"); got != 1 {
+		t.Errorf("increment after window = %d; want 1", got)
+	}
+}
+
+// recordingFlightGroup is a FlightGroup that records the keys it is
+// asked to load and to forget.
+type recordingFlightGroup struct {
+	mu        sync.Mutex
+	keys      []string
+	forgotten []string
+	orig      FlightGroup
+}
+
+func (g *recordingFlightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	g.keys = append(g.keys, key)
+	g.mu.Unlock()
+	return g.orig.Do(key, fn)
+}
+
+func (g *recordingFlightGroup) DoChan(key string, fn func() (interface{}, error)) <-chan singleflight.Result {
+	g.mu.Lock()
+	g.keys = append(g.keys, key)
+	g.mu.Unlock()
+	return g.orig.DoChan(key, fn)
+}
+
+func (g *recordingFlightGroup) Forget(key string) {
+	g.mu.Lock()
+	g.forgotten = append(g.forgotten, key)
+	g.mu.Unlock()
+	g.orig.Forget(key)
+}
+
+func (g *recordingFlightGroup) Lock(fn func()) {
+	g.orig.Lock(fn)
+}
+
+func TestLoadFlightGroupOption(t *testing.T) {
+	flight := &recordingFlightGroup{orig: &singleflight.Group{}}
+	g := newGroupOpts("TestLoadFlightGroupOption-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("flight:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{LoadFlightGroup: flight})
+
+	for _, key := range []string{"a", "b", "a"} {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(flight.keys, want) {
+		t.Errorf("flight group loads = %q; want %q", flight.keys, want)
+	}
+
+	if err := g.Remove(dummyCtx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(flight.forgotten, want) {
+		t.Errorf("flight group forgot %q; want %q", flight.forgotten, want)
+	}
+}
+
+func TestLoadsShared(t *testing.T) {
+	release := make(chan struct{})
+	g := newGroup("TestLoadsShared-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		<-release
+		return dest.SetString("shared:"+key, time.Time{})
+	}), NoPeers{})
+
+	const n = 5
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var s string
+			g.Get(dummyCtx, "key", StringSink(&s), nil)
+		}()
+	}
+	// Let the goroutines above pile up on the same load.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := g.Stats.LoadsShared.Get(); got != n-1 {
+		t.Errorf("LoadsShared = %d; want %d", got, n-1)
+	}
+}
+
+func TestInFlightLoads(t *testing.T) {
+	started := make(chan string)
+	release := make(chan struct{})
+	g := newGroup("TestInFlightLoads-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		started <- key
+		<-release
+		return dest.SetString("inflight:"+key, time.Time{})
+	}), NoPeers{})
+
+	keys := []string{"a", "b", "c"}
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		// Two callers per key; singleflight should fold each pair into
+		// one in-flight load.
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				var s string
+				g.Get(dummyCtx, key, StringSink(&s), nil)
+			}(key)
+		}
+	}
+	for range keys {
+		<-started
+	}
+	if got, want := g.Stats.InFlightLoads.Get(), int64(len(keys)); got != want {
+		t.Errorf("InFlightLoads while blocked = %d; want %d", got, want)
+	}
+	close(release)
+	wg.Wait()
+
+	if got := g.Stats.InFlightLoads.Get(); got != 0 {
+		t.Errorf("InFlightLoads after loads = %d; want 0", got)
+	}
+	var s string
+	g.Get(dummyCtx, "a", StringSink(&s), nil)
+	if got := g.Stats.InFlightLoads.Get(); got != 0 {
+		t.Errorf("InFlightLoads after cache hit = %d; want 0", got)
+	}
+}
+
+func TestNoSingleflight(t *testing.T) {
+	var calls AtomicInt
+	started := make(chan bool)
+	release := make(chan struct{})
+	g := newGroupOpts("TestNoSingleflight-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		calls.Add(1)
+		started <- true
+		<-release
+		return dest.SetString("caller-specific:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{
+		NoSingleflight: func(key string) bool { return strings.HasPrefix(key, "private/") },
+	})
+
+	const key = "private/key"
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var s string
+			if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// Both getters must be running at once for the gets to finish.
+	<-started
+	<-started
+	close(release)
+	wg.Wait()
+
+	if got := calls.Get(); got != 2 {
+		t.Errorf("getter called %d times; want 2", got)
+	}
+	if got := g.Stats.LoadsShared.Get(); got != 0 {
+		t.Errorf("LoadsShared = %d; want 0", got)
+	}
+	// Both loads stored the key; the cache must only account for one.
+	wantBytes := int64(len(key) + len("caller-specific:"+key))
+	if got := g.mainCache.bytes(); got != wantBytes {
+		t.Errorf("cache has %d bytes; want %d", got, wantBytes)
+	}
+	if got := g.mainCache.items(); got != 1 {
+		t.Errorf("cache has %d items; want 1", got)
+	}
+}
+
+func TestForceRefresh(t *testing.T) {
+	var version AtomicInt
+	g := newGroup("TestForceRefresh-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		version.Add(1)
+		return dest.SetString(fmt.Sprintf("%s@%d", key, version.Get()), time.Time{})
+	}), NoPeers{})
+
+	get := func(ctx context.Context) string {
+		var s string
+		if err := g.Get(ctx, "key", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	steps := []struct {
+		ctx  context.Context
+		want string
+	}{
+		{dummyCtx, "key@1"},
+		{dummyCtx, "key@1"},
+		{WithForceRefresh(dummyCtx), "key@2"},
+		{dummyCtx, "key@2"},
+	}
+	for i, step := range steps {
+		if got := get(step.ctx); got != step.want {
+			t.Errorf("step %d: Get = %q; want %q", i, got, step.want)
+		}
+	}
+	if got := g.mainCache.items(); got != 1 {
+		t.Errorf("cache has %d items; want 1", got)
+	}
+}
+
+// evictionGetter returns "value-"+key, so that two-digit keys make
+// entries of evictionEntryBytes bytes.
+var evictionGetter = GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+	return dest.SetString("value-"+key, time.Time{})
+})
+
+const evictionEntryBytes = 10
+
+// getKeys gets the two-digit keys 00 to n-1 from g.
+func getKeys(t *testing.T, g *Group, n int) {
+	for i := 0; i < n; i++ {
+		var s string
+		if err := g.Get(dummyCtx, fmt.Sprintf("%02d", i), StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEvictionEventsDrop(t *testing.T) {
+	g := newGroupOpts("TestEvictionEventsDrop-group", 3*evictionEntryBytes, evictionGetter, NoPeers{}, &GroupOptions{
+		EvictionEventBuffer: 2,
+	})
+	getKeys(t, g, 10) // 7 evictions, nobody listening
+	if got := g.Stats.EvictionEventsDropped.Get(); got != 5 {
+		t.Errorf("EvictionEventsDropped = %d; want 5", got)
+	}
+	for _, want := range []string{"00", "01"} {
+		ev := <-g.EvictionEvents()
+		if ev.Key != want || ev.Bytes != evictionEntryBytes || ev.Cache != MainCache {
+			t.Errorf("event = %+v; want {Key:%s Bytes:%d Cache:MainCache}", ev, want, evictionEntryBytes)
+		}
+	}
+
+	g = newGroup("TestEvictionEventsDisabled-group", cacheSize, evictionGetter, NoPeers{})
+	if g.EvictionEvents() != nil {
+		t.Error("EvictionEvents is non-nil without EvictionEventBuffer")
+	}
+}
+
+func TestEvictionEventsBlock(t *testing.T) {
+	g := newGroupOpts("TestEvictionEventsBlock-group", 3*evictionEntryBytes, evictionGetter, NoPeers{}, &GroupOptions{
+		EvictionEventBuffer: 1,
+		EvictionOverflow:    BlockOnOverflow,
+	})
+	var keys []string
+	consumed := make(chan bool)
+	go func() {
+		for ev := range g.EvictionEvents() {
+			time.Sleep(time.Millisecond) // a slow consumer
+			keys = append(keys, ev.Key)
+			if len(keys) == 17 {
+				close(consumed)
+			}
+		}
+	}()
+	getKeys(t, g, 20)
+	select {
+	case <-consumed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for eviction events")
+	}
+	if keys[0] != "00" || keys[16] != "16" {
+		t.Errorf("events for %q; want 00 through 16 in order", keys)
+	}
+	if got := g.Stats.EvictionEventsDropped.Get(); got != 0 {
+		t.Errorf("EvictionEventsDropped = %d; want 0", got)
+	}
+}
+
+func TestLoadLatency(t *testing.T) {
+	var now time.Time
+	g := newGroupOpts("TestLoadLatency-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		d, err := time.ParseDuration(strings.SplitN(key, "/", 2)[0])
+		if err != nil {
+			return err
+		}
+		now = now.Add(d)
+		return dest.SetString(key, time.Time{})
+	}), NoPeers{}, &GroupOptions{RecordLoadLatency: true})
+	g.now = func() time.Time { return now }
+
+	loads := []struct {
+		d time.Duration
+		n int
+	}{
+		{10 * time.Millisecond, 50},
+		{20 * time.Millisecond, 40},
+		{100 * time.Millisecond, 9},
+		{time.Second, 1},
+	}
+	for _, l := range loads {
+		for i := 0; i < l.n; i++ {
+			var s string
+			key := fmt.Sprintf("%v/%d", l.d, i)
+			if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+				t.Fatal(err)
+			}
+			// Cache hits are not loads.
+			if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	st := g.LoadLatency()
+	if st.Count != 100 {
+		t.Errorf("Count = %d; want 100", st.Count)
+	}
+	for _, p := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"P50", st.P50, 10 * time.Millisecond},
+		{"P90", st.P90, 20 * time.Millisecond},
+		{"P99", st.P99, 100 * time.Millisecond},
+	} {
+		if diff := p.got - p.want; diff < -p.want/16 || diff > p.want/16 {
+			t.Errorf("%s = %v; want about %v", p.name, p.got, p.want)
+		}
+	}
+
+	if st := newGroup("TestLoadLatencyDisabled-group", cacheSize, evictionGetter, NoPeers{}).LoadLatency(); st.Count != 0 {
+		t.Errorf("LoadLatency without RecordLoadLatency = %+v; want empty", st)
+	}
+}
+
+func TestRecordLatency(t *testing.T) {
+	var now time.Time
+	peer := &fakePeer{}
+	g := newGroupOpts("TestRecordLatency-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		now = now.Add(10 * time.Millisecond)
+		return dest.SetString(key, time.Time{})
+	}), prefixPeers{peer}, &GroupOptions{RecordLatency: true})
+	g.now = func() time.Time { return now }
+
+	for _, key := range []string{"local-a", "local-b", "remote-a"} {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		which LatencyType
+		count int64
+	}{
+		{GetLatency, 3},
+		{PeerFetchLatency, 1},
+		{OriginLatency, 2},
+	} {
+		st := g.Latency(c.which)
+		if st.Count != c.count {
+			t.Errorf("Latency(%d).Count = %d; want %d", c.which, st.Count, c.count)
+		}
+		var n int64
+		for _, b := range st.Buckets {
+			n += b.Count
+		}
+		if n != st.Count {
+			t.Errorf("Latency(%d) buckets count %d durations; want %d", c.which, n, st.Count)
+		}
+	}
+	if st := g.Latency(OriginLatency); len(st.Buckets) != 1 || st.Buckets[0].Max < 10*time.Millisecond {
+		t.Errorf("Latency(OriginLatency).Buckets = %+v; want one bucket of 10ms", st.Buckets)
+	}
+	peers := g.PeerLatencies()
+	if len(peers) != 1 || peers["fakePeer"].Count != 1 {
+		t.Errorf("PeerLatencies() = %+v; want one fetch from fakePeer", peers)
+	}
+
+	g.ResetLatency()
+	for _, which := range []LatencyType{GetLatency, PeerFetchLatency, OriginLatency} {
+		if st := g.Latency(which); st.Count != 0 || len(st.Buckets) != 0 {
+			t.Errorf("Latency(%d) after ResetLatency = %+v; want empty", which, st)
+		}
+	}
+	if peers := g.PeerLatencies(); len(peers) != 0 {
+		t.Errorf("PeerLatencies() after ResetLatency = %+v; want empty", peers)
+	}
+
+	if st := newGroup("TestRecordLatencyDisabled-group", cacheSize, evictionGetter, NoPeers{}).Latency(GetLatency); st.Count != 0 {
+		t.Errorf("Latency(GetLatency) without RecordLatency = %+v; want empty", st)
+	}
+}
+
+func TestLatencyBucketMax(t *testing.T) {
+	// The last buckets only hold durations too long for a
+	// time.Duration.
+	for i := 0; i < latencyBuckets && latencyBucketMax(i) >= 0; i++ {
+		max := latencyBucketMax(i)
+		if got := latencyBucket(max); got != i {
+			t.Errorf("latencyBucket(latencyBucketMax(%d)) = %d", i, got)
+		}
+		if max+1 > 0 {
+			if got := latencyBucket(max + 1); got != i+1 {
+				t.Errorf("latencyBucket(latencyBucketMax(%d)+1) = %d; want %d", i, got, i+1)
+			}
+		}
+	}
+}
+
+func TestPin(t *testing.T) {
+	g := newGroupOpts("TestPin-group", 10*evictionEntryBytes, evictionGetter, NoPeers{}, &GroupOptions{
+		MaxPinnedBytes: 3 * evictionEntryBytes,
+	})
+	getKeys(t, g, 2)
+	for _, key := range []string{"00", "01"} {
+		if err := g.Pin(key); err != nil {
+			t.Fatalf("Pin(%s): %v", key, err)
+		}
+	}
+	// Pinned before it is loaded.
+	if err := g.Pin("99"); err != nil {
+		t.Fatalf("Pin(99): %v", err)
+	}
+
+	getKeys(t, g, 50)
+	var s string
+	if err := g.Get(dummyCtx, "99", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	getKeys(t, g, 50)
+	for _, key := range []string{"00", "01", "99"} {
+		if _, ok := g.Contains(key); !ok {
+			t.Errorf("pinned key %s was evicted", key)
+		}
+	}
+	if _, ok := g.Contains("10"); ok {
+		t.Error("unpinned key 10 survived eviction pressure")
+	}
+	st := g.CacheStats(MainCache)
+	if st.PinnedBytes != 3*evictionEntryBytes {
+		t.Errorf("PinnedBytes = %d; want %d", st.PinnedBytes, 3*evictionEntryBytes)
+	}
+	if st.Bytes > 10*evictionEntryBytes {
+		t.Errorf("cache holds %d bytes; want at most %d", st.Bytes, 10*evictionEntryBytes)
+	}
+
+	if err := g.Pin("49"); err != errPinLimit {
+		t.Errorf("Pin beyond MaxPinnedBytes error = %v; want %v", err, errPinLimit)
+	}
+
+	g.Unpin("00")
+	getKeys(t, g, 50)
+	if _, ok := g.Contains("00"); ok {
+		t.Error("unpinned key 00 was not evicted")
+	}
+	if got := g.CacheStats(MainCache).PinnedBytes; got != 2*evictionEntryBytes {
+		t.Errorf("PinnedBytes after Unpin = %d; want %d", got, 2*evictionEntryBytes)
+	}
+}
+
+func TestNotFoundLocal(t *testing.T) {
+	g := newGroup("TestNotFoundLocal-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return fmt.Errorf("no row for %q: %w", key, ErrNotFound)
+	}), NoPeers{})
+	var s string
+	if err := g.Get(dummyCtx, "missing", StringSink(&s), nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get error = %v; want ErrNotFound", err)
+	}
+}
+
+func TestMaxKeyLength(t *testing.T) {
+	var gotKeys []string
+	g := newGroupOpts("TestMaxKeyLength-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		gotKeys = append(gotKeys, key)
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{MaxKeyLength: 32})
+
+	prefix := "https://example.com/" + strings.Repeat("very/long/path/", 10)
+	long1, long2 := prefix+"1", prefix+"2"
+	if d1, d2 := g.storageKey(long1), g.storageKey(long2); d1 == d2 {
+		t.Fatalf("distinct keys share digest %q", d1)
+	}
+	if got := g.storageKey("short"); got != "short" {
+		t.Errorf("storageKey(short) = %q; want it unchanged", got)
+	}
+
+	for _, key := range []string{long1, long2, long1} {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if want := "value:" + key; s != want {
+			t.Errorf("Get = %q; want %q", s, want)
+		}
+	}
+	if want := []string{long1, long2}; !reflect.DeepEqual(gotKeys, want) {
+		t.Errorf("getter received keys %q; want %q", gotKeys, want)
+	}
+	if _, ok := g.Contains(long1); !ok {
+		t.Error("long key not cached")
+	}
+	wantBytes := int64(2 * len(g.storageKey(long1)))
+	wantBytes += int64(len("value:"+long1) + len("value:"+long2))
+	if got := g.mainCache.bytes(); got != wantBytes {
+		t.Errorf("cache has %d bytes; want %d", got, wantBytes)
+	}
+}
+
+func compressibleValue(key string) string {
+	return strings.Repeat("value:"+key+";", 100)
+}
+
+func TestCompressInMemory(t *testing.T) {
+	loads := 0
+	g := newGroupOpts("TestCompressInMemory-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads++
+		if key == "small" {
+			return dest.SetString("tiny", time.Time{})
+		}
+		return dest.SetString(compressibleValue(key), time.Time{})
+	}), NoPeers{}, &GroupOptions{CompressInMemory: true})
+
+	for i := 0; i < 2; i++ {
+		var s string
+		if err := g.Get(dummyCtx, "big", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if want := compressibleValue("big"); s != want {
+			t.Fatalf("Get(big) = %d bytes; want %d bytes", len(s), len(want))
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loads = %d; want 1", loads)
+	}
+
+	v, ok := g.mainCache.get("big")
+	if !ok || !v.compressed {
+		t.Fatalf("cached big value: ok = %v, compressed = %v; want both true", ok, v.compressed)
+	}
+	raw := int64(len("big") + len(compressibleValue("big")))
+	bigBytes := int64(len("big") + v.Len())
+	if got := g.mainCache.bytes(); got != bigBytes || got >= raw {
+		t.Errorf("cache has %d bytes; want %d, less than the uncompressed %d", got, bigBytes, raw)
+	}
+
+	var s string
+	if err := g.Get(dummyCtx, "small", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s != "tiny" {
+		t.Errorf("Get(small) = %q; want %q", s, "tiny")
+	}
+	if v, _ := g.mainCache.get("small"); v.compressed {
+		t.Error("value below CompressMinBytes was compressed")
+	}
+	if got, want := g.mainCache.bytes(), bigBytes+int64(len("small")+len("tiny")); got != want {
+		t.Errorf("cache has %d bytes; want %d", got, want)
+	}
+}
+
+func benchmarkGetCompressed(b *testing.B, compress bool) {
+	g := newGroupOpts(fmt.Sprintf("BenchmarkGetCompressed-%v-group", compress), cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(compressibleValue(key), time.Time{})
+	}), NoPeers{}, &GroupOptions{CompressInMemory: compress})
+	defer DeregisterGroup(g.Name())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var buf []byte
+		if err := g.Get(dummyCtx, "key", AllocatingByteSliceSink(&buf), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetUncompressed(b *testing.B) { benchmarkGetCompressed(b, false) }
+func BenchmarkGetCompressed(b *testing.B)   { benchmarkGetCompressed(b, true) }
+
+func TestHotCacheClock(t *testing.T) {
+	const cacheBytes = 1000
+	g := newGroupOpts("TestHotCacheClock-group", cacheBytes, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), prefixPeers{&fakePeer{}}, &GroupOptions{HotCacheClock: true})
+
+	var s string
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("remote-%d", i)
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		// Keep remote-0 in use; the sweeps pass over it.
+		if err := g.Get(dummyCtx, "remote-0", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if n := g.CacheStats(HotCache).Bytes; n > cacheBytes {
+			t.Fatalf("hot cache holds %d bytes; want at most %d", n, cacheBytes)
+		}
+	}
+	stats := g.CacheStats(HotCache)
+	if stats.Evictions == 0 {
+		t.Error("no evictions from a full hot cache")
+	}
+	if stats.Hits < 499 {
+		t.Errorf("hot cache served %d hits; want at least the 499 of remote-0", stats.Hits)
+	}
+	if which, ok := g.Contains("remote-0"); !ok || which != HotCache {
+		t.Error("the key in use was evicted from the hot cache")
+	}
+}
+
+func benchmarkHotCacheReads(b *testing.B, clock bool) {
+	g := newGroupOpts(fmt.Sprintf("BenchmarkHotCacheReads-%v-group", clock), cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), prefixPeers{&fakePeer{}}, &GroupOptions{HotCacheClock: clock})
+	defer DeregisterGroup(g.Name())
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("remote-%d", i)
+		var s string
+		if err := g.Get(dummyCtx, keys[i], StringSink(&s), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, ok := g.hotCache.get(keys[i%len(keys)]); !ok {
+				b.Fatal("hot cache miss")
+			}
+		}
+	})
+}
+
+func BenchmarkHotCacheReadsLRU(b *testing.B)   { benchmarkHotCacheReads(b, false) }
+func BenchmarkHotCacheReadsClock(b *testing.B) { benchmarkHotCacheReads(b, true) }
+
+func TestMaxConcurrentLoads(t *testing.T) {
+	const (
+		limit = 2
+		keys  = 10
+	)
+	var (
+		mu           sync.Mutex
+		active, peak int
+		releaseLoads = make(chan bool)
+	)
+	g := newGroupOpts("TestMaxConcurrentLoads-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		<-releaseLoads
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{MaxConcurrentLoads: limit})
+
+	errc := make(chan error, keys)
+	for i := 0; i < keys; i++ {
+		go func(key string) {
+			var s string
+			errc <- g.Get(dummyCtx, key, StringSink(&s), nil)
+		}(fmt.Sprintf("key-%d", i))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for g.Stats.LoadsQueued.Get() != keys-limit {
+		if time.Now().After(deadline) {
+			t.Fatalf("LoadsQueued = %d; want %d", g.Stats.LoadsQueued.Get(), keys-limit)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(releaseLoads)
+	for i := 0; i < keys; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if peak != limit {
+		t.Errorf("peak concurrent loads = %d; want %d", peak, limit)
+	}
+	if n := g.Stats.LoadsQueued.Get(); n != 0 {
+		t.Errorf("LoadsQueued = %d after all loads; want 0", n)
+	}
+}
+
+func TestMaxConcurrentLoadsThrottled(t *testing.T) {
+	started, releaseLoads := make(chan bool, 1), make(chan bool)
+	g := newGroupOpts("TestMaxConcurrentLoadsThrottled-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		if key == "slow" {
+			started <- true
+			<-releaseLoads
+		}
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{MaxConcurrentLoads: 1})
+
+	errc := make(chan error, 1)
+	go func() {
+		var s string
+		errc <- g.Get(dummyCtx, "slow", StringSink(&s), nil)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var s string
+	if err := g.Get(ctx, "queued", StringSink(&s), nil); err != ErrLoadThrottled {
+		t.Errorf("Get while the only slot is busy = %v; want %v", err, ErrLoadThrottled)
+	}
+	close(releaseLoads)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Get(context.Background(), "queued", StringSink(&s), nil); err != nil {
+		t.Fatalf("Get after the slot was freed: %v", err)
+	}
+}
+
+func TestMaxInFlightLoads(t *testing.T) {
+	const limit = 2
+	started, releaseLoads := make(chan string, limit+1), make(chan bool)
+	var peer fakePeer
+	g := newGroupOpts("TestMaxInFlightLoads-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		started <- key
+		<-releaseLoads
+		return dest.SetString("value:"+key, time.Time{})
+	}), prefixPeers{&peer}, &GroupOptions{MaxInFlightLoads: limit})
+
+	get := func(ctx context.Context, key string, errc chan<- error) {
+		var s string
+		errc <- g.Get(ctx, key, StringSink(&s), nil)
+	}
+	errc := make(chan error, limit+2)
+	for i := 0; i < limit; i++ {
+		go get(dummyCtx, fmt.Sprintf("blocked-%d", i), errc)
+		<-started
+	}
+
+	// A distinct key waits, even one owned by a peer, and gives up
+	// when its context does.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var s string
+	if err := g.Get(ctx, "remote-key", StringSink(&s), nil); err != ErrLoadThrottled {
+		t.Errorf("Get of a peer's key while saturated = %v; want %v", err, ErrLoadThrottled)
+	}
+	if peer.hits != 0 {
+		t.Errorf("peer got %d requests while saturated; want 0", peer.hits)
+	}
+
+	// Loads requested by peers are exempt.
+	peerCtx := withPeerHops(context.Background(), 1)
+	go get(peerCtx, "from-peer", errc)
+	if key := <-started; key != "from-peer" {
+		t.Fatalf("getter started loading %q; want from-peer", key)
+	}
+
+	go get(dummyCtx, "queued", errc)
+	deadline := time.Now().Add(5 * time.Second)
+	for g.Stats.InFlightLoadsQueued.Get() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("InFlightLoadsQueued = %d; want 1", g.Stats.InFlightLoadsQueued.Get())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := g.Stats.InFlightLoads.Get(); n != limit+1 {
+		t.Errorf("InFlightLoads = %d; want %d", n, limit+1)
+	}
+	select {
+	case key := <-started:
+		t.Fatalf("getter started loading %q while saturated", key)
+	default:
+	}
+
+	// Freeing the slots lets the queued load through.
+	close(releaseLoads)
+	for i := 0; i < limit+2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := g.Stats.InFlightLoadsQueued.Get(); n != 0 {
+		t.Errorf("InFlightLoadsQueued = %d after all loads; want 0", n)
+	}
+}
+
+// replicaPeers is a ReplicaPeerPicker handing out replicas round-robin.
+type replicaPeers struct {
+	fakePeers
+	replicas []ProtoGetter
+	next     int
+}
+
+func (p *replicaPeers) PickReplicaPeer(key string, n int) (ProtoGetter, bool) {
+	peer := p.replicas[p.next%n]
+	p.next++
+	return peer, peer != nil
+}
+
+func TestReadReplicas(t *testing.T) {
+	owner, replica1, replica2 := &fakePeer{}, &fakePeer{}, &fakePeer{}
+	peers := &replicaPeers{
+		fakePeers: fakePeers{owner},
+		replicas:  []ProtoGetter{owner, replica1, replica2},
+	}
+	localHits := 0
+	g := newGroupOpts("TestReadReplicas-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		localHits++
+		return dest.SetString("got:"+key, time.Time{})
+	}), peers, &GroupOptions{ReadReplicas: 3})
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if s != "got:"+key {
+			t.Errorf("Get(%q) = %q; want %q", key, s, "got:"+key)
+		}
+	}
+	if owner.hits != 10 || replica1.hits != 10 || replica2.hits != 10 || localHits != 0 {
+		t.Errorf("hits: owner %d, replicas %d and %d, local %d; want 10, 10, 10, 0",
+			owner.hits, replica1.hits, replica2.hits, localHits)
+	}
+}
+
+// replicaReadPeer records whether it was asked for keys as a replica.
+type replicaReadPeer struct {
+	fakePeer
+	replicaReads int
+}
+
+func (p *replicaReadPeer) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	if replicaRead(ctx) {
+		p.replicaReads++
+	}
+	return p.fakePeer.Get(ctx, in, out)
+}
+
+func TestServeReplicaRead(t *testing.T) {
+	owner := &replicaReadPeer{}
+	localHits := 0
+	g := newGroupOpts("TestServeReplicaRead-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		localHits++
+		return dest.SetString("got:"+key, time.Time{})
+	}), fakePeers{owner}, &GroupOptions{HotCacheMinPeerFetches: 5})
+
+	// A replica read forwarded by a peer is fetched from the owner
+	// rather than loaded here, and mirrored however cold the key is.
+	ctx := withReplicaRead(withPeerHops(context.Background(), 1), true)
+	for i := 0; i < 2; i++ {
+		var s string
+		if err := g.Get(ctx, "key", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if owner.hits != 1 || owner.replicaReads != 0 || localHits != 0 {
+		t.Errorf("owner hits %d, of which replica reads %d; local hits %d; want 1, 0, 0",
+			owner.hits, owner.replicaReads, localHits)
+	}
+	if which, ok := g.Contains("key"); !ok || which != HotCache {
+		t.Errorf("Contains(key) = %v, %v; want HotCache, true", which, ok)
+	}
+}
+
+// keySet is an ExistenceFilter of a fixed set of keys.
+type keySet map[string]bool
+
+func (s keySet) MightContain(key string) bool { return s[key] }
+
+func TestExistenceFilter(t *testing.T) {
+	var loaded []string
+	g := newGroupOpts("TestExistenceFilter-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loaded = append(loaded, key)
+		if key == "false-positive" {
+			return ErrNotFound
+		}
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{ExistenceFilter: keySet{"present": true, "false-positive": true}})
+
+	var s string
+	if err := g.Get(dummyCtx, "present", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Get(dummyCtx, "absent", StringSink(&s), nil); err != ErrNotFound {
+		t.Errorf("Get(absent) error = %v; want ErrNotFound", err)
+	}
+	if err := g.Get(dummyCtx, "false-positive", StringSink(&s), nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(false-positive) error = %v; want ErrNotFound", err)
+	}
+	if want := []string{"present", "false-positive"}; !reflect.DeepEqual(loaded, want) {
+		t.Errorf("getter loaded %q; want %q", loaded, want)
+	}
+	if n := g.Stats.FilteredLoads.Get(); n != 1 {
+		t.Errorf("FilteredLoads = %d; want 1", n)
+	}
+}
+
+// flakyOrigin is a getter whose values expire after ttl and that fails
+// once down is set.
+type flakyOrigin struct {
+	down  AtomicInt
+	loads AtomicInt
+	ttl   time.Duration
+}
+
+func (o *flakyOrigin) Get(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+	o.loads.Add(1)
+	if o.down.Get() != 0 {
+		return errors.New("origin is down")
+	}
+	return dest.SetString(fmt.Sprintf("value:%s@%d", key, o.loads.Get()), time.Now().Add(o.ttl))
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy EvictionPolicy
+		want   string
+	}{
+		{EvictLRU, "[a c]"},
+		{EvictLFU, "[b d]"},
+		{EvictFIFO, "[a b]"},
+		// a, b and c were all hit again, so a, the least recently hit,
+		// goes first, and then d, the only entry never hit again.
+		{EvictSLRU, "[a d]"},
+		{EvictARC, "[a d]"},
+	} {
+		var evicted []string
+		// Room for three entries of a one byte key and a nine byte value.
+		g := newGroupOpts(fmt.Sprintf("TestEvictionPolicy-%d", tt.policy), 30, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+			return errors.New("unexpected load")
+		}), NoPeers{}, &GroupOptions{
+			EvictionPolicy: tt.policy,
+			OnEvicted:      func(key string, value ByteView) { evicted = append(evicted, key) },
+		})
+		value := ByteView{s: "123456789"}
+		hit := func(keys ...string) {
+			for _, key := range keys {
+				g.mainCache.get(key)
+			}
+		}
+		for _, key := range []string{"a", "b", "c"} {
+			g.populateCache(key, value, &g.mainCache)
+		}
+		hit("a", "a", "a", "b", "c")
+		g.populateCache("d", value, &g.mainCache)
+		hit("b")
+		g.populateCache("e", value, &g.mainCache)
+
+		if got := fmt.Sprint(evicted); got != tt.want {
+			t.Errorf("policy %d evicted %s; want %s", tt.policy, got, tt.want)
+		}
+		if got := g.mainCache.bytes(); got > 30 {
+			t.Errorf("policy %d: main cache holds %d bytes; want at most 30", tt.policy, got)
+		}
+	}
+}
+
+func TestOnEvictedOutsideLock(t *testing.T) {
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		if key == "big" {
+			return dest.SetString(strings.Repeat("x", 50), time.Time{})
+		}
+		return dest.SetString("small", time.Time{})
+	})
+	for _, workers := range []int{0, 2} {
+		var (
+			mu      sync.Mutex
+			evicted []string
+			release = make(chan bool)
+		)
+		g := newGroupOpts(fmt.Sprintf("TestOnEvictedOutsideLock-%d", workers), 100, getter, NoPeers{}, &GroupOptions{
+			OnEvicted: func(key string, value ByteView) {
+				<-release
+				mu.Lock()
+				evicted = append(evicted, key+"="+value.String())
+				mu.Unlock()
+			},
+			EvictionWorkers: workers,
+		})
+		get := func(key string) error {
+			var s string
+			return g.Get(dummyCtx, key, StringSink(&s), nil)
+		}
+		for i := 0; i < 10; i++ {
+			if err := get(fmt.Sprintf("key-%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Loading the big value evicts six small ones at once, each
+		// stuck in OnEvicted until released.
+		loaded := make(chan error, 1)
+		go func() { loaded <- get("big") }()
+		if workers > 0 {
+			select {
+			case err := <-loaded:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("workers=%d: Get evicting entries waited for OnEvicted", workers)
+			}
+		}
+		hit := make(chan error, 1)
+		go func() { hit <- get("key-9") }()
+		select {
+		case err := <-hit:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("workers=%d: Get of a cached key blocked by OnEvicted", workers)
+		}
+
+		close(release)
+		if workers == 0 {
+			if err := <-loaded; err != nil {
+				t.Fatal(err)
+			}
+		}
+		g.Close()
+		mu.Lock()
+		sort.Strings(evicted)
+		if want := []string{"key-0=small", "key-1=small", "key-2=small", "key-3=small", "key-4=small", "key-5=small"}; !reflect.DeepEqual(evicted, want) {
+			t.Errorf("workers=%d: OnEvicted called for %q; want %q", workers, evicted, want)
+		}
+		mu.Unlock()
+		if n := g.Stats.CacheHits.Get(); n != 1 {
+			t.Errorf("workers=%d: %d cache hits; want 1", workers, n)
+		}
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	origin := &flakyOrigin{ttl: 20 * time.Millisecond}
+	g := newGroupOpts("TestServeStaleOnError-group", cacheSize, origin, NoPeers{}, &GroupOptions{ServeStaleOnError: true})
+
+	var s string
+	if info, err := g.GetWithInfo(dummyCtx, "key", StringSink(&s), nil); err != nil || info.Stale || s != "value:key@1" {
+		t.Fatalf("first Get = %q, %+v, %v; want a fresh value:key@1", s, info, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// Expired values are still loaded afresh while the origin is up.
+	if info, err := g.GetWithInfo(dummyCtx, "key", StringSink(&s), nil); err != nil || info.Stale || s != "value:key@2" {
+		t.Fatalf("Get after expiry = %q, %+v, %v; want a fresh value:key@2", s, info, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	origin.down.Store(1)
+	if info, err := g.GetWithInfo(dummyCtx, "key", StringSink(&s), nil); err != nil || !info.Stale || s != "value:key@2" {
+		t.Errorf("Get with the origin down = %q, %+v, %v; want a stale value:key@2", s, info, err)
+	}
+	if n := g.Stats.StaleServed.Get(); n != 1 {
+		t.Errorf("StaleServed = %d; want 1", n)
+	}
+	if n := g.Stats.LocalLoadErrs.Get(); n != 1 {
+		t.Errorf("LocalLoadErrs = %d; want the failed load counted", n)
+	}
+	if _, ok := g.Contains("key"); ok {
+		t.Error("Contains reports a stale value as cached")
+	}
+}
+
+func TestServeStaleOnErrorMaxStale(t *testing.T) {
+	origin := &flakyOrigin{ttl: 10 * time.Millisecond}
+	g := newGroupOpts("TestServeStaleOnErrorMaxStale-group", cacheSize, origin, NoPeers{}, &GroupOptions{
+		ServeStaleOnError: true,
+		MaxStale:          20 * time.Millisecond,
+	})
+
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	origin.down.Store(1)
+	time.Sleep(50 * time.Millisecond)
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err == nil {
+		t.Errorf("Get past MaxStale = %q; want the load error", s)
+	}
+}
+
+// expiringPeer is a fakePeer whose values expire after ttl.
+type expiringPeer struct {
+	*fakePeer
+	ttl time.Duration
+}
+
+func (p expiringPeer) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	if err := p.fakePeer.Get(ctx, in, out); err != nil {
+		return err
+	}
+	out.Expire = proto.Int64(time.Now().Add(p.ttl).UnixNano())
+	return nil
+}
+
+func TestPreferWarmLocal(t *testing.T) {
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("local:"+key, time.Time{})
+	})
+	for _, prefer := range []bool{true, false} {
+		peer := expiringPeer{&fakePeer{}, 10 * time.Millisecond}
+		g := newGroupOpts(fmt.Sprintf("TestPreferWarmLocal-%v", prefer), cacheSize, getter, prefixPeers{peer}, &GroupOptions{PreferWarmLocal: prefer})
+
+		var s string
+		if info, err := g.GetWithInfo(dummyCtx, "remote-key", StringSink(&s), nil); err != nil || info.PossiblyStale || s != "got:remote-key" {
+			t.Fatalf("prefer=%v: first Get = %q, %+v, %v; want a fresh got:remote-key", prefer, s, info, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		// The owner goes down once the mirrored copy expired.
+		peer.fail = true
+		info, err := g.GetWithInfo(dummyCtx, "remote-key", StringSink(&s), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefer {
+			if !info.PossiblyStale || s != "got:remote-key" {
+				t.Errorf("Get with the owner down = %q, %+v; want the warm got:remote-key, possibly stale", s, info)
+			}
+			if peer.hits != 1 {
+				t.Errorf("owner asked %d times; want the warm copy served without asking it again", peer.hits)
+			}
+			if n := g.Stats.WarmLocalServed.Get(); n != 1 {
+				t.Errorf("WarmLocalServed = %d; want 1", n)
+			}
+		} else if info.PossiblyStale || s != "local:remote-key" {
+			t.Errorf("Get with the owner down and no PreferWarmLocal = %q, %+v; want a local load", s, info)
+		}
+
+		// Keys never mirrored still go to the owner first.
+		if info, err := g.GetWithInfo(dummyCtx, "remote-cold", StringSink(&s), nil); err != nil || info.PossiblyStale || s != "local:remote-cold" {
+			t.Errorf("prefer=%v: Get of a cold key = %q, %+v, %v; want a local load", prefer, s, info, err)
+		}
+	}
+}
+
+func TestSharedLoadGroup(t *testing.T) {
+	var (
+		shared  singleflight.Group
+		calls   AtomicInt
+		release = make(chan bool)
+	)
+	origin := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		calls.Add(1)
+		<-release
+		return dest.SetString("origin:"+key, time.Time{})
+	})
+	opts := &GroupOptions{SharedLoadGroup: &shared, SharedLoadNamespace: "origin"}
+	g1 := newGroupOpts("TestSharedLoadGroup-1", cacheSize, origin, NoPeers{}, opts)
+	g2 := newGroupOpts("TestSharedLoadGroup-2", cacheSize, origin, NoPeers{}, opts)
+	other := newGroupOpts("TestSharedLoadGroup-other", cacheSize, origin, NoPeers{}, &GroupOptions{SharedLoadGroup: &shared})
+
+	results := make(chan string, 2)
+	for _, g := range []*Group{g1, g2} {
+		go func(g *Group) {
+			var s string
+			if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil {
+				s = "ERROR:" + err.Error()
+			}
+			results <- s
+		}(g)
+	}
+	time.Sleep(100 * time.Millisecond) // let both loads join one call
+	close(release)
+	for i := 0; i < 2; i++ {
+		if s := <-results; s != "origin:key" {
+			t.Errorf("Get = %q; want %q", s, "origin:key")
+		}
+	}
+	if n := calls.Get(); n != 1 {
+		t.Errorf("origin called %d times by two groups sharing a load group; want 1", n)
+	}
+	for _, g := range []*Group{g1, g2} {
+		if _, ok := g.Contains("key"); !ok {
+			t.Errorf("group %s did not cache the shared value", g.Name())
+		}
+	}
+
+	// A group in its own namespace loads the key itself.
+	var s string
+	if err := other.Get(dummyCtx, "key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Get(); n != 2 {
+		t.Errorf("origin called %d times after a load in another namespace; want 2", n)
+	}
+}
+
+// prefixPeers nominates peer for the keys starting with "remote-", and
+// owns the others itself.
+type prefixPeers struct {
+	peer ProtoGetter
+}
+
+func (p prefixPeers) PickPeer(key string) (ProtoGetter, bool) {
+	return p.peer, strings.HasPrefix(key, "remote-")
+}
+
+func (p prefixPeers) GetAll() []ProtoGetter { return []ProtoGetter{p.peer} }
+
+func TestAdaptiveCacheSplit(t *testing.T) {
+	const cacheBytes = 4096
+	newSplitGroup := func(name string) *Group {
+		return newGroupOpts(name, cacheBytes, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+			return dest.SetString("got:"+key, time.Time{})
+		}), prefixPeers{&fakePeer{}}, &GroupOptions{AdaptiveCacheSplit: true, AdaptiveSplitInterval: 100})
+	}
+	get := func(g *Group, key string) {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	minHot, maxHot := int64(cacheBytes/64), int64(cacheBytes/2)
+
+	// A few popular keys owned by a peer, among a scan of local keys
+	// that are never read again: the hot cache should grow.
+	g := newSplitGroup("TestAdaptiveCacheSplit-hot")
+	if got, want := g.HotCacheLimit(), int64(cacheBytes/9); got != want {
+		t.Fatalf("initial HotCacheLimit = %d; want %d", got, want)
+	}
+	for i := 0; i < 5000; i++ {
+		get(g, fmt.Sprintf("remote-%d", i%10))
+		get(g, fmt.Sprintf("local-%d", i))
+	}
+	if got := g.HotCacheLimit(); got != maxHot {
+		t.Errorf("remote working set: HotCacheLimit = %d; want %d", got, maxHot)
+	}
+
+	// The opposite: local keys are popular, peer keys are scanned.
+	g = newSplitGroup("TestAdaptiveCacheSplit-main")
+	for i := 0; i < 5000; i++ {
+		get(g, fmt.Sprintf("local-%d", i%10))
+		get(g, fmt.Sprintf("remote-%d", i))
+	}
+	if got := g.HotCacheLimit(); got != minHot {
+		t.Errorf("local working set: HotCacheLimit = %d; want %d", got, minHot)
+	}
+
+	// Then the workload shifts back to the peer's keys.
+	for i := 0; i < 5000; i++ {
+		get(g, fmt.Sprintf("remote-%d", i%10))
+		get(g, fmt.Sprintf("local-scan-%d", i))
+	}
+	if got := g.HotCacheLimit(); got != maxHot {
+		t.Errorf("after shift: HotCacheLimit = %d; want %d", got, maxHot)
+	}
+
+	static := newGroup("TestAdaptiveCacheSplit-static", cacheBytes, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(key, time.Time{})
+	}), NoPeers{})
+	if got := static.HotCacheLimit(); got != -1 {
+		t.Errorf("static split: HotCacheLimit = %d; want -1", got)
+	}
+}
+
+func TestTenantBudgets(t *testing.T) {
+	var loads AtomicInt
+	g := newGroupOpts("TestTenantBudgets-group", 12000, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString(strings.Repeat("v", 90), time.Time{})
+	}), NoPeers{}, &GroupOptions{
+		KeyTenant: func(key string) string {
+			if i := strings.IndexByte(key, ':'); i >= 0 {
+				return key[:i]
+			}
+			return ""
+		},
+		TenantBudgets: map[string]int64{"quiet": 2000, "noisy": 4000},
+	})
+	get := func(key string) {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The quiet tenant and keys of the shared pool fit in their
+	// budgets: about a hundred bytes each.
+	for i := 0; i < 10; i++ {
+		get(fmt.Sprintf("quiet:%d", i))
+		get(fmt.Sprintf("shared-%d", i))
+	}
+	// The noisy tenant loads far more than its budget.
+	for i := 0; i < 1000; i++ {
+		get(fmt.Sprintf("noisy:%d", i))
+	}
+
+	loads.Store(0)
+	for i := 0; i < 10; i++ {
+		get(fmt.Sprintf("quiet:%d", i))
+		get(fmt.Sprintf("shared-%d", i))
+	}
+	if got := loads.Get(); got != 0 {
+		t.Errorf("the noisy tenant evicted %d keys of others", got)
+	}
+
+	quiet, noisy := g.TenantCacheStats("quiet", MainCache), g.TenantCacheStats("noisy", MainCache)
+	if quiet.Items != 10 || quiet.Evictions != 0 {
+		t.Errorf("quiet tenant stats = %+v; want 10 items and no evictions", quiet)
+	}
+	if noisy.Bytes > 4000 || noisy.Evictions == 0 {
+		t.Errorf("noisy tenant stats = %+v; want at most 4000 bytes and evictions", noisy)
+	}
+
+	// An unlisted tenant is confined to the shared pool's 6000 bytes.
+	for i := 0; i < 1000; i++ {
+		get(fmt.Sprintf("other:%d", i))
+	}
+	loads.Store(0)
+	for i := 0; i < 10; i++ {
+		get(fmt.Sprintf("quiet:%d", i))
+	}
+	if got := loads.Get(); got != 0 {
+		t.Errorf("the shared pool evicted %d keys of the quiet tenant", got)
+	}
+	all := g.CacheStats(MainCache)
+	if shared := all.Bytes - quiet.Bytes - g.TenantCacheStats("noisy", MainCache).Bytes; shared > 6000 {
+		t.Errorf("shared pool holds %d bytes; want at most 6000", shared)
+	}
+	if got := g.TenantCacheStats("other", MainCache); got != (CacheStats{}) {
+		t.Errorf("stats of a tenant without a budget = %+v; want zero", got)
+	}
+}
+
+func TestRoutingKey(t *testing.T) {
+	var peers fakePeers
+	for i := 0; i < 8; i++ {
+		peers = append(peers, &fakePeer{})
+	}
+	g := newGroupOpts("TestRoutingKey-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), peers, &GroupOptions{
+		// Route by the part of the key before the first slash.
+		RoutingKey: func(key string) string {
+			if i := strings.IndexByte(key, '/'); i >= 0 {
+				return key[:i]
+			}
+			return key
+		},
+	})
+
+	keys := []string{"user-1/profile", "user-1/settings", "user-1/avatar", "user-1"}
+	for _, key := range keys {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if want := "got:" + key; s != want {
+			t.Errorf("Get(%q) = %q; want %q", key, s, want)
+		}
+	}
+	owner, _ := peers.PickPeer("user-1")
+	for _, peer := range peers {
+		hits, want := peer.(*fakePeer).hits, 0
+		if peer == owner {
+			want = len(keys)
+		}
+		if hits != want {
+			t.Errorf("%d keys routed to a peer; want %d", hits, want)
+		}
+	}
+	if n := g.CacheStats(HotCache).Items; n != int64(len(keys)) {
+		t.Errorf("hot cache holds %d items; want one per key, %d", n, len(keys))
+	}
+}
+
+// fakeLocker is a DistributedLocker shared by groups standing in for
+// one group in the processes of a cluster. Since their names differ,
+// it only locks the part of each lock's name after the group's.
+type fakeLocker struct {
+	mu       sync.Mutex
+	locks    map[string]chan bool
+	acquires []string
+}
+
+func (l *fakeLocker) Acquire(ctx context.Context, name string) (func(), error) {
+	key := name[strings.IndexByte(name, '/')+1:]
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]chan bool)
+	}
+	lock := l.locks[key]
+	if lock == nil {
+		lock = make(chan bool, 1)
+		l.locks[key] = lock
+	}
+	l.acquires = append(l.acquires, name)
+	l.mu.Unlock()
+	select {
+	case lock <- true:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *fakeLocker) acquired() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.acquires...)
+}
+
+func TestDistributedLocker(t *testing.T) {
+	var (
+		locker       fakeLocker
+		mu           sync.Mutex
+		active, peak int
+		loads        int
+		releaseLoads = make(chan bool)
+	)
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		mu.Lock()
+		active++
+		loads++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		<-releaseLoads
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	// Two processes that both believe they own the key, as during
+	// churn, share one origin.
+	var groups []*Group
+	for _, name := range []string{"TestDistributedLocker-a", "TestDistributedLocker-b"} {
+		groups = append(groups, newGroupOpts(name, cacheSize, getter, NoPeers{}, &GroupOptions{DistributedLocker: &locker}))
+	}
+
+	errc := make(chan error, len(groups))
+	for _, g := range groups {
+		go func(g *Group) {
+			var s string
+			errc <- g.Get(context.Background(), "key", StringSink(&s), nil)
+		}(g)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(locker.acquired()) != len(groups) {
+		if time.Now().After(deadline) {
+			t.Fatalf("lock acquired %d times; want %d", len(locker.acquired()), len(groups))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < len(groups); i++ {
+		releaseLoads <- true
+	}
+	for range groups {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if peak != 1 || loads != len(groups) {
+		t.Errorf("%d loads, at most %d concurrently; want %d loads one at a time", loads, peak, len(groups))
+	}
+	acquired := locker.acquired()
+	sort.Strings(acquired)
+	if want := []string{"TestDistributedLocker-a/key", "TestDistributedLocker-b/key"}; !reflect.DeepEqual(acquired, want) {
+		t.Errorf("locks acquired = %q; want %q", acquired, want)
+	}
+
+	// A lock that cannot be taken fails the load.
+	ctx, cancel := context.WithCancel(context.Background())
+	release, err := locker.Acquire(ctx, groups[0].Name()+"/held")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	cancel()
+	var s string
+	if err := groups[0].Get(ctx, "held", StringSink(&s), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get with the lock held elsewhere = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	var loads AtomicInt
+	g := newGroup("TestReadOnly-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("loaded:"+key, time.Time{})
+	}), NoPeers{})
+
+	var s string
+	if err := g.Get(dummyCtx, "cached", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	g.SetReadOnly(true)
+	if !g.ReadOnly() {
+		t.Error("ReadOnly() = false after SetReadOnly(true)")
+	}
+	if err := g.Get(dummyCtx, "cached", StringSink(&s), nil); err != nil || s != "loaded:cached" {
+		t.Errorf("Get(cached) while read-only = %q, %v; want the cached value", s, err)
+	}
+	if err := g.Get(dummyCtx, "missing", StringSink(&s), nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Get(missing) while read-only = %v; want ErrReadOnly", err)
+	}
+	if got := loads.Get(); got != 1 {
+		t.Errorf("getter loads = %d; want 1, before the group was read-only", got)
+	}
+	if got := g.Stats.ReadOnlyRejects.Get(); got != 1 {
+		t.Errorf("ReadOnlyRejects = %d; want 1", got)
+	}
+
+	g.SetReadOnly(false)
+	if err := g.Get(dummyCtx, "missing", StringSink(&s), nil); err != nil || s != "loaded:missing" {
+		t.Errorf("Get(missing) after SetReadOnly(false) = %q, %v; want it loaded", s, err)
+	}
+}
+
+func TestGetIfChanged(t *testing.T) {
+	var loads AtomicInt
+	g := newGroup("TestGetIfChanged-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("loaded:"+key, time.Time{})
+	}), keyPeers{"remote": &fakePeer{}})
+
+	for _, key := range []string{"local", "remote"} {
+		want := "loaded:" + key
+		if key == "remote" {
+			want = "got:" + key
+		}
+		s := "untouched"
+		changed, err := g.GetIfChanged(dummyCtx, key, ETag([]byte(want)), StringSink(&s))
+		if err != nil || changed || s != "untouched" {
+			t.Errorf("GetIfChanged(%s) with the current ETag = %v, %v, set %q; want unchanged", key, changed, err, s)
+		}
+		changed, err = g.GetIfChanged(dummyCtx, key, ETag([]byte("old")), StringSink(&s))
+		if err != nil || !changed || s != want {
+			t.Errorf("GetIfChanged(%s) with an old ETag = %v, %v, set %q; want changed to %q", key, changed, err, s, want)
+		}
+	}
+	if got := loads.Get(); got != 1 {
+		t.Errorf("getter loads = %d; want 1", got)
+	}
+	if got := g.Stats.NotModified.Get(); got != 2 {
+		t.Errorf("NotModified = %d; want 2", got)
+	}
+}
+
+func TestGetWithInfoSource(t *testing.T) {
+	now := time.Unix(1000, 0)
+	g := newGroupOpts("TestGetWithInfoSource-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), prefixPeers{&fakePeer{}}, &GroupOptions{
+		Clock:             func() time.Time { return now },
+		HotCachePromotion: promotionFunc(func(string, ByteView) bool { return true }),
+	})
+	for i, tc := range []struct {
+		key    string
+		source ValueSource
+		age    time.Duration
+		bytes  int
+	}{
+		{"key", SourceOrigin, 0, len("value:key")},
+		{"key", SourceMainCache, time.Minute, len("value:key")},
+		{"remote-key", SourcePeer, 0, len("got:remote-key")},
+		{"remote-key", SourceHotCache, time.Minute, len("got:remote-key")},
+	} {
+		var s string
+		info, err := g.GetWithInfo(dummyCtx, tc.key, StringSink(&s), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Source != tc.source || info.Age != tc.age || info.Bytes != tc.bytes {
+			t.Errorf("Get %d of %q: source %v, age %v, %d bytes; want %v, %v, %d", i, tc.key, info.Source, info.Age, info.Bytes, tc.source, tc.age, tc.bytes)
+		}
+		now = now.Add(time.Minute)
+	}
+}
+
+func TestDeregisterGroup(t *testing.T) {
+	const name = "TestDeregisterGroup-group"
+	var evicted []string
+	g := newGroupOpts(name, 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{OnEvicted: func(key string, value ByteView) {
+		evicted = append(evicted, key)
+	}})
+	for _, key := range []string{"a", "b"} {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	DeregisterGroup(name)
+	if GetGroup(name) != nil {
+		t.Error("GetGroup returned the deregistered group")
+	}
+	if st := g.CacheStats(MainCache); st.Items != 0 || st.Bytes != 0 {
+		t.Errorf("deregistered group holds %d items, %d bytes; want none", st.Items, st.Bytes)
+	}
+	if len(evicted) != 2 {
+		t.Errorf("OnEvicted called for %q; want both keys", evicted)
+	}
+	// The name can be used again.
+	defer DeregisterGroup(name)
+	newGroup(name, 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("", time.Time{})
+	}), NoPeers{})
+}
+
+func TestSetCacheBytes(t *testing.T) {
+	g := newGroup("TestSetCacheBytes-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(strings.Repeat("x", 100), time.Time{})
+	}), NoPeers{})
+	for i := 0; i < 10; i++ {
+		var s string
+		if err := g.Get(dummyCtx, fmt.Sprintf("key-%d", i), StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := g.CacheStats(MainCache).Items; n != 10 {
+		t.Fatalf("cache holds %d items; want 10", n)
+	}
+	g.SetCacheBytes(350)
+	if st := g.CacheStats(MainCache); st.Items != 3 || st.Bytes > 350 {
+		t.Errorf("after shrinking, cache holds %d items, %d bytes; want 3 within 350 bytes", st.Items, st.Bytes)
+	}
+	g.SetCacheBytes(0)
+	if n := g.CacheStats(MainCache).Items; n != 0 {
+		t.Errorf("after SetCacheBytes(0), cache holds %d items; want 0", n)
+	}
+	var s string
+	if err := g.Get(dummyCtx, "key-0", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := g.CacheStats(MainCache).Items; n != 0 {
+		t.Errorf("with no cache bytes, Get cached %d items; want 0", n)
+	}
+}
+
+func TestSetCacheBytesTenants(t *testing.T) {
+	g := newGroupOpts("TestSetCacheBytesTenants-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(strings.Repeat("x", 100), time.Time{})
+	}), NoPeers{}, &GroupOptions{
+		KeyTenant: func(key string) string {
+			if i := strings.IndexByte(key, ':'); i >= 0 {
+				return key[:i]
+			}
+			return ""
+		},
+		TenantBudgets: map[string]int64{"tenant": 4000},
+	})
+	for i := 0; i < 10; i++ {
+		var s string
+		if err := g.Get(dummyCtx, fmt.Sprintf("tenant:%d", i), StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := g.TenantCacheStats("tenant", MainCache).Items; n != 10 {
+		t.Fatalf("tenant cache holds %d items; want 10", n)
+	}
+	g.SetCacheBytes(0)
+	if n := g.TenantCacheStats("tenant", MainCache).Items; n != 0 {
+		t.Errorf("after SetCacheBytes(0), tenant cache holds %d items; want 0", n)
+	}
+}
+
+// clientPeers is a prefixPeers for a process owning no keys.
+type clientPeers struct {
+	prefixPeers
+}
+
+func (clientPeers) IsClient() bool { return true }
+
+func TestClientPeerPicker(t *testing.T) {
+	peer := &fakePeer{}
+	var loads AtomicInt
+	g := newGroupOpts("TestClientPeerPicker-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("local:"+key, time.Time{})
+	}), clientPeers{prefixPeers{peer}}, &GroupOptions{
+		HotCachePromotion: promotionFunc(func(string, ByteView) bool { return true }),
+	})
+	var s string
+	if err := g.Get(dummyCtx, "remote-key", StringSink(&s), nil); err != nil || s != "got:remote-key" {
+		t.Fatalf("Get = %q, %v; want %q", s, err, "got:remote-key")
+	}
+	if n := g.CacheStats(HotCache).Items; n != 1 {
+		t.Errorf("hot cache holds %d items; want the mirrored value", n)
+	}
+
+	// Values loaded locally after the owner failed are not cached.
+	peer.fail = true
+	for i := 0; i < 2; i++ {
+		if err := g.Get(dummyCtx, "remote-other", StringSink(&s), nil); err != nil || s != "local:remote-other" {
+			t.Fatalf("Get %d = %q, %v; want %q", i, s, err, "local:remote-other")
+		}
+	}
+	if n := loads.Get(); n != 2 {
+		t.Errorf("getter loaded %d times; want 2", n)
+	}
+	if n := g.CacheStats(MainCache).Items; n != 0 {
+		t.Errorf("main cache holds %d items; want none", n)
+	}
+}
@@ -0,0 +1,495 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/melojustme/groupcache/consistenthash"
+	pb "github.com/melojustme/groupcache/groupcachepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCPool implements PeerPicker for a pool of gRPC peers, as an
+// alternative to HTTPPool. Peers serve the GroupCache service of
+// groupcachepb, sending the same messages as HTTPPool's peers do, and
+// the flags HTTPPool sends as headers, such as the hop count, as
+// metadata of the same names.
+type GRPCPool struct {
+	// self is this peer's address, for example "example.net:8000".
+	self string
+
+	opts GRPCPoolOptions
+
+	mu    sync.Mutex   // serializes changes of peers
+	peers atomic.Value // of *grpcPeerSet
+}
+
+// GRPCPoolOptions are the configurations of a GRPCPool.
+type GRPCPoolOptions struct {
+	// Replicas specifies the number of key replicas on the consistent hash.
+	// If zero, it defaults to 50.
+	Replicas int
+
+	// HashFn specifies the hash function of the consistent hash.
+	// If nil, it defaults to crc32.ChecksumIEEE.
+	HashFn consistenthash.Hash
+
+	// DialOptions are passed to grpc.Dial when connecting to peers,
+	// such as transport credentials for mutual TLS and client
+	// interceptors. They must include transport credentials.
+	// If nil, connections are made without transport security.
+	DialOptions []grpc.DialOption
+}
+
+// grpcPeerSet is a snapshot of the peers of a GRPCPool.
+type grpcPeerSet struct {
+	ring    *consistenthash.Map
+	getters map[string]*grpcGetter // keyed by address
+}
+
+// NewGRPCPool initializes a gRPC pool of peers, registers itself as a
+// PeerPicker, and registers the GroupCache service on server to answer
+// the requests of its peers. The self argument is the address other
+// peers reach server at, as passed to Set, for example
+// "example.net:8000".
+func NewGRPCPool(self string, server *grpc.Server) *GRPCPool {
+	return NewGRPCPoolOpts(self, server, nil)
+}
+
+// NewGRPCPoolOpts is like NewGRPCPool, with the given options.
+func NewGRPCPoolOpts(self string, server *grpc.Server, o *GRPCPoolOptions) *GRPCPool {
+	p := newGRPCPool(self, o)
+	pb.RegisterGroupCacheServer(server, grpcServer{})
+	RegisterPeerPicker(func() PeerPicker { return p })
+	return p
+}
+
+// newGRPCPool creates a GRPCPool without registering it as the
+// process-wide PeerPicker, nor its service on a server.
+func newGRPCPool(self string, o *GRPCPoolOptions) *GRPCPool {
+	p := &GRPCPool{self: self}
+	if o != nil {
+		p.opts = *o
+	}
+	if p.opts.Replicas == 0 {
+		p.opts.Replicas = defaultReplicas
+	}
+	if p.opts.DialOptions == nil {
+		p.opts.DialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	p.peers.Store(&grpcPeerSet{ring: consistenthash.New(p.opts.Replicas, p.opts.HashFn)})
+	return p
+}
+
+func (p *GRPCPool) current() *grpcPeerSet {
+	return p.peers.Load().(*grpcPeerSet)
+}
+
+// Set updates the pool's list of peers, given by address. Connections
+// to peers that remain are kept, and those to the others closed.
+func (p *GRPCPool) Set(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.current()
+	ps := &grpcPeerSet{
+		ring:    consistenthash.New(p.opts.Replicas, p.opts.HashFn),
+		getters: make(map[string]*grpcGetter, len(peers)),
+	}
+	ps.ring.Add(peers...)
+	for _, peer := range peers {
+		if h := old.getters[peer]; h != nil {
+			ps.getters[peer] = h
+			continue
+		}
+		ps.getters[peer] = newGRPCGetter(peer, p.opts.DialOptions)
+	}
+	p.peers.Store(ps)
+	for peer, h := range old.getters {
+		if ps.getters[peer] == nil {
+			h.close()
+		}
+	}
+}
+
+// Close closes the connections to the pool's peers.
+func (p *GRPCPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, h := range p.current().getters {
+		h.close()
+	}
+	p.peers.Store(&grpcPeerSet{ring: consistenthash.New(p.opts.Replicas, p.opts.HashFn)})
+}
+
+func (p *GRPCPool) PickPeer(key string) (ProtoGetter, bool) {
+	ps := p.current()
+	if ps.ring.IsEmpty() {
+		return nil, false
+	}
+	if peer := ps.ring.Get(key); peer != p.self {
+		return ps.getters[peer], true
+	}
+	return nil, false
+}
+
+// PickOwners implements OwnersPeerPicker, returning the first n peers
+// for key on the consistent hash.
+func (p *GRPCPool) PickOwners(key string, n int) []ProtoGetter {
+	ps := p.current()
+	names := ps.ring.GetN(key, n)
+	owners := make([]ProtoGetter, len(names))
+	for i, name := range names {
+		if name != p.self {
+			owners[i] = ps.getters[name]
+		}
+	}
+	return owners
+}
+
+// GetAll returns all the peers in the pool
+func (p *GRPCPool) GetAll() []ProtoGetter {
+	ps := p.current()
+	res := make([]ProtoGetter, 0, len(ps.getters))
+	for _, h := range ps.getters {
+		res = append(res, h)
+	}
+	return res
+}
+
+// grpcServer answers the requests of a GRPCPool's peers, like
+// HTTPPool.ServeHTTP.
+type grpcServer struct{}
+
+// group returns the group named in a request received with ctx, and
+// the context to serve it with.
+func (grpcServer) group(ctx context.Context, name string) (*Group, context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	flag := func(header string) bool { return len(md.Get(header)) > 0 }
+	var hops int
+	if h := md.Get(hopsHeader); len(h) > 0 {
+		n, err := strconv.Atoi(h[0])
+		if err != nil || n < 0 {
+			return nil, nil, status.Error(codes.InvalidArgument, "bad "+hopsHeader+" metadata")
+		}
+		hops = n
+	}
+	if hops > maxPeerHops {
+		return nil, nil, status.Error(codes.Aborted, "peer forwarding loop detected")
+	}
+	if hops == 0 {
+		hops = 1
+	}
+	g := GetGroup(name)
+	if g == nil {
+		return nil, nil, status.Error(codes.NotFound, "no such group: "+name)
+	}
+	ctx = withPeerHops(ctx, hops)
+	if flag(refreshHeader) {
+		ctx = WithForceRefresh(ctx)
+	}
+	if flag(replicaHeader) {
+		ctx = withReplicaRead(ctx, true)
+	}
+	if flag(ownerFetchHeader) {
+		ctx = withOwnerFetch(ctx)
+	}
+	g.Stats.ServerRequests.Add(1)
+	return g, ctx, nil
+}
+
+// grpcError returns the status answering a request failing with err.
+// ErrNotFound and ErrReadOnly are told apart from other errors by the
+// trailer set for them, as by the headers HTTPPool sets.
+func grpcError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		grpc.SetTrailer(ctx, metadata.Pairs(notFoundHeader, "1"))
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrReadOnly):
+		grpc.SetTrailer(ctx, metadata.Pairs(readOnlyHeader, "1"))
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// getResponse returns the response carrying view.
+func getResponse(view ByteView) *pb.GetResponse {
+	var expireNano int64
+	if !view.e.IsZero() {
+		expireNano = view.Expire().UnixNano()
+	}
+	return &pb.GetResponse{Value: view.ByteSlice(), Expire: &expireNano, Meta: view.meta, Tags: view.tags}
+}
+
+func expireTime(nano int64) time.Time {
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(nano/int64(time.Second), nano%int64(time.Second))
+}
+
+func (s grpcServer) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	g, ctx, err := s.group(ctx, in.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	g.adoptGeneration(in.GetGeneration())
+	var view ByteView
+	info, err := g.GetWithInfo(ctx, in.GetKey(), ByteViewSink(&view), nil)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	if in.GetPopulate() {
+		return &pb.GetResponse{}, nil
+	}
+	// Answer a conditional Get sent by GetIfChanged without the value
+	// if the caller holds it already.
+	if in.Etag != nil && *in.Etag == view.etag() {
+		return &pb.GetResponse{NotModified: proto.Bool(true)}, nil
+	}
+	g.Stats.BytesServedToPeers.Add(int64(view.Len()))
+	// The sink's view lacks the metadata if the getter populated it.
+	view.meta = info.Meta
+	return getResponse(view), nil
+}
+
+func (s grpcServer) Set(ctx context.Context, in *pb.SetRequest) (*pb.GetResponse, error) {
+	g, _, err := s.group(ctx, in.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	if in.GetHotCache() {
+		g.localSetHot(in.GetKey(), in.Value, expireTime(in.GetExpire()), in.Tags)
+		return &pb.GetResponse{}, nil
+	}
+	g.localSetTagged(in.GetKey(), in.Value, expireTime(in.GetExpire()), in.Tags, &g.mainCache)
+	return &pb.GetResponse{}, nil
+}
+
+func (s grpcServer) GetOrSet(ctx context.Context, in *pb.SetRequest) (*pb.GetResponse, error) {
+	g, _, err := s.group(ctx, in.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	view := g.getOrSetLocally(in.GetKey(), in.Value, expireTime(in.GetExpire()))
+	g.Stats.BytesServedToPeers.Add(int64(view.Len()))
+	return getResponse(view), nil
+}
+
+func (s grpcServer) Remove(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	g, _, err := s.group(ctx, in.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	g.localRemove(in.GetKey())
+	return &pb.GetResponse{}, nil
+}
+
+func (s grpcServer) RemoveTag(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	g, _, err := s.group(ctx, in.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	g.localRemoveTag(in.GetKey())
+	return &pb.GetResponse{}, nil
+}
+
+func (s grpcServer) Exists(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	g, _, err := s.group(ctx, in.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := g.Contains(in.GetKey()); !ok {
+		return nil, grpcError(ctx, ErrNotFound)
+	}
+	return &pb.GetResponse{}, nil
+}
+
+func (s grpcServer) Checksum(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	g, _, err := s.group(ctx, in.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	// Only the main cache of the key's owner holds its checksum.
+	sum, ok := g.mainChecksum(in.GetKey())
+	if !ok {
+		return nil, grpcError(ctx, ErrNotFound)
+	}
+	return &pb.GetResponse{Checksum: &sum}, nil
+}
+
+func (s grpcServer) GetMulti(ctx context.Context, in *pb.GetMultiRequest) (*pb.GetMultiResponse, error) {
+	g, ctx, err := s.group(ctx, in.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	g.adoptGeneration(in.GetGeneration())
+	return g.serveGetMulti(ctx, in.Keys), nil
+}
+
+// grpcGetter is the ProtoGetter of a GRPCPool's peer.
+type grpcGetter struct {
+	addr   string
+	conn   *grpc.ClientConn
+	client pb.GroupCacheClient
+	err    error // of dialing, returned by every call if non-nil
+}
+
+func newGRPCGetter(addr string, opts []grpc.DialOption) *grpcGetter {
+	h := &grpcGetter{addr: addr}
+	h.conn, h.err = grpc.Dial(addr, opts...)
+	if h.err == nil {
+		h.client = pb.NewGroupCacheClient(h.conn)
+	}
+	return h
+}
+
+func (h *grpcGetter) close() {
+	if h.conn != nil {
+		h.conn.Close()
+	}
+}
+
+func (h *grpcGetter) GetURL() string {
+	return h.addr
+}
+
+// call makes a request with fn, passing it the context to make it
+// with, which carries the metadata HTTPPool would send as headers.
+func (h *grpcGetter) call(ctx context.Context, fn func(context.Context, ...grpc.CallOption) (*pb.GetResponse, error)) (*pb.GetResponse, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	md := metadata.Pairs(hopsHeader, strconv.Itoa(peerHops(ctx)+1))
+	if forceRefresh(ctx) {
+		md.Set(refreshHeader, "1")
+	}
+	if replicaRead(ctx) {
+		md.Set(replicaHeader, "1")
+	}
+	if ownerFetch(ctx) {
+		md.Set(ownerFetchHeader, "1")
+	}
+	var trailer metadata.MD
+	res, err := fn(metadata.NewOutgoingContext(ctx, md), grpc.Trailer(&trailer))
+	if err == nil {
+		return res, nil
+	}
+	switch {
+	case len(trailer.Get(notFoundHeader)) > 0:
+		return nil, ErrNotFound
+	case len(trailer.Get(readOnlyHeader)) > 0:
+		return nil, ErrReadOnly
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	}
+	return nil, err
+}
+
+func (h *grpcGetter) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	res, err := h.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+		return h.client.Get(ctx, in, opts...)
+	})
+	if err != nil {
+		return err
+	}
+	proto.Merge(out, res)
+	return nil
+}
+
+func (h *grpcGetter) Set(ctx context.Context, in *pb.SetRequest) error {
+	_, err := h.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+		return h.client.Set(ctx, in, opts...)
+	})
+	return err
+}
+
+func (h *grpcGetter) GetOrSet(ctx context.Context, in *pb.SetRequest, out *pb.GetResponse) error {
+	res, err := h.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+		return h.client.GetOrSet(ctx, in, opts...)
+	})
+	if err != nil {
+		return err
+	}
+	proto.Merge(out, res)
+	return nil
+}
+
+func (h *grpcGetter) Exists(ctx context.Context, in *pb.GetRequest) (bool, error) {
+	_, err := h.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+		return h.client.Exists(ctx, in, opts...)
+	})
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *grpcGetter) Checksum(ctx context.Context, in *pb.GetRequest) (uint32, bool, error) {
+	res, err := h.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+		return h.client.Checksum(ctx, in, opts...)
+	})
+	if err == ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return res.GetChecksum(), true, nil
+}
+
+func (h *grpcGetter) Remove(ctx context.Context, in *pb.GetRequest) error {
+	_, err := h.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+		return h.client.Remove(ctx, in, opts...)
+	})
+	return err
+}
+
+func (h *grpcGetter) RemoveTag(ctx context.Context, in *pb.GetRequest) error {
+	_, err := h.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+		return h.client.RemoveTag(ctx, in, opts...)
+	})
+	return err
+}
+
+func (h *grpcGetter) GetMulti(ctx context.Context, in *pb.GetMultiRequest, out *pb.GetMultiResponse) error {
+	var res *pb.GetMultiResponse
+	_, err := h.call(ctx, func(ctx context.Context, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+		var err error
+		res, err = h.client.GetMulti(ctx, in, opts...)
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+	proto.Merge(out, res)
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/melojustme/groupcache/groupcachepb"
+	"google.golang.org/grpc"
+)
+
+// startGRPCServer serves the GroupCache service on a loopback port,
+// returning its address and a function stopping it.
+func startGRPCServer(t *testing.T) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	pb.RegisterGroupCacheServer(s, grpcServer{})
+	go s.Serve(ln)
+	return ln.Addr().String(), s.Stop
+}
+
+func TestGRPCPool(t *testing.T) {
+	var loads AtomicInt
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		if key == "remote-missing" {
+			return ErrNotFound
+		}
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	owner := newGroup("TestGRPCPool-owner", 1<<20, getter, NoPeers{})
+	addr, stop := startGRPCServer(t)
+	defer stop()
+	p := newGRPCPool("127.0.0.1:1", nil)
+	defer p.Close()
+	p.Set("127.0.0.1:1", addr)
+	peer := &renamingGetter{ProtoGetter: p.current().getters[addr], group: owner.Name()}
+	client := newGroup("TestGRPCPool-client", 1<<20, getter, prefixPeers{peer})
+
+	ctx := context.Background()
+	var s string
+	if err := client.Get(ctx, "remote-key", StringSink(&s), nil); err != nil || s != "value:remote-key" {
+		t.Fatalf("Get = %q, %v; want value:remote-key", s, err)
+	}
+	if got := owner.Stats.ServerRequests.Get(); got != 1 {
+		t.Errorf("owner ServerRequests = %d; want 1", got)
+	}
+	if err := client.Get(ctx, "remote-missing", StringSink(&s), nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing key = %v; want ErrNotFound", err)
+	}
+	if got := loads.Get(); got != 2 {
+		t.Errorf("getter loads = %d; want 2, by the owner only", got)
+	}
+
+	if ok, err := peer.Exists(ctx, &pb.GetRequest{Key: proto.String("remote-key")}); err != nil || !ok {
+		t.Errorf("Exists of a cached key = %v, %v; want true", ok, err)
+	}
+	if ok, err := peer.Exists(ctx, &pb.GetRequest{Key: proto.String("remote-other")}); err != nil || ok {
+		t.Errorf("Exists of an uncached key = %v, %v; want false", ok, err)
+	}
+	sum, ok, err := peer.Checksum(ctx, &pb.GetRequest{Key: proto.String("remote-key")})
+	if want, _ := owner.mainChecksum("remote-key"); err != nil || !ok || sum != want {
+		t.Errorf("Checksum = %d, %v, %v; want %d", sum, ok, err, want)
+	}
+
+	var multi pb.GetMultiResponse
+	err = peer.GetMulti(ctx, &pb.GetMultiRequest{Keys: []string{"remote-key", "remote-missing"}}, &multi)
+	if err != nil || len(multi.Values) != 2 || string(multi.Values[0].Value) != "value:remote-key" || !multi.Values[1].GetNotFound() {
+		t.Errorf("GetMulti = %v, %v; want the cached value and a missing key", multi.Values, err)
+	}
+
+	// Populate requests load the key without answering with the value.
+	var populated pb.GetResponse
+	if err := peer.Get(ctx, &pb.GetRequest{Key: proto.String("remote-populated"), Populate: proto.Bool(true)}, &populated); err != nil || populated.Value != nil {
+		t.Errorf("populate Get = %q, %v; want no value", populated.Value, err)
+	}
+	if _, ok := owner.Contains("remote-populated"); !ok {
+		t.Errorf("owner does not hold the key of a populate Get")
+	}
+
+	// Hot key pushes are left out of the main cache, and so ignored by
+	// the owner of the key.
+	if err := peer.Set(ctx, &pb.SetRequest{Key: proto.String("remote-pushed"), Value: []byte("pushed"), HotCache: proto.Bool(true)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := owner.lookupCacheIn("remote-pushed"); ok {
+		t.Errorf("owner cached a hot key push")
+	}
+
+	// The owner adopts the generation of the requests it gets.
+	client.SetGeneration(2)
+	if err := client.Get(ctx, "remote-key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := owner.Generation(); got != 2 {
+		t.Errorf("owner generation after a Get under generation 2 = %d; want 2", got)
+	}
+	if err := peer.GetMulti(ctx, &pb.GetMultiRequest{Keys: []string{"remote-key"}, Generation: proto.Uint64(3)}, &multi); err != nil {
+		t.Fatal(err)
+	}
+	if got := owner.Generation(); got != 3 {
+		t.Errorf("owner generation after a GetMulti under generation 3 = %d; want 3", got)
+	}
+
+	if err := client.Set(ctx, "remote-set", []byte("set value"), time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	var res pb.GetResponse
+	if err := peer.GetOrSet(ctx, &pb.SetRequest{Key: proto.String("remote-set"), Value: []byte("other")}, &res); err != nil || string(res.Value) != "set value" {
+		t.Errorf("GetOrSet of a set key = %q, %v; want the value set first", res.Value, err)
+	}
+	if err := client.Remove(ctx, "remote-set"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := owner.Contains("remote-set"); ok {
+		t.Errorf("owner still holds remote-set after Remove")
+	}
+
+	// Requests forwarded too many times are refused.
+	err = peer.Get(withPeerHops(ctx, maxPeerHops), &pb.GetRequest{Key: proto.String("remote-loop")}, &res)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Get forwarded %d times = %v; want a loop error", maxPeerHops+1, err)
+	}
+}
+
+func TestGRPCPoolPickPeer(t *testing.T) {
+	p := newGRPCPool("self:1", nil)
+	defer p.Close()
+	p.Set("self:1", "peer-a:1", "peer-b:1")
+	local, remote := 0, map[string]int{}
+	for i := 0; i < 100; i++ {
+		peer, ok := p.PickPeer(string(rune('a'+i%26)) + string(rune('a'+i/26)))
+		if !ok {
+			local++
+			continue
+		}
+		remote[peer.GetURL()]++
+	}
+	if local == 0 || remote["peer-a:1"] == 0 || remote["peer-b:1"] == 0 || len(remote) != 2 {
+		t.Errorf("picked self %d times and peers %v; want keys spread over all three", local, remote)
+	}
+	if got := len(p.GetAll()); got != 3 {
+		t.Errorf("GetAll returned %d peers; want 3", got)
+	}
+
+	p.Set("self:1", "peer-a:1")
+	if got := len(p.GetAll()); got != 2 {
+		t.Errorf("GetAll after removing a peer returned %d peers; want 2", got)
+	}
+}
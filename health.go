@@ -0,0 +1,229 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultHealthCheckFailures is how many probes in a row a peer must
+// fail before it is ejected, if HTTPPoolOptions.HealthCheckFailures is
+// zero.
+const defaultHealthCheckFailures = 3
+
+// healthCheck periodically probes the peers of an HTTPPool when
+// HTTPPoolOptions.HealthCheckInterval is set.
+type healthCheck struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startHealthCheck starts probing the peers of p every
+// HTTPPoolOptions.HealthCheckInterval.
+func (p *HTTPPool) startHealthCheck() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &healthCheck{cancel: cancel, done: make(chan struct{})}
+	p.healthCheck = c
+	go func() {
+		defer close(c.done)
+		t := time.NewTicker(p.opts.HealthCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				p.checkPeers(ctx)
+			}
+		}
+	}()
+}
+
+// stop stops the probes and waits for those in flight to end.
+func (c *healthCheck) stop() {
+	c.cancel()
+	<-c.done
+}
+
+// checkPeers probes each peer other than p itself, then ejects from
+// the consistent hash those that failed HealthCheckFailures probes in
+// a row and puts back those ejected that answered, calling
+// OnPeerDown and OnPeerUp for them.
+func (p *HTTPPool) checkPeers(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, p.opts.HealthCheckTimeout)
+	defer cancel()
+	ps := p.current()
+	errs := make(map[*httpGetter]error, len(ps.getters))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for peer, h := range ps.getters {
+		if peer == p.self {
+			continue
+		}
+		wg.Add(1)
+		go func(h *httpGetter) {
+			defer wg.Done()
+			err := p.probe(ctx, h)
+			mu.Lock()
+			errs[h] = err
+			mu.Unlock()
+		}(h)
+	}
+	wg.Wait()
+	if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+		// Close was called: the probes failed for lack of time, not
+		// because the peers are down.
+		return
+	}
+
+	var down map[string]error
+	var up []string
+	p.mu.Lock()
+	ps = p.current()
+	changed := false
+	for peer, h := range ps.getters {
+		err, ok := errs[h]
+		if !ok {
+			// Set replaced the peer since it was probed.
+			continue
+		}
+		if err == nil {
+			h.probeFailures = 0
+			if ps.down[peer] {
+				up = append(up, peer)
+				changed = true
+			}
+			continue
+		}
+		h.probeFailures++
+		if !ps.down[peer] && h.probeFailures >= p.opts.HealthCheckFailures {
+			if down == nil {
+				down = make(map[string]error)
+			}
+			down[peer] = err
+			changed = true
+		}
+	}
+	if changed {
+		ejected := make(map[string]bool, len(ps.down)+len(down))
+		for peer := range ps.down {
+			ejected[peer] = true
+		}
+		for peer := range down {
+			ejected[peer] = true
+		}
+		for _, peer := range up {
+			delete(ejected, peer)
+		}
+		p.peers.Store(p.newPeerSet(ps.getters, ejected))
+	}
+	p.mu.Unlock()
+
+	for peer, err := range down {
+		if log := p.logger(); log != nil {
+			log.WithFields(logrus.Fields{
+				"err":      err,
+				"category": "groupcache",
+			}).Warnf("ejecting peer '%s' failing health checks", peer)
+		}
+		if p.opts.OnPeerDown != nil {
+			p.opts.OnPeerDown(peer, err)
+		}
+	}
+	for _, peer := range up {
+		if p.opts.OnPeerUp != nil {
+			p.opts.OnPeerUp(peer)
+		}
+	}
+}
+
+// newPeerSet returns the peers of getters, keeping those in down off
+// the consistent hash.
+func (p *HTTPPool) newPeerSet(getters map[string]*httpGetter, down map[string]bool) *peerSet {
+	ps := &peerSet{ring: p.newRing(), getters: getters}
+	live := make([]string, 0, len(getters))
+	for peer := range getters {
+		if down[peer] {
+			continue
+		}
+		live = append(live, peer)
+	}
+	ps.ring.Add(live...)
+	if len(live) < len(getters) {
+		ps.down = down
+	}
+	return ps
+}
+
+// probe sends a health check to the peer of h, returning an error
+// unless it was answered with a 2xx status.
+func (p *HTTPPool) probe(ctx context.Context, h *httpGetter) error {
+	u := h.baseURL + pingPath + "/"
+	if p.opts.HealthCheckPath != "" {
+		base, err := url.Parse(h.baseURL)
+		if err != nil {
+			return err
+		}
+		ref, err := url.Parse(p.opts.HealthCheckPath)
+		if err != nil {
+			return err
+		}
+		u = base.ResolveReference(ref).String()
+	}
+	method := http.MethodGet
+	if p.opts.HealthCheckPath == "" {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return err
+	}
+	h.modify(ctx, req)
+	res, err := h.transport(ctx).RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("health check of %s: %s", u, res.Status)
+	}
+	return nil
+}
+
+// DownPeers returns, sorted, the peers currently ejected from the
+// consistent hash for failing the probes of
+// HTTPPoolOptions.HealthCheckInterval.
+func (p *HTTPPool) DownPeers() []string {
+	ps := p.current()
+	var res []string
+	for peer := range ps.down {
+		res = append(res, peer)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckEjectsDeadPeers(t *testing.T) {
+	var sick int32
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("probed %q, want /healthz", r.URL.Path)
+		}
+		if atomic.LoadInt32(&sick) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flaky.Close()
+
+	var downs, ups []string
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{
+		HealthCheckPath:     "/healthz",
+		HealthCheckTimeout:  time.Second,
+		HealthCheckFailures: 2,
+		OnPeerDown:          func(peer string, err error) { downs = append(downs, peer) },
+		OnPeerUp:            func(peer string) { ups = append(ups, peer) },
+	})
+	p.Set(healthy.URL, flaky.URL)
+
+	owners := func() map[string]bool {
+		res := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			peer, ok := p.PickPeer(strconv.Itoa(i))
+			if !ok {
+				t.Fatal("no peer picked")
+			}
+			res[peer.(*httpGetter).baseURL] = true
+		}
+		return res
+	}
+	flakyBase := flaky.URL + defaultBasePath
+	if !owners()[flakyBase] {
+		t.Fatal("flaky peer owns no keys before failing")
+	}
+
+	atomic.StoreInt32(&sick, 1)
+	p.checkPeers(context.Background())
+	if len(downs) != 0 || len(p.DownPeers()) != 0 {
+		t.Fatalf("peer ejected after a single failure; downs = %v", downs)
+	}
+	p.checkPeers(context.Background())
+	if len(downs) != 1 || downs[0] != flaky.URL {
+		t.Fatalf("downs = %v, want [%s]", downs, flaky.URL)
+	}
+	if got := p.DownPeers(); len(got) != 1 || got[0] != flaky.URL {
+		t.Errorf("DownPeers() = %v, want [%s]", got, flaky.URL)
+	}
+	if owners()[flakyBase] {
+		t.Error("ejected peer still owns keys")
+	}
+	if n := len(p.GetAll()); n != 1 {
+		t.Errorf("GetAll returned %d peers, want 1", n)
+	}
+
+	// Setting the same peers again keeps the dead one off the ring.
+	p.Set(healthy.URL, flaky.URL)
+	if owners()[flakyBase] {
+		t.Error("Set put the ejected peer back on the ring")
+	}
+
+	atomic.StoreInt32(&sick, 0)
+	p.checkPeers(context.Background())
+	if len(ups) != 1 || ups[0] != flaky.URL {
+		t.Fatalf("ups = %v, want [%s]", ups, flaky.URL)
+	}
+	if len(p.DownPeers()) != 0 {
+		t.Errorf("DownPeers() = %v after recovery", p.DownPeers())
+	}
+	if !owners()[flakyBase] {
+		t.Error("recovered peer owns no keys")
+	}
+}
+
+func TestHealthCheckPingsByDefault(t *testing.T) {
+	peer := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(peer)
+	defer ts.Close()
+
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{
+		HealthCheckInterval: 10 * time.Millisecond,
+		HealthCheckFailures: 1,
+	})
+	defer p.Close()
+	p.Set(ts.URL)
+	if err := p.probe(context.Background(), p.current().getters[ts.URL]); err != nil {
+		t.Errorf("probe of a groupcache peer: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// getFromPeerHedged is getFromPeer, also asking a backup peer for key
+// if peer did not answer within GroupOptions.HedgeDelay, and returning
+// the first value either peer returns.
+func (g *Group) getFromPeerHedged(ctx context.Context, peer ProtoGetter, key string, mirror bool) (ByteView, error) {
+	if g.opts.HedgeDelay <= 0 {
+		return g.getFromPeer(ctx, peer, key, mirror)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// The fetches run concurrently, so their steps are recorded here
+	// rather than by getFromPeer.
+	explain := explaining(ctx)
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if explain != nil {
+		fetchCtx = context.WithValue(fetchCtx, explainKey{}, (*ExplainResult)(nil))
+	}
+
+	type result struct {
+		peer  ProtoGetter
+		value ByteView
+		err   error
+	}
+	results := make(chan result, 2)
+	fetch := func(peer ProtoGetter) {
+		value, err := g.getFromPeer(fetchCtx, peer, key, mirror)
+		results <- result{peer, value, err}
+	}
+	go fetch(peer)
+	timer := time.NewTimer(g.opts.HedgeDelay)
+	defer timer.Stop()
+
+	pending, hedged := 1, false
+	var ownerErr, hedgeErr error
+	for {
+		select {
+		case <-timer.C:
+			backup, ok := g.pickBackupPeer(key, peer)
+			if !ok {
+				continue
+			}
+			g.Stats.HedgedRequests.Add(1)
+			pending, hedged = pending+1, true
+			go fetch(backup)
+		case r := <-results:
+			pending--
+			if explain != nil {
+				explain.PeerFetches = append(explain.PeerFetches, ExplainPeerFetch{Peer: r.peer.GetURL(), Replica: replicaRead(ctx), Err: r.err})
+			}
+			if r.err == nil {
+				if r.peer != peer {
+					g.Stats.HedgeWins.Add(1)
+				}
+				return r.value, nil
+			}
+			if r.peer == peer {
+				ownerErr = r.err
+				// The owner's answer is final if it found no value,
+				// or if no hedge was sent yet: the caller then tries
+				// the backup peer as usual.
+				if !hedged || errors.Is(r.err, ErrNotFound) || errors.Is(r.err, ErrReadOnly) {
+					return ByteView{}, r.err
+				}
+			} else {
+				hedgeErr = r.err
+			}
+			if pending == 0 {
+				if ownerErr != nil {
+					return ByteView{}, ownerErr
+				}
+				return ByteView{}, hedgeErr
+			}
+		}
+	}
+}
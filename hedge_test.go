@@ -0,0 +1,104 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+)
+
+// stallingPeer answers Gets after delay, or fails once their context
+// is done, reporting that on canceled.
+type stallingPeer struct {
+	fakePeer
+	delay    time.Duration
+	canceled chan bool
+}
+
+func (p *stallingPeer) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	select {
+	case <-time.After(p.delay):
+		out.Value = []byte("owner:" + in.GetKey())
+		return nil
+	case <-ctx.Done():
+		p.canceled <- true
+		return ctx.Err()
+	}
+}
+
+// hedgePeers picks owner for every key, and backup as its backup peer.
+type hedgePeers struct {
+	owner, backup ProtoGetter
+}
+
+func (p hedgePeers) PickPeer(key string) (ProtoGetter, bool) { return p.owner, true }
+func (p hedgePeers) GetAll() []ProtoGetter                   { return []ProtoGetter{p.owner, p.backup} }
+
+func (p hedgePeers) PickBackupPeer(key string, failed ProtoGetter) (ProtoGetter, bool) {
+	return p.backup, failed != p.backup
+}
+
+func TestHedgeDelay(t *testing.T) {
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		t.Errorf("getter called for %q", key)
+		return dest.SetString("local:"+key, time.Time{})
+	})
+	owner := &stallingPeer{delay: time.Hour, canceled: make(chan bool, 1)}
+	g := newGroupOpts("TestHedgeDelay-group", cacheSize, getter, hedgePeers{owner, &fakePeer{}}, &GroupOptions{HedgeDelay: 10 * time.Millisecond})
+
+	// The stalled owner is hedged, and its fetch canceled once the
+	// backup peer answered.
+	var s string
+	if err := g.Get(dummyCtx, "stalled", StringSink(&s), nil); err != nil || s != "got:stalled" {
+		t.Fatalf("Get with a stalled owner = %q, %v; want the backup peer's value", s, err)
+	}
+	select {
+	case <-owner.canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("the owner's fetch was not canceled")
+	}
+	if hedged, wins := g.Stats.HedgedRequests.Get(), g.Stats.HedgeWins.Get(); hedged != 1 || wins != 1 {
+		t.Errorf("HedgedRequests, HedgeWins = %d, %d; want 1, 1", hedged, wins)
+	}
+
+	// An owner answering within the delay is not hedged.
+	fast := &stallingPeer{canceled: make(chan bool, 1)}
+	g2 := newGroupOpts("TestHedgeDelay-fast", cacheSize, getter, hedgePeers{fast, &fakePeer{}}, &GroupOptions{HedgeDelay: time.Hour})
+	if err := g2.Get(dummyCtx, "key", StringSink(&s), nil); err != nil || s != "owner:key" {
+		t.Fatalf("Get with a fast owner = %q, %v; want the owner's value", s, err)
+	}
+	if got := g2.Stats.HedgedRequests.Get(); got != 0 {
+		t.Errorf("HedgedRequests = %d; want 0", got)
+	}
+}
+
+func TestHedgeDelayExplain(t *testing.T) {
+	owner := &stallingPeer{delay: time.Hour, canceled: make(chan bool, 1)}
+	g := newGroupOpts("TestHedgeDelayExplain-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("local:"+key, time.Time{})
+	}), hedgePeers{owner, &fakePeer{}}, &GroupOptions{HedgeDelay: time.Millisecond})
+	res, err := g.Explain(dummyCtx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.PeerFetches) != 1 || res.PeerFetches[0].Err != nil {
+		t.Errorf("PeerFetches = %+v; want the backup peer's fetch", res.PeerFetches)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/melojustme/groupcache/groupcachepb"
+	"github.com/sirupsen/logrus"
+)
+
+// hotKeys tracks the keys of a group that peers fetch most often, for
+// GroupOptions.HotKeyThreshold.
+type hotKeys struct {
+	fetches *freqSketch
+
+	mu       sync.Mutex
+	start    time.Time           // of the current window
+	pushed   map[string]struct{} // keys replicated within the window
+	bytes    int64               // of the values of pushed
+	maxBytes int64
+}
+
+func (g *Group) initHotKeys() {
+	if g.opts.HotKeyThreshold <= 0 {
+		return
+	}
+	if g.opts.HotKeyWindow == 0 {
+		g.opts.HotKeyWindow = defaultHotCacheWindow
+	}
+	g.hotKeys = &hotKeys{
+		fetches:  newFreqSketch(g.opts.HotKeyWindow),
+		maxBytes: g.opts.HotKeyMaxBytes,
+	}
+	g.hotKeys.fetches.now = g.opts.Clock
+}
+
+// claim reports whether key, whose value is size bytes, may be
+// replicated now: it was not within the current window, and its value
+// fits in what is left of the window's budget, which it then uses.
+func (h *hotKeys) claim(key string, size int64, now time.Time, window time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.start) >= window {
+		h.start, h.pushed, h.bytes = now, make(map[string]struct{}), 0
+	}
+	if _, ok := h.pushed[key]; ok || h.bytes+size > h.maxBytes {
+		return false
+	}
+	h.pushed[key] = struct{}{}
+	h.bytes += size
+	return true
+}
+
+// observeHotKey counts a fetch of key, which the group owns, by a peer,
+// replicating value into the hot cache of every peer once key crosses
+// GroupOptions.HotKeyThreshold.
+func (g *Group) observeHotKey(ctx context.Context, key string, value ByteView) {
+	h := g.hotKeys
+	if h == nil || peerHops(ctx) == 0 || replicaRead(ctx) {
+		return
+	}
+	if h.fetches.increment(key) < g.opts.HotKeyThreshold {
+		return
+	}
+	if !h.claim(key, int64(value.Len()), g.clock(), g.opts.HotKeyWindow) {
+		return
+	}
+	g.Stats.HotKeysReplicated.Add(1)
+	g.pushHotKey(key, value)
+}
+
+// pushHotKey stores value in the hot cache of every peer in the
+// background.
+func (g *Group) pushHotKey(key string, value ByteView) {
+	b := value.ByteSlice()
+	for _, peer := range g.peers.GetAll() {
+		go func(peer ProtoGetter) {
+			var expire int64
+			if e := value.Expire(); !e.IsZero() {
+				expire = e.UnixNano()
+			}
+			req := &pb.SetRequest{
+				Group:    &g.name,
+				Key:      &key,
+				Value:    b,
+				Expire:   &expire,
+				Tags:     value.tags,
+				HotCache: proto.Bool(true),
+			}
+			if err := peer.Set(context.Background(), req); err != nil {
+				if log := g.logger(); log != nil {
+					log.WithFields(logrus.Fields{
+						"err":      err,
+						"key":      key,
+						"category": "groupcache",
+					}).Warnf("error replicating hot key to peer '%s'", peer.GetURL())
+				}
+				g.Stats.PeerErrors.Add(1)
+				return
+			}
+			g.Stats.HotKeyPushes.Add(1)
+		}(peer)
+	}
+}
+
+// localSetHot stores value under key in the hot cache, as pushed by the
+// owner of key under GroupOptions.HotKeyThreshold. The owner itself,
+// which is also sent the push, keeps key in its main cache instead.
+func (g *Group) localSetHot(key string, value []byte, expire time.Time, tags []string) {
+	g.peersOnce.Do(g.initPeers)
+	if _, ok := g.pickPeer(key); !ok {
+		return
+	}
+	g.localSetTagged(key, value, expire, tags, &g.hotCache)
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// ownedPeers is a PeerPicker leaving every key to the current peer,
+// whose peers are only sent requests for all of them.
+type ownedPeers []ProtoGetter
+
+func (p ownedPeers) PickPeer(key string) (ProtoGetter, bool) { return nil, false }
+func (p ownedPeers) GetAll() []ProtoGetter                   { return p }
+
+func TestHotKeyReplication(t *testing.T) {
+	peer := newGroup("TestHotKeyReplication-peer", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected load")
+	}), prefixPeers{&fakePeer{}})
+	ts := httptest.NewServer(newHTTPPool("http://127.0.0.1", nil))
+	defer ts.Close()
+
+	owner := newGroupOpts("TestHotKeyReplication-owner", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), ownedPeers{&renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: peer.Name()}}, &GroupOptions{
+		HotKeyThreshold: 3,
+		HotKeyMaxBytes:  20, // room for a single value
+	})
+	fromPeer := withPeerHops(context.Background(), 1)
+	get := func(ctx context.Context, key string, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			var s string
+			if err := owner.Get(ctx, key, StringSink(&s), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Local Gets do not count.
+	get(context.Background(), "remote-local", 10)
+	// The first fetch loads the key, and the next three hit it.
+	get(fromPeer, "remote-hot", 4)
+	for deadline := time.Now().Add(time.Second); owner.Stats.HotKeyPushes.Get() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got := owner.Stats.HotKeyPushes.Get(); got != 1 {
+		t.Fatalf("HotKeyPushes = %d; want 1", got)
+	}
+	if v, which, ok := peer.lookupCacheIn("remote-hot"); !ok || which != HotCache || v.String() != "value:remote-hot" {
+		t.Errorf("peer holds %q in cache %v, %v; want value:remote-hot in its hot cache", v.String(), which, ok)
+	}
+
+	// Neither the same key within the window nor one beyond the byte
+	// budget are pushed again.
+	get(fromPeer, "remote-hot", 5)
+	get(fromPeer, "remote-other", 5)
+	if got := owner.Stats.HotKeysReplicated.Get(); got != 1 {
+		t.Errorf("HotKeysReplicated = %d; want 1", got)
+	}
+
+	// The owner of a pushed key keeps it in its main cache.
+	peer.localSetHot("local", []byte("pushed"), time.Time{}, nil)
+	if _, _, ok := peer.lookupCacheIn("local"); ok {
+		t.Error("owner stored a pushed key in its hot cache")
+	}
+}
+
+func TestHotKeyThresholdAbove255(t *testing.T) {
+	owner := newGroupOpts("TestHotKeyThresholdAbove255-owner", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), ownedPeers{&fakePeer{}}, &GroupOptions{HotKeyThreshold: 300})
+	fromPeer := withPeerHops(context.Background(), 1)
+
+	// The first fetch loads the key, and the next 300 hit it.
+	for i := 0; i < 301; i++ {
+		var s string
+		if err := owner.Get(fromPeer, "remote-hot", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if i < 300 && owner.Stats.HotKeysReplicated.Get() != 0 {
+			t.Fatalf("key replicated after %d hits; want 300", i)
+		}
+	}
+	if got := owner.Stats.HotKeysReplicated.Get(); got != 1 {
+		t.Errorf("HotKeysReplicated = %d; want 1", got)
+	}
+}
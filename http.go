@@ -19,36 +19,189 @@ package groupcache
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/melojustme/groupcache/consistenthash"
 	pb "github.com/melojustme/groupcache/groupcachepb"
-
-	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
 )
 
 const defaultBasePath = "/_github.com/melojustme/groupcache/"
 
 const defaultReplicas = 50
 
+// hopsHeader carries the number of peer hops a request has already
+// taken. It is used to detect requests that are being forwarded in a
+// loop because of a misconfigured peer list.
+const hopsHeader = "X-Groupcache-Hops"
+
+// refreshHeader is set on requests made with a context returned by
+// WithForceRefresh, asking the peer to refresh the key as well.
+const refreshHeader = "X-Groupcache-Refresh"
+
+// replicaHeader is set on requests routed to a replica of the key by
+// GroupOptions.ReadReplicas.
+const replicaHeader = "X-Groupcache-Replica-Read"
+
+// ownerFetchHeader is set on requests made by an owner of the key to
+// another owner under GroupOptions.Replication.
+const ownerFetchHeader = "X-Groupcache-Owner-Fetch"
+
+// checksumHeader is set on HEAD requests made by
+// httpGetter.Checksum, asking for the checksum of the cached value,
+// and carries it, in decimal, on the response.
+const checksumHeader = "X-Groupcache-Checksum"
+
+// ifAbsentHeader is set on PUT requests made by httpGetter.GetOrSet,
+// asking to store the value only if the key holds none and to return
+// the value it holds, and on the response.
+const ifAbsentHeader = "X-Groupcache-If-Absent"
+
+// tagHeader is set on DELETE requests made by httpGetter.RemoveTag,
+// whose key is a tag whose values to remove.
+const tagHeader = "X-Groupcache-Tag"
+
+// generationHeader carries the generation of the requesting group, in
+// decimal, on the Get and GetMulti requests of groups whose generation
+// is not 0. See Group.SetGeneration.
+const generationHeader = "X-Groupcache-Generation"
+
+// populateHeader is set on Get requests made by Group.Prefetch, asking
+// the peer to load the key and answer 204 No Content rather than send
+// the value.
+const populateHeader = "X-Groupcache-Populate"
+
+// hotCacheHeader is set on PUT requests pushing the value of a hot key
+// under GroupOptions.HotKeyThreshold, asking the peer to store it in
+// its hot cache.
+const hotCacheHeader = "X-Groupcache-Hot-Cache"
+
+// multiHeader is set on POST requests made by httpGetter.GetMulti, and
+// on the responses of the peers serving them.
+const multiHeader = "X-Groupcache-Multi"
+
+// quoteETag returns etag as the value of an HTTP ETag or If-None-Match
+// header.
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
+
+// requestFlagKey is the context key holding the name of a header that
+// makeRequest sets to "1", such as checksumHeader.
+type requestFlagKey struct{}
+
+// withRequestFlag returns a copy of ctx making makeRequest set header.
+func withRequestFlag(ctx context.Context, header string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, requestFlagKey{}, header)
+}
+
+// notFoundHeader is set on 404 responses to requests for keys that
+// the getter reported as ErrNotFound, telling them apart from requests
+// for unknown groups.
+const notFoundHeader = "X-Groupcache-Not-Found"
+
+// readOnlyHeader is set on 503 responses to requests for keys that
+// could not be loaded because the group is read-only.
+const readOnlyHeader = "X-Groupcache-Read-Only"
+
+// tooLargeHeader is set on 413 responses to requests for keys whose
+// value the peer refused to serve as ErrValueTooLarge.
+const tooLargeHeader = "X-Groupcache-Too-Large"
+
+// sourceHeader, keyHeader and valueLengthHeader are set on responses to
+// Get requests for informational purposes only, telling whether the
+// value was a cache hit ("cache") or loaded for the request ("origin"),
+// the key, escaped as a path segment, and the length of the value.
+// Cache hits also carry an Age header. httpGetter ignores them.
+const (
+	sourceHeader      = "X-Groupcache-Source"
+	keyHeader         = "X-Groupcache-Key"
+	valueLengthHeader = "X-Groupcache-Value-Length"
+)
+
+// base64KeyParam is set on requests whose key is sent in the path
+// base64 encoded, because path escaping would not protect it.
+const base64KeyParam = "key64"
+
+// streamHeader is set on responses whose body was written by
+// writeStreamedGetResponse.
+const streamHeader = "X-Groupcache-Stream"
+
+const defaultStreamThreshold = 1 << 20
+
+// defaultSuccessRateWindow is the default HTTPPoolOptions.SuccessRateWindow.
+const defaultSuccessRateWindow = time.Minute
+
+// Defaults for the HTTPPoolOptions.AdaptiveTimeout settings.
+const (
+	defaultAdaptiveTimeoutMultiple = 3
+	defaultAdaptiveTimeoutMin      = 10 * time.Millisecond
+	defaultAdaptiveTimeoutMax      = time.Second
+	defaultAdaptiveTimeoutWindow   = 1000
+)
+
+// adaptiveTimeoutMinSamples is how many Gets a peer must answer before
+// its adaptive timeout follows their latency rather than staying at
+// HTTPPoolOptions.AdaptiveTimeoutMax.
+const adaptiveTimeoutMinSamples = 20
+
+// maxPeerHops is the maximum number of times a request may be forwarded
+// between peers before ServeHTTP refuses to handle it.
+const maxPeerHops = 2
+
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
 type HTTPPool struct {
 	// this peer's base URL, e.g. "https://example.net:8000"
 	self string
 
+	// client is set on pools made by NewHTTPClient, whose process is
+	// not one of the peers.
+	client bool
+
 	// opts specifies the options.
 	opts HTTPPoolOptions
 
-	mu          sync.Mutex // guards peers and httpGetters
-	peers       *consistenthash.Map
-	httpGetters map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
+	mu    sync.Mutex   // serializes updates of peers
+	peers atomic.Value // of *peerSet, replaced as a whole on updates
+
+	keepWarm    *keepWarm    // nil unless opts.KeepWarmInterval is set
+	healthCheck *healthCheck // nil unless opts.HealthCheckInterval is set
+
+	inFlight chan struct{} // nil unless opts.MaxConcurrentRequests is set
+	limiter  *rateLimiter  // nil unless opts.MaxPeerQPS is set
+
+	draining int32 // poolServing until Drain is called, accessed atomically
+}
+
+// A peerSet is the consistent hash of a pool's peers and their getters.
+// It is never modified once stored in HTTPPool.peers, so that it can be
+// read without locking.
+type peerSet struct {
+	ring    *consistenthash.Map
+	getters map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
+
+	// down holds the peers of getters kept off ring for failing
+	// health checks, if any.
+	down map[string]bool
 }
 
 // HTTPPoolOptions are the configurations of a HTTPPool.
@@ -65,21 +218,259 @@ type HTTPPoolOptions struct {
 	// If blank, it defaults to crc32.ChecksumIEEE.
 	HashFn consistenthash.Hash
 
+	// HashFn64 optionally specifies a 64-bit hash function for the
+	// consistent hash, taking precedence over HashFn. Set
+	// Use64BitHash to use the default 64-bit hash instead.
+	// Changing the ring width reassigns key ownership, so every peer
+	// must be configured the same way.
+	HashFn64 consistenthash.Hash64
+
+	// Use64BitHash selects a 64-bit consistent hash ring, using
+	// HashFn64 if set or consistenthash's default 64-bit hash.
+	Use64BitHash bool
+
 	// Transport optionally specifies an http.RoundTripper for the client
 	// to use when it makes a request.
 	// If nil, the client uses http.DefaultTransport.
+	// Peers named by unix:// URLs are sent requests through a
+	// transport of their own instead.
 	Transport func(context.Context) http.RoundTripper
 
+	// DialContext optionally specifies the function dialing the peers
+	// named by unix:// URLs, such as "unix:///var/run/groupcache.sock",
+	// which are sent requests over the Unix domain socket at the URL's
+	// path rather than over TCP. It is passed the network "unix" and
+	// the path of the socket.
+	// If nil, the sockets are dialed with a net.Dialer.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	// Context optionally specifies a context for the server to use when it
-	// receives a request.
+	// receives a request, for example carrying values read from headers
+	// that the peer's RequestModifier added.
 	// If nil, uses the http.Request.Context()
 	Context func(*http.Request) context.Context
+
+	// RequestModifier optionally specifies a function called with each
+	// request sent to a peer, and the context it is sent for, before
+	// it is sent. It may add headers to the request, such as auth
+	// tokens, tenant ids or tracing baggage derived from the context.
+	// Changes to the request's method, URL, Host or body are undone,
+	// and the headers groupcache sets take precedence.
+	RequestModifier func(ctx context.Context, req *http.Request)
+
+	// Authenticator optionally authenticates the requests exchanged
+	// with peers, such as NewHMACAuthenticator or
+	// NewBearerAuthenticator: it signs the requests sent to peers,
+	// and requests received without valid credentials are rejected
+	// with 401 Unauthorized.
+	// If nil, any request reaching BasePath is served.
+	Authenticator PeerAuthenticator
+
+	// Codec specifies how messages exchanged with peers are encoded.
+	// Every peer in the cluster must use the same codec.
+	// If nil, it defaults to ProtoCodec.
+	Codec WireCodec
+
+	// StreamThreshold specifies the value size, in bytes, from which
+	// responses to peers are streamed directly from the cache instead
+	// of being encoded into a separate buffer first. Streaming is only
+	// supported by ProtoCodec.
+	// If zero, it defaults to 1MB. If negative, responses are never
+	// streamed. A threshold of 1 streams every response, so that
+	// serving a value copies it only into the connection.
+	StreamThreshold int
+
+	// StreamChunkSize, if positive, makes streamed responses write
+	// their value in chunks of at most that many bytes, rather than in
+	// a single call, as ByteView.WriteChunked does.
+	StreamChunkSize int
+
+	// Compression optionally specifies how to compress the responses
+	// to Get and GetMulti sent to peers, such as GzipCompression. The
+	// pool asks its peers for compressed responses too, which peers
+	// without the same compression answer uncompressed.
+	Compression WireCompression
+
+	// CompressMinBytes specifies the size, in bytes, of the values
+	// from which responses are compressed with Compression.
+	// If zero, it defaults to 1KB.
+	CompressMinBytes int
+
+	// BackupPeers specifies how many of the peers following a key's
+	// owner on the consistent hash may be asked for the key when its
+	// owner fails. One of them is picked at random, weighted by its
+	// recent success rate, so that the load of a failed peer spreads
+	// over several others.
+	// If zero, keys whose owner fails are loaded locally.
+	BackupPeers int
+
+	// SuccessRateWindow specifies the period over which the success
+	// rate of each peer is measured for picking backup peers.
+	// If zero, it defaults to 1 minute.
+	SuccessRateWindow time.Duration
+
+	// BreakerFailures, if positive, trips a circuit breaker around each
+	// peer after that many consecutive failed fetches. Fetches from the
+	// peer then fail at once with ErrCircuitOpen for BreakerCooldown,
+	// so that the keys it owns are fetched from backup peers or loaded
+	// locally without waiting for it to time out. A single fetch is
+	// then sent to probe the peer, which closes the breaker if it
+	// succeeds and opens it for another BreakerCooldown otherwise.
+	// If zero, fetches are sent to peers however often they fail.
+	BreakerFailures int
+
+	// BreakerCooldown specifies how long a peer's circuit breaker stays
+	// open under BreakerFailures before the peer is probed.
+	// If zero, it defaults to 5 seconds.
+	BreakerCooldown time.Duration
+
+	// MaxResponseBytes bounds the size of the response bodies read
+	// from peers, so that a misbehaving peer cannot make this process
+	// allocate without limit. Larger responses fail with
+	// ErrResponseTooLarge.
+	// If zero, responses are not limited.
+	MaxResponseBytes int64
+
+	// MaxServedValueBytes bounds the size of the values served to
+	// peers, matching the MaxResponseBytes of the peers. Larger values
+	// are refused, and peers' Gets of them fail with ErrValueTooLarge
+	// rather than loading them locally.
+	// If zero, values of any size are served.
+	MaxServedValueBytes int64
+
+	// MaxPrewarmBytes bounds the bytes of values sent in response to,
+	// and accepted by, PrewarmFrom for each group, and those sent and
+	// accepted by Drain for each group and peer.
+	// If zero, it defaults to 64MB.
+	MaxPrewarmBytes int64
+
+	// HandoffEntries is the number of the most recently used entries
+	// of each group that Drain hands off to the peers taking them over.
+	// If zero, it defaults to 10000.
+	HandoffEntries int
+
+	// PeerTimeout bounds each Get from a peer, in addition to the
+	// caller's context.
+	// If zero, Gets are only bounded by their context.
+	PeerTimeout time.Duration
+
+	// AdaptiveTimeout replaces PeerTimeout with a timeout per peer of
+	// AdaptiveTimeoutMultiple times the p99 latency of the peer's
+	// recent Gets, within [AdaptiveTimeoutMin, AdaptiveTimeoutMax], so
+	// that outliers are abandoned early on fast peers without timing
+	// out the usual Gets of slow ones. Gets that fail, other than for
+	// a missing key, do not count towards the latency. Until a peer
+	// has answered 20 Gets, its timeout is AdaptiveTimeoutMax.
+	// HTTPPool.PeerTimeouts reports the current timeouts.
+	AdaptiveTimeout bool
+
+	// AdaptiveTimeoutMultiple is the multiple of the p99 latency used
+	// with AdaptiveTimeout.
+	// If zero, it defaults to 3.
+	AdaptiveTimeoutMultiple float64
+
+	// AdaptiveTimeoutMin and AdaptiveTimeoutMax bound the timeouts
+	// used with AdaptiveTimeout.
+	// If zero, AdaptiveTimeoutMin defaults to 10ms, and
+	// AdaptiveTimeoutMax to PeerTimeout, or 1 second if that is zero.
+	AdaptiveTimeoutMin time.Duration
+	AdaptiveTimeoutMax time.Duration
+
+	// AdaptiveTimeoutWindow specifies over how many of a peer's most
+	// recent Gets its p99 latency is measured with AdaptiveTimeout:
+	// between AdaptiveTimeoutWindow and twice as many.
+	// If zero, it defaults to 1000.
+	AdaptiveTimeoutWindow int
+
+	// KeepWarmInterval, if positive, makes the pool ping each of its
+	// peers every KeepWarmInterval with a request they answer without
+	// doing any work, so that idle connections to them stay open and
+	// Gets do not pay for new ones after quiet periods. Close stops
+	// the pings.
+	// If zero, peers are not pinged.
+	KeepWarmInterval time.Duration
+
+	// KeepWarmConns specifies how many concurrent pings each peer is
+	// sent every KeepWarmInterval, and thus how many connections to
+	// it are kept warm. The transport must keep that many idle
+	// connections per host: http.DefaultTransport keeps 2.
+	// If zero, it defaults to 1.
+	KeepWarmConns int
+
+	// HealthCheckInterval, if positive, makes the pool probe each of
+	// its peers every HealthCheckInterval. A peer failing
+	// HealthCheckFailures probes in a row is taken off the consistent
+	// hash, its keys falling to the other peers, until it answers a
+	// probe again. Each process judges its peers on its own, so peers
+	// may briefly disagree on who owns a key. Close stops the probes.
+	// If zero, peers are not probed, and stay on the consistent hash
+	// until removed with Set.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckPath specifies the URL probed on each peer, resolved
+	// against the peer's base URL: "/healthz" is probed at the root
+	// of the peer's host. Probes succeed if answered with a 2xx
+	// status.
+	// If blank, probes are the pings of KeepWarmInterval, which
+	// groupcache answers under the base path of the peer.
+	HealthCheckPath string
+
+	// HealthCheckTimeout bounds each round of probes.
+	// If zero, it defaults to HealthCheckInterval.
+	HealthCheckTimeout time.Duration
+
+	// HealthCheckFailures specifies how many probes in a row a peer
+	// must fail to be taken off the consistent hash.
+	// If zero, it defaults to 3.
+	HealthCheckFailures int
+
+	// OnPeerDown, if non-nil, is called with a peer taken off the
+	// consistent hash for failing health checks and the error of its
+	// last probe.
+	OnPeerDown func(peer string, err error)
+
+	// OnPeerUp, if non-nil, is called with a peer put back on the
+	// consistent hash after answering a health check.
+	OnPeerUp func(peer string)
+
+	// MaxConcurrentRequests bounds the requests from peers the pool
+	// serves at once, so that a hot key or a misbehaving peer cannot
+	// tie up the server's goroutines and memory. Requests beyond it
+	// are answered with 429 Too Many Requests and a Retry-After
+	// header, and counted in Stats.ServerConcurrencyShed.
+	// If zero, requests are not limited.
+	MaxConcurrentRequests int
+
+	// MaxPeerQPS bounds the rate of the requests the pool serves for
+	// each peer, allowing bursts of up to MaxPeerBurst requests.
+	// Requests beyond it are answered with 429 Too Many Requests and a
+	// Retry-After header set to when the peer may send one again, and
+	// counted in Stats.ServerRateShed.
+	// If zero, requests are not limited.
+	MaxPeerQPS float64
+
+	// MaxPeerBurst specifies how many requests a peer may send at once
+	// under MaxPeerQPS.
+	// If zero, it defaults to MaxPeerQPS, rounded up.
+	MaxPeerBurst int
+
+	// PeerID optionally identifies the peer that sent a request, for
+	// MaxPeerQPS.
+	// If nil, peers are told apart by the host of the request's
+	// remote address.
+	PeerID func(*http.Request) string
+
+	// Logger optionally specifies the logger reporting the pool's
+	// errors, such as peers failing the pings of KeepWarmInterval.
+	// If nil, the logger set by SetLogger is used.
+	Logger *logrus.Entry
 }
 
 // NewHTTPPool initializes an HTTP pool of peers, and registers itself as a PeerPicker.
 // For convenience, it also registers itself as an http.Handler with http.DefaultServeMux.
 // The self argument should be a valid base URL that points to the current server,
-// for example "http://example.net:8000".
+// for example "http://example.net:8000", or "unix:///var/run/groupcache.sock"
+// for a server on a Unix domain socket.
 func NewHTTPPool(self string) *HTTPPool {
 	p := NewHTTPPoolOpts(self, nil)
 	http.Handle(p.opts.BasePath, p)
@@ -97,9 +488,44 @@ func NewHTTPPoolOpts(self string, o *HTTPPoolOptions) *HTTPPool {
 	}
 	httpPoolMade = true
 
+	p := newHTTPPool(self, o)
+	RegisterPeerPicker(func() PeerPicker { return p })
+	return p
+}
+
+// NewHTTPClient initializes an HTTP pool for a process that reads from
+// a cluster of peers without joining it, such as a short-lived batch
+// job, and registers it as the PeerPicker. Every key is fetched from
+// its owner among the peers given to Set, and the process takes no
+// segment of the consistent hash: the client should not be listed
+// among the peers of the others, and does not serve requests. Groups
+// using it keep no main cache, only mirroring peers' values in their
+// hot cache as their options say; values they load themselves, once
+// the owner failed, are not cached. Like NewHTTPPoolOpts, it may be
+// called only once, instead of NewHTTPPool.
+func NewHTTPClient(o *HTTPPoolOptions) *HTTPPool {
+	if httpPoolMade {
+		panic("groupcache: NewHTTPPool must be called only once")
+	}
+	httpPoolMade = true
+
+	p := newHTTPPool("", o)
+	p.client = true
+	RegisterPeerPicker(func() PeerPicker { return p })
+	return p
+}
+
+// IsClient implements ClientPeerPicker, reporting whether p was made
+// by NewHTTPClient.
+func (p *HTTPPool) IsClient() bool {
+	return p.client
+}
+
+// newHTTPPool creates an HTTPPool without registering it as the
+// process-wide PeerPicker.
+func newHTTPPool(self string, o *HTTPPoolOptions) *HTTPPool {
 	p := &HTTPPool{
-		self:        self,
-		httpGetters: make(map[string]*httpGetter),
+		self: self,
 	}
 	if o != nil {
 		p.opts = *o
@@ -110,67 +536,469 @@ func NewHTTPPoolOpts(self string, o *HTTPPoolOptions) *HTTPPool {
 	if p.opts.Replicas == 0 {
 		p.opts.Replicas = defaultReplicas
 	}
-	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
-
-	RegisterPeerPicker(func() PeerPicker { return p })
+	if p.opts.Codec == nil {
+		p.opts.Codec = ProtoCodec{}
+	}
+	if p.opts.StreamThreshold == 0 {
+		p.opts.StreamThreshold = defaultStreamThreshold
+	}
+	if p.opts.CompressMinBytes == 0 {
+		p.opts.CompressMinBytes = defaultCompressResponseBytes
+	}
+	if p.opts.SuccessRateWindow == 0 {
+		p.opts.SuccessRateWindow = defaultSuccessRateWindow
+	}
+	if p.opts.BreakerCooldown == 0 {
+		p.opts.BreakerCooldown = defaultBreakerCooldown
+	}
+	if p.opts.MaxPrewarmBytes == 0 {
+		p.opts.MaxPrewarmBytes = defaultMaxPrewarmBytes
+	}
+	if p.opts.HandoffEntries == 0 {
+		p.opts.HandoffEntries = defaultHandoffEntries
+	}
+	if p.opts.AdaptiveTimeoutMultiple == 0 {
+		p.opts.AdaptiveTimeoutMultiple = defaultAdaptiveTimeoutMultiple
+	}
+	if p.opts.AdaptiveTimeoutMin == 0 {
+		p.opts.AdaptiveTimeoutMin = defaultAdaptiveTimeoutMin
+	}
+	if p.opts.AdaptiveTimeoutMax == 0 {
+		p.opts.AdaptiveTimeoutMax = p.opts.PeerTimeout
+		if p.opts.AdaptiveTimeoutMax == 0 {
+			p.opts.AdaptiveTimeoutMax = defaultAdaptiveTimeoutMax
+		}
+	}
+	if p.opts.AdaptiveTimeoutWindow == 0 {
+		p.opts.AdaptiveTimeoutWindow = defaultAdaptiveTimeoutWindow
+	}
+	if p.opts.KeepWarmConns == 0 {
+		p.opts.KeepWarmConns = 1
+	}
+	if p.opts.HealthCheckTimeout == 0 {
+		p.opts.HealthCheckTimeout = p.opts.HealthCheckInterval
+	}
+	if p.opts.HealthCheckFailures == 0 {
+		p.opts.HealthCheckFailures = defaultHealthCheckFailures
+	}
+	if p.opts.MaxConcurrentRequests > 0 {
+		p.inFlight = make(chan struct{}, p.opts.MaxConcurrentRequests)
+	}
+	if p.opts.MaxPeerQPS > 0 {
+		p.limiter = newRateLimiter(p.opts.MaxPeerQPS, p.opts.MaxPeerBurst)
+	}
+	p.peers.Store(&peerSet{ring: p.newRing()})
+	if p.opts.KeepWarmInterval > 0 {
+		p.startKeepWarm()
+	}
+	if p.opts.HealthCheckInterval > 0 {
+		p.startHealthCheck()
+	}
 	return p
 }
 
+// logger returns the logger reporting the pool's errors, or nil if
+// they are not logged.
+func (p *HTTPPool) logger() *logrus.Entry {
+	if p.opts.Logger != nil {
+		return p.opts.Logger
+	}
+	return logger
+}
+
+// current returns the pool's current peers.
+func (p *HTTPPool) current() *peerSet {
+	return p.peers.Load().(*peerSet)
+}
+
+// newRing returns an empty consistent hash ring configured from opts.
+func (p *HTTPPool) newRing() *consistenthash.Map {
+	if p.opts.Use64BitHash || p.opts.HashFn64 != nil {
+		return consistenthash.New64(p.opts.Replicas, p.opts.HashFn64)
+	}
+	return consistenthash.New(p.opts.Replicas, p.opts.HashFn)
+}
+
 // Set updates the pool's list of peers.
 // Each peer value should be a valid base URL,
-// for example "http://example.net:8000".
+// for example "http://example.net:8000", or the unix:// URL of a Unix
+// domain socket, for example "unix:///var/run/groupcache.sock".
 func (p *HTTPPool) Set(peers ...string) {
+	baseURLs := make(map[string]string, len(peers))
+	for _, peer := range peers {
+		baseURLs[peer] = peerBaseURL(peer, p.opts.BasePath)
+	}
+	p.setPeers(peers, baseURLs)
+}
+
+// SetURLs updates the pool's list of peers, like Set, but lets each
+// peer serve groupcache requests under its own path. The scheme and
+// host of each URL identify the peer, for example
+// "http://example.net:8000", and its path, if any, replaces
+// HTTPPoolOptions.BasePath when making requests to that peer. The path
+// of a unix:// URL is that of the peer's socket instead, under which
+// it serves requests under HTTPPoolOptions.BasePath.
+func (p *HTTPPool) SetURLs(peers ...*url.URL) {
+	names := make([]string, 0, len(peers))
+	baseURLs := make(map[string]string, len(peers))
+	for _, u := range peers {
+		name := u.Scheme + "://" + u.Host
+		basePath := p.opts.BasePath
+		if u.Scheme == "unix" {
+			name = unixScheme + u.Path
+		} else if u.Path != "" && u.Path != "/" {
+			basePath = u.Path
+			if !strings.HasSuffix(basePath, "/") {
+				basePath += "/"
+			}
+		}
+		names = append(names, name)
+		baseURLs[name] = peerBaseURL(name, basePath)
+	}
+	p.setPeers(names, baseURLs)
+}
+
+// setPeers replaces the pool's peers with the named peers, making
+// requests to each under the given base URL. The new peers are swapped
+// in at once, so concurrent calls to PickPeer never wait for setPeers.
+// Getters of peers whose base URL is unchanged are kept, along with
+// their success rates, and stay off the consistent hash if they were
+// failing health checks.
+func (p *HTTPPool) setPeers(peers []string, baseURLs map[string]string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
-	p.peers.Add(peers...)
-	p.httpGetters = make(map[string]*httpGetter, len(peers))
+	old := p.current()
+	getters := make(map[string]*httpGetter, len(peers))
+	var down map[string]bool
 	for _, peer := range peers {
-		p.httpGetters[peer] = &httpGetter{
-			getTransport: p.opts.Transport,
-			baseURL:      peer + p.opts.BasePath,
+		if h := old.getters[peer]; h != nil && h.baseURL == baseURLs[peer] {
+			getters[peer] = h
+			if old.down[peer] {
+				if down == nil {
+					down = make(map[string]bool)
+				}
+				down[peer] = true
+			}
+			continue
+		}
+		h := &httpGetter{
+			getTransport:  p.opts.Transport,
+			baseURL:       baseURLs[peer],
+			codec:         p.opts.Codec,
+			compression:   p.opts.Compression,
+			maxBytes:      p.opts.MaxResponseBytes,
+			timeout:       p.opts.PeerTimeout,
+			modifyRequest: p.opts.RequestModifier,
+			auth:          p.opts.Authenticator,
+		}
+		if socket := unixSocket(peer); socket != "" {
+			h.socket = socket
+			h.unix = p.unixTransport(socket)
+		}
+		if p.opts.BackupPeers > 0 {
+			h.health = &peerHealth{window: p.opts.SuccessRateWindow}
+		}
+		if p.opts.BreakerFailures > 0 {
+			h.breaker = &circuitBreaker{failures: p.opts.BreakerFailures, cooldown: p.opts.BreakerCooldown}
 		}
+		if p.opts.AdaptiveTimeout {
+			h.adaptive = &adaptiveTimeout{
+				latency:  newRollingLatency(p.opts.AdaptiveTimeoutWindow),
+				multiple: p.opts.AdaptiveTimeoutMultiple,
+				min:      p.opts.AdaptiveTimeoutMin,
+				max:      p.opts.AdaptiveTimeoutMax,
+			}
+		}
+		getters[peer] = h
 	}
+	p.peers.Store(p.newPeerSet(getters, down))
 }
 
-// GetAll returns all the peers in the pool
+// GetAll returns all the peers in the pool, but those taken off the
+// consistent hash for failing health checks.
 func (p *HTTPPool) GetAll() []ProtoGetter {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	ps := p.current()
 
-	var i int
-	res := make([]ProtoGetter, len(p.httpGetters))
-	for _, v := range p.httpGetters {
-		res[i] = v
-		i++
+	res := make([]ProtoGetter, 0, len(ps.getters))
+	for peer, v := range ps.getters {
+		if ps.down[peer] {
+			continue
+		}
+		res = append(res, v)
 	}
 	return res
 }
 
+// PeerTimeouts returns the timeout currently applied to Gets from each
+// of the pool's peers, keyed by peer, or zero for peers whose Gets are
+// only bounded by their context. See HTTPPoolOptions.AdaptiveTimeout.
+func (p *HTTPPool) PeerTimeouts() map[string]time.Duration {
+	ps := p.current()
+	res := make(map[string]time.Duration, len(ps.getters))
+	for peer, h := range ps.getters {
+		res[peer] = h.currentTimeout()
+	}
+	return res
+}
+
+// StatsHandler returns a handler that renders the stats of all
+// registered groups and the pool's current peers as JSON. It is meant
+// for an internal admin endpoint, and is served separately from the
+// peer protocol handled by ServeHTTP.
+func (p *HTTPPool) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ps := p.current()
+		res := poolStats{Self: p.self, Peers: make([]string, 0, len(ps.getters))}
+		for peer := range ps.getters {
+			res.Peers = append(res.Peers, peer)
+		}
+		if p.opts.PeerTimeout > 0 || p.opts.AdaptiveTimeout {
+			res.PeerTimeouts = p.PeerTimeouts()
+		}
+		sort.Strings(res.Peers)
+		res.DownPeers = p.DownPeers()
+		for _, g := range GetGroups() {
+			gs := groupStats{
+				Name:      g.Name(),
+				Stats:     &g.Stats,
+				MainCache: g.CacheStats(MainCache),
+				HotCache:  g.CacheStats(HotCache),
+			}
+			if g.opts.RecordLatency {
+				gs.Latency = &groupLatency{
+					Get:       g.Latency(GetLatency),
+					PeerFetch: g.Latency(PeerFetchLatency),
+					Origin:    g.Latency(OriginLatency),
+					Peers:     g.PeerLatencies(),
+				}
+			}
+			res.Groups = append(res.Groups, gs)
+		}
+		body, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+// poolStats is the JSON document served by HTTPPool.StatsHandler.
+type poolStats struct {
+	Self   string       `json:"self"`
+	Peers  []string     `json:"peers"`
+	Groups []groupStats `json:"groups"`
+
+	// PeerTimeouts holds HTTPPool.PeerTimeouts in nanoseconds, if
+	// Gets from peers time out.
+	PeerTimeouts map[string]time.Duration `json:"peerTimeouts,omitempty"`
+
+	// DownPeers holds HTTPPool.DownPeers, if any.
+	DownPeers []string `json:"downPeers,omitempty"`
+}
+
+type groupStats struct {
+	Name      string     `json:"name"`
+	Stats     *Stats     `json:"stats"`
+	MainCache CacheStats `json:"mainCache"`
+	HotCache  CacheStats `json:"hotCache"`
+
+	// Latency holds the group's latency histograms, with durations in
+	// nanoseconds, if it records them.
+	Latency *groupLatency `json:"latency,omitempty"`
+}
+
+type groupLatency struct {
+	Get       LatencyStats            `json:"get"`
+	PeerFetch LatencyStats            `json:"peerFetch"`
+	Origin    LatencyStats            `json:"origin"`
+	Peers     map[string]LatencyStats `json:"peers"`
+}
+
 func (p *HTTPPool) PickPeer(key string) (ProtoGetter, bool) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if p.peers.IsEmpty() {
+	ps := p.current()
+	if ps.ring.IsEmpty() {
+		return nil, false
+	}
+	if peer := ps.ring.Get(key); peer != p.self {
+		return ps.getters[peer], true
+	}
+	return nil, false
+}
+
+// PickReplicaPeer implements ReplicaPeerPicker, picking at random one
+// of the first n peers for key on the consistent hash.
+func (p *HTTPPool) PickReplicaPeer(key string, n int) (ProtoGetter, bool) {
+	ps := p.current()
+	names := ps.ring.GetN(key, n)
+	if len(names) == 0 {
 		return nil, false
 	}
-	if peer := p.peers.Get(key); peer != p.self {
-		return p.httpGetters[peer], true
+	if name := names[rand.Intn(len(names))]; name != p.self {
+		return ps.getters[name], true
 	}
 	return nil, false
 }
 
+// PickOwners implements OwnersPeerPicker, returning the first n peers
+// for key on the consistent hash.
+func (p *HTTPPool) PickOwners(key string, n int) []ProtoGetter {
+	ps := p.current()
+	names := ps.ring.GetN(key, n)
+	owners := make([]ProtoGetter, len(names))
+	for i, name := range names {
+		if name != p.self {
+			owners[i] = ps.getters[name]
+		}
+	}
+	return owners
+}
+
+// PickBackupPeer implements BackupPeerPicker, picking one of the
+// HTTPPoolOptions.BackupPeers peers that follow the owner of key on the
+// consistent hash, weighted by their recent success rate. It never
+// picks failed or the current peer, nor peers whose circuit breaker is
+// open under HTTPPoolOptions.BreakerFailures.
+func (p *HTTPPool) PickBackupPeer(key string, failed ProtoGetter) (ProtoGetter, bool) {
+	if p.opts.BackupPeers <= 0 {
+		return nil, false
+	}
+	ps := p.current()
+	names := ps.ring.GetN(key, p.opts.BackupPeers+1)
+	var candidates []*httpGetter
+	for i, name := range names {
+		if i == 0 || name == p.self {
+			continue
+		}
+		if h := ps.getters[name]; h != nil && ProtoGetter(h) != failed && !h.breaker.isOpen() {
+			candidates = append(candidates, h)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	weights := make([]float64, len(candidates))
+	var total float64
+	for i, h := range candidates {
+		weights[i] = h.health.successRate()
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return candidates[i], true
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1], true
+}
+
+// requestPath returns the path, relative to a peer's base path, and
+// query of a request for key in group.
+//
+// Keys are arbitrary bytes, so each is escaped as a path segment of its
+// own, slashes included. That does not survive http.ServeMux, which
+// cleans the unescaped path: keys that would then contain empty, "."
+// or ".." segments are sent base64 encoded instead.
+func requestPath(group, key string) string {
+	if !cleanSafe(key) {
+		return url.PathEscape(group) + "/" + base64.RawURLEncoding.EncodeToString([]byte(key)) + "?" + base64KeyParam + "=1"
+	}
+	return url.PathEscape(group) + "/" + url.PathEscape(key)
+}
+
+// cleanSafe reports whether key, as the last element of a path, is
+// left alone by path.Clean.
+func cleanSafe(key string) bool {
+	segs := strings.Split(key, "/")
+	for i, seg := range segs {
+		if seg == "." || seg == ".." || seg == "" && (len(segs) == 1 || i < len(segs)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePath returns the group and key of a request built by requestPath.
+func (p *HTTPPool) parsePath(r *http.Request) (group, key string, err error) {
+	// Split the escaped path, so that the slashes of a group name
+	// do not end it.
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, p.opts.BasePath) {
+		path = r.URL.Path
+	}
+	parts := strings.SplitN(path[len(p.opts.BasePath):], "/", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("no key in path")
+	}
+	if group, err = url.PathUnescape(parts[0]); err != nil {
+		return "", "", err
+	}
+	if r.URL.RawQuery != "" && r.URL.Query().Get(base64KeyParam) != "" {
+		b, err := base64.RawURLEncoding.DecodeString(parts[1])
+		return group, string(b), err
+	}
+	key, err = url.PathUnescape(parts[1])
+	return group, key, err
+}
+
 func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Parse request.
 	if !strings.HasPrefix(r.URL.Path, p.opts.BasePath) {
 		panic("HTTPPool serving unexpected path: " + r.URL.Path)
 	}
-	parts := strings.SplitN(r.URL.Path[len(p.opts.BasePath):], "/", 2)
-	if len(parts) != 2 {
+	if auth := p.opts.Authenticator; auth != nil {
+		if err := auth.Verify(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	groupName, key, err := p.parsePath(r)
+	if err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	groupName := parts[0]
-	key := parts[1]
+	draining := atomic.LoadInt32(&p.draining)
+	if groupName == pingPath {
+		if draining != poolServing {
+			http.Error(w, errPoolDrained.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if groupName == handoffPath {
+		p.serveHandoff(w, r, key)
+		return
+	}
+	if draining == poolDrained {
+		http.Error(w, errPoolDrained.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if groupName == prewarmPath {
+		p.servePrewarm(w, r, key)
+		return
+	}
+
+	var hops int
+	if h := r.Header.Get(hopsHeader); h != "" {
+		n, err := strconv.Atoi(h)
+		if err != nil || n < 0 {
+			http.Error(w, "bad "+hopsHeader+" header", http.StatusBadRequest)
+			return
+		}
+		hops = n
+	}
+	if hops > maxPeerHops {
+		http.Error(w, "peer forwarding loop detected", http.StatusLoopDetected)
+		return
+	}
+	// Peers that predate the header still forwarded the request once.
+	if hops == 0 {
+		hops = 1
+	}
 
 	// Fetch the value for this group/key.
 	group := GetGroup(groupName)
@@ -178,17 +1006,66 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
 		return
 	}
+	done, shed := p.shed(w, r, group)
+	if shed {
+		return
+	}
+	defer done()
 	var ctx context.Context
 	if p.opts.Context != nil {
 		ctx = p.opts.Context(r)
 	} else {
 		ctx = r.Context()
 	}
+	ctx = withPeerHops(ctx, hops)
+	if r.Header.Get(refreshHeader) != "" {
+		ctx = WithForceRefresh(ctx)
+	}
+	if r.Header.Get(replicaHeader) != "" {
+		ctx = withReplicaRead(ctx, true)
+	}
+	if r.Header.Get(ownerFetchHeader) != "" {
+		ctx = withOwnerFetch(ctx)
+	}
+	if h := r.Header.Get(generationHeader); h != "" {
+		gen, err := strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			http.Error(w, "bad "+generationHeader+" header", http.StatusBadRequest)
+			return
+		}
+		group.adoptGeneration(gen)
+	}
 
 	group.Stats.ServerRequests.Add(1)
 
+	// Report whether the key is cached, without loading it: 200 if it
+	// is, 404 with the not found header if it is not.
+	if r.Method == http.MethodHead {
+		// Or with its checksum, if asked to, which only the main cache
+		// of the key's owner holds.
+		if r.Header.Get(checksumHeader) != "" {
+			sum, ok := group.mainChecksum(key)
+			if !ok {
+				w.Header().Set(notFoundHeader, "1")
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set(checksumHeader, strconv.FormatUint(uint64(sum), 10))
+			return
+		}
+		if _, ok := group.Contains(key); !ok {
+			w.Header().Set(notFoundHeader, "1")
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+
 	// Delete the key and return 200
 	if r.Method == http.MethodDelete {
+		if r.Header.Get(tagHeader) != "" {
+			group.localRemoveTag(key)
+			return
+		}
 		group.localRemove(key)
 		return
 	}
@@ -196,9 +1073,8 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// The read the body and set the key value
 	if r.Method == http.MethodPut {
 		defer r.Body.Close()
-		b := bufferPool.Get().(*bytes.Buffer)
-		b.Reset()
-		defer bufferPool.Put(b)
+		b := getBuffer()
+		defer putBuffer(b)
 		_, err := io.Copy(b, r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -206,7 +1082,7 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var out pb.SetRequest
-		err = proto.Unmarshal(b.Bytes(), &out)
+		err = p.opts.Codec.DecodeSetRequest(b.Bytes(), &out)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -217,75 +1093,463 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			expire = time.Unix(*out.Expire/int64(time.Second), *out.Expire%int64(time.Second))
 		}
 
-		group.localSet(*out.Key, out.Value, expire, &group.mainCache)
+		if r.Header.Get(hotCacheHeader) != "" {
+			group.localSetHot(*out.Key, out.Value, expire, out.Tags)
+			return
+		}
+		if r.Header.Get(ifAbsentHeader) == "" {
+			group.localSetTagged(*out.Key, out.Value, expire, out.Tags, &group.mainCache)
+			return
+		}
+		view := group.getOrSetLocally(*out.Key, out.Value, expire)
+		var expireNano int64
+		if !view.e.IsZero() {
+			expireNano = view.Expire().UnixNano()
+		}
+		body, err := p.opts.Codec.EncodeGetResponse(&pb.GetResponse{Value: view.ByteSlice(), Expire: &expireNano, Meta: view.meta, Tags: view.tags})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		group.Stats.BytesServedToPeers.Add(int64(view.Len()))
+		h := w.Header()
+		h.Set(ifAbsentHeader, "1")
+		h.Set("Content-Type", p.opts.Codec.ContentType())
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
 		return
 	}
 
-	var b []byte
-
-	value := AllocatingByteSliceSink(&b)
-	err := group.Get(ctx, key, value, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Get the keys of a GetMulti request.
+	if r.Method == http.MethodPost && r.Header.Get(multiHeader) != "" {
+		p.serveGetMulti(ctx, w, r, group)
 		return
 	}
 
-	view, err := value.view()
+	var view ByteView
+	info, err := group.GetWithInfo(ctx, key, ByteViewSink(&view), nil)
+	if errors.Is(err, ErrNotFound) {
+		w.Header().Set(notFoundHeader, "1")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrReadOnly) {
+		w.Header().Set(readOnlyHeader, "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err == nil && r.Header.Get(populateHeader) != "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err == nil && p.tooLarge(view.Len()) {
+		err = ErrValueTooLarge
+	}
+	if errors.Is(err, ErrValueTooLarge) {
+		w.Header().Set(tooLargeHeader, "1")
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	// Answer a conditional Get sent by GetIfChanged without the value
+	// if the caller holds it already.
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := quoteETag(view.etag())
+		if match == etag {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	group.Stats.BytesServedToPeers.Add(int64(view.Len()))
+	// The sink's view lacks the metadata if the getter populated it.
+	view.meta = info.Meta
+
+	h := w.Header()
+	h.Set(keyHeader, url.PathEscape(key))
+	h.Set(valueLengthHeader, strconv.Itoa(view.Len()))
+	if view.stored != 0 {
+		h.Set(sourceHeader, "cache")
+		age := group.clock().Sub(time.Unix(0, view.stored))
+		h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	} else {
+		h.Set(sourceHeader, "origin")
+	}
+
 	var expireNano int64
 	if !view.e.IsZero() {
 		expireNano = view.Expire().UnixNano()
 	}
 
-	// Write the value to the response body as a proto message.
-	body, err := proto.Marshal(&pb.GetResponse{Value: b, Expire: &expireNano})
+	// Large values are streamed straight from the cache rather than
+	// being copied into an encoded message first.
+	if _, ok := p.opts.Codec.(ProtoCodec); ok && p.opts.StreamThreshold > 0 && view.Len() >= p.opts.StreamThreshold {
+		h.Set("Content-Type", p.opts.Codec.ContentType())
+		h.Set(streamHeader, "1")
+		if zw := p.compressedBody(w, r, view.Len()); zw != nil {
+			writeStreamedGetResponse(zw, view, expireNano, p.opts.StreamChunkSize)
+			zw.Close()
+			return
+		}
+		h.Set("Content-Length", strconv.Itoa(streamedGetResponseLen(view, expireNano)))
+		writeStreamedGetResponse(w, view, expireNano, p.opts.StreamChunkSize)
+		return
+	}
+
+	// Write the value to the response body as an encoded message.
+	// ProtoCodec's is the streamed encoding, written into a pooled
+	// buffer straight from the view rather than from a copy of the
+	// value marshaled into a new slice.
+	var body []byte
+	if _, ok := p.opts.Codec.(ProtoCodec); ok {
+		b := getBuffer()
+		defer putBuffer(b)
+		writeStreamedGetResponse(b, view, expireNano, 0)
+		body = b.Bytes()
+	} else {
+		var err error
+		body, err = p.opts.Codec.EncodeGetResponse(&pb.GetResponse{Value: view.ByteSlice(), Expire: &expireNano, Meta: view.meta, Tags: view.tags})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	h.Set("Content-Type", p.opts.Codec.ContentType())
+	if zw := p.compressedBody(w, r, view.Len()); zw != nil {
+		zw.Write(body)
+		zw.Close()
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// serveGetMulti answers a GetMulti request for keys of group, sent as
+// their count then each key in RawCodec's framing. The response holds
+// the count of keys then, for each, a byte of multiFound, multiNotFound,
+// multiReadOnly or multiError, followed by its value's GetResponse
+// encoded with the pool's codec or by the error message, as strings.
+func (p *HTTPPool) serveGetMulti(ctx context.Context, w http.ResponseWriter, r *http.Request, group *Group) {
+	body := getBuffer()
+	defer putBuffer(body)
+	if _, err := io.Copy(body, r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The keys are copied out of the buffer.
+	d := rawDecoder{b: body.Bytes()}
+	keys := d.strings()
+	if d.err != nil {
+		http.Error(w, d.err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := group.serveGetMulti(ctx, keys)
+	for i, v := range res.Values {
+		// Peers get refused values on their own, learning why.
+		if v.Error == nil && p.tooLarge(len(v.Value)) {
+			res.Values[i] = &pb.GetResponse{Error: proto.String(ErrValueTooLarge.Error())}
+		}
+	}
+	b, err := encodeMultiResponse(p.opts.Codec, res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/x-protobuf")
-	w.Write(body)
+	h := w.Header()
+	h.Set(multiHeader, "1")
+	h.Set("Content-Type", "application/octet-stream")
+	if zw := p.compressedBody(w, r, len(b)); zw != nil {
+		zw.Write(b)
+		zw.Close()
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// tooLarge reports whether a value of n bytes exceeds
+// HTTPPoolOptions.MaxServedValueBytes.
+func (p *HTTPPool) tooLarge(n int) bool {
+	return p.opts.MaxServedValueBytes > 0 && int64(n) > p.opts.MaxServedValueBytes
+}
+
+// The outcomes of the keys of a GetMulti response served over HTTP.
+const (
+	multiFound = iota
+	multiNotFound
+	multiReadOnly
+	multiError
+)
+
+func encodeMultiResponse(codec WireCodec, res *pb.GetMultiResponse) ([]byte, error) {
+	b := appendUvarint(nil, uint64(len(res.Values)))
+	for _, v := range res.Values {
+		switch {
+		case v.GetNotFound():
+			b = append(b, multiNotFound)
+		case v.GetReadOnly():
+			b = append(b, multiReadOnly)
+		case v.Error != nil:
+			b = appendString(append(b, multiError), v.GetError())
+		default:
+			enc, err := codec.EncodeGetResponse(v)
+			if err != nil {
+				return nil, err
+			}
+			b = appendString(append(b, multiFound), string(enc))
+		}
+	}
+	return b, nil
+}
+
+func decodeMultiResponse(codec WireCodec, b []byte, out *pb.GetMultiResponse) error {
+	d := rawDecoder{b: b}
+	n := d.count()
+	if d.err != nil {
+		return d.err
+	}
+	out.Values = make([]*pb.GetResponse, n)
+	for i := range out.Values {
+		v := &pb.GetResponse{}
+		switch d.byte() {
+		case multiFound:
+			if err := codec.DecodeGetResponse([]byte(d.string()), v); err != nil {
+				return err
+			}
+		case multiNotFound:
+			v.NotFound = proto.Bool(true)
+		case multiReadOnly:
+			v.ReadOnly = proto.Bool(true)
+		default:
+			v.Error = proto.String(d.string())
+		}
+		out.Values[i] = v
+	}
+	return d.err
 }
 
 type httpGetter struct {
 	getTransport func(context.Context) http.RoundTripper
 	baseURL      string
+	socket       string            // of peers named by unix:// URLs
+	unix         http.RoundTripper // dials socket; overrides getTransport
+	codec        WireCodec
+	compression  WireCompression // nil unless compressed responses are asked for
+	health       *peerHealth     // nil unless backup peers are enabled
+	breaker      *circuitBreaker // nil unless HTTPPoolOptions.BreakerFailures is set
+	maxBytes     int64           // of response bodies; unlimited if zero
+
+	timeout  time.Duration    // of Gets; none if zero
+	adaptive *adaptiveTimeout // overrides timeout if non-nil
+
+	modifyRequest func(context.Context, *http.Request) // HTTPPoolOptions.RequestModifier
+	auth          PeerAuthenticator                    // HTTPPoolOptions.Authenticator
+
+	probeFailures int // health checks failed in a row; guarded by HTTPPool.mu
+}
+
+// modify applies HTTPPoolOptions.RequestModifier to req, keeping the
+// method, URL and body it was created with, then signs it with
+// HTTPPoolOptions.Authenticator.
+func (h *httpGetter) modify(ctx context.Context, req *http.Request) {
+	if h.modifyRequest != nil {
+		method, u, host := req.Method, *req.URL, req.Host
+		body, getBody, length := req.Body, req.GetBody, req.ContentLength
+		h.modifyRequest(ctx, req)
+		req.Method, req.URL, req.Host = method, &u, host
+		req.Body, req.GetBody, req.ContentLength = body, getBody, length
+	}
+	if h.auth != nil {
+		h.auth.Sign(req)
+	}
+}
+
+// ErrResponseTooLarge is returned when a peer's response body exceeds
+// HTTPPoolOptions.MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("groupcache: peer response exceeds MaxResponseBytes")
+
+// limitedBody reads from r until more than left bytes would be read,
+// and then fails with ErrResponseTooLarge.
+type limitedBody struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// Only fail if there is more to read.
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// peerHealth tracks the outcome of recent fetches from a peer.
+type peerHealth struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	start     time.Time // of the current window
+	successes int
+	failures  int
+}
+
+// record records the outcome of a fetch, starting a new window if the
+// current one has elapsed.
+func (ph *peerHealth) record(ok bool) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	if now := time.Now(); now.Sub(ph.start) >= ph.window {
+		ph.start, ph.successes, ph.failures = now, 0, 0
+	}
+	if ok {
+		ph.successes++
+	} else {
+		ph.failures++
+	}
+}
+
+// successRate returns the smoothed fraction of fetches in the current
+// window that succeeded. A peer with no recorded fetches rates 0.5.
+func (ph *peerHealth) successRate() float64 {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	if time.Since(ph.start) >= ph.window {
+		return 0.5
+	}
+	return float64(ph.successes+1) / float64(ph.successes+ph.failures+2)
+}
+
+// adaptiveTimeout computes the timeout of Gets from a peer with
+// HTTPPoolOptions.AdaptiveTimeout.
+type adaptiveTimeout struct {
+	latency  *rollingLatency // of the peer's recent answered Gets
+	multiple float64
+	min, max time.Duration
+}
+
+// timeout returns multiple times the recent p99 latency, within
+// [min, max].
+func (a *adaptiveTimeout) timeout() time.Duration {
+	st := a.latency.stats()
+	if st.Count < adaptiveTimeoutMinSamples {
+		return a.max
+	}
+	d := time.Duration(a.multiple * float64(st.P99))
+	if d < a.min {
+		return a.min
+	}
+	if d > a.max {
+		return a.max
+	}
+	return d
+}
+
+// currentTimeout returns the timeout to apply to the next Get, or zero
+// if there is none.
+func (h *httpGetter) currentTimeout() time.Duration {
+	if h.adaptive != nil {
+		return h.adaptive.timeout()
+	}
+	return h.timeout
 }
 
 func (p *httpGetter) GetURL() string {
+	if p.socket != "" {
+		return unixScheme + p.socket
+	}
 	return p.baseURL
 }
 
+// transport returns the http.RoundTripper of requests to the peer.
+func (h *httpGetter) transport(ctx context.Context) http.RoundTripper {
+	if h.unix != nil {
+		return h.unix
+	}
+	if h.getTransport != nil {
+		return h.getTransport(ctx)
+	}
+	return http.DefaultTransport
+}
+
 var bufferPool = sync.Pool{
 	New: func() interface{} { return new(bytes.Buffer) },
 }
 
+// maxPooledBufferBytes bounds the capacity of the buffers returned to
+// bufferPool, so that a few large values do not keep their memory
+// pinned by the pool.
+const maxPooledBufferBytes = 1 << 20
+
+// getBuffer returns an empty buffer from bufferPool.
+func getBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// putBuffer returns b, which must no longer be used, to bufferPool.
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledBufferBytes {
+		bufferPool.Put(b)
+	}
+}
+
 type request interface {
 	GetGroup() string
 	GetKey() string
 }
 
 func (h *httpGetter) makeRequest(ctx context.Context, m string, in request, b io.Reader, out *http.Response) error {
-	u := fmt.Sprintf(
-		"%v%v/%v",
-		h.baseURL,
-		url.QueryEscape(in.GetGroup()),
-		url.QueryEscape(in.GetKey()),
-	)
+	u := h.baseURL + requestPath(in.GetGroup(), in.GetKey())
 	req, err := http.NewRequestWithContext(ctx, m, u, b)
 	if err != nil {
 		return err
 	}
-
-	tr := http.DefaultTransport
-	if h.getTransport != nil {
-		tr = h.getTransport(ctx)
+	h.modify(ctx, req)
+	req.Header.Set(hopsHeader, strconv.Itoa(peerHops(ctx)+1))
+	if forceRefresh(ctx) {
+		req.Header.Set(refreshHeader, "1")
+	}
+	if replicaRead(ctx) {
+		req.Header.Set(replicaHeader, "1")
+	}
+	if ownerFetch(ctx) {
+		req.Header.Set(ownerFetchHeader, "1")
+	}
+	if header, ok := ctx.Value(requestFlagKey{}).(string); ok {
+		req.Header.Set(header, "1")
+	}
+	if r, ok := in.(*pb.GetRequest); ok && r.Etag != nil {
+		req.Header.Set("If-None-Match", quoteETag(*r.Etag))
+	}
+	if r, ok := in.(*pb.GetRequest); ok && r.GetPopulate() {
+		req.Header.Set(populateHeader, "1")
+	}
+	if r, ok := in.(*pb.SetRequest); ok && r.GetHotCache() {
+		req.Header.Set(hotCacheHeader, "1")
+	}
+	if r, ok := in.(interface{ GetGeneration() uint64 }); ok && r.GetGeneration() != 0 {
+		req.Header.Set(generationHeader, strconv.FormatUint(r.GetGeneration(), 10))
+	}
+	if h.compression != nil {
+		req.Header.Set("Accept-Encoding", h.compression.Encoding())
 	}
 
-	res, err := tr.RoundTrip(req)
+	res, err := h.transport(ctx).RoundTrip(req)
 	if err != nil {
 		return err
 	}
@@ -294,30 +1558,95 @@ func (h *httpGetter) makeRequest(ctx context.Context, m string, in request, b io
 }
 
 func (h *httpGetter) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	allowed, probe := h.breaker.allow()
+	if !allowed {
+		return ErrCircuitOpen
+	}
+	reqCtx := ctx
+	if timeout := h.currentTimeout(); timeout > 0 {
+		if reqCtx == nil {
+			reqCtx = context.Background()
+		}
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(reqCtx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := h.get(reqCtx, in, out)
+	answered := err == nil || err == ErrNotFound || err == ErrReadOnly || err == ErrValueTooLarge
+	if h.adaptive != nil && answered {
+		h.adaptive.latency.record(time.Since(start))
+	}
+	// Timing out on the peer is a failure, unlike the caller giving up.
+	counted := err == nil || ctx == nil || ctx.Err() == nil
+	if h.health != nil && counted {
+		// A peer reporting a missing key, or one it may not load, is
+		// healthy.
+		h.health.record(answered)
+	}
+	h.breaker.record(probe, answered, counted)
+	return err
+}
+
+func (h *httpGetter) get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
 	var res http.Response
 	if err := h.makeRequest(ctx, http.MethodGet, in, nil, &res); err != nil {
 		return err
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound && res.Header.Get(notFoundHeader) != "" {
+		return ErrNotFound
+	}
+	if res.StatusCode == http.StatusServiceUnavailable && res.Header.Get(readOnlyHeader) != "" {
+		return ErrReadOnly
+	}
+	if res.StatusCode == http.StatusRequestEntityTooLarge && res.Header.Get(tooLargeHeader) != "" {
+		return ErrValueTooLarge
+	}
+	if res.StatusCode == http.StatusNotModified {
+		out.NotModified = proto.Bool(true)
+		return nil
+	}
+	// A populate request was answered without the value. Peers that
+	// predate them send it anyway.
+	if res.StatusCode == http.StatusNoContent && in.GetPopulate() {
+		return nil
+	}
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("server returned: %v", res.Status)
 	}
-	b := bufferPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bufferPool.Put(b)
-	_, err := io.Copy(b, res.Body)
+	body, err := h.responseBody(&res)
 	if err != nil {
-		return fmt.Errorf("reading response body: %v", err)
+		return err
 	}
-	err = proto.Unmarshal(b.Bytes(), out)
+	defer body.Close()
+	if res.Header.Get(streamHeader) != "" {
+		// The length of a compressed body says nothing of the
+		// fields it holds.
+		size := res.ContentLength
+		if res.Header.Get("Content-Encoding") != "" {
+			size = -1
+		}
+		if err := readStreamedGetResponse(body, out, h.maxBytes, size); err != nil {
+			return fmt.Errorf("reading streamed response body: %w", err)
+		}
+		return nil
+	}
+	b := getBuffer()
+	defer putBuffer(b)
+	_, err = io.Copy(b, body)
+	if err != nil {
+		return fmt.Errorf("reading response body: %w", err)
+	}
+	err = h.codec.DecodeGetResponse(b.Bytes(), out)
 	if err != nil {
-		return fmt.Errorf("decoding response body: %v", err)
+		return &DecodeError{What: "response body", Err: err}
 	}
 	return nil
 }
 
 func (h *httpGetter) Set(ctx context.Context, in *pb.SetRequest) error {
-	body, err := proto.Marshal(in)
+	body, err := h.codec.EncodeSetRequest(in)
 	if err != nil {
 		return fmt.Errorf("while marshaling SetRequest body: %w", err)
 	}
@@ -337,6 +1666,114 @@ func (h *httpGetter) Set(ctx context.Context, in *pb.SetRequest) error {
 	return nil
 }
 
+func (h *httpGetter) GetOrSet(ctx context.Context, in *pb.SetRequest, out *pb.GetResponse) error {
+	body, err := h.codec.EncodeSetRequest(in)
+	if err != nil {
+		return fmt.Errorf("while marshaling SetRequest body: %w", err)
+	}
+	var res http.Response
+	if err := h.makeRequest(withRequestFlag(ctx, ifAbsentHeader), http.MethodPut, in, bytes.NewReader(body), &res); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	// Peers that predate GetOrSet store the value as for Set.
+	if res.Header.Get(ifAbsentHeader) == "" {
+		return errors.New("peer does not support GetOrSet, and stored the value unconditionally")
+	}
+	r, err := h.responseBody(&res)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading response body: %w", err)
+	}
+	if err := h.codec.DecodeGetResponse(b, out); err != nil {
+		return &DecodeError{What: "response body", Err: err}
+	}
+	return nil
+}
+
+// multiRequest is the request of makeRequest for a GetMultiRequest,
+// made for the group rather than a key.
+type multiRequest struct {
+	*pb.GetMultiRequest
+}
+
+func (multiRequest) GetKey() string { return "" }
+
+func (h *httpGetter) GetMulti(ctx context.Context, in *pb.GetMultiRequest, out *pb.GetMultiResponse) error {
+	if h.breaker.isOpen() {
+		return ErrCircuitOpen
+	}
+	body := appendStrings(nil, in.Keys)
+	var res http.Response
+	if err := h.makeRequest(withRequestFlag(ctx, multiHeader), http.MethodPost, multiRequest{in}, bytes.NewReader(body), &res); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	if res.Header.Get(multiHeader) == "" {
+		return errors.New("peer does not support GetMulti")
+	}
+	r, err := h.responseBody(&res)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading response body: %w", err)
+	}
+	if err := decodeMultiResponse(h.codec, b, out); err != nil {
+		return &DecodeError{What: "response body", Err: err}
+	}
+	return nil
+}
+
+func (h *httpGetter) Exists(ctx context.Context, in *pb.GetRequest) (bool, error) {
+	var res http.Response
+	if err := h.makeRequest(ctx, http.MethodHead, in, nil, &res); err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return true, nil
+	case res.StatusCode == http.StatusNotFound && res.Header.Get(notFoundHeader) != "":
+		return false, nil
+	}
+	return false, fmt.Errorf("server returned: %v", res.Status)
+}
+
+func (h *httpGetter) Checksum(ctx context.Context, in *pb.GetRequest) (uint32, bool, error) {
+	var res http.Response
+	if err := h.makeRequest(withRequestFlag(ctx, checksumHeader), http.MethodHead, in, nil, &res); err != nil {
+		return 0, false, err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		// Peers that predate checksums answer as for Exists.
+		sum, err := strconv.ParseUint(res.Header.Get(checksumHeader), 10, 32)
+		if err != nil {
+			return 0, false, fmt.Errorf("peer returned no valid %s header", checksumHeader)
+		}
+		return uint32(sum), true, nil
+	case res.StatusCode == http.StatusNotFound && res.Header.Get(notFoundHeader) != "":
+		return 0, false, nil
+	}
+	return 0, false, fmt.Errorf("server returned: %v", res.Status)
+}
+
 func (h *httpGetter) Remove(ctx context.Context, in *pb.GetRequest) error {
 	var res http.Response
 	if err := h.makeRequest(ctx, http.MethodDelete, in, nil, &res); err != nil {
@@ -353,3 +1790,7 @@ func (h *httpGetter) Remove(ctx context.Context, in *pb.GetRequest) error {
 	}
 	return nil
 }
+
+func (h *httpGetter) RemoveTag(ctx context.Context, in *pb.GetRequest) error {
+	return h.Remove(withRequestFlag(ctx, tagHeader), in)
+}
@@ -18,21 +18,33 @@ package groupcache
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -242,3 +254,1744 @@ func awaitAddrReady(t *testing.T, addr string, wg *sync.WaitGroup) {
 		time.Sleep(delay)
 	}
 }
+
+func TestHTTPPoolSelfLoop(t *testing.T) {
+	// The pool's self address is misconfigured, so every key appears to
+	// belong to the remote peer, which is in fact this very server.
+	p := newHTTPPool("http://misconfigured-self", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	p.Set(ts.URL)
+
+	var loads AtomicInt
+	getter := GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("loop:"+key, time.Time{})
+	})
+	g := newGroup("TestHTTPPoolSelfLoop-group", 1<<20, getter, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	var value string
+	if err := g.Get(ctx, "key", StringSink(&value), nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "loop:key"; value != want {
+		t.Errorf("Get = %q; want %q", value, want)
+	}
+	if got := loads.Get(); got != 1 {
+		t.Errorf("getter called %d times; want 1", got)
+	}
+}
+
+func TestHTTPPoolMaxHops(t *testing.T) {
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+defaultBasePath+"group/key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(hopsHeader, strconv.Itoa(maxPeerHops+1))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusLoopDetected {
+		t.Errorf("status = %d; want %d", res.StatusCode, http.StatusLoopDetected)
+	}
+}
+
+func largeValue(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestHTTPPoolStreamLargeValue(t *testing.T) {
+	p := newHTTPPool("http://misconfigured-self", &HTTPPoolOptions{StreamThreshold: 1 << 10})
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	p.Set(ts.URL)
+
+	want := largeValue(4 << 20)
+	expire := time.Now().Add(time.Hour)
+	g := newGroup("TestHTTPPoolStreamLargeValue-group", 16<<20, GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		if key == "small" {
+			return dest.SetString("small value", expire)
+		}
+		return dest.SetBytes(want, expire)
+	}), p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for _, key := range []string{"large", "small"} {
+		out := &pb.GetResponse{}
+		if err := p.current().getters[ts.URL].Get(ctx, &pb.GetRequest{Group: proto.String(g.Name()), Key: proto.String(key)}, out); err != nil {
+			t.Fatal(err)
+		}
+		if key == "large" && !bytes.Equal(out.Value, want) {
+			t.Errorf("streamed value differs from the original")
+		}
+		if key == "small" && string(out.Value) != "small value" {
+			t.Errorf("small value = %q; want %q", out.Value, "small value")
+		}
+		if out.GetExpire() != expire.UnixNano() {
+			t.Errorf("%s: expire = %d; want %d", key, out.GetExpire(), expire.UnixNano())
+		}
+	}
+}
+
+// countingWriter is an http.ResponseWriter that discards the body.
+type countingWriter struct {
+	header http.Header
+	n      int
+}
+
+func (w *countingWriter) Header() http.Header         { return w.header }
+func (w *countingWriter) WriteHeader(statusCode int)  {}
+func (w *countingWriter) Write(b []byte) (int, error) { w.n += len(b); return len(b), nil }
+
+func TestServeHTTPStreamMemory(t *testing.T) {
+	const size = 8 << 20
+	p := newHTTPPool("http://127.0.0.1", nil)
+	g := newGroup("TestServeHTTPStreamMemory-group", 2*size, GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetBytes(largeValue(size), time.Time{})
+	}), NoPeers{})
+
+	// Load the value into the cache before measuring.
+	var v ByteView
+	if err := g.Get(context.Background(), "key", ByteViewSink(&v), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	w := &countingWriter{header: make(http.Header)}
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultBasePath+g.Name()+"/key", nil))
+	runtime.ReadMemStats(&after)
+
+	if w.n < size {
+		t.Fatalf("wrote %d bytes; want at least %d", w.n, size)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/4 {
+		t.Errorf("serving a %d byte value allocated %d bytes; want it streamed", size, alloc)
+	}
+}
+
+func TestBytesServed(t *testing.T) {
+	p := newHTTPPool("http://127.0.0.1", nil)
+	g := newGroup("TestBytesServed-group", 1<<20, GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(strings.Repeat("x", len(key)), time.Time{})
+	}), NoPeers{})
+
+	// A load, a cache hit and another load.
+	for _, key := range []string{"a", "a", "bbb"} {
+		var s string
+		if err := g.Get(context.Background(), key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := g.Stats.BytesServedLocal.Get(); got != 5 {
+		t.Errorf("BytesServedLocal = %d; want 5", got)
+	}
+
+	for _, key := range []string{"bbb", "cccc"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultBasePath+g.Name()+"/"+key, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("ServeHTTP status = %d; want %d", w.Code, http.StatusOK)
+		}
+	}
+	if got := g.Stats.BytesServedToPeers.Get(); got != 7 {
+		t.Errorf("BytesServedToPeers = %d; want 7", got)
+	}
+	if got := g.Stats.BytesServedLocal.Get(); got != 5 {
+		t.Errorf("BytesServedLocal after peer requests = %d; want 5", got)
+	}
+}
+
+func TestHTTPPoolPerPeerBasePath(t *testing.T) {
+	serve := func(prefix string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, prefix) {
+				http.Error(w, "unexpected path "+r.URL.Path, http.StatusNotFound)
+				return
+			}
+			body, _ := proto.Marshal(&pb.GetResponse{Value: []byte(r.URL.Path)})
+			w.Write(body)
+		}))
+	}
+	cacheServer := serve("/cache/")
+	defer cacheServer.Close()
+	rootServer := serve(defaultBasePath)
+	defer rootServer.Close()
+
+	cacheURL, _ := url.Parse(cacheServer.URL + "/cache")
+	rootURL, _ := url.Parse(rootServer.URL)
+
+	p := newHTTPPool("http://127.0.0.1", nil)
+	p.SetURLs(cacheURL, rootURL)
+
+	tests := []struct {
+		peer string
+		path string
+	}{
+		{cacheServer.URL, "/cache/group/key"},
+		{rootServer.URL, defaultBasePath + "group/key"},
+	}
+	for _, tt := range tests {
+		getter, ok := p.current().getters[tt.peer]
+		if !ok {
+			t.Fatalf("no getter for peer %s", tt.peer)
+		}
+		out := &pb.GetResponse{}
+		err := getter.Get(context.Background(), &pb.GetRequest{Group: proto.String("group"), Key: proto.String("key")}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out.Value) != tt.path {
+			t.Errorf("peer %s was asked for %q; want %q", tt.peer, out.Value, tt.path)
+		}
+	}
+}
+
+func TestHTTPPoolBackupPeers(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		hits    = make(map[string]int)
+		failing string
+	)
+	var urls []string
+	for i := 0; i < 4; i++ {
+		var ts *httptest.Server
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[ts.URL]++
+			fail := ts.URL == failing
+			mu.Unlock()
+			if fail {
+				http.Error(w, "primary is down", http.StatusInternalServerError)
+				return
+			}
+			body, _ := proto.Marshal(&pb.GetResponse{Value: []byte("backup")})
+			w.Write(body)
+		}))
+		defer ts.Close()
+		urls = append(urls, ts.URL)
+	}
+
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{BackupPeers: 3})
+	p.Set(urls...)
+	primary, _ := p.PickPeer("key")
+	mu.Lock()
+	failing = strings.TrimSuffix(primary.GetURL(), defaultBasePath)
+	mu.Unlock()
+
+	// With no cache, every Get goes to the primary, then to a backup.
+	g := newGroup("TestHTTPPoolBackupPeers-group", 0, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), p)
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		var s string
+		if err := g.Get(context.Background(), "key", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := hits[failing]; got != n {
+		t.Errorf("primary got %d requests; want %d", got, n)
+	}
+	for _, u := range urls {
+		if u == failing {
+			continue
+		}
+		// Each of the 3 backups should take about a third of the retries.
+		if got := hits[u]; got < n/6 || got > n/2 {
+			t.Errorf("backup %s got %d of %d retries; want them spread evenly", u, got, n)
+		}
+	}
+	if got := g.Stats.LocalLoads.Get(); got != 0 {
+		t.Errorf("LocalLoads = %d; want 0", got)
+	}
+}
+
+func TestHTTPPoolReadReplicas(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		hits         = make(map[string]int)
+		replicaReads = make(map[string]int)
+	)
+	var urls []string
+	for i := 0; i < 4; i++ {
+		var ts *httptest.Server
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[ts.URL]++
+			if r.Header.Get(replicaHeader) != "" {
+				replicaReads[ts.URL]++
+			}
+			mu.Unlock()
+			body, _ := proto.Marshal(&pb.GetResponse{Value: []byte("value")})
+			w.Write(body)
+		}))
+		defer ts.Close()
+		urls = append(urls, ts.URL)
+	}
+
+	p := newHTTPPool("http://127.0.0.1", nil)
+	p.Set(urls...)
+	replicas := p.current().ring.GetN("key", 3)
+
+	// With no cache, every Get goes to one of the key's 3 replicas.
+	g := newGroupOpts("TestHTTPPoolReadReplicas-group", 0, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), p, &GroupOptions{ReadReplicas: 3})
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		var s string
+		if err := g.Get(context.Background(), "key", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, u := range replicas {
+		if got := hits[u]; got < n/6 || got > n/2 {
+			t.Errorf("replica %s got %d of %d reads; want them spread evenly", u, got, n)
+		}
+		// Only the non-owners are asked to serve as replicas.
+		if got, want := replicaReads[u], hits[u]; i == 0 && got != 0 || i > 0 && got != want {
+			t.Errorf("replica %d got %d replica reads of %d; want %d", i, got, hits[u], want)
+		}
+	}
+	if total := hits[replicas[0]] + hits[replicas[1]] + hits[replicas[2]]; total != n {
+		t.Errorf("replicas got %d of %d reads", total, n)
+	}
+}
+
+func TestHTTPPoolPickOwners(t *testing.T) {
+	p := newHTTPPool("http://self", nil)
+	p.Set("http://self", "http://peer-a", "http://peer-b", "http://peer-c")
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		names := p.current().ring.GetN(key, 3)
+		owners := p.PickOwners(key, 3)
+		if len(owners) != len(names) {
+			t.Fatalf("PickOwners(%q) returned %d owners; want %d", key, len(owners), len(names))
+		}
+		for i, name := range names {
+			var want ProtoGetter
+			if name != "http://self" {
+				want = p.current().getters[name]
+			}
+			if got := owners[i]; got != want {
+				t.Errorf("PickOwners(%q)[%d] = %v; want the peer %s", key, i, got, name)
+			}
+		}
+	}
+}
+
+func TestHTTPPoolOwnerFetch(t *testing.T) {
+	var loads AtomicInt
+	g := newGroup("TestHTTPPoolOwnerFetch-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+
+	// Another owner only gets the copy held here, never a load.
+	r := httptest.NewRequest(http.MethodGet, defaultBasePath+g.Name()+"/key", nil)
+	r.Header.Set(ownerFetchHeader, "1")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Header().Get(notFoundHeader) == "" || loads.Get() != 0 {
+		t.Errorf("owner fetch of an uncached key: not found header %q, %d loads; want it set, 0 loads",
+			w.Header().Get(notFoundHeader), loads.Get())
+	}
+}
+
+func TestHTTPPoolForceRefresh(t *testing.T) {
+	// The owner: a refresh request from a peer bypasses its cache.
+	var version AtomicInt
+	owner := newGroup("TestHTTPPoolForceRefresh-owner", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		version.Add(1)
+		return dest.SetString(fmt.Sprintf("%s@%d", key, version.Get()), time.Time{})
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	serve := func(refresh bool) string {
+		r := httptest.NewRequest(http.MethodGet, defaultBasePath+owner.Name()+"/key", nil)
+		if refresh {
+			r.Header.Set(refreshHeader, "1")
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		var out pb.GetResponse
+		if err := proto.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		return string(out.Value)
+	}
+	for i, step := range []struct {
+		refresh bool
+		want    string
+	}{{false, "key@1"}, {false, "key@1"}, {true, "key@2"}, {false, "key@2"}} {
+		if got := serve(step.refresh); got != step.want {
+			t.Errorf("owner step %d: served %q; want %q", i, got, step.want)
+		}
+	}
+
+	// A non-owner: a forced refresh skips its hot cache and asks the
+	// owner to refresh too.
+	var requests, refreshes AtomicInt
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get(refreshHeader) != "" {
+			refreshes.Add(1)
+		}
+		body, _ := proto.Marshal(&pb.GetResponse{Value: []byte(fmt.Sprintf("remote@%d", requests.Get()))})
+		w.Write(body)
+	}))
+	defer ts.Close()
+	client := newGroup("TestHTTPPoolForceRefresh-client", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), fakePeers{&httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}})
+
+	ctx := context.Background()
+	for i, step := range []struct {
+		ctx  context.Context
+		want string
+	}{{ctx, "remote@1"}, {ctx, "remote@1"}, {WithForceRefresh(ctx), "remote@2"}, {ctx, "remote@2"}} {
+		var s string
+		if err := client.Get(step.ctx, "key", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if s != step.want {
+			t.Errorf("client step %d: Get = %q; want %q", i, s, step.want)
+		}
+	}
+	if requests.Get() != 2 || refreshes.Get() != 1 {
+		t.Errorf("owner got %d requests, %d refreshes; want 2, 1", requests.Get(), refreshes.Get())
+	}
+}
+
+func TestHTTPPoolSetKeepsGetters(t *testing.T) {
+	p := newHTTPPool("http://self", nil)
+	p.Set("http://a", "http://b")
+	a, b := p.current().getters["http://a"], p.current().getters["http://b"]
+
+	p.Set("http://a", "http://c")
+	if p.current().getters["http://a"] != a {
+		t.Error("getter of unchanged peer was replaced")
+	}
+	if _, ok := p.current().getters["http://b"]; ok {
+		t.Error("getter of removed peer was kept")
+	}
+
+	u, _ := url.Parse("http://b/other/")
+	p.SetURLs(u)
+	if p.current().getters["http://b"] == b {
+		t.Error("getter of peer with a new base path was kept")
+	}
+}
+
+func TestHTTPPoolConcurrentSet(t *testing.T) {
+	p := newHTTPPool("http://self", nil)
+	peers := [][]string{
+		{"http://a", "http://b", "http://c"},
+		{"http://b", "http://c", "http://d"},
+	}
+	p.Set(peers[0]...)
+
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				peer, ok := p.PickPeer(fmt.Sprintf("key-%d-%d", i, n))
+				if !ok || peer == nil {
+					t.Error("PickPeer found no peer")
+					return
+				}
+				p.GetAll()
+			}
+		}(i)
+	}
+	for i := 0; i < 1000; i++ {
+		p.Set(peers[i%2]...)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkHTTPPoolPickPeerDuringSet(b *testing.B) {
+	p := newHTTPPool("http://self", nil)
+	peers := make([]string, 32)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("http://10.0.0.%d:8080", i)
+	}
+	p.Set(peers...)
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			p.Set(peers[:len(peers)-i%2]...)
+		}
+	}()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			p.PickPeer(strconv.Itoa(i))
+		}
+	})
+}
+
+func TestHTTPPoolNotFound(t *testing.T) {
+	owner := newGroup("TestHTTPPoolNotFound-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return ErrNotFound
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	getter := &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}
+	get := func(group string) error {
+		return getter.Get(context.Background(), &pb.GetRequest{Group: proto.String(group), Key: proto.String("missing")}, &pb.GetResponse{})
+	}
+	if err := get(owner.Name()); err != ErrNotFound {
+		t.Errorf("httpGetter.Get of a missing key error = %v; want ErrNotFound", err)
+	}
+	// An unknown group is a misconfiguration, not a missing key.
+	if err := get("no-such-group"); err == nil || err == ErrNotFound {
+		t.Errorf("httpGetter.Get of an unknown group error = %v; want another error", err)
+	}
+
+	var localLoads AtomicInt
+	client := newGroup("TestHTTPPoolNotFound-client", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		localLoads.Add(1)
+		return dest.SetString("local", time.Time{})
+	}), fakePeers{&renamingGetter{ProtoGetter: getter, group: owner.Name()}})
+
+	var s string
+	if err := client.Get(context.Background(), "missing", StringSink(&s), nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a key missing on its owner error = %v; want ErrNotFound", err)
+	}
+	if got := localLoads.Get(); got != 0 {
+		t.Errorf("client loaded the key locally %d times; want 0", got)
+	}
+	if got := client.Stats.PeerErrors.Get(); got != 0 {
+		t.Errorf("PeerErrors = %d; want 0", got)
+	}
+}
+
+// renamingGetter asks its ProtoGetter for keys of another group, so
+// a group can use a peer serving another group in the same process.
+type renamingGetter struct {
+	ProtoGetter
+	group string
+}
+
+func (r *renamingGetter) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	return r.ProtoGetter.Get(ctx, &pb.GetRequest{Group: &r.group, Key: in.Key, Etag: in.Etag, Generation: in.Generation, Populate: in.Populate}, out)
+}
+
+func (r *renamingGetter) Exists(ctx context.Context, in *pb.GetRequest) (bool, error) {
+	return r.ProtoGetter.Exists(ctx, &pb.GetRequest{Group: &r.group, Key: in.Key})
+}
+
+func (r *renamingGetter) Checksum(ctx context.Context, in *pb.GetRequest) (uint32, bool, error) {
+	return r.ProtoGetter.Checksum(ctx, &pb.GetRequest{Group: &r.group, Key: in.Key})
+}
+
+func (r *renamingGetter) Set(ctx context.Context, in *pb.SetRequest) error {
+	return r.ProtoGetter.Set(ctx, &pb.SetRequest{Group: &r.group, Key: in.Key, Value: in.Value, Expire: in.Expire, Tags: in.Tags, HotCache: in.HotCache})
+}
+
+func (r *renamingGetter) GetOrSet(ctx context.Context, in *pb.SetRequest, out *pb.GetResponse) error {
+	return r.ProtoGetter.GetOrSet(ctx, &pb.SetRequest{Group: &r.group, Key: in.Key, Value: in.Value, Expire: in.Expire}, out)
+}
+
+func (r *renamingGetter) Remove(ctx context.Context, in *pb.GetRequest) error {
+	return r.ProtoGetter.Remove(ctx, &pb.GetRequest{Group: &r.group, Key: in.Key})
+}
+
+func (r *renamingGetter) GetMulti(ctx context.Context, in *pb.GetMultiRequest, out *pb.GetMultiResponse) error {
+	return r.ProtoGetter.GetMulti(ctx, &pb.GetMultiRequest{Group: &r.group, Keys: in.Keys, Generation: in.Generation}, out)
+}
+
+func (r *renamingGetter) RemoveTag(ctx context.Context, in *pb.GetRequest) error {
+	return r.ProtoGetter.RemoveTag(ctx, &pb.GetRequest{Group: &r.group, Key: in.Key})
+}
+
+func TestStatsHandler(t *testing.T) {
+	p := newHTTPPool("http://self", nil)
+	p.Set("http://self", "http://peer-b", "http://peer-a")
+	g := newGroup("TestStatsHandler-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	for i := 0; i < 3; i++ {
+		var s string
+		if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	p.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q; want application/json", ct)
+	}
+	var res struct {
+		Self   string
+		Peers  []string
+		Groups []struct {
+			Name      string
+			Stats     map[string]int64
+			MainCache CacheStats
+			Latency   json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	if want := []string{"http://peer-a", "http://peer-b", "http://self"}; res.Self != "http://self" || strings.Join(res.Peers, ",") != strings.Join(want, ",") {
+		t.Errorf("self %q, peers %q; want %q, %q", res.Self, res.Peers, "http://self", want)
+	}
+	for _, gs := range res.Groups {
+		if gs.Name != g.Name() {
+			continue
+		}
+		if gs.Stats["Gets"] != 3 || gs.Stats["CacheHits"] != 2 || gs.Stats["LocalLoads"] != 1 {
+			t.Errorf("stats = %v; want 3 Gets, 2 CacheHits, 1 LocalLoads", gs.Stats)
+		}
+		if gs.MainCache.Items != 1 || gs.MainCache.Hits != 2 {
+			t.Errorf("main cache stats = %+v; want 1 item and 2 hits", gs.MainCache)
+		}
+		if gs.Latency != nil {
+			t.Errorf("latency = %s; want none without RecordLatency", gs.Latency)
+		}
+		return
+	}
+	t.Errorf("group %q missing from %s", g.Name(), rec.Body.String())
+}
+
+func TestServeHTTPInfoHeaders(t *testing.T) {
+	p := newHTTPPool("http://self", &HTTPPoolOptions{StreamThreshold: 16})
+	g := newGroup("TestServeHTTPInfoHeaders-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(strings.Repeat("v", len(key)), time.Time{})
+	}), NoPeers{})
+	now := time.Unix(1e9, 0)
+	g.now = func() time.Time { return now }
+
+	// "short" is encoded by the codec, the long key is streamed.
+	for _, key := range []string{"short", strings.Repeat("k", 32)} {
+		get := func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultBasePath+g.Name()+"/"+key, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("ServeHTTP status = %d; want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get(keyHeader); got != key {
+				t.Errorf("%s = %q; want %q", keyHeader, got, key)
+			}
+			if got, want := w.Header().Get(valueLengthHeader), strconv.Itoa(len(key)); got != want {
+				t.Errorf("%s = %q; want %q", valueLengthHeader, got, want)
+			}
+			if got, want := w.Header().Get("Content-Length"), strconv.Itoa(w.Body.Len()); got != want {
+				t.Errorf("Content-Length = %q; want %q", got, want)
+			}
+			return w
+		}
+
+		w := get()
+		if got := w.Header().Get(sourceHeader); got != "origin" {
+			t.Errorf("fresh load: %s = %q; want origin", sourceHeader, got)
+		}
+		if age, ok := w.Header()["Age"]; ok {
+			t.Errorf("fresh load: Age = %q; want none", age)
+		}
+
+		now = now.Add(90 * time.Second)
+		w = get()
+		if got := w.Header().Get(sourceHeader); got != "cache" {
+			t.Errorf("cache hit: %s = %q; want cache", sourceHeader, got)
+		}
+		if got := w.Header().Get("Age"); got != "90" {
+			t.Errorf("cache hit: Age = %q; want 90", got)
+		}
+	}
+}
+
+func TestHTTPPoolConcurrentLoadsShareRequest(t *testing.T) {
+	var requests AtomicInt
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		body, _ := proto.Marshal(&pb.GetResponse{Value: []byte("remote")})
+		w.Write(body)
+	}))
+	defer ts.Close()
+	g := newGroup("TestHTTPPoolConcurrentLoadsShareRequest-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), fakePeers{&httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}})
+
+	const n = 2
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			var s string
+			errc <- g.Get(context.Background(), "key", StringSink(&s), nil)
+		}()
+	}
+	// Both callers missed the cache; whether the second one joins the
+	// first's flight or finds the value cached once it is done, the
+	// owner must only be asked once.
+	for g.Stats.Loads.Get() < n || requests.Get() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < n; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := requests.Get(); got != 1 {
+		t.Errorf("owner got %d requests for concurrent loads of one key; want 1", got)
+	}
+}
+
+func TestGetReaderFromPeer(t *testing.T) {
+	value := bytes.Repeat([]byte("abcdefgh"), 512<<10) // 4MB, above the stream threshold
+	owner := newGroup("TestGetReaderFromPeer-owner", 16<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetBytes(value, time.Time{})
+	}), NoPeers{})
+	var streamed AtomicInt
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r)
+		if w.Header().Get(streamHeader) != "" {
+			streamed.Add(1)
+		}
+	}))
+	defer ts.Close()
+
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+	client := newGroup("TestGetReaderFromPeer-client", 16<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), prefixPeers{peer})
+
+	r, err := client.GetReader(context.Background(), "remote-big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("read %d bytes differing from the owner's %d byte value", len(got), len(value))
+	}
+	if streamed.Get() != 1 {
+		t.Errorf("owner streamed %d responses; want 1", streamed.Get())
+	}
+}
+
+func TestHTTPPoolGeneration(t *testing.T) {
+	var loads AtomicInt
+	owner := newGroup("TestHTTPPoolGeneration-owner", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+	client := newGroup("TestHTTPPoolGeneration-client", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), prefixPeers{peer})
+
+	get := func(key string) {
+		t.Helper()
+		var s string
+		if err := client.Get(context.Background(), key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get("remote-a")
+	get("remote-a")
+	if loads.Get() != 1 || owner.Generation() != 0 {
+		t.Fatalf("before SetGeneration: %d loads, owner generation %d; want 1 load, generation 0", loads.Get(), owner.Generation())
+	}
+
+	// The owner adopts the client's generation, so the client does not
+	// get the value the owner cached under the previous one.
+	client.SetGeneration(2)
+	get("remote-a")
+	if loads.Get() != 2 || owner.Generation() != 2 {
+		t.Errorf("after SetGeneration(2): %d loads, owner generation %d; want 2 loads, generation 2", loads.Get(), owner.Generation())
+	}
+	if got := owner.Stats.PeerGenerations.Get(); got != 1 {
+		t.Errorf("owner PeerGenerations = %d; want 1", got)
+	}
+
+	// Requests under older generations leave the owner's alone.
+	client.SetGeneration(1)
+	get("remote-a")
+	if loads.Get() != 2 || owner.Generation() != 2 {
+		t.Errorf("after SetGeneration(1): %d loads, owner generation %d; want 2 loads, generation 2", loads.Get(), owner.Generation())
+	}
+
+	client.SetGeneration(3)
+	var s1, s2 string
+	if err := client.GetMulti(context.Background(), []string{"remote-a", "remote-b"}, []Sink{StringSink(&s1), StringSink(&s2)}); err != nil {
+		t.Fatal(err)
+	}
+	if loads.Get() != 4 || owner.Generation() != 3 {
+		t.Errorf("after GetMulti under generation 3: %d loads, owner generation %d; want 4 loads, generation 3", loads.Get(), owner.Generation())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, defaultBasePath+owner.Name()+"/remote-a", nil)
+	req.Header.Set(generationHeader, "not-a-number")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad %s header: status %d; want %d", generationHeader, w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHTTPPoolUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skipf("no Unix domain sockets on %s", runtime.GOOS)
+	}
+	socket := filepath.Join(t.TempDir(), "groupcache.sock")
+	self := "unix://" + socket
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	owner := newGroup("TestHTTPPoolUnixSocket-owner", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	go newHTTPPool(self, nil).Serve(l)
+
+	var dials AtomicInt
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			if network != "unix" || addr != socket {
+				t.Errorf("dialed %s %s; want unix %s", network, addr, socket)
+			}
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	})
+	for i, set := range []func(){
+		func() { p.Set(self) },
+		func() {
+			u, err := url.Parse(self)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.SetURLs(u)
+		},
+	} {
+		set()
+		peer, ok := p.PickPeer("remote-a")
+		if !ok {
+			t.Fatal("no peer picked")
+		}
+		if got := peer.GetURL(); got != self {
+			t.Errorf("GetURL() = %q; want %q", got, self)
+		}
+		client := newGroup(fmt.Sprintf("TestHTTPPoolUnixSocket-client-%d", i), cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+			return errors.New("unexpected local load")
+		}), prefixPeers{&renamingGetter{ProtoGetter: peer, group: owner.Name()}})
+		var s string
+		if err := client.Get(context.Background(), "remote-a", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if s != "value:remote-a" {
+			t.Errorf("got %q; want %q", s, "value:remote-a")
+		}
+	}
+	if dials.Get() == 0 {
+		t.Error("DialContext was not called")
+	}
+}
+
+func TestHTTPPoolGetWithMeta(t *testing.T) {
+	large := strings.Repeat("x", 2<<20) // above the stream threshold
+	for _, tc := range codecs {
+		getter := &metaGetter{value: func(key string) string {
+			if strings.HasSuffix(key, "-large") {
+				return large
+			}
+			return "value:" + key
+		}}
+		owner := newGroup("TestHTTPPoolGetWithMeta-owner-"+tc.name, 8<<20, getter, NoPeers{})
+		p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{Codec: tc.codec})
+		ts := httptest.NewServer(p)
+		defer ts.Close()
+
+		peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: tc.codec}, group: owner.Name()}
+		client := newGroup("TestHTTPPoolGetWithMeta-client-"+tc.name, 8<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+			return errors.New("unexpected local load")
+		}), prefixPeers{peer})
+
+		for _, key := range []string{"remote-small", "remote-large"} {
+			// The first Get loads the key on the owner, the second
+			// finds it cached there or in the client's hot cache.
+			for i := 0; i < 2; i++ {
+				var s string
+				meta, err := client.GetWithMeta(context.Background(), key, StringSink(&s))
+				if err != nil {
+					t.Fatalf("%s: %v", tc.name, err)
+				}
+				if string(meta) != "meta:"+key || len(s) != len(getter.value(key)) {
+					t.Errorf("%s: GetWithMeta(%q) #%d = %q and a %d byte value; want %q and %d bytes",
+						tc.name, key, i, meta, len(s), "meta:"+key, len(getter.value(key)))
+				}
+			}
+		}
+		if n := getter.loads.Get(); n != 2 {
+			t.Errorf("%s: owner loaded %d keys; want 2", tc.name, n)
+		}
+	}
+}
+
+func TestHTTPPoolGetMulti(t *testing.T) {
+	for _, tc := range codecs {
+		var ownerLoads AtomicInt
+		owner := newGroup("TestHTTPPoolGetMulti-owner-"+tc.name, 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+			ownerLoads.Add(1)
+			if strings.HasSuffix(key, "-missing") {
+				return ErrNotFound
+			}
+			return dest.SetString("value:"+key, time.Time{})
+		}), NoPeers{})
+		p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{Codec: tc.codec})
+		ts := httptest.NewServer(p)
+		defer ts.Close()
+
+		peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: tc.codec}, group: owner.Name()}
+		client := newGroup("TestHTTPPoolGetMulti-client-"+tc.name, 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+			return dest.SetString("local:"+key, time.Time{})
+		}), prefixPeers{peer})
+
+		keys := []string{"remote-a", "remote-missing", "local", "remote-b"}
+		values := make([]string, len(keys))
+		dests := make([]Sink, len(keys))
+		for i := range keys {
+			dests[i] = StringSink(&values[i])
+		}
+		err := client.GetMulti(context.Background(), keys, dests)
+		var merr MultiError
+		if !errors.As(err, &merr) || len(merr) != len(keys) || !errors.Is(merr[1], ErrNotFound) {
+			t.Fatalf("%s: GetMulti error = %v; want a MultiError with ErrNotFound for the missing key", tc.name, err)
+		}
+		for i, want := range []string{"value:remote-a", "", "local:local", "value:remote-b"} {
+			if i != 1 && merr[i] != nil {
+				t.Errorf("%s: GetMulti error for %q = %v", tc.name, keys[i], merr[i])
+			}
+			if values[i] != want {
+				t.Errorf("%s: GetMulti got %q for %q; want %q", tc.name, values[i], keys[i], want)
+			}
+		}
+		if n := owner.Stats.ServerRequests.Get(); n != 1 {
+			t.Errorf("%s: owner served %d requests; want 1", tc.name, n)
+		}
+		if n := ownerLoads.Get(); n != 3 {
+			t.Errorf("%s: owner loaded %d keys; want 3", tc.name, n)
+		}
+	}
+}
+
+// tenantKey is the context key of the tenant propagated to peers by
+// TestHTTPPoolRequestModifier.
+type tenantKey struct{}
+
+func TestHTTPPoolRequestModifier(t *testing.T) {
+	modifier := func(ctx context.Context, req *http.Request) {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		req.Header.Set("X-Tenant", tenant)
+		req.Header.Set(hopsHeader, "7")
+		// None of these may break the request.
+		req.Method = http.MethodPatch
+		req.URL.Path = "/elsewhere"
+		req.Body = nil
+	}
+	tenantCtx := context.WithValue(context.Background(), tenantKey{}, "acme")
+
+	var tenants []string
+	owner := newGroup("TestHTTPPoolRequestModifier-owner", cacheSize, GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		tenants = append(tenants, tenant)
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{
+		Context: func(r *http.Request) context.Context {
+			if r.Header.Get(hopsHeader) != "1" {
+				t.Errorf("peer received the %s header %q; want groupcache's own", hopsHeader, r.Header.Get(hopsHeader))
+			}
+			return context.WithValue(r.Context(), tenantKey{}, r.Header.Get("X-Tenant"))
+		},
+		RequestModifier: modifier,
+	})
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	p.Set(ts.URL)
+
+	h := p.current().getters[ts.URL]
+	if h.modifyRequest == nil {
+		t.Fatal("pool getter does not apply the RequestModifier")
+	}
+	out := &pb.GetResponse{}
+	if err := h.Get(tenantCtx, &pb.GetRequest{Group: proto.String(owner.Name()), Key: proto.String("key")}, out); err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Value) != "value:key" {
+		t.Errorf("Get = %q; want value:key", out.Value)
+	}
+	if len(tenants) != 1 || tenants[0] != "acme" {
+		t.Errorf("owner loaded the key for tenants %q; want the modifier's header read back by Context", tenants)
+	}
+	if err := h.Set(tenantCtx, &pb.SetRequest{Group: proto.String(owner.Name()), Key: proto.String("set"), Value: []byte("stored")}); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := owner.Get(dummyCtx, "set", StringSink(&s), nil); err != nil || s != "stored" {
+		t.Errorf("value Set through the modified request = %q, %v; want stored", s, err)
+	}
+}
+
+func TestHTTPPoolMaxResponseBytes(t *testing.T) {
+	value := bytes.Repeat([]byte("x"), 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/stream/") {
+			w.Header().Set(streamHeader, "1")
+			writeStreamedGetResponse(w, ByteView{b: value}, 0, 0)
+			return
+		}
+		body, _ := proto.Marshal(&pb.GetResponse{Value: value})
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	p := newHTTPPool("http://self", &HTTPPoolOptions{MaxResponseBytes: 100})
+	p.Set(ts.URL)
+	if got := p.current().getters[ts.URL].maxBytes; got != 100 {
+		t.Fatalf("getter limited to %d bytes; want 100", got)
+	}
+
+	for _, base := range []string{"/buffered/", "/stream/"} {
+		for _, max := range []int64{100, 0, 2000} {
+			h := &httpGetter{baseURL: ts.URL + base, codec: ProtoCodec{}, maxBytes: max}
+			out := &pb.GetResponse{}
+			err := h.Get(context.Background(), &pb.GetRequest{Group: proto.String("group"), Key: proto.String("key")}, out)
+			if max == 100 {
+				if !errors.Is(err, ErrResponseTooLarge) {
+					t.Errorf("%s response over a %d byte limit error = %v; want ErrResponseTooLarge", base, max, err)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(out.Value, value) {
+				t.Errorf("%s response with a %d byte limit = %d bytes, %v; want the value", base, max, len(out.Value), err)
+			}
+		}
+	}
+}
+
+func TestHTTPPoolPeerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	p := newHTTPPool("http://self", &HTTPPoolOptions{PeerTimeout: 20 * time.Millisecond})
+	p.Set(ts.URL)
+	if got := p.PeerTimeouts()[ts.URL]; got != 20*time.Millisecond {
+		t.Errorf("PeerTimeouts()[peer] = %v; want 20ms", got)
+	}
+	h := p.current().getters[ts.URL]
+	err := h.Get(context.Background(), &pb.GetRequest{Group: proto.String("group"), Key: proto.String("key")}, &pb.GetResponse{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get from a stuck peer = %v; want context.DeadlineExceeded", err)
+	}
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	p := newHTTPPool("http://self", &HTTPPoolOptions{
+		AdaptiveTimeout:       true,
+		AdaptiveTimeoutMin:    time.Millisecond,
+		AdaptiveTimeoutMax:    time.Second,
+		AdaptiveTimeoutWindow: 100,
+	})
+	p.Set("http://peer")
+	h := p.current().getters["http://peer"]
+	timeout := func() time.Duration { return p.PeerTimeouts()["http://peer"] }
+	record := func(n int, d time.Duration) {
+		for i := 0; i < n; i++ {
+			h.adaptive.latency.record(d)
+		}
+	}
+	near := func(got, want time.Duration) bool {
+		return got > want*9/10 && got < want*11/10
+	}
+
+	record(adaptiveTimeoutMinSamples-1, 10*time.Millisecond)
+	if got := timeout(); got != time.Second {
+		t.Errorf("timeout before %d samples = %v; want the 1s maximum", adaptiveTimeoutMinSamples, got)
+	}
+
+	// Once filled, the window measures a p99 of 10ms, but for one
+	// outlier in a hundred.
+	record(100-adaptiveTimeoutMinSamples, 10*time.Millisecond)
+	record(1, 500*time.Millisecond)
+	if got := timeout(); !near(got, 30*time.Millisecond) {
+		t.Errorf("timeout after 10ms Gets = %v; want about 3 times 10ms", got)
+	}
+
+	// After two windows the 10ms Gets are forgotten.
+	record(200, 2*time.Millisecond)
+	if got := timeout(); !near(got, 6*time.Millisecond) {
+		t.Errorf("timeout after 2ms Gets = %v; want about 3 times 2ms", got)
+	}
+
+	record(200, 100*time.Microsecond)
+	if got := timeout(); got != time.Millisecond {
+		t.Errorf("timeout after 100us Gets = %v; want the 1ms minimum", got)
+	}
+	record(200, 5*time.Second)
+	if got := timeout(); got != time.Second {
+		t.Errorf("timeout after 5s Gets = %v; want the 1s maximum", got)
+	}
+}
+
+func TestHTTPPoolChecksum(t *testing.T) {
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	owner := newGroup("TestHTTPPoolChecksum-owner", 1<<20, getter, NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+	client := newGroup("TestHTTPPoolChecksum-client", 1<<20, getter, prefixPeers{peer})
+
+	ctx := context.Background()
+	var s string
+	for _, key := range []string{"remote-current", "remote-updated", "remote-removed"} {
+		if err := client.Get(ctx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		client.populateCache(key, ByteView{s: s}, &client.hotCache)
+	}
+	// Updates the client missed.
+	owner.localSet("remote-updated", []byte("new value"), time.Time{}, &owner.mainCache)
+	owner.localRemove("remote-removed")
+
+	sum, ok, err := peer.Checksum(ctx, &pb.GetRequest{Key: proto.String("remote-updated")})
+	if err != nil || !ok || sum != crc32.ChecksumIEEE([]byte("new value")) {
+		t.Errorf("Checksum(remote-updated) = %d, %v, %v; want the checksum of the new value", sum, ok, err)
+	}
+	if _, ok, err := peer.Checksum(ctx, &pb.GetRequest{Key: proto.String("remote-removed")}); err != nil || ok {
+		t.Errorf("Checksum(remote-removed) = _, %v, %v; want not held", ok, err)
+	}
+
+	client.syncHotCache(ctx, 10)
+	for key, want := range map[string]bool{"remote-current": true, "remote-updated": false, "remote-removed": false} {
+		if got := client.hotCache.peek(key); got != want {
+			t.Errorf("after sync, hot cache holds %s = %v; want %v", key, got, want)
+		}
+	}
+	if got := client.Stats.AntiEntropyInvalidations.Get(); got != 2 {
+		t.Errorf("AntiEntropyInvalidations = %d; want 2", got)
+	}
+	if err := client.Get(ctx, "remote-updated", StringSink(&s), nil); err != nil || s != "new value" {
+		t.Errorf("Get(remote-updated) after sync = %q, %v; want the new value", s, err)
+	}
+}
+
+func TestHTTPPoolGetOrSet(t *testing.T) {
+	var loads AtomicInt
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	owner := newGroup("TestHTTPPoolGetOrSet-owner", 1<<20, getter, NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+
+	// Two clients race to supply the value; the owner keeps one.
+	clients := []*Group{
+		newGroup("TestHTTPPoolGetOrSet-client1", 1<<20, getter, prefixPeers{peer}),
+		newGroup("TestHTTPPoolGetOrSet-client2", 1<<20, getter, prefixPeers{peer}),
+	}
+	ctx := context.Background()
+	results := make([]string, len(clients))
+	var wg sync.WaitGroup
+	for i, g := range clients {
+		wg.Add(1)
+		go func(i int, g *Group) {
+			defer wg.Done()
+			if err := g.GetOrSet(ctx, "remote-key", StringSink(&results[i]), []byte(g.Name())); err != nil {
+				t.Error(err)
+			}
+		}(i, g)
+	}
+	wg.Wait()
+
+	var s string
+	if err := owner.Get(ctx, "remote-key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s != clients[0].Name() && s != clients[1].Name() {
+		t.Fatalf("owner holds %q; want one of the supplied values", s)
+	}
+	for i, got := range results {
+		if got != s {
+			t.Errorf("client %d GetOrSet = %q; want the value the owner kept, %q", i+1, got, s)
+		}
+	}
+	if got := loads.Get(); got != 0 {
+		t.Errorf("GetOrSet made %d loads; want 0", got)
+	}
+}
+
+func TestExistsAnywhere(t *testing.T) {
+	var loads AtomicInt
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	owner := newGroup("TestExistsAnywhere-owner", 1<<20, getter, NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	// The owner owns the keys starting with "remote-", the client the
+	// others.
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+	client := newGroup("TestExistsAnywhere-client", 1<<20, getter, prefixPeers{peer})
+
+	ctx := context.Background()
+	var s string
+	for _, g := range []*Group{owner, client} {
+		if err := g.Get(ctx, "local-cached", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := owner.Get(ctx, "remote-cached", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	loads.Store(0)
+
+	for _, tt := range []struct {
+		key  string
+		want bool
+	}{
+		{"local-cached", true},   // in the client's main cache
+		{"remote-cached", true},  // in the owner's main cache only
+		{"local-missing", false}, // owned by the client, not cached
+		{"remote-missing", false},
+	} {
+		got, err := client.ExistsAnywhere(ctx, tt.key)
+		if err != nil {
+			t.Fatalf("ExistsAnywhere(%q) error: %v", tt.key, err)
+		}
+		if got != tt.want {
+			t.Errorf("ExistsAnywhere(%q) = %v; want %v", tt.key, got, tt.want)
+		}
+	}
+	if got := loads.Get(); got != 0 {
+		t.Errorf("ExistsAnywhere made %d loads; want 0", got)
+	}
+	for _, key := range []string{"remote-cached", "remote-missing"} {
+		if which, ok := client.Contains(key); ok {
+			t.Errorf("ExistsAnywhere cached %q in the client's %v cache", key, which)
+		}
+	}
+	if _, ok := owner.Contains("remote-missing"); ok {
+		t.Error("ExistsAnywhere cached remote-missing in the owner")
+	}
+
+	// An unknown group is an error, not a missing key.
+	bad := &renamingGetter{ProtoGetter: peer.ProtoGetter, group: "no-such-group"}
+	client2 := newGroup("TestExistsAnywhere-client2", 1<<20, getter, prefixPeers{bad})
+	var pe *PeerError
+	if _, err := client2.ExistsAnywhere(ctx, "remote-cached"); !errors.As(err, &pe) {
+		t.Errorf("ExistsAnywhere on an unknown group error = %v; want a *PeerError", err)
+	}
+}
+
+func TestHTTPPoolBinaryKeys(t *testing.T) {
+	owner := newGroup("TestHTTPPoolBinaryKeys-owner", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("got:"+key, time.Time{})
+	}), NoPeers{})
+	// Serve the pool behind a ServeMux, as NewHTTPPool does, since
+	// it cleans the request paths.
+	p := newHTTPPool("http://127.0.0.1", nil)
+	mux := http.NewServeMux()
+	mux.Handle(defaultBasePath, p)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+	client := newGroup("TestHTTPPoolBinaryKeys-client", 0, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected local load")
+	}), fakePeers{peer})
+
+	ctx := context.Background()
+	for _, key := range []string{
+		"plain",
+		"a/b",
+		"a//b",
+		"/leading",
+		"trailing/",
+		".",
+		"..",
+		"a/./b",
+		"a/../b",
+		"../../etc/passwd",
+		"space and+plus",
+		"query?a=b&key64=1#frag",
+		"100%",
+		"%2F%00",
+		"nul\x00byte",
+		"\xff\xfe\x80 not utf-8",
+		"tab\tnewline\n",
+	} {
+		var s string
+		if err := client.Get(ctx, key, StringSink(&s), nil); err != nil {
+			t.Errorf("Get(%q) through the peer: %v", key, err)
+			continue
+		}
+		if want := "got:" + key; s != want {
+			t.Errorf("Get(%q) through the peer = %q; want %q", key, s, want)
+		}
+
+		// Set stores the value under the same key on the owner.
+		want := []byte("set:" + key)
+		if err := client.Set(ctx, key, want, time.Time{}, false); err != nil {
+			t.Errorf("Set(%q) through the peer: %v", key, err)
+			continue
+		}
+		var v ByteView
+		if err := owner.Get(ctx, key, ByteViewSink(&v), nil); err != nil || !v.EqualBytes(want) {
+			t.Errorf("owner Get(%q) after Set = %q, %v; want %q", key, v, err, want)
+		}
+		if err := client.Get(ctx, key, StringSink(&s), nil); err != nil || s != string(want) {
+			t.Errorf("Get(%q) through the peer after Set = %q, %v; want %q", key, s, err, want)
+		}
+
+		if err := client.Remove(ctx, key); err != nil {
+			t.Errorf("Remove(%q) through the peer: %v", key, err)
+		}
+		if which, ok := owner.Contains(key); ok {
+			t.Errorf("owner still holds %q in its %v cache after Remove", key, which)
+		}
+	}
+}
+
+func TestHTTPPoolKeepWarm(t *testing.T) {
+	var pings, conns AtomicInt
+	server := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, defaultBasePath+pingPath+"/") {
+			pings.Add(1)
+		}
+		server.ServeHTTP(w, r)
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	const interval, rounds = 20 * time.Millisecond, 10
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	p := newHTTPPool("http://self", &HTTPPoolOptions{
+		KeepWarmInterval: interval,
+		KeepWarmConns:    2,
+		Transport:        func(context.Context) http.RoundTripper { return tr },
+	})
+	p.Set("http://self", ts.URL)
+	time.Sleep(rounds*interval + interval/2)
+	p.Close()
+
+	// Each round pings the peer twice; allow the slow rounds of a
+	// loaded machine, but never more than the ticker fires.
+	got := pings.Get()
+	if got < 2*rounds/2 || got > 2*rounds {
+		t.Errorf("got %d pings in %d intervals; want about %d", got, rounds, 2*rounds)
+	}
+	if n := conns.Get(); n > 2 {
+		t.Errorf("pings opened %d connections; want at most 2 reused ones", n)
+	}
+	time.Sleep(2 * interval)
+	if after := pings.Get(); after != got {
+		t.Errorf("got %d pings after Close; want none", after-got)
+	}
+}
+
+func TestHTTPPoolKeepWarmLogsFailures(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	var buf bytes.Buffer
+	logs := logrus.New()
+	logs.Out = &buf
+	p := newHTTPPool("http://self", &HTTPPoolOptions{KeepWarmConns: 2, Logger: logrus.NewEntry(logs)})
+	p.opts.KeepWarmInterval = time.Second
+	p.Set("http://self", ts.URL)
+	p.pingPeers(context.Background())
+
+	if n := strings.Count(buf.String(), "error pinging peer"); n != 1 {
+		t.Errorf("pool logged %d failed pings of the peer; want 1 per round:\n%s", n, buf.String())
+	}
+}
+
+func TestHTTPPoolReadOnly(t *testing.T) {
+	var loads AtomicInt
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	owner := newGroup("TestHTTPPoolReadOnly-owner", 1<<20, getter, NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+	client := newGroup("TestHTTPPoolReadOnly-client", 1<<20, getter, prefixPeers{peer})
+
+	ctx := context.Background()
+	var s string
+	if err := client.Get(ctx, "remote-cached", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	owner.SetReadOnly(true)
+	if err := client.Get(ctx, "remote-cached", StringSink(&s), nil); err != nil || s != "value:remote-cached" {
+		t.Errorf("Get(remote-cached) = %q, %v; want the owner's cached value", s, err)
+	}
+	// The owner rejects the miss, and the client does not load it
+	// itself instead.
+	if err := client.Get(ctx, "remote-missing", StringSink(&s), nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Get(remote-missing) = %v; want ErrReadOnly", err)
+	}
+	if got := loads.Get(); got != 1 {
+		t.Errorf("getter loads = %d; want 1, before the owner was read-only", got)
+	}
+	if got := client.Stats.PeerErrors.Get(); got != 0 {
+		t.Errorf("PeerErrors = %d; want 0", got)
+	}
+
+	owner.SetReadOnly(false)
+	if err := client.Get(ctx, "remote-missing", StringSink(&s), nil); err != nil || s != "value:remote-missing" {
+		t.Errorf("Get(remote-missing) after SetReadOnly(false) = %q, %v; want it loaded", s, err)
+	}
+}
+
+func TestHTTPPoolGetIfChanged(t *testing.T) {
+	var loads AtomicInt
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	owner := newGroup("TestHTTPPoolGetIfChanged-owner", 1<<20, getter, NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+	client := newGroup("TestHTTPPoolGetIfChanged-client", 1<<20, getter, prefixPeers{peer})
+
+	// The owner holds nothing yet: it loads the key, then finds that
+	// the caller already has the value.
+	ctx := context.Background()
+	s := "untouched"
+	changed, err := client.GetIfChanged(ctx, "remote-key", ETag([]byte("value:remote-key")), StringSink(&s))
+	if err != nil || changed || s != "untouched" {
+		t.Errorf("GetIfChanged with the current ETag = %v, %v, set %q; want unchanged", changed, err, s)
+	}
+	if got := loads.Get(); got != 1 {
+		t.Errorf("getter loads = %d; want 1, by the owner", got)
+	}
+	if got := owner.Stats.BytesServedToPeers.Get(); got != 0 {
+		t.Errorf("owner served %d bytes; want none for an unchanged value", got)
+	}
+
+	owner.localSet("remote-key", []byte("new value"), time.Time{}, &owner.mainCache)
+	changed, err = client.GetIfChanged(ctx, "remote-key", ETag([]byte("value:remote-key")), StringSink(&s))
+	if err != nil || !changed || s != "new value" {
+		t.Errorf("GetIfChanged with an old ETag = %v, %v, set %q; want changed to the new value", changed, err, s)
+	}
+	if got := loads.Get(); got != 1 {
+		t.Errorf("getter loads = %d; want 1", got)
+	}
+	if got := client.Stats.NotModified.Get(); got != 1 {
+		t.Errorf("client NotModified = %d; want 1", got)
+	}
+}
+
+func TestHTTPPoolInvalidateTag(t *testing.T) {
+	var loads AtomicInt
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	owner := newGroup("TestHTTPPoolInvalidateTag-owner", 1<<20, getter, NoPeers{})
+	// Stream every response, so that the tags travel in the stream.
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{StreamThreshold: 1})
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+	client := newGroupOpts("TestHTTPPoolInvalidateTag-client", 1<<20, getter, prefixPeers{peer}, &GroupOptions{HotCacheMinPeerFetches: 1})
+
+	ctx := context.Background()
+	if err := client.SetWithTags(ctx, "remote-key", []byte("set value"), time.Time{}, false, []string{"user:1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := owner.mainCache.taggedKeys("user:1"); len(got) != 1 {
+		t.Fatalf("owner's keys tagged user:1 = %v; want the key set by the client", got)
+	}
+	// The hot copy the client mirrors is indexed too.
+	var s string
+	if err := client.Get(ctx, "remote-key", StringSink(&s), nil); err != nil || s != "set value" {
+		t.Fatalf("Get(remote-key) = %q, %v; want the set value", s, err)
+	}
+	if got := client.hotCache.taggedKeys("user:1"); len(got) != 1 {
+		t.Fatalf("client's hot keys tagged user:1 = %v; want the mirrored key", got)
+	}
+
+	if err := client.InvalidateTag(ctx, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.Contains("remote-key"); ok {
+		t.Error("client still holds the invalidated key")
+	}
+	if _, ok := owner.Contains("remote-key"); ok {
+		t.Error("owner still holds the invalidated key")
+	}
+	if err := client.Get(ctx, "remote-key", StringSink(&s), nil); err != nil || s != "value:remote-key" {
+		t.Errorf("Get(remote-key) after InvalidateTag = %q, %v; want it loaded again", s, err)
+	}
+	if got := loads.Get(); got != 1 {
+		t.Errorf("getter loads = %d; want 1", got)
+	}
+}
+
+// encodingRecorder records the Content-Encoding of the responses it
+// passes on.
+type encodingRecorder struct {
+	mu        sync.Mutex
+	encodings []string
+}
+
+func (r *encodingRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		r.mu.Lock()
+		r.encodings = append(r.encodings, res.Header.Get("Content-Encoding"))
+		r.mu.Unlock()
+	}
+	return res, err
+}
+
+func (r *encodingRecorder) last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.encodings[len(r.encodings)-1]
+}
+
+func TestHTTPPoolCompression(t *testing.T) {
+	values := map[string]string{
+		"remote-small":    "small",
+		"remote-large":    strings.Repeat("large ", 1000),
+		"remote-streamed": strings.Repeat("streamed ", 2000),
+	}
+	owner := newGroup("TestHTTPPoolCompression-owner", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(values[key], time.Time{})
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{Compression: GzipCompression{Level: gzip.BestSpeed}, StreamThreshold: 10000})
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	rec := &encodingRecorder{}
+	getter := &httpGetter{
+		getTransport: func(context.Context) http.RoundTripper { return rec },
+		baseURL:      ts.URL + defaultBasePath,
+		codec:        ProtoCodec{},
+		compression:  GzipCompression{},
+		maxBytes:     1 << 20,
+	}
+	for _, tc := range []struct {
+		key, encoding string
+	}{
+		{"remote-small", ""},
+		{"remote-large", "gzip"},
+		{"remote-streamed", "gzip"},
+	} {
+		var res pb.GetResponse
+		if err := getter.Get(context.Background(), &pb.GetRequest{Group: proto.String(owner.Name()), Key: proto.String(tc.key)}, &res); err != nil {
+			t.Fatalf("Get(%q): %v", tc.key, err)
+		}
+		if string(res.Value) != values[tc.key] {
+			t.Errorf("Get(%q) = %d bytes; want %d", tc.key, len(res.Value), len(values[tc.key]))
+		}
+		if got := rec.last(); got != tc.encoding {
+			t.Errorf("Get(%q) response Content-Encoding = %q; want %q", tc.key, got, tc.encoding)
+		}
+	}
+
+	// Peers that do not ask for the compression get plain responses.
+	plain := &httpGetter{getTransport: getter.getTransport, baseURL: getter.baseURL, codec: ProtoCodec{}}
+	var res pb.GetResponse
+	if err := plain.Get(context.Background(), &pb.GetRequest{Group: proto.String(owner.Name()), Key: proto.String("remote-large")}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Value) != values["remote-large"] {
+		t.Errorf("Get without compression = %d bytes; want %d", len(res.Value), len(values["remote-large"]))
+	}
+
+	// MaxResponseBytes applies to the decompressed body.
+	getter.maxBytes = 1000
+	err := getter.Get(context.Background(), &pb.GetRequest{Group: proto.String(owner.Name()), Key: proto.String("remote-large")}, &res)
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("Get of a compressed response above MaxResponseBytes = %v; want ErrResponseTooLarge", err)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP", true},
+		{"br;q=1.0, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"x-gzip", false},
+	} {
+		if got := acceptsEncoding(tc.header, "gzip"); got != tc.want {
+			t.Errorf("acceptsEncoding(%q, gzip) = %v; want %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPClientPool(t *testing.T) {
+	p := newHTTPPool("", nil)
+	p.client = true
+	p.Set("http://10.0.0.1:8000", "http://10.0.0.2:8000")
+	if !p.IsClient() {
+		t.Error("IsClient = false; want true")
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := p.PickPeer(fmt.Sprintf("key-%d", i)); !ok {
+			t.Fatalf("PickPeer(key-%d) picked no peer; a client owns no keys", i)
+		}
+	}
+	if newHTTPPool("http://10.0.0.1:8000", nil).IsClient() {
+		t.Error("IsClient of a peer's pool = true; want false")
+	}
+}
+
+func TestHTTPPoolMaxServedValueBytes(t *testing.T) {
+	owner := newGroup("TestHTTPPoolMaxServedValueBytes-owner", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(strings.Repeat("x", len(key)*10), time.Time{})
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{MaxServedValueBytes: 50})
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	getter := &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}
+
+	var res pb.GetResponse
+	if err := getter.Get(context.Background(), &pb.GetRequest{Group: proto.String(owner.Name()), Key: proto.String("small")}, &res); err != nil {
+		t.Fatalf("Get(small): %v", err)
+	}
+	if err := getter.Get(context.Background(), &pb.GetRequest{Group: proto.String(owner.Name()), Key: proto.String("too-large")}, &res); err != ErrValueTooLarge {
+		t.Errorf("Get(too-large) error = %v; want ErrValueTooLarge", err)
+	}
+
+	var multi pb.GetMultiResponse
+	if err := getter.GetMulti(context.Background(), &pb.GetMultiRequest{Group: proto.String(owner.Name()), Keys: []string{"small", "too-large"}}, &multi); err != nil {
+		t.Fatal(err)
+	}
+	if v := multi.Values[0]; v.Error != nil || len(v.Value) != 50 {
+		t.Errorf("GetMulti small value = %d bytes, error %q; want 50, none", len(v.Value), v.GetError())
+	}
+	if v := multi.Values[1]; v.GetError() != ErrValueTooLarge.Error() {
+		t.Errorf("GetMulti too-large error = %q; want %q", v.GetError(), ErrValueTooLarge)
+	}
+}
+
+func TestHTTPPoolEncodedResponse(t *testing.T) {
+	expire := time.Now().Add(time.Hour).Truncate(time.Second)
+	g := newGroup("TestHTTPPoolEncodedResponse-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, expire)
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	for i := 0; i < 2; i++ { // from the origin, then from the cache
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", defaultBasePath+g.Name()+"/key", nil))
+		var res pb.GetResponse
+		if err := (ProtoCodec{}).DecodeGetResponse(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if string(res.Value) != "value:key" || res.GetExpire() != expire.UnixNano() {
+			t.Errorf("response = %q expiring at %d; want %q expiring at %d", res.Value, res.GetExpire(), "value:key", expire.UnixNano())
+		}
+		if got, want := rec.Header().Get("Content-Length"), strconv.Itoa(rec.Body.Len()); got != want {
+			t.Errorf("Content-Length = %s; want %s", got, want)
+		}
+	}
+}
+
+func BenchmarkHTTPPoolServeGet(b *testing.B) {
+	g := newGroup("BenchmarkHTTPPoolServeGet-group", 1<<20, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(strings.Repeat("x", 4<<10), time.Time{})
+	}), NoPeers{})
+	defer DeregisterGroup(g.Name())
+	p := newHTTPPool("http://127.0.0.1", nil)
+	req := httptest.NewRequest("GET", defaultBasePath+g.Name()+"/key", nil)
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
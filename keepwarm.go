@@ -0,0 +1,136 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pingPath is the first path element, in place of a group name, of
+// the requests sent to keep connections to peers warm.
+const pingPath = "_ping"
+
+// keepWarm periodically pings the peers of an HTTPPool when
+// HTTPPoolOptions.KeepWarmInterval is set.
+type keepWarm struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startKeepWarm starts pinging the peers of p every
+// HTTPPoolOptions.KeepWarmInterval.
+func (p *HTTPPool) startKeepWarm() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &keepWarm{cancel: cancel, done: make(chan struct{})}
+	p.keepWarm = w
+	go func() {
+		defer close(w.done)
+		t := time.NewTicker(p.opts.KeepWarmInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				p.pingPeers(ctx)
+			}
+		}
+	}()
+}
+
+// stop stops the pings and waits for those in flight to end.
+func (w *keepWarm) stop() {
+	w.cancel()
+	<-w.done
+}
+
+// pingPeers sends HTTPPoolOptions.KeepWarmConns concurrent pings to
+// each peer other than p itself, so that as many connections to it are
+// left idle in the transport, and waits for them to end. Pings are
+// bounded by KeepWarmInterval, and their failures logged once per peer
+// and round: a peer that is down is otherwise only noticed by the Gets
+// sent to it.
+func (p *HTTPPool) pingPeers(ctx context.Context) {
+	pingCtx, cancel := context.WithTimeout(ctx, p.opts.KeepWarmInterval)
+	defer cancel()
+	var wg sync.WaitGroup
+	for peer, h := range p.current().getters {
+		if peer == p.self {
+			continue
+		}
+		var once sync.Once
+		for i := 0; i < p.opts.KeepWarmConns; i++ {
+			wg.Add(1)
+			go func(h *httpGetter) {
+				defer wg.Done()
+				err := h.ping(pingCtx)
+				// Pings cut short by Close are not failures.
+				if log := p.logger(); err != nil && log != nil && ctx.Err() == nil {
+					once.Do(func() {
+						log.WithFields(logrus.Fields{
+							"err":      err,
+							"category": "groupcache",
+						}).Warnf("error pinging peer '%s'", h.GetURL())
+					})
+				}
+			}(h)
+		}
+	}
+	wg.Wait()
+}
+
+// ping sends a request that the peer answers without doing any work,
+// reading the response to the end so that its connection can be
+// reused.
+func (h *httpGetter) ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.baseURL+pingPath+"/", nil)
+	if err != nil {
+		return err
+	}
+	h.modify(ctx, req)
+	res, err := h.transport(ctx).RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	return nil
+}
+
+// Close stops the background work of the pool, the pings sent with
+// HTTPPoolOptions.KeepWarmInterval and the probes sent with
+// HealthCheckInterval. The pool keeps serving requests and sending
+// Gets to its peers.
+func (p *HTTPPool) Close() {
+	if p.keepWarm != nil {
+		p.keepWarm.stop()
+	}
+	if p.healthCheck != nil {
+		p.healthCheck.stop()
+	}
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrLargeObjectChanged is returned by the reader of GetLargeObject
+// when the object changed in the origin while its chunks were cached,
+// so that they no longer match the manifest the reader started from.
+// The manifest is removed, and the next GetLargeObject starts afresh.
+var ErrLargeObjectChanged = errors.New("groupcache: large object changed while being read")
+
+// defaultLargeObjectParallelism is the default
+// GroupOptions.LargeObjectParallelism.
+const defaultLargeObjectParallelism = 4
+
+// largeManifestSuffix is appended to a key to name the manifest entry
+// of its large object. Chunk i is named by appending "#i".
+const largeManifestSuffix = "#manifest"
+
+func largeChunkKey(key string, chunk int) string {
+	return key + "#" + strconv.Itoa(chunk)
+}
+
+// parseLargeKey splits the key of a large object's manifest or chunk
+// into the object's key and the chunk's index, which is -1 for the
+// manifest.
+func parseLargeKey(key string) (object string, chunk int, ok bool) {
+	i := strings.LastIndexByte(key, '#')
+	if i < 0 {
+		return "", 0, false
+	}
+	object, suffix := key[:i], key[i:]
+	if suffix == largeManifestSuffix {
+		return object, -1, true
+	}
+	n, err := strconv.Atoi(suffix[1:])
+	if err != nil || n < 0 || largeChunkKey(object, n) != key {
+		return "", 0, false
+	}
+	return object, n, true
+}
+
+// A largeManifest describes how a large object is stored: inline in
+// the manifest entry if it fits in one chunk, or chunked otherwise.
+type largeManifest struct {
+	inline    ByteView
+	chunked   bool
+	size      int64
+	chunkSize int64
+	sums      []uint32 // CRC-32 of each chunk
+}
+
+// newLargeManifest returns the manifest of value cut into chunks of
+// chunkSize bytes.
+func newLargeManifest(value []byte, chunkSize int) *largeManifest {
+	if len(value) <= chunkSize {
+		return &largeManifest{inline: ByteView{b: value}}
+	}
+	m := &largeManifest{chunked: true, size: int64(len(value)), chunkSize: int64(chunkSize)}
+	for off := 0; off < len(value); off += chunkSize {
+		m.sums = append(m.sums, crc32.ChecksumIEEE(value[off:off+m.chunkLen(off/chunkSize)]))
+	}
+	return m
+}
+
+// chunkLen returns the length of chunk i.
+func (m *largeManifest) chunkLen(i int) int {
+	if n := m.size - int64(i)*m.chunkSize; n < m.chunkSize {
+		return int(n)
+	}
+	return int(m.chunkSize)
+}
+
+// matches reports whether chunk i of the object m describes is v.
+func (m *largeManifest) matches(i int, v ByteView) bool {
+	if v.Len() != m.chunkLen(i) {
+		return false
+	}
+	if v.b != nil {
+		return crc32.ChecksumIEEE(v.b) == m.sums[i]
+	}
+	return crc32.ChecksumIEEE([]byte(v.s)) == m.sums[i]
+}
+
+// encode returns the manifest as stored in the cache: a 0 byte followed
+// by the inline value, or a 1 byte followed by the varint size and
+// chunk size and the big-endian checksum of each chunk.
+func (m *largeManifest) encode() []byte {
+	if !m.chunked {
+		b := make([]byte, 1+m.inline.Len())
+		m.inline.Copy(b[1:])
+		return b
+	}
+	b := make([]byte, 1, 1+2*binary.MaxVarintLen64+4*len(m.sums))
+	b[0] = 1
+	b = appendUvarint(b, uint64(m.size))
+	b = appendUvarint(b, uint64(m.chunkSize))
+	for _, sum := range m.sums {
+		b = append(b, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+	}
+	return b
+}
+
+func decodeLargeManifest(v ByteView) (*largeManifest, error) {
+	bad := &DecodeError{What: "large object manifest", Err: errors.New("malformed manifest")}
+	if v.Len() == 0 {
+		return nil, bad
+	}
+	if v.At(0) == 0 {
+		return &largeManifest{inline: v.SliceFrom(1)}, nil
+	}
+	b := v.SliceFrom(1).ByteSlice()
+	size, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, bad
+	}
+	b = b[n:]
+	chunkSize, n := binary.Uvarint(b)
+	if n <= 0 || chunkSize == 0 {
+		return nil, bad
+	}
+	b = b[n:]
+	m := &largeManifest{chunked: true, size: int64(size), chunkSize: int64(chunkSize)}
+	if uint64(len(b)) != 4*((size+chunkSize-1)/chunkSize) {
+		return nil, bad
+	}
+	for ; len(b) > 0; b = b[4:] {
+		m.sums = append(m.sums, binary.BigEndian.Uint32(b))
+	}
+	return m, nil
+}
+
+// getLargePart loads the object stored under key from the getter and
+// stores in dest its manifest if chunk is -1, or chunk otherwise.
+func (g *Group) getLargePart(ctx context.Context, key string, chunk int, dest Sink, fixFunc func() interface{}) (ByteView, error) {
+	var object ByteView
+	value, err := g.callGetter(ctx, key, ByteViewSink(&object), fixFunc)
+	if err != nil {
+		return ByteView{}, err
+	}
+	b, expire := value.ByteSlice(), value.Expire()
+	m := newLargeManifest(b, g.opts.LargeObjectChunkSize)
+	if chunk >= 0 {
+		if !m.chunked || chunk >= len(m.sums) {
+			return ByteView{}, &GetterError{Key: largeChunkKey(key, chunk), Err: ErrNotFound}
+		}
+		off := int64(chunk) * m.chunkSize
+		if err := dest.SetBytes(b[off:off+int64(m.chunkLen(chunk))], expire); err != nil {
+			return ByteView{}, err
+		}
+		return dest.view()
+	}
+	if m.chunked {
+		// Hand the chunks to their owners now, rather than have each
+		// of them load the object again to cut its chunk.
+		g.pushLargeChunks(ctx, key, b, m, expire)
+	}
+	if err := dest.SetBytes(m.encode(), expire); err != nil {
+		return ByteView{}, err
+	}
+	return dest.view()
+}
+
+// pushLargeChunks stores the chunks of object, described by m, with
+// their owners.
+func (g *Group) pushLargeChunks(ctx context.Context, key string, object []byte, m *largeManifest, expire time.Time) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, g.opts.LargeObjectParallelism)
+	for i := range m.sums {
+		off := int64(i) * m.chunkSize
+		chunk, ck := object[off:off+int64(m.chunkLen(i))], largeChunkKey(key, i)
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			// A chunk that could not be stored is loaded again
+			// when read.
+			err := g.Set(ctx, ck, chunk, expire, false)
+			if log := g.logger(); err != nil && log != nil {
+				log.WithFields(logrus.Fields{
+					"err":      err,
+					"key":      ck,
+					"category": "groupcache",
+				}).Warnf("error storing chunk of large object")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// GetLargeObject returns a reader over the value of key, stored as a
+// large object if GroupOptions.LargeObjectChunkSize is set: in one
+// entry if it fits in a chunk, and otherwise split into chunks stored
+// under the keys key#0, key#1, ..., each routed to its own owner,
+// along with a manifest entry under key#manifest listing their
+// checksums.
+//
+// The manifest's owner loads the object from the getter and stores its
+// chunks with their owners. The reader then fetches the chunks in
+// order, up to LargeObjectParallelism of them at a time. A chunk that
+// was evicted meanwhile is loaded again on its own: its owner loads the
+// object and keeps just that chunk. A chunk that no longer matches the
+// manifest, because the object changed in the origin since, is fetched
+// once more; if it still does not match, the reader fails with
+// ErrLargeObjectChanged. The caller must close the reader.
+func (g *Group) GetLargeObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	if g.opts.LargeObjectChunkSize <= 0 {
+		return nil, errors.New("groupcache: GetLargeObject requires GroupOptions.LargeObjectChunkSize")
+	}
+	var v ByteView
+	if err := g.Get(ctx, key+largeManifestSuffix, ByteViewSink(&v), nil); err != nil {
+		return nil, err
+	}
+	m, err := decodeLargeManifest(v)
+	if err != nil {
+		return nil, err
+	}
+	if !m.chunked {
+		return ioutil.NopCloser(m.inline.Reader()), nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &largeObjectReader{
+		g:       g,
+		ctx:     ctx,
+		cancel:  cancel,
+		key:     key,
+		m:       m,
+		fetches: make([]chan largeChunkResult, len(m.sums)),
+	}, nil
+}
+
+type largeChunkResult struct {
+	value ByteView
+	err   error
+}
+
+// largeObjectReader reads the chunks of a large object, fetching the
+// next LargeObjectParallelism ones ahead of the reads.
+type largeObjectReader struct {
+	g      *Group
+	ctx    context.Context
+	cancel context.CancelFunc
+	key    string
+	m      *largeManifest
+
+	fetches []chan largeChunkResult // fetches[i] receives chunk i
+	started int                     // chunks fetched or being fetched
+	next    int                     // index of the chunk after cur
+	cur     ByteView                // unread bytes of the current chunk
+	err     error
+}
+
+func (r *largeObjectReader) Read(p []byte) (int, error) {
+	for r.cur.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.next == len(r.fetches) {
+			return 0, io.EOF
+		}
+		for ; r.started < len(r.fetches) && r.started < r.next+r.g.opts.LargeObjectParallelism; r.started++ {
+			c := make(chan largeChunkResult, 1)
+			r.fetches[r.started] = c
+			go func(i int) {
+				v, err := r.g.getLargeChunk(r.ctx, r.key, r.m, i)
+				c <- largeChunkResult{v, err}
+			}(r.started)
+		}
+		res := <-r.fetches[r.next]
+		r.fetches[r.next] = nil
+		r.next++
+		r.cur, r.err = res.value, res.err
+	}
+	n := r.cur.Copy(p)
+	r.cur = r.cur.SliceFrom(n)
+	return n, nil
+}
+
+// Close stops fetching chunks.
+func (r *largeObjectReader) Close() error {
+	r.cancel()
+	r.err = errors.New("groupcache: read from closed large object reader")
+	r.cur = ByteView{}
+	return nil
+}
+
+// getLargeChunk fetches chunk i of the large object stored under key,
+// described by m.
+func (g *Group) getLargeChunk(ctx context.Context, key string, m *largeManifest, i int) (ByteView, error) {
+	ck := largeChunkKey(key, i)
+	for tries := 0; ; tries++ {
+		var v ByteView
+		if err := g.Get(ctx, ck, ByteViewSink(&v), nil); err != nil {
+			return ByteView{}, err
+		}
+		if m.matches(i, v) {
+			return v, nil
+		}
+		if tries > 0 {
+			// The origin's object differs from the manifest's.
+			if err := g.Remove(ctx, key+largeManifestSuffix); err != nil {
+				return ByteView{}, err
+			}
+			return ByteView{}, ErrLargeObjectChanged
+		}
+		// The cached chunk was cut from another version of the
+		// object; cut it afresh.
+		g.Stats.LargeChunkRefetches.Add(1)
+		if err := g.Remove(ctx, ck); err != nil {
+			return ByteView{}, err
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// largeOrigin serves objects of the size given by their key, "n:<size>",
+// whose bytes depend on version, counting its loads.
+type largeOrigin struct {
+	loads   AtomicInt
+	version AtomicInt
+}
+
+func (o *largeOrigin) object(key string) string {
+	var size int
+	fmt.Sscanf(key, "n:%d", &size)
+	var b strings.Builder
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "%d.%d,", o.version.Get(), i)
+	}
+	return b.String()[:size]
+}
+
+func (o *largeOrigin) Get(_ context.Context, key string, dest Sink, _ func() interface{}) error {
+	o.loads.Add(1)
+	return dest.SetString(o.object(key), time.Time{})
+}
+
+func readLargeObject(t *testing.T, g *Group, key string) (string, error) {
+	t.Helper()
+	r, err := g.GetLargeObject(dummyCtx, key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+func TestGetLargeObject(t *testing.T) {
+	origin := &largeOrigin{}
+	g := newGroupOpts("TestGetLargeObject-group", cacheSize, origin, NoPeers{}, &GroupOptions{
+		LargeObjectChunkSize:   10,
+		LargeObjectParallelism: 2,
+	})
+
+	for _, key := range []string{"n:0", "n:7", "n:10", "n:11", "n:95"} {
+		loads := origin.loads.Get()
+		for i := 0; i < 2; i++ {
+			got, err := readLargeObject(t, g, key)
+			if err != nil {
+				t.Fatalf("GetLargeObject(%q): %v", key, err)
+			}
+			if want := origin.object(key); got != want {
+				t.Errorf("GetLargeObject(%q) #%d = %q; want %q", key, i, got, want)
+			}
+		}
+		if n := origin.loads.Get() - loads; n != 1 {
+			t.Errorf("GetLargeObject(%q) twice loaded the object %d times; want once", key, n)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := g.Contains(largeChunkKey("n:95", i)); !ok {
+			t.Errorf("chunk %d of n:95 not cached", i)
+		}
+	}
+	if _, ok := g.Contains(largeChunkKey("n:7", 0)); ok {
+		t.Error("object fitting in one chunk was chunked")
+	}
+}
+
+func TestGetLargeObjectMissingChunk(t *testing.T) {
+	origin := &largeOrigin{}
+	g := newGroupOpts("TestGetLargeObjectMissingChunk-group", cacheSize, origin, NoPeers{}, &GroupOptions{LargeObjectChunkSize: 10})
+	want := origin.object("n:45")
+	if _, err := readLargeObject(t, g, "n:45"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An evicted chunk is loaded again, alone.
+	g.localRemove(largeChunkKey("n:45", 2))
+	if got, err := readLargeObject(t, g, "n:45"); err != nil || got != want {
+		t.Fatalf("GetLargeObject after evicting a chunk = %q, %v; want %q", got, err, want)
+	}
+	if n := origin.loads.Get(); n != 2 {
+		t.Errorf("origin loaded %d times; want 2", n)
+	}
+	if _, ok := g.Contains(largeChunkKey("n:45", 2)); !ok {
+		t.Error("reloaded chunk not cached")
+	}
+
+	// A chunk not matching the manifest is cut afresh.
+	g.localSet(largeChunkKey("n:45", 1), []byte("corrupted!"), time.Time{}, &g.mainCache)
+	if got, err := readLargeObject(t, g, "n:45"); err != nil || got != want {
+		t.Fatalf("GetLargeObject with a mismatched chunk = %q, %v; want %q", got, err, want)
+	}
+	if n := g.Stats.LargeChunkRefetches.Get(); n != 1 {
+		t.Errorf("LargeChunkRefetches = %d; want 1", n)
+	}
+
+	// Once the object changed in the origin, evicted chunks no longer
+	// match the manifest, until it is loaded again.
+	origin.version.Add(1)
+	g.localRemove(largeChunkKey("n:45", 3))
+	if _, err := readLargeObject(t, g, "n:45"); !errors.Is(err, ErrLargeObjectChanged) {
+		t.Fatalf("GetLargeObject of a changed object = %v; want ErrLargeObjectChanged", err)
+	}
+	if got, err := readLargeObject(t, g, "n:45"); err != nil || got != origin.object("n:45") {
+		t.Errorf("GetLargeObject after the change = %q, %v; want %q", got, err, origin.object("n:45"))
+	}
+}
+
+func TestParseLargeKey(t *testing.T) {
+	for _, tc := range []struct {
+		key    string
+		object string
+		chunk  int
+		ok     bool
+	}{
+		{"a#manifest", "a", -1, true},
+		{"a#0", "a", 0, true},
+		{"a#b#12", "a#b", 12, true},
+		{"a", "", 0, false},
+		{"a#", "", 0, false},
+		{"a#01", "", 0, false},
+		{"a#+1", "", 0, false},
+		{"a#-1", "", 0, false},
+	} {
+		object, chunk, ok := parseLargeKey(tc.key)
+		if object != tc.object || chunk != tc.chunk || ok != tc.ok {
+			t.Errorf("parseLargeKey(%q) = %q, %d, %v; want %q, %d, %v", tc.key, object, chunk, ok, tc.object, tc.chunk, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyStats summarizes recorded durations. Percentiles are accurate
+// to within about 6%.
+type LatencyStats struct {
+	Count int64
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+
+	// Buckets holds the histogram of the durations, from the shortest
+	// to the longest, leaving out empty buckets. It is only set by
+	// Group.Latency and Group.PeerLatencies.
+	Buckets []LatencyBucket
+}
+
+// A LatencyBucket counts the recorded durations from the Max of the
+// previous bucket, exclusive, to its own Max, inclusive.
+type LatencyBucket struct {
+	Max   time.Duration
+	Count int64
+}
+
+// Histogram layout: durations below 2^latencySubBits nanoseconds get a
+// bucket each; above that, each power of two is split into
+// 2^(latencySubBits-1) equal buckets, like an HDR histogram with
+// latencySubBits-1 significant bits.
+const (
+	latencySubBits = 4
+	latencySub     = 1 << (latencySubBits - 1)
+	latencyBuckets = (64-latencySubBits+1)*latencySub + latencySub
+)
+
+// A latencyHistogram counts durations in logarithmic buckets, using a
+// fixed amount of memory however many durations it records. It is safe
+// for concurrent use.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64 // accessed atomically
+}
+
+func latencyBucket(d time.Duration) int {
+	v := uint64(d)
+	if d < 0 {
+		v = 0
+	}
+	if v < 1<<latencySubBits {
+		return int(v)
+	}
+	shift := uint(bits.Len64(v) - latencySubBits)
+	return int(shift)*latencySub + int(v>>shift)
+}
+
+// latencyBucketValue returns the midpoint of the durations counted in
+// bucket i.
+func latencyBucketValue(i int) time.Duration {
+	if i < 1<<latencySubBits {
+		return time.Duration(i)
+	}
+	shift := uint(i/latencySub - 1)
+	lo := uint64(i%latencySub+latencySub) << shift
+	return time.Duration(lo + (uint64(1)<<shift)/2)
+}
+
+// latencyBucketMax returns the longest duration counted in bucket i.
+func latencyBucketMax(i int) time.Duration {
+	if i < 1<<latencySubBits {
+		return time.Duration(i)
+	}
+	shift := uint(i/latencySub - 1)
+	lo := uint64(i%latencySub+latencySub) << shift
+	return time.Duration(lo + (uint64(1) << shift) - 1)
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	atomic.AddUint64(&h.counts[latencyBucket(d)], 1)
+}
+
+func (h *latencyHistogram) stats() LatencyStats {
+	return latencyStatsOf(h)
+}
+
+// histogram is stats with the Buckets set.
+func (h *latencyHistogram) histogram() LatencyStats {
+	var counts [latencyBuckets]uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	st := summarizeLatency(&counts)
+	for i, n := range counts {
+		if n > 0 {
+			st.Buckets = append(st.Buckets, LatencyBucket{Max: latencyBucketMax(i), Count: int64(n)})
+		}
+	}
+	return st
+}
+
+// reset forgets the recorded durations. Those recorded concurrently
+// may be kept or forgotten.
+func (h *latencyHistogram) reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+}
+
+// latencyStatsOf summarizes the durations recorded by all of hs.
+func latencyStatsOf(hs ...*latencyHistogram) LatencyStats {
+	var counts [latencyBuckets]uint64
+	for _, h := range hs {
+		for i := range counts {
+			counts[i] += atomic.LoadUint64(&h.counts[i])
+		}
+	}
+	return summarizeLatency(&counts)
+}
+
+// summarizeLatency returns the count and percentiles of the durations
+// of a histogram, without its Buckets.
+func summarizeLatency(counts *[latencyBuckets]uint64) LatencyStats {
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	st := LatencyStats{Count: int64(total)}
+	if total == 0 {
+		return st
+	}
+	percentile := func(q uint64) time.Duration {
+		rank := (total*q + 99) / 100 // ceil(total * q%)
+		var seen uint64
+		for i, n := range counts {
+			seen += n
+			if seen >= rank {
+				return latencyBucketValue(i)
+			}
+		}
+		return latencyBucketValue(len(counts) - 1)
+	}
+	st.P50, st.P90, st.P99 = percentile(50), percentile(90), percentile(99)
+	return st
+}
+
+// A rollingLatency summarizes the most recent durations it records:
+// between window and twice window of them, as it keeps the durations
+// of the current and the previous window only. It is safe for
+// concurrent use.
+type rollingLatency struct {
+	window int64
+
+	mu        sync.Mutex
+	n         int64 // durations in cur
+	cur, prev *latencyHistogram
+}
+
+func newRollingLatency(window int) *rollingLatency {
+	return &rollingLatency{
+		window: int64(window),
+		cur:    new(latencyHistogram),
+		prev:   new(latencyHistogram),
+	}
+}
+
+func (r *rollingLatency) record(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n >= r.window {
+		r.prev, r.cur, r.n = r.cur, new(latencyHistogram), 0
+	}
+	r.cur.record(d)
+	r.n++
+}
+
+func (r *rollingLatency) stats() LatencyStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return latencyStatsOf(r.prev, r.cur)
+}
+
+// A LatencyType selects one of the latency histograms a group records
+// with GroupOptions.RecordLatency.
+type LatencyType int
+
+const (
+	// GetLatency is the latency of the group's Gets, from call to
+	// return, whether they hit a cache or not.
+	GetLatency LatencyType = iota + 1
+
+	// PeerFetchLatency is the latency of the group's fetches of keys
+	// from peers, failed ones included.
+	PeerFetchLatency
+
+	// OriginLatency is the latency of the group's loads of keys from
+	// its getter, as summarized by LoadLatency.
+	OriginLatency
+)
+
+// Latency returns the histogram of the durations of which, since the
+// group was created or ResetLatency was last called. It is empty
+// unless GroupOptions.RecordLatency is set, except for OriginLatency,
+// which GroupOptions.RecordLoadLatency records too.
+func (g *Group) Latency(which LatencyType) LatencyStats {
+	var h *latencyHistogram
+	switch which {
+	case GetLatency:
+		h = g.getLatency
+	case PeerFetchLatency:
+		h = g.peerLatency
+	case OriginLatency:
+		h = g.loadLatency
+	}
+	if h == nil {
+		return LatencyStats{}
+	}
+	return h.histogram()
+}
+
+// PeerLatencies returns the histogram of the durations of the group's
+// fetches from each peer, keyed by the peer's URL, as Latency does for
+// PeerFetchLatency over all peers. It is empty unless
+// GroupOptions.RecordLatency is set.
+func (g *Group) PeerLatencies() map[string]LatencyStats {
+	res := make(map[string]LatencyStats)
+	g.peerLatencies.Range(func(url, h interface{}) bool {
+		res[url.(string)] = h.(*latencyHistogram).histogram()
+		return true
+	})
+	return res
+}
+
+// ResetLatency forgets the durations recorded by the group's latency
+// histograms so far, so that Latency and PeerLatencies summarize the
+// durations recorded since.
+func (g *Group) ResetLatency() {
+	for _, h := range []*latencyHistogram{g.getLatency, g.peerLatency, g.loadLatency} {
+		if h != nil {
+			h.reset()
+		}
+	}
+	g.peerLatencies.Range(func(url, _ interface{}) bool {
+		g.peerLatencies.Delete(url)
+		return true
+	})
+}
+
+// recordPeerLatency records that a fetch from peer took d, if
+// GroupOptions.RecordLatency is set.
+func (g *Group) recordPeerLatency(peer ProtoGetter, d time.Duration) {
+	if g.peerLatency == nil {
+		return
+	}
+	g.peerLatency.record(d)
+	url := peer.GetURL()
+	h, ok := g.peerLatencies.Load(url)
+	if !ok {
+		h, _ = g.peerLatencies.LoadOrStore(url, new(latencyHistogram))
+	}
+	h.(*latencyHistogram).record(d)
+}
@@ -19,10 +19,14 @@ package lru
 
 import (
 	"container/list"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-// Cache is an LRU cache. It is not safe for concurrent access.
+// Cache is an LRU cache, unless its Policy selects another order of
+// eviction. It is not safe for concurrent access, except for
+// concurrent calls of Get and Peek in Clock mode.
 type Cache struct {
 	// MaxEntries is the maximum number of cache entries before
 	// an item is evicted. Zero means no limit.
@@ -32,17 +36,171 @@ type Cache struct {
 	// executed when an entry is purged from the cache.
 	OnEvicted func(key Key, value interface{})
 
-	ll    *list.List
+	// OnEvictedErr optionally specifies a callback function to be
+	// executed when an entry is purged from the cache, for callbacks
+	// that can fail. A non-nil error is passed to OnEvictionError.
+	//
+	// The entry has already been removed from the cache when the
+	// callback runs and stays removed whatever it returns. Callbacks
+	// run synchronously, OnEvicted first, on the goroutine whose call
+	// caused the eviction, so a blocking callback stalls that call.
+	OnEvictedErr func(key Key, value interface{}) error
+
+	// OnEvictionError optionally specifies a function to be called
+	// with the errors returned by OnEvictedErr. If nil, those errors
+	// are discarded.
+	OnEvictionError func(key Key, err error)
+
+	// OnEvictedReason optionally specifies a callback function to be
+	// executed when an entry is purged from the cache, with why it was
+	// purged and how old it was. It runs after OnEvicted and
+	// OnEvictedErr.
+	OnEvictedReason func(key Key, value interface{}, info EvictionInfo)
+
+	// SizeOf optionally returns the size of an entry, reported as
+	// EvictionInfo.Size. If nil, sizes are reported as zero.
+	SizeOf func(key Key, value interface{}) int64
+
+	// Policy selects the entry RemoveOldest evicts. It must be set
+	// before the first Add.
+	Policy Policy
+
+	// Segmented enables segmented LRU (SLRU) mode. New entries are
+	// placed in a probationary segment and only promoted to a
+	// protected segment on a second hit, so a one-shot scan over
+	// many unique keys evicts other probationary entries rather than
+	// frequently reused ones. It only applies to the LRU policy, and
+	// must be set before the first Add.
+	Segmented bool
+
+	// Clock enables CLOCK mode, an approximation of LRU also known as
+	// second chance. A hit only sets a reference bit on the entry,
+	// atomically, instead of moving it to the front, so that Get does
+	// not modify the cache and may be called concurrently with other
+	// Gets and Peeks, for example under a read lock. RemoveOldest then
+	// sweeps from the oldest entry on, giving each entry whose bit is
+	// set, which it clears, a second chance at the front, and removes
+	// the first one whose bit is clear. Get reports expired entries
+	// as missing without removing them. Clock takes precedence over
+	// Policy and Segmented, and must be set before the first Add.
+	Clock bool
+
+	// Now optionally specifies the function telling the current time,
+	// by which entries expire. If nil, time.Now is used.
+	Now func() time.Time
+
+	ll    *list.List // probationary segment; the only list in plain mode
+	pl    *list.List // protected segment, used only in segmented mode
 	cache map[interface{}]*list.Element
+
+	// heads holds the frontmost entry of each use count in ll under
+	// the LFU policy, where ll is ordered by decreasing use count, and
+	// newest the entry added last, which RemoveOldest spares under the
+	// LFU and ARC policies.
+	heads  map[int]*list.Element
+	newest *list.Element
+
+	// Under the ARC policy, ll holds the entries used once and pl
+	// those used again. b1 and b2 hold the keys of the entries last
+	// evicted from ll and pl, most recently evicted first, indexed by
+	// ghosts, and target is the number of entries ARC aims to keep in
+	// ll.
+	b1, b2 *list.List
+	ghosts map[interface{}]*list.Element
+	target int
+}
+
+// A Policy selects the entry a Cache evicts first.
+type Policy int
+
+const (
+	// LRU evicts the least recently used entry.
+	LRU Policy = iota
+
+	// LFU evicts the least frequently used entry, and the least
+	// recently used of those used as often. Adding an entry counts as
+	// its first use, and every Get hit or Add of its key as another.
+	// The entry added last is only evicted if no other can be, so that
+	// adding an entry to a full cache evicts another rather than
+	// itself. Counts never decay, so an entry that was popular once
+	// outlives newer ones until they are used as often.
+	LFU
+
+	// FIFO evicts the entry added first. Hits do not reorder entries.
+	FIFO
+
+	// ARC is the adaptive replacement policy. Like segmented LRU, it
+	// keeps the entries used once apart from those used again, but
+	// rather than a fixed share it adapts the room of each: the
+	// keys of recently evicted entries are remembered, and adding one
+	// again makes room for more entries of the kind it was evicted
+	// from. A scan over many keys used once then only evicts others
+	// used once, while a working set too large for the entries used
+	// again wins room back from them. RemoveOldest removes the least
+	// recently used entry of the kind overrunning its room, sparing
+	// the entry added last as LFU does. The cache remembers as many
+	// keys as MaxEntries, or as it holds entries if MaxEntries is zero.
+	// ARC takes precedence over Segmented.
+	ARC
+)
+
+// protectedPercent is the share of a segmented cache's entries that
+// the protected segment may hold before its least recently used
+// entries are demoted back to the probationary segment.
+const protectedPercent = 80
+
+// An EvictionReason tells why an entry was purged from a Cache.
+type EvictionReason int
+
+const (
+	// EvictedCapacity is the reason of entries removed by RemoveOldest,
+	// including when MaxEntries is exceeded.
+	EvictedCapacity EvictionReason = iota
+
+	// EvictedRemoved is the reason of entries removed by Remove.
+	EvictedRemoved
+
+	// EvictedExpired is the reason of entries found expired by Get.
+	EvictedExpired
+
+	// EvictedCleared is the reason of entries removed by Clear.
+	EvictedCleared
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictedCapacity:
+		return "capacity"
+	case EvictedRemoved:
+		return "removed"
+	case EvictedExpired:
+		return "expired"
+	case EvictedCleared:
+		return "cleared"
+	}
+	return "EvictionReason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// EvictionInfo describes an entry purged from a Cache, for
+// OnEvictedReason.
+type EvictionInfo struct {
+	Reason EvictionReason
+	Age    time.Duration // since the entry was added
+	Size   int64         // as returned by SizeOf
 }
 
 // A Key may be any value that is comparable. See http://golang.org/ref/spec#Comparison_operators
 type Key interface{}
 
 type entry struct {
-	key    Key
-	value  interface{}
-	expire time.Time
+	key       Key
+	value     interface{}
+	expire    time.Time
+	protected bool  // entry lives in pl rather than ll
+	pinned    bool  // entry is skipped by RemoveOldest
+	ref       int32 // entry was hit since the last sweep, in Clock mode
+	uses      int   // times the entry was used, under the LFU policy
+	added     int64 // Unix time in nanoseconds, only with OnEvictedReason
 }
 
 // New creates a new Cache.
@@ -56,6 +214,16 @@ func New(maxEntries int) *Cache {
 	}
 }
 
+// NewSegmented creates a new Cache in segmented LRU mode.
+// If maxEntries is zero, the cache has no limit and it's assumed
+// that eviction is done by the caller.
+func NewSegmented(maxEntries int) *Cache {
+	c := New(maxEntries)
+	c.Segmented = true
+	c.pl = list.New()
+	return c
+}
+
 // Add adds a value to the cache.
 func (c *Cache) Add(key Key, value interface{}, expire time.Time) {
 	if c.cache == nil {
@@ -63,17 +231,38 @@ func (c *Cache) Add(key Key, value interface{}, expire time.Time) {
 		c.ll = list.New()
 	}
 	if ee, ok := c.cache[key]; ok {
-		c.ll.MoveToFront(ee)
 		ee.Value.(*entry).value = value
+		c.touch(ee)
 		return
 	}
-	ele := c.ll.PushFront(&entry{key, value, expire})
+	kv := &entry{key: key, value: value, expire: expire}
+	if c.OnEvictedReason != nil {
+		kv.added = c.now().UnixNano()
+	}
+	var ele *list.Element
+	switch {
+	case c.lfu():
+		ele = c.pushLFU(kv)
+		c.newest = ele
+	case c.arc():
+		ele = c.pushARC(kv)
+		c.newest = ele
+	default:
+		ele = c.ll.PushFront(kv)
+	}
 	c.cache[key] = ele
-	if c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries {
+	if c.MaxEntries != 0 && c.Len() > c.MaxEntries {
 		c.RemoveOldest()
 	}
 }
 
+func (c *Cache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
 // Get looks up a key's value from the cache.
 func (c *Cache) Get(key Key) (value interface{}, ok bool) {
 	if c.cache == nil {
@@ -82,45 +271,431 @@ func (c *Cache) Get(key Key) (value interface{}, ok bool) {
 	if ele, hit := c.cache[key]; hit {
 		entry := ele.Value.(*entry)
 		// If the entry has expired, remove it from the cache
-		if !entry.expire.IsZero() && entry.expire.Before(time.Now()) {
-			c.removeElement(ele)
+		if !entry.expire.IsZero() && entry.expire.Before(c.now()) {
+			if !c.Clock {
+				c.removeElement(ele, EvictedExpired)
+			}
 			return nil, false
 		}
 
-		c.ll.MoveToFront(ele)
+		c.touch(ele)
+		return entry.value, true
+	}
+	return
+}
+
+// GetOrAdd looks up a key's value from the cache like Get, and if it
+// is missing adds the value returned by fn, without expiration.
+// loaded reports whether the value was already in the cache. fn is
+// not called if it was.
+func (c *Cache) GetOrAdd(key Key, fn func() interface{}) (value interface{}, loaded bool) {
+	if value, ok := c.Get(key); ok {
+		return value, true
+	}
+	value = fn()
+	c.Add(key, value, time.Time{})
+	return value, false
+}
+
+// Peek looks up a key's value from the cache without updating its
+// recency or promoting it. Expired entries are reported as missing but
+// left in place.
+func (c *Cache) Peek(key Key) (value interface{}, ok bool) {
+	if c.cache == nil {
+		return
+	}
+	if ele, hit := c.cache[key]; hit {
+		entry := ele.Value.(*entry)
+		if !entry.expire.IsZero() && entry.expire.Before(c.now()) {
+			return nil, false
+		}
 		return entry.value, true
 	}
 	return
 }
 
+// SetExpire sets the expire time of key's entry, reporting whether
+// key was in the cache. It does not change the entry's recency.
+func (c *Cache) SetExpire(key Key, expire time.Time) bool {
+	if c.cache == nil {
+		return false
+	}
+	ele, hit := c.cache[key]
+	if hit {
+		ele.Value.(*entry).expire = expire
+	}
+	return hit
+}
+
+// Range calls f for each entry in the cache, from most to least
+// recently used, until f returns false. Protected entries of a
+// segmented cache come before probationary ones. In Clock mode,
+// entries come from the most recently added or given a second chance
+// on. Under the LFU policy, they come from the most to the least
+// frequently used, under FIFO from the last added on, and under ARC
+// those used again come before those used once. Expired
+// entries are skipped but left in place, and recency is not updated.
+// f must not modify the cache.
+func (c *Cache) Range(f func(key Key, value interface{}) bool) {
+	if c.cache == nil {
+		return
+	}
+	now := c.now()
+	for _, l := range []*list.List{c.pl, c.ll} {
+		if l == nil {
+			continue
+		}
+		for e := l.Front(); e != nil; e = e.Next() {
+			kv := e.Value.(*entry)
+			if !kv.expire.IsZero() && kv.expire.Before(now) {
+				continue
+			}
+			if !f(kv.key, kv.value) {
+				return
+			}
+		}
+	}
+}
+
+// Keys returns the keys of the unexpired entries in the cache, in the
+// order Range visits them: from most to least recently used under the
+// LRU policy. It does not update recency.
+func (c *Cache) Keys() []Key {
+	keys := make([]Key, 0, c.Len())
+	c.Range(func(key Key, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
 // Remove removes the provided key from the cache.
 func (c *Cache) Remove(key Key) {
 	if c.cache == nil {
 		return
 	}
 	if ele, hit := c.cache[key]; hit {
-		c.removeElement(ele)
+		c.removeElement(ele, EvictedRemoved)
 	}
 }
 
-// RemoveOldest removes the oldest item from the cache.
+// RemoveOldest removes the oldest item from the cache that is not
+// pinned. In segmented mode probationary entries are removed before
+// protected ones. In Clock mode, it removes the oldest item not
+// pinned nor hit since the last sweep. Under the LFU, FIFO and ARC
+// policies, it removes the first unpinned item they evict.
 func (c *Cache) RemoveOldest() {
 	if c.cache == nil {
 		return
 	}
-	ele := c.ll.Back()
-	if ele != nil {
-		c.removeElement(ele)
+	if c.Clock {
+		c.sweep()
+		return
+	}
+	lists := []*list.List{c.ll, c.pl}
+	if c.arc() && c.ll.Len() <= c.target {
+		lists[0], lists[1] = c.pl, c.ll
+	}
+	var newest *list.Element
+	for _, l := range lists {
+		if l == nil {
+			continue
+		}
+		for e := l.Back(); e != nil; e = e.Prev() {
+			if e.Value.(*entry).pinned {
+				continue
+			}
+			if e == c.newest {
+				newest = e
+				continue
+			}
+			c.evict(e)
+			return
+		}
+	}
+	if newest != nil {
+		c.evict(newest)
+	}
+}
+
+// evict removes e to make room, remembering its key under the ARC
+// policy.
+func (c *Cache) evict(e *list.Element) {
+	if c.arc() {
+		kv := e.Value.(*entry)
+		c.addGhost(kv.key, kv.protected)
 	}
+	c.removeElement(e, EvictedCapacity)
 }
 
-func (c *Cache) removeElement(e *list.Element) {
+// Pin protects the entry for key from RemoveOldest, and so from
+// eviction when MaxEntries is exceeded, until Unpin is called. The
+// entry may still be removed by Remove, Clear or expiry. Pin reports
+// whether key was in the cache. Pinning does not change its recency.
+func (c *Cache) Pin(key Key) bool {
+	return c.setPinned(key, true)
+}
+
+// Unpin makes the entry for key evictable again, reporting whether
+// key was in the cache.
+func (c *Cache) Unpin(key Key) bool {
+	return c.setPinned(key, false)
+}
+
+func (c *Cache) setPinned(key Key, pinned bool) bool {
+	if c.cache == nil {
+		return false
+	}
+	ele, hit := c.cache[key]
+	if hit {
+		ele.Value.(*entry).pinned = pinned
+	}
+	return hit
+}
+
+// sweep removes the entry RemoveOldest removes in Clock mode. Each
+// entry is passed over at most twice: once to clear its reference
+// bit, and once more if it is pinned.
+func (c *Cache) sweep() {
+	for n := 2 * c.ll.Len(); n > 0; n-- {
+		e := c.ll.Back()
+		kv := e.Value.(*entry)
+		if kv.pinned || atomic.LoadInt32(&kv.ref) != 0 {
+			atomic.StoreInt32(&kv.ref, 0)
+			c.ll.MoveToFront(e)
+			continue
+		}
+		c.removeElement(e, EvictedCapacity)
+		return
+	}
+}
+
+// touch records a hit on e, moving it to the front of its segment or,
+// in segmented mode, promoting it from probationary to protected.
+func (c *Cache) touch(e *list.Element) {
+	kv := e.Value.(*entry)
+	if c.Clock {
+		if atomic.LoadInt32(&kv.ref) == 0 {
+			atomic.StoreInt32(&kv.ref, 1)
+		}
+		return
+	}
+	switch c.Policy {
+	case LFU:
+		c.useLFU(e)
+		return
+	case FIFO:
+		return
+	}
+	if !c.Segmented && c.Policy != ARC {
+		c.ll.MoveToFront(e)
+		return
+	}
+	if kv.protected {
+		c.pl.MoveToFront(e)
+		return
+	}
+	if c.pl == nil {
+		c.pl = list.New()
+	}
 	c.ll.Remove(e)
+	kv.protected = true
+	ele := c.pl.PushFront(kv)
+	c.cache[kv.key] = ele
+	if e == c.newest {
+		c.newest = ele
+	}
+	if !c.arc() {
+		c.balance()
+	}
+}
+
+// balance demotes the least recently used protected entries back to
+// the probationary segment until the protected segment is within
+// its share of the cache.
+func (c *Cache) balance() {
+	limit := c.MaxEntries
+	if limit == 0 {
+		limit = c.Len()
+	}
+	limit = limit * protectedPercent / 100
+	if limit < 1 {
+		limit = 1
+	}
+	for c.pl.Len() > limit {
+		e := c.pl.Back()
+		kv := e.Value.(*entry)
+		c.pl.Remove(e)
+		kv.protected = false
+		c.cache[kv.key] = c.ll.PushFront(kv)
+	}
+}
+
+// lfu reports whether ll is ordered by use count, under the LFU
+// policy.
+func (c *Cache) lfu() bool {
+	return c.Policy == LFU && !c.Clock
+}
+
+// pushLFU adds kv to ll as used once, in front of the other entries
+// used once, which come last.
+func (c *Cache) pushLFU(kv *entry) *list.Element {
+	if c.heads == nil {
+		c.heads = make(map[int]*list.Element)
+	}
+	kv.uses = 1
+	var e *list.Element
+	if head := c.heads[1]; head != nil {
+		e = c.ll.InsertBefore(kv, head)
+	} else {
+		e = c.ll.PushBack(kv)
+	}
+	c.heads[1] = e
+	return e
+}
+
+// useLFU counts a use of e, moving it to the front of the entries used
+// as often as it now is. Those come right before the entries used as
+// often as it was, so e only moves if others are in either group.
+func (c *Cache) useLFU(e *list.Element) {
 	kv := e.Value.(*entry)
+	c.unlinkLFU(e)
+	kv.uses++
+	if head := c.heads[kv.uses]; head != nil {
+		c.ll.MoveBefore(e, head)
+	} else if head := c.heads[kv.uses-1]; head != nil {
+		c.ll.MoveBefore(e, head)
+	}
+	c.heads[kv.uses] = e
+}
+
+// unlinkLFU hands the head of e's use count over to the next entry
+// with that count, if e is the head.
+func (c *Cache) unlinkLFU(e *list.Element) {
+	kv := e.Value.(*entry)
+	if c.heads[kv.uses] != e {
+		return
+	}
+	if next := e.Next(); next != nil && next.Value.(*entry).uses == kv.uses {
+		c.heads[kv.uses] = next
+	} else {
+		delete(c.heads, kv.uses)
+	}
+}
+
+// arc reports whether the cache evicts under the ARC policy.
+func (c *Cache) arc() bool {
+	return c.Policy == ARC && !c.Clock
+}
+
+// pushARC adds kv to ll, or to pl if its key was evicted lately, in
+// which case the room of the kind of entries it was evicted from
+// grows by as many entries as there are keys evicted from the other
+// kind per key evicted from its own, or one if more.
+func (c *Cache) pushARC(kv *entry) *list.Element {
+	if c.pl == nil {
+		c.pl = list.New()
+	}
+	g, ok := c.ghosts[kv.key]
+	if !ok {
+		return c.ll.PushFront(kv)
+	}
+	if g.Value.(*ghost).used {
+		c.b2.Remove(g)
+		c.target -= maxInt(c.b1.Len()/(c.b2.Len()+1), 1)
+		if c.target < 0 {
+			c.target = 0
+		}
+	} else {
+		c.b1.Remove(g)
+		c.target += maxInt(c.b2.Len()/(c.b1.Len()+1), 1)
+		if n := c.capacity(); c.target > n {
+			c.target = n
+		}
+	}
+	delete(c.ghosts, kv.key)
+	kv.protected = true
+	return c.pl.PushFront(kv)
+}
+
+// A ghost is the key of an entry evicted under the ARC policy, used
+// again before its eviction if used is set.
+type ghost struct {
+	key  Key
+	used bool
+}
+
+// addGhost remembers key as evicted under the ARC policy, forgetting
+// the keys evicted longest ago beyond the capacity of the cache.
+func (c *Cache) addGhost(key Key, used bool) {
+	if c.ghosts == nil {
+		c.ghosts = make(map[interface{}]*list.Element)
+		c.b1, c.b2 = list.New(), list.New()
+	}
+	l := c.b1
+	if used {
+		l = c.b2
+	}
+	c.ghosts[key] = l.PushFront(&ghost{key: key, used: used})
+	for n := c.capacity(); c.b1.Len()+c.b2.Len() > n; {
+		l := c.b2
+		if c.b2.Len() == 0 || c.b1.Len() > 0 && c.ll.Len()+c.b1.Len() >= n {
+			l = c.b1
+		}
+		delete(c.ghosts, l.Remove(l.Back()).(*ghost).key)
+	}
+}
+
+// capacity returns the number of entries the cache holds when full,
+// as best known.
+func (c *Cache) capacity() int {
+	if c.MaxEntries != 0 {
+		return c.MaxEntries
+	}
+	return c.Len()
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (c *Cache) removeElement(e *list.Element, reason EvictionReason) {
+	kv := e.Value.(*entry)
+	if c.lfu() {
+		c.unlinkLFU(e)
+	}
+	if e == c.newest {
+		c.newest = nil
+	}
+	if kv.protected {
+		c.pl.Remove(e)
+	} else {
+		c.ll.Remove(e)
+	}
 	delete(c.cache, kv.key)
+	c.evicted(kv, reason)
+}
+
+// evicted runs the eviction callbacks for kv.
+func (c *Cache) evicted(kv *entry, reason EvictionReason) {
 	if c.OnEvicted != nil {
 		c.OnEvicted(kv.key, kv.value)
 	}
+	if c.OnEvictedErr != nil {
+		if err := c.OnEvictedErr(kv.key, kv.value); err != nil && c.OnEvictionError != nil {
+			c.OnEvictionError(kv.key, err)
+		}
+	}
+	if c.OnEvictedReason != nil {
+		info := EvictionInfo{Reason: reason, Age: c.now().Sub(time.Unix(0, kv.added))}
+		if c.SizeOf != nil {
+			info.Size = c.SizeOf(kv.key, kv.value)
+		}
+		c.OnEvictedReason(kv.key, kv.value, info)
+	}
 }
 
 // Len returns the number of items in the cache.
@@ -128,17 +703,24 @@ func (c *Cache) Len() int {
 	if c.cache == nil {
 		return 0
 	}
+	if c.pl != nil {
+		return c.ll.Len() + c.pl.Len()
+	}
 	return c.ll.Len()
 }
 
 // Clear purges all stored items from the cache.
 func (c *Cache) Clear() {
-	if c.OnEvicted != nil {
+	if c.OnEvicted != nil || c.OnEvictedErr != nil || c.OnEvictedReason != nil {
 		for _, e := range c.cache {
-			kv := e.Value.(*entry)
-			c.OnEvicted(kv.key, kv.value)
+			c.evicted(e.Value.(*entry), EvictedCleared)
 		}
 	}
 	c.ll = nil
+	c.pl = nil
 	c.cache = nil
+	c.heads = nil
+	c.newest = nil
+	c.b1, c.b2, c.ghosts = nil, nil, nil
+	c.target = 0
 }
@@ -17,7 +17,10 @@ limitations under the License.
 package lru
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -121,3 +124,556 @@ func TestExpire(t *testing.T) {
 		}
 	}
 }
+
+func TestSegmentedScanResistance(t *testing.T) {
+	lru := NewSegmented(10)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("hot%d", i)
+		lru.Add(key, i, time.Time{})
+		lru.Get(key) // second hit promotes to protected
+	}
+	for i := 0; i < 100; i++ {
+		lru.Add(fmt.Sprintf("scan%d", i), i, time.Time{})
+	}
+	if lru.Len() != 10 {
+		t.Fatalf("got %d entries; want 10", lru.Len())
+	}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("hot%d", i)
+		if _, ok := lru.Get(key); !ok {
+			t.Errorf("%s was evicted by a scan", key)
+		}
+	}
+}
+
+func TestSegmentedProtectedLimit(t *testing.T) {
+	var evictedKeys []Key
+	lru := NewSegmented(10)
+	lru.OnEvicted = func(key Key, value interface{}) {
+		evictedKeys = append(evictedKeys, key)
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("myKey%d", i)
+		lru.Add(key, i, time.Time{})
+		lru.Get(key)
+	}
+	if got := lru.pl.Len(); got != 8 {
+		t.Fatalf("protected segment has %d entries; want 8", got)
+	}
+	// myKey0 and myKey1 were demoted, so they are the first to go.
+	lru.RemoveOldest()
+	lru.RemoveOldest()
+	if len(evictedKeys) != 2 || evictedKeys[0] != Key("myKey0") || evictedKeys[1] != Key("myKey1") {
+		t.Fatalf("got evicted keys %v; want [myKey0 myKey1]", evictedKeys)
+	}
+	lru.Remove("myKey5")
+	if lru.Len() != 7 {
+		t.Fatalf("got %d entries; want 7", lru.Len())
+	}
+}
+
+func TestARC(t *testing.T) {
+	lru := withPolicy(ARC)(10)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("hot%d", i)
+		lru.Add(key, i, time.Time{})
+		lru.Get(key) // second use moves the entry to pl
+	}
+	for i := 0; i < 100; i++ {
+		lru.Add(fmt.Sprintf("scan%d", i), i, time.Time{})
+	}
+	if lru.Len() != 10 {
+		t.Fatalf("got %d entries; want 10", lru.Len())
+	}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("hot%d", i)
+		if _, ok := lru.Get(key); !ok {
+			t.Errorf("%s was evicted by a scan", key)
+		}
+	}
+	if lru.target != 0 {
+		t.Fatalf("target = %d after a scan; want 0", lru.target)
+	}
+
+	// Adding back a key evicted after a single use makes room for
+	// more such entries.
+	lru.Add("scan94", 94, time.Time{})
+	if lru.target != 1 {
+		t.Errorf("target = %d after adding back an evicted key; want 1", lru.target)
+	}
+	if e := lru.cache["scan94"].Value.(*entry); !e.protected {
+		t.Error("key added back is not in pl")
+	}
+	if n := lru.b1.Len() + lru.b2.Len(); n > 10 {
+		t.Errorf("cache remembers %d evicted keys; want at most 10", n)
+	}
+
+	lru.Clear()
+	if lru.ghosts != nil || lru.target != 0 {
+		t.Error("Clear kept evicted keys")
+	}
+}
+
+func TestARCSparesNewest(t *testing.T) {
+	var evictedKeys []Key
+	lru := withPolicy(ARC)(2)
+	lru.OnEvicted = func(key Key, value interface{}) {
+		evictedKeys = append(evictedKeys, key)
+	}
+	lru.Add("a", 1, time.Time{})
+	lru.Get("a")
+	lru.Add("b", 2, time.Time{})
+	lru.Get("b")
+	lru.Add("c", 3, time.Time{})
+	if len(evictedKeys) != 1 || evictedKeys[0] != Key("a") {
+		t.Fatalf("got evicted keys %v; want [a]", evictedKeys)
+	}
+	if _, ok := lru.Get("c"); !ok {
+		t.Error("entry just added was evicted")
+	}
+}
+
+// scanTrace returns a key trace in which a small working set is
+// repeatedly accessed, interleaved with long scans over unique keys.
+func scanTrace() []string {
+	var trace []string
+	scan := 0
+	for round := 0; round < 100; round++ {
+		for pass := 0; pass < 2; pass++ {
+			for i := 0; i < 50; i++ {
+				trace = append(trace, fmt.Sprintf("hot%d", i))
+			}
+		}
+		for i := 0; i < 200; i++ {
+			trace = append(trace, fmt.Sprintf("scan%d", scan))
+			scan++
+		}
+	}
+	return trace
+}
+
+// skewTrace returns a key trace drawn from 1000 keys with a Zipf
+// distribution, so that a few keys are accessed far more often than
+// the others regardless of when they were last accessed.
+func skewTrace() []string {
+	r := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(r, 1.1, 1, 999)
+	trace := make([]string, 20000)
+	for i := range trace {
+		trace[i] = fmt.Sprintf("key%d", z.Uint64())
+	}
+	return trace
+}
+
+// withPolicy returns a constructor of caches with the given policy.
+func withPolicy(p Policy) func(int) *Cache {
+	return func(maxEntries int) *Cache {
+		c := New(maxEntries)
+		c.Policy = p
+		return c
+	}
+}
+
+func BenchmarkHitRatioScanLRU(b *testing.B)  { benchmarkHitRatio(b, scanTrace(), New) }
+func BenchmarkHitRatioScanSLRU(b *testing.B) { benchmarkHitRatio(b, scanTrace(), NewSegmented) }
+func BenchmarkHitRatioScanLFU(b *testing.B)  { benchmarkHitRatio(b, scanTrace(), withPolicy(LFU)) }
+func BenchmarkHitRatioScanFIFO(b *testing.B) { benchmarkHitRatio(b, scanTrace(), withPolicy(FIFO)) }
+func BenchmarkHitRatioScanARC(b *testing.B)  { benchmarkHitRatio(b, scanTrace(), withPolicy(ARC)) }
+func BenchmarkHitRatioSkewLRU(b *testing.B)  { benchmarkHitRatio(b, skewTrace(), New) }
+func BenchmarkHitRatioSkewSLRU(b *testing.B) { benchmarkHitRatio(b, skewTrace(), NewSegmented) }
+func BenchmarkHitRatioSkewLFU(b *testing.B)  { benchmarkHitRatio(b, skewTrace(), withPolicy(LFU)) }
+func BenchmarkHitRatioSkewFIFO(b *testing.B) { benchmarkHitRatio(b, skewTrace(), withPolicy(FIFO)) }
+func BenchmarkHitRatioSkewARC(b *testing.B)  { benchmarkHitRatio(b, skewTrace(), withPolicy(ARC)) }
+
+func benchmarkHitRatio(b *testing.B, trace []string, newCache func(int) *Cache) {
+	var hits, gets int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lru := newCache(100)
+		for _, key := range trace {
+			gets++
+			if _, ok := lru.Get(key); ok {
+				hits++
+				continue
+			}
+			lru.Add(key, key, time.Time{})
+		}
+	}
+	b.ReportMetric(float64(hits)/float64(gets), "hits/get")
+}
+
+func TestGetOrAdd(t *testing.T) {
+	lru := New(2)
+	calls := 0
+	fn := func() interface{} {
+		calls++
+		return calls
+	}
+	if v, loaded := lru.GetOrAdd("a", fn); loaded || v != 1 {
+		t.Errorf("GetOrAdd(a) on empty cache = %v, %v; want 1, false", v, loaded)
+	}
+	if v, loaded := lru.GetOrAdd("a", fn); !loaded || v != 1 {
+		t.Errorf("GetOrAdd(a) again = %v, %v; want 1, true", v, loaded)
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times; want 1", calls)
+	}
+
+	// A hit promotes the entry like Get, so b is evicted rather than a.
+	lru.GetOrAdd("b", fn)
+	lru.GetOrAdd("a", fn)
+	lru.GetOrAdd("c", fn)
+	if _, ok := lru.Get("a"); !ok {
+		t.Error("a was evicted despite being used by GetOrAdd")
+	}
+	if _, ok := lru.Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+}
+
+func TestPeek(t *testing.T) {
+	lru := New(2)
+	lru.Add("a", 1, time.Time{})
+	lru.Add("b", 2, time.Time{})
+	if v, ok := lru.Peek("a"); !ok || v != 1 {
+		t.Fatalf("Peek(a) = %v, %v; want 1, true", v, ok)
+	}
+	// Peek must not have refreshed "a", so it is still the oldest.
+	lru.Add("c", 3, time.Time{})
+	if _, ok := lru.Peek("a"); ok {
+		t.Error("Peek promoted the entry")
+	}
+	lru.Add("d", 4, time.Now().Add(-time.Second))
+	if _, ok := lru.Peek("d"); ok {
+		t.Error("Peek returned an expired entry")
+	}
+	if _, ok := lru.Peek("missing"); ok {
+		t.Error("Peek returned a missing entry")
+	}
+}
+
+func TestSetExpire(t *testing.T) {
+	lru := New(0)
+	lru.Add("a", 1, time.Now().Add(-time.Second))
+	if !lru.SetExpire("a", time.Now().Add(time.Hour)) {
+		t.Fatal("SetExpire(a) = false; want true")
+	}
+	if _, ok := lru.Get("a"); !ok {
+		t.Error("entry still expired after SetExpire")
+	}
+	lru.SetExpire("a", time.Now().Add(-time.Second))
+	if _, ok := lru.Get("a"); ok {
+		t.Error("entry not expired after SetExpire to the past")
+	}
+	if lru.SetExpire("missing", time.Time{}) {
+		t.Error("SetExpire(missing) = true; want false")
+	}
+}
+
+func TestNow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	lru := New(0)
+	lru.Now = func() time.Time { return now }
+	lru.Add("a", 1, now.Add(time.Minute))
+	if _, ok := lru.Get("a"); !ok {
+		t.Fatal("entry expired before its expire time by Now")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := lru.Peek("a"); ok {
+		t.Error("entry not expired after its expire time by Now")
+	}
+}
+
+func TestRange(t *testing.T) {
+	lru := New(0)
+	lru.Add("a", 1, time.Time{})
+	lru.Add("b", 2, time.Now().Add(-time.Second))
+	lru.Add("c", 3, time.Time{})
+	lru.Add("d", 4, time.Time{})
+
+	var keys []Key
+	lru.Range(func(key Key, value interface{}) bool {
+		keys = append(keys, key)
+		return key != "a"
+	})
+	if want := []Key{"d", "c", "a"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Range visited %v; want %v", keys, want)
+	}
+
+	keys = nil
+	lru.Range(func(key Key, value interface{}) bool {
+		keys = append(keys, key)
+		return false
+	})
+	if want := []Key{"d"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Range visited %v after stopping; want %v", keys, want)
+	}
+
+	// Range must not have refreshed "a", so it is still the oldest.
+	lru.RemoveOldest()
+	lru.RemoveOldest()
+	if _, ok := lru.Get("a"); ok {
+		t.Error("Range promoted an entry")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	lru := New(0)
+	if keys := lru.Keys(); len(keys) != 0 {
+		t.Errorf("Keys of an empty cache = %v; want none", keys)
+	}
+	lru.Add("a", 1, time.Time{})
+	lru.Add("b", 2, time.Time{})
+	lru.Add("expired", 3, time.Now().Add(-time.Second))
+	lru.Add("c", 4, time.Time{})
+	lru.Get("a")
+	lru.Peek("b")
+
+	if got, want := lru.Keys(), []Key{"a", "c", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys = %v; want %v", got, want)
+	}
+	// Keys leaves the order of eviction alone.
+	lru.RemoveOldest()
+	if _, ok := lru.Peek("b"); ok {
+		t.Error("RemoveOldest after Keys did not evict the least recently used entry")
+	}
+}
+
+func TestPin(t *testing.T) {
+	lru := New(3)
+	lru.Add("pinned", 0, time.Time{})
+	if !lru.Pin("pinned") {
+		t.Fatal("Pin of a cached key reported false")
+	}
+	if lru.Pin("missing") {
+		t.Error("Pin of a missing key reported true")
+	}
+	for i := 0; i < 10; i++ {
+		lru.Add(fmt.Sprintf("key%d", i), i, time.Time{})
+	}
+	if _, ok := lru.Get("pinned"); !ok {
+		t.Fatal("pinned entry was evicted")
+	}
+	if lru.Len() != 3 {
+		t.Errorf("Len = %d; want 3", lru.Len())
+	}
+	if _, ok := lru.Get("key7"); ok {
+		t.Error("key7 survived; want the oldest unpinned entries evicted")
+	}
+
+	lru.Unpin("pinned")
+	lru.Get("key8")
+	lru.Get("key9")
+	lru.RemoveOldest()
+	if _, ok := lru.Get("pinned"); ok {
+		t.Error("unpinned entry was not evicted")
+	}
+
+	// RemoveOldest does nothing if every entry is pinned.
+	lru = New(0)
+	lru.Add("a", 1, time.Time{})
+	lru.Pin("a")
+	lru.RemoveOldest()
+	if lru.Len() != 1 {
+		t.Errorf("Len = %d after RemoveOldest of pinned entries; want 1", lru.Len())
+	}
+}
+
+func TestEvictErr(t *testing.T) {
+	errFailed := errors.New("write-back failed")
+	var reported []Key
+	lru := New(2)
+	lru.OnEvictedErr = func(key Key, value interface{}) error {
+		if value.(int)%2 == 0 {
+			return errFailed
+		}
+		return nil
+	}
+	lru.OnEvictionError = func(key Key, err error) {
+		if err != errFailed {
+			t.Errorf("OnEvictionError(%v) err = %v; want %v", key, err, errFailed)
+		}
+		reported = append(reported, key)
+	}
+
+	for i := 0; i < 4; i++ {
+		lru.Add(fmt.Sprintf("myKey%d", i), i, time.Time{})
+	}
+	lru.RemoveOldest()
+
+	if want := []Key{"myKey0", "myKey2"}; fmt.Sprint(reported) != fmt.Sprint(want) {
+		t.Errorf("reported errors for %v; want %v", reported, want)
+	}
+	// Failed evictions are still evictions.
+	if lru.Len() != 1 {
+		t.Errorf("got %d entries; want 1", lru.Len())
+	}
+	if _, ok := lru.Get("myKey2"); ok {
+		t.Error("entry whose eviction callback failed is still cached")
+	}
+}
+
+func TestEvictReason(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var got []string
+	lru := New(2)
+	lru.Now = func() time.Time { return now }
+	lru.SizeOf = func(key Key, value interface{}) int64 { return int64(value.(int)) }
+	lru.OnEvictedReason = func(key Key, value interface{}, info EvictionInfo) {
+		got = append(got, fmt.Sprintf("%v:%v:%v:%d", key, info.Reason, info.Age, info.Size))
+	}
+
+	lru.Add("a", 1, time.Time{})
+	now = now.Add(time.Second)
+	lru.Add("b", 2, now.Add(time.Second))
+	lru.Add("c", 3, time.Time{}) // evicts a
+	lru.Remove("c")
+	now = now.Add(2 * time.Second)
+	lru.Get("b") // expired
+	lru.Add("d", 4, time.Time{})
+	lru.Clear()
+
+	want := []string{"a:capacity:1s:1", "c:removed:0s:3", "b:expired:2s:2", "d:cleared:0s:4"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("evictions = %q; want %q", got, want)
+	}
+}
+
+func TestClock(t *testing.T) {
+	var evicted []Key
+	lru := &Cache{Clock: true, OnEvicted: func(key Key, value interface{}) { evicted = append(evicted, key) }}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		lru.Add(k, k, time.Time{})
+	}
+	lru.Get("a")
+	lru.Get("c")
+	lru.Pin("b")
+
+	// a and c get a second chance and b is pinned, leaving d.
+	lru.RemoveOldest()
+	if want := []Key{"d"}; !reflect.DeepEqual(evicted, want) {
+		t.Fatalf("evicted %v; want %v", evicted, want)
+	}
+	// Their bits cleared, a and c go next, in sweep order.
+	lru.RemoveOldest()
+	lru.RemoveOldest()
+	if want := []Key{"d", "a", "c"}; !reflect.DeepEqual(evicted, want) {
+		t.Fatalf("evicted %v; want %v", evicted, want)
+	}
+	// Only pinned entries are left.
+	lru.RemoveOldest()
+	if lru.Len() != 1 || len(evicted) != 3 {
+		t.Errorf("RemoveOldest with only pinned entries left evicted %v", evicted)
+	}
+
+	lru.Add("expired", 1, time.Now().Add(-time.Second))
+	if _, ok := lru.Get("expired"); ok || lru.Len() != 2 {
+		t.Errorf("Get of an expired entry hit or removed it; want a miss leaving it in place")
+	}
+}
+
+func TestLFU(t *testing.T) {
+	var evicted []Key
+	lru := &Cache{Policy: LFU, OnEvicted: func(key Key, value interface{}) { evicted = append(evicted, key) }}
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		lru.Add(k, k, time.Time{})
+	}
+	// a and c are used three times, b twice, d and e once.
+	for _, k := range []string{"a", "c", "a", "b", "c"} {
+		lru.Get(k)
+	}
+	lru.Add("f", "f", time.Time{})
+	lru.Pin("d")
+
+	var order []Key
+	lru.Range(func(key Key, value interface{}) bool {
+		order = append(order, key)
+		return true
+	})
+	if want := []Key{"c", "a", "b", "f", "e", "d"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("Range order = %v; want %v, most frequently then recently used first", order, want)
+	}
+
+	// d is pinned and f, the newest entry, spared, so e, the least
+	// frequently used, goes first, then b, then a, used as often as c
+	// but less recently, and c.
+	for i := 0; i < 4; i++ {
+		lru.RemoveOldest()
+	}
+	if want := []Key{"e", "b", "a", "c"}; !reflect.DeepEqual(evicted, want) {
+		t.Fatalf("evicted %v; want %v", evicted, want)
+	}
+	// Only once it is the last unpinned entry does f go.
+	lru.RemoveOldest()
+	lru.Unpin("d")
+	lru.RemoveOldest()
+	if want := []Key{"e", "b", "a", "c", "f", "d"}; !reflect.DeepEqual(evicted, want) {
+		t.Fatalf("evicted %v; want %v", evicted, want)
+	}
+	if lru.Len() != 0 {
+		t.Errorf("Len = %d; want 0", lru.Len())
+	}
+}
+
+func TestLFUMaxEntries(t *testing.T) {
+	lru := New(2)
+	lru.Policy = LFU
+	lru.Add("popular", 1, time.Time{})
+	lru.Get("popular")
+	for i := 0; i < 10; i++ {
+		lru.Add(i, i, time.Time{})
+	}
+	if _, ok := lru.Get("popular"); !ok {
+		t.Error("frequently used entry was evicted by a stream of new ones")
+	}
+	if _, ok := lru.Get(9); !ok || lru.Len() != 2 {
+		t.Errorf("latest entry missing, or Len = %d; want 2", lru.Len())
+	}
+
+	// A new entry is admitted even if every other was used more.
+	lru.Add("new", 1, time.Time{})
+	if _, ok := lru.Peek("new"); !ok {
+		t.Error("new entry evicted to make room for itself")
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	var evicted []Key
+	lru := &Cache{Policy: FIFO, MaxEntries: 3, OnEvicted: func(key Key, value interface{}) { evicted = append(evicted, key) }}
+	for _, k := range []string{"a", "b", "c"} {
+		lru.Add(k, k, time.Time{})
+	}
+	// Hits, even replacing a's value, do not save a from going first.
+	lru.Get("a")
+	lru.Add("a", "A", time.Time{})
+	lru.Add("d", "d", time.Time{})
+	if want := []Key{"a"}; !reflect.DeepEqual(evicted, want) {
+		t.Fatalf("evicted %v; want %v", evicted, want)
+	}
+	lru.Pin("b")
+	lru.RemoveOldest()
+	if want := []Key{"a", "c"}; !reflect.DeepEqual(evicted, want) {
+		t.Fatalf("evicted %v with b pinned; want %v", evicted, want)
+	}
+}
+
+func TestClockConcurrentGets(t *testing.T) {
+	lru := &Cache{Clock: true}
+	for i := 0; i < 100; i++ {
+		lru.Add(i, i, time.Time{})
+	}
+	done := make(chan bool)
+	for g := 0; g < 4; g++ {
+		go func() {
+			for i := 0; i < 1000; i++ {
+				if v, ok := lru.Get(i % 100); !ok || v != i%100 {
+					t.Errorf("Get(%d) = %v, %v", i%100, v, ok)
+				}
+			}
+			done <- true
+		}()
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+}
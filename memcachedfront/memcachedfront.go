@@ -0,0 +1,291 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package memcachedfront serves the values of groupcache groups over
+// the retrieval commands of the memcached text protocol, so that
+// clients written in other languages can read from a cluster with an
+// ordinary memcached client.
+//
+// Keys are namespaced by group, as "group/key": the first slash
+// separates the name of the group from the key loaded with Group.Get.
+// Only the get, gets, version and quit commands are supported; the
+// cache is filled by its getters, never by clients.
+package memcachedfront
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/melojustme/groupcache"
+)
+
+// maxKeyLength is the longest key the memcached protocol allows.
+const maxKeyLength = 250
+
+// maxLineLength bounds the command lines read from clients.
+const maxLineLength = 64 << 10
+
+// A Server answers memcached get commands with the values of groupcache
+// groups. The zero Server serves the groups registered in the process.
+type Server struct {
+	// GetGroup optionally returns the group named name, or nil if the
+	// server should not serve it.
+	// If nil, groupcache.GetGroup is used.
+	GetGroup func(name string) *groupcache.Group
+
+	// Timeout, if positive, bounds the time each get command may take
+	// to load its keys.
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("memcachedfront: server closed")
+
+// ListenAndServe listens on the TCP address addr and serves the
+// registered groups to the clients connecting to it.
+func ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return (&Server{}).Serve(l)
+}
+
+// Serve accepts connections on l, serving each on its own goroutine,
+// until l fails or Close is called. It closes l before returning.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l, nil)
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(nil, conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrack(nil, conn)
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// Close stops the listeners given to Serve and closes the connections
+// being served.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) track(l net.Listener, c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if l != nil {
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	}
+	if c != nil {
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
+		}
+		s.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener, c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	delete(s.conns, c)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// ServeConn answers the commands read from conn until the client
+// quits or the connection fails, and then closes conn.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	r := bufio.NewReaderSize(conn, 4096)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				w.WriteString("CLIENT_ERROR line too long\r\n")
+				w.Flush()
+			}
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else {
+			switch cmd := fields[0]; cmd {
+			case "get", "gets":
+				s.get(w, fields[1:], cmd == "gets")
+			case "version":
+				w.WriteString("VERSION groupcache\r\n")
+			case "quit":
+				w.Flush()
+				return
+			default:
+				w.WriteString("ERROR\r\n")
+			}
+		}
+		// Pipelined commands are answered together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLine reads a command line ending in "\r\n" or "\n" from r,
+// without the line ending, failing with bufio.ErrBufferFull if it is
+// longer than maxLineLength.
+func readLine(r *bufio.Reader) (string, error) {
+	var buf []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		buf = append(buf, chunk...)
+		if len(buf) > maxLineLength {
+			return "", bufio.ErrBufferFull
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+}
+
+// get answers a get or gets command for keys. The response is built
+// in full before it is written, so that a failure to load one key
+// answers the whole command with a SERVER_ERROR.
+func (s *Server) get(w *bufio.Writer, keys []string, cas bool) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	var res bytes.Buffer
+	for _, key := range keys {
+		if len(key) > maxKeyLength {
+			w.WriteString("CLIENT_ERROR key too long\r\n")
+			return
+		}
+		value, ok, err := s.lookup(ctx, key)
+		if err != nil {
+			w.WriteString("SERVER_ERROR " + sanitize(err.Error()) + "\r\n")
+			return
+		}
+		if !ok {
+			continue
+		}
+		res.WriteString("VALUE " + key + " 0 " + strconv.Itoa(value.Len()))
+		if cas {
+			h := fnv.New64a()
+			value.WriteTo(h)
+			res.WriteString(" " + strconv.FormatUint(h.Sum64(), 10))
+		}
+		res.WriteString("\r\n")
+		value.WriteTo(&res)
+		res.WriteString("\r\n")
+	}
+	res.WriteString("END\r\n")
+	res.WriteTo(w)
+}
+
+// lookup returns the value of key, a "group/key" pair, reporting
+// whether there is one: keys of unknown groups, or that their group
+// does not find, have none.
+func (s *Server) lookup(ctx context.Context, key string) (groupcache.ByteView, bool, error) {
+	i := strings.IndexByte(key, '/')
+	if i < 0 {
+		return groupcache.ByteView{}, false, nil
+	}
+	getGroup := s.GetGroup
+	if getGroup == nil {
+		getGroup = groupcache.GetGroup
+	}
+	g := getGroup(key[:i])
+	if g == nil {
+		return groupcache.ByteView{}, false, nil
+	}
+	var value groupcache.ByteView
+	if err := g.Get(ctx, key[i+1:], groupcache.ByteViewSink(&value), nil); err != nil {
+		if errors.Is(err, groupcache.ErrNotFound) {
+			return groupcache.ByteView{}, false, nil
+		}
+		return groupcache.ByteView{}, false, err
+	}
+	return value, true, nil
+}
+
+// sanitize keeps an error message on the single line of a
+// SERVER_ERROR response.
+func sanitize(msg string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcachedfront
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/melojustme/groupcache"
+)
+
+func init() {
+	groupcache.NewGroup("memcachedfront-test", 1<<20, groupcache.GetterFunc(func(_ context.Context, key string, dest groupcache.Sink, fixFunc func() interface{}) error {
+		switch key {
+		case "missing":
+			return groupcache.ErrNotFound
+		case "broken":
+			return errors.New("origin down\nbadly")
+		}
+		return dest.SetString("value:"+key, time.Time{})
+	}))
+}
+
+// roundTrip sends req to a server connection and returns the first
+// lines lines of the response.
+func roundTrip(t *testing.T, s *Server, req string, lines int) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+	go io.WriteString(client, req)
+	r := bufio.NewReader(client)
+	var res strings.Builder
+	for i := 0; i < lines; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading response to %q: %v", req, err)
+		}
+		res.WriteString(line)
+	}
+	return res.String()
+}
+
+func TestGet(t *testing.T) {
+	s := &Server{}
+	for _, tc := range []struct {
+		req   string
+		lines int
+		want  string
+	}{
+		{"get memcachedfront-test/a\r\n", 3, "VALUE memcachedfront-test/a 0 7\r\nvalue:a\r\nEND\r\n"},
+		{
+			"get memcachedfront-test/a memcachedfront-test/missing nogroup/b nokey memcachedfront-test/b\n", 5,
+			"VALUE memcachedfront-test/a 0 7\r\nvalue:a\r\nVALUE memcachedfront-test/b 0 7\r\nvalue:b\r\nEND\r\n",
+		},
+		{"get memcachedfront-test/broken\r\n", 1, "SERVER_ERROR groupcache: loading key \"broken\": origin down badly\r\n"},
+		{"get " + strings.Repeat("k", maxKeyLength+1) + "\r\n", 1, "CLIENT_ERROR key too long\r\n"},
+		{"get\r\n", 1, "ERROR\r\n"},
+		{"set memcachedfront-test/a 0 0 1\r\n", 1, "ERROR\r\n"},
+		{"version\r\n", 1, "VERSION groupcache\r\n"},
+		// Pipelined commands are all answered.
+		{"get memcachedfront-test/missing\r\nversion\r\n", 2, "END\r\nVERSION groupcache\r\n"},
+	} {
+		if got := roundTrip(t, s, tc.req, tc.lines); got != tc.want {
+			t.Errorf("response to %q = %q; want %q", tc.req, got, tc.want)
+		}
+	}
+}
+
+func TestGets(t *testing.T) {
+	s := &Server{}
+	first := roundTrip(t, s, "gets memcachedfront-test/c\r\n", 3)
+	fields := strings.Fields(strings.SplitN(first, "\r\n", 2)[0])
+	if len(fields) != 5 || fields[0] != "VALUE" || fields[3] != "7" {
+		t.Fatalf("gets response = %q; want a VALUE line with a cas value", first)
+	}
+	if again := roundTrip(t, s, "gets memcachedfront-test/c\r\n", 3); again != first {
+		t.Errorf("second gets response = %q; want the same cas as %q", again, first)
+	}
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{GetGroup: func(name string) *groupcache.Group {
+		if name == "alias" {
+			return groupcache.GetGroup("memcachedfront-test")
+		}
+		return nil
+	}}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "get alias/d memcachedfront-test/d\r\n")
+	r := bufio.NewReader(conn)
+	var res strings.Builder
+	for i := 0; i < 3; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.WriteString(line)
+	}
+	if want := "VALUE alias/d 0 7\r\nvalue:d\r\nEND\r\n"; res.String() != want {
+		t.Errorf("response = %q; want %q", res.String(), want)
+	}
+
+	s.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Serve after Close = %v; want %v", err, ErrServerClosed)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("connection still open after Close")
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+)
+
+// GetMulti gets the value of each of keys into the Sink of dests at
+// the same index, as concurrent Gets of each would, but with a single
+// request per peer: the keys owned by a peer and missing from this
+// process's caches are fetched from it with one GetMulti request, and
+// those this process owns are loaded concurrently. Keys fetched that
+// way do not join loads of them in progress, and those a peer failed
+// to return are then got as Get would after a cache miss.
+//
+// It returns nil if it got every key, a MultiError holding an error
+// per key otherwise.
+func (g *Group) GetMulti(ctx context.Context, keys []string, dests []Sink) error {
+	g.peersOnce.Do(g.initPeers)
+	if len(dests) != len(keys) {
+		return errors.New("groupcache: GetMulti needs a Sink per key")
+	}
+	errs := make(MultiError, len(keys))
+	var wg sync.WaitGroup
+	byPeer := make(map[ProtoGetter][]int)
+	for i, key := range keys {
+		peer, ok := g.pickPeer(key)
+		if !ok || dests[i] == nil || forceRefresh(ctx) {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = g.Get(ctx, keys[i], dests[i], nil)
+			}(i)
+			continue
+		}
+		g.Stats.Gets.Add(1)
+		dests[i].Reset()
+		if value, cacheHit := g.lookupCache(key); cacheHit {
+			g.Stats.CacheHits.Add(1)
+			g.countServedLocal(ctx, value)
+			errs[i] = setSinkView(dests[i], value)
+			continue
+		}
+		byPeer[peer] = append(byPeer[peer], i)
+	}
+	for peer, idx := range byPeer {
+		wg.Add(1)
+		go func(peer ProtoGetter, idx []int) {
+			defer wg.Done()
+			g.getMultiFromPeer(ctx, peer, keys, dests, idx, errs)
+		}(peer, idx)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+// getMultiFromPeer fetches the keys at indexes idx of keys from peer
+// with a single request, into dests, recording their errors in errs.
+func (g *Group) getMultiFromPeer(ctx context.Context, peer ProtoGetter, keys []string, dests []Sink, idx []int, errs []error) {
+	req := &pb.GetMultiRequest{Group: &g.name, Keys: make([]string, len(idx)), Generation: g.peerGeneration()}
+	for j, i := range idx {
+		req.Keys[j] = keys[i]
+	}
+	res := &pb.GetMultiResponse{}
+	g.Stats.MultiPeerRequests.Add(1)
+	err := peer.GetMulti(ctx, req, res)
+	if err == nil && len(res.Values) != len(idx) {
+		err = fmt.Errorf("peer returned %d values for %d keys", len(res.Values), len(idx))
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			for _, i := range idx {
+				errs[i] = &PeerError{Peer: peer, Err: err}
+			}
+			return
+		}
+		if log := g.logger(); log != nil {
+			log.WithFields(logrus.Fields{
+				"err":      err,
+				"keys":     len(idx),
+				"category": "groupcache",
+			}).Errorf("error retrieving keys from peer '%s'", peer.GetURL())
+		}
+		g.Stats.PeerErrors.Add(1)
+	}
+
+	var wg sync.WaitGroup
+	for j, i := range idx {
+		var v *pb.GetResponse
+		if err == nil {
+			v = res.Values[j]
+		}
+		if v != nil && v.Error == nil {
+			g.Stats.Loads.Add(1)
+			switch {
+			case v.GetNotFound():
+				errs[i] = &PeerError{Peer: peer, Err: ErrNotFound}
+				continue
+			case v.GetReadOnly():
+				errs[i] = &PeerError{Peer: peer, Err: ErrReadOnly}
+				continue
+			}
+			if value, verr := peerView(peer, v); verr == nil {
+				g.Stats.PeerLoads.Add(1)
+				g.mirrorPeerValue(keys[i], value, false)
+				g.countServedLocal(ctx, value)
+				errs[i] = setSinkView(dests[i], value)
+				continue
+			}
+		}
+		// Get the key on its own, as after a cache miss.
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, populated, err := g.load(ctx, keys[i], dests[i], nil)
+			if err == nil {
+				g.countServedLocal(ctx, value)
+				if !populated {
+					err = setSinkView(dests[i], value)
+				}
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+}
+
+// serveMultiConcurrency bounds how many keys of a peer's GetMulti
+// request are got at once.
+const serveMultiConcurrency = 64
+
+// serveGetMulti answers a peer's GetMulti request for keys, getting
+// them concurrently as the peer's Gets of each would be, at most
+// serveMultiConcurrency at a time.
+func (g *Group) serveGetMulti(ctx context.Context, keys []string) *pb.GetMultiResponse {
+	res := &pb.GetMultiResponse{Values: make([]*pb.GetResponse, len(keys))}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, serveMultiConcurrency)
+	for i, key := range keys {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, key string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			var view ByteView
+			info, err := g.GetWithInfo(ctx, key, ByteViewSink(&view), nil)
+			switch {
+			case errors.Is(err, ErrNotFound):
+				res.Values[i] = &pb.GetResponse{NotFound: proto.Bool(true)}
+			case errors.Is(err, ErrReadOnly):
+				res.Values[i] = &pb.GetResponse{ReadOnly: proto.Bool(true)}
+			case err != nil:
+				res.Values[i] = &pb.GetResponse{Error: proto.String(err.Error())}
+			default:
+				// The sink's view lacks the metadata if the getter
+				// populated it.
+				view.meta = info.Meta
+				g.Stats.BytesServedToPeers.Add(int64(view.Len()))
+				res.Values[i] = getResponse(view)
+			}
+		}(i, key)
+	}
+	wg.Wait()
+	return res
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetMulti(t *testing.T) {
+	peer1, peer2 := &fakePeer{}, &fakePeer{}
+	var localLoads AtomicInt
+	g := newGroupOpts("TestGetMulti-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		localLoads.Add(1)
+		if key == "missing" {
+			return ErrNotFound
+		}
+		return dest.SetString("local:"+key, time.Time{})
+	}), fakePeers{peer1, peer2, nil}, &GroupOptions{})
+
+	var keys []string
+	for i := 0; i < 30; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+	getMulti := func() []string {
+		t.Helper()
+		values := make([]string, len(keys))
+		dests := make([]Sink, len(keys))
+		for i := range keys {
+			dests[i] = StringSink(&values[i])
+		}
+		if err := g.GetMulti(dummyCtx, keys, dests); err != nil {
+			t.Fatal(err)
+		}
+		return values
+	}
+	values := getMulti()
+	local := 0
+	for i, key := range keys {
+		want := "got:" + key
+		if peer, ok := g.pickPeer(key); !ok {
+			want = "local:" + key
+			local++
+		} else if peer == nil {
+			t.Fatalf("no peer for %q", key)
+		}
+		if values[i] != want {
+			t.Errorf("GetMulti got %q for %q; want %q", values[i], key, want)
+		}
+	}
+	if peer1.hits != 1 || peer2.hits != 1 || localLoads.Get() != int64(local) {
+		t.Errorf("peer hits %d and %d, %d local loads; want 1, 1, %d", peer1.hits, peer2.hits, localLoads.Get(), local)
+	}
+	if got := g.Stats.MultiPeerRequests.Get(); got != 2 {
+		t.Errorf("MultiPeerRequests = %d; want 2", got)
+	}
+
+	// The values are cached by now.
+	getMulti()
+	if peer1.hits != 1 || peer2.hits != 1 || localLoads.Get() != int64(local) {
+		t.Errorf("peer hits %d and %d, %d local loads after a second GetMulti; want 1, 1, %d", peer1.hits, peer2.hits, localLoads.Get(), local)
+	}
+	if gets, hits := g.Stats.Gets.Get(), g.Stats.CacheHits.Get(); gets != 60 || hits != 30 {
+		t.Errorf("Gets, CacheHits = %d, %d; want 60, 30", gets, hits)
+	}
+
+	// Keys fail independently.
+	var s1, s2 string
+	err := g.GetMulti(dummyCtx, []string{"missing", "key-0"}, []Sink{StringSink(&s1), StringSink(&s2)})
+	var merr MultiError
+	if !errors.As(err, &merr) || len(merr) != 2 || !errors.Is(merr[0], ErrNotFound) || merr[1] != nil {
+		t.Errorf("GetMulti of a missing key and another = %v; want a MultiError of ErrNotFound and nil", err)
+	}
+}
+
+func TestGetMultiPeerError(t *testing.T) {
+	peer := &fakePeer{fail: true}
+	g := newGroupOpts("TestGetMultiPeerError-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("local:"+key, time.Time{})
+	}), fakePeers{peer}, &GroupOptions{})
+
+	// Keys the owner failed to return are got on their own, as after
+	// a cache miss: asked again to the peer, then loaded locally.
+	keys := []string{"a", "b"}
+	values := make([]string, len(keys))
+	if err := g.GetMulti(dummyCtx, keys, []Sink{StringSink(&values[0]), StringSink(&values[1])}); err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != "local:a" || values[1] != "local:b" {
+		t.Errorf("GetMulti = %q; want the local values", values)
+	}
+	if peer.hits != 3 {
+		t.Errorf("peer hits = %d; want 3, GetMulti then a Get per key", peer.hits)
+	}
+}
+
+func TestServeGetMultiConcurrency(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running, most int
+	)
+	g := newGroupOpts("TestServeGetMultiConcurrency-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return dest.SetString("local:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{})
+
+	keys := make([]string, 4*serveMultiConcurrency)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	res := g.serveGetMulti(dummyCtx, keys)
+	for i, v := range res.Values {
+		if got := string(v.GetValue()); got != "local:"+keys[i] {
+			t.Fatalf("value of %q = %q; want %q", keys[i], got, "local:"+keys[i])
+		}
+	}
+	if most > serveMultiConcurrency {
+		t.Errorf("%d keys got at once; want at most %d", most, serveMultiConcurrency)
+	}
+}
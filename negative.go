@@ -0,0 +1,101 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/melojustme/groupcache/lru"
+)
+
+// defaultNegativeCacheEntries is the default of
+// GroupOptions.NegativeCacheEntries.
+const defaultNegativeCacheEntries = 10000
+
+// negativeCache remembers the errors keys failed to load with, under
+// GroupOptions.NegativeTTL and GroupOptions.ErrorTTL.
+type negativeCache struct {
+	notFoundTTL, errorTTL time.Duration
+	now                   func() time.Time // for GroupOptions.Clock; time.Now if nil
+
+	mu  sync.Mutex
+	lru *lru.Cache // of error
+}
+
+func newNegativeCache(o *GroupOptions) *negativeCache {
+	c := &negativeCache{
+		notFoundTTL: o.NegativeTTL,
+		errorTTL:    o.ErrorTTL,
+		now:         o.Clock,
+		lru:         lru.New(o.NegativeCacheEntries),
+	}
+	c.lru.Now = o.Clock
+	return c
+}
+
+// get returns the error key last failed to load with, if it has not
+// expired.
+func (c *negativeCache) get(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err, ok := c.lru.Get(key); ok {
+		return err.(error)
+	}
+	return nil
+}
+
+// add remembers that key failed to load with err, if errors like err
+// are cached. Errors saying nothing of the key, such as those of
+// canceled loads and of throttled or rejected ones, never are.
+func (c *negativeCache) add(key string, err error) {
+	ttl := c.errorTTL
+	switch {
+	case errors.Is(err, ErrNotFound):
+		ttl = c.notFoundTTL
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, ErrLoadThrottled), errors.Is(err, ErrReadOnly):
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	c.lru.Add(key, err, now().Add(ttl))
+}
+
+// remove forgets any error key failed to load with.
+func (c *negativeCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Remove(key)
+}
+
+// forgetError forgets any error cached for key, as a value was stored
+// or removed for it.
+func (g *Group) forgetError(key string) {
+	if g.negative != nil {
+		g.negative.remove(g.storageKey(key))
+	}
+}
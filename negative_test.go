@@ -0,0 +1,82 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNegativeTTL(t *testing.T) {
+	errBroken := errors.New("broken")
+	loads := map[string]int{}
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads[key]++
+		if key == "broken" {
+			return errBroken
+		}
+		return ErrNotFound
+	})
+	get := func(g *Group, ctx context.Context, key string, want error) {
+		t.Helper()
+		var s string
+		if err := g.Get(ctx, key, StringSink(&s), nil); !errors.Is(err, want) {
+			t.Fatalf("Get(%q) error = %v; want %v", key, err, want)
+		}
+	}
+
+	g := newGroupOpts("TestNegativeTTL-group", cacheSize, getter, NoPeers{}, &GroupOptions{NegativeTTL: time.Hour})
+	get(g, dummyCtx, "missing", ErrNotFound)
+	get(g, dummyCtx, "missing", ErrNotFound)
+	if loads["missing"] != 1 || g.Stats.NegativeHits.Get() != 1 {
+		t.Errorf("missing key loaded %d times, %d negative hits; want 1, 1", loads["missing"], g.Stats.NegativeHits.Get())
+	}
+
+	// Refreshes load the key anyway, and Remove forgets the error.
+	get(g, WithForceRefresh(context.Background()), "missing", ErrNotFound)
+	if err := g.Remove(dummyCtx, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	get(g, dummyCtx, "missing", ErrNotFound)
+	if loads["missing"] != 3 {
+		t.Errorf("missing key loaded %d times; want 3", loads["missing"])
+	}
+
+	// Other errors are only remembered under ErrorTTL.
+	get(g, dummyCtx, "broken", errBroken)
+	get(g, dummyCtx, "broken", errBroken)
+	if loads["broken"] != 2 {
+		t.Errorf("broken key loaded %d times without ErrorTTL; want 2", loads["broken"])
+	}
+	g2 := newGroupOpts("TestNegativeTTL-errors", cacheSize, getter, NoPeers{}, &GroupOptions{ErrorTTL: time.Hour})
+	get(g2, dummyCtx, "broken", errBroken)
+	get(g2, dummyCtx, "broken", errBroken)
+	if loads["broken"] != 3 {
+		t.Errorf("broken key loaded %d times with ErrorTTL; want 3", loads["broken"])
+	}
+
+	// Remembered errors expire.
+	g3 := newGroupOpts("TestNegativeTTL-expiry", cacheSize, getter, NoPeers{}, &GroupOptions{NegativeTTL: time.Millisecond})
+	get(g3, dummyCtx, "missing", ErrNotFound)
+	time.Sleep(5 * time.Millisecond)
+	get(g3, dummyCtx, "missing", ErrNotFound)
+	if loads["missing"] != 5 {
+		t.Errorf("missing key loaded %d times; want 5", loads["missing"])
+	}
+}
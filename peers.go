@@ -29,6 +29,26 @@ type ProtoGetter interface {
 	Get(context context.Context, in *pb.GetRequest, out *pb.GetResponse) error
 	Remove(context context.Context, in *pb.GetRequest) error
 	Set(context context.Context, in *pb.SetRequest) error
+	// GetOrSet returns the value the peer holds for the key in out,
+	// after storing the value of in if it holds none. Concurrent calls
+	// for a key store only one value, which they all return. It never
+	// loads the key from the getter, but waits for a load in progress.
+	GetOrSet(context context.Context, in *pb.SetRequest, out *pb.GetResponse) error
+	// Exists reports whether the peer holds the key in its main or hot
+	// cache, without loading it.
+	Exists(context context.Context, in *pb.GetRequest) (bool, error)
+	// Checksum returns the CRC-32 (IEEE) checksum of the value the
+	// peer holds for the key in its main cache, and whether it holds
+	// one, without loading it.
+	Checksum(context context.Context, in *pb.GetRequest) (sum uint32, ok bool, err error)
+	// RemoveTag removes from the peer's caches the values stored
+	// with the tag held in the Key of in, as Group.InvalidateTag does
+	// locally.
+	RemoveTag(context context.Context, in *pb.GetRequest) error
+	// GetMulti gets the keys of in as Get would get each, returning
+	// in out a response per key, in order. A key the peer got no value
+	// for has a response telling why.
+	GetMulti(context context.Context, in *pb.GetMultiRequest, out *pb.GetMultiResponse) error
 	// GetURL returns the peer URL
 	GetURL() string
 }
@@ -44,12 +64,128 @@ type PeerPicker interface {
 	GetAll() []ProtoGetter
 }
 
+// ClientPeerPicker is implemented by a PeerPicker that can pick peers
+// for a process that is not one of them, such as the HTTPPool returned
+// by NewHTTPClient. Groups whose picker is a client keep no main
+// cache.
+type ClientPeerPicker interface {
+	// IsClient reports whether the current process owns no keys.
+	IsClient() bool
+}
+
+// BackupPeerPicker is implemented by a PeerPicker that can nominate
+// another peer to fetch a key from when fetching it from the peer
+// returned by PickPeer failed.
+type BackupPeerPicker interface {
+	// PickBackupPeer returns a peer other than failed to fetch key
+	// from, and true to indicate that such a peer was nominated.
+	PickBackupPeer(key string, failed ProtoGetter) (peer ProtoGetter, ok bool)
+}
+
+// ReplicaPeerPicker is implemented by a PeerPicker that can spread
+// reads of a key over several peers, as used by
+// GroupOptions.ReadReplicas.
+type ReplicaPeerPicker interface {
+	// PickReplicaPeer returns one of the first n peers for key in the
+	// picker's order of ownership, the owner among them, and true to
+	// indicate that a remote peer was nominated. It returns nil, false
+	// if it nominated the current peer.
+	PickReplicaPeer(key string, n int) (peer ProtoGetter, ok bool)
+}
+
+// OwnersPeerPicker is implemented by a PeerPicker that can make
+// several peers own a key, as used by GroupOptions.Replication.
+type OwnersPeerPicker interface {
+	// PickOwners returns the first n peers for key in the picker's
+	// order of ownership, the owner returned by PickPeer first. The
+	// current peer, if among them, is returned as nil.
+	PickOwners(key string, n int) []ProtoGetter
+}
+
+// RingPeerPicker is implemented by a PeerPicker placing keys on a
+// consistent hash ring, such as HTTPPool and GRPCPool, to inspect the
+// ring, for example to check its balance after changing the peers.
+type RingPeerPicker interface {
+	// WhoOwns returns the name of the peer owning key on the ring,
+	// the current peer included, or "" if the ring is empty.
+	WhoOwns(key string) string
+	// RingState describes the ring and the share of it each peer owns.
+	RingState() RingState
+}
+
 // NoPeers is an implementation of PeerPicker that never finds a peer.
 type NoPeers struct{}
 
 func (NoPeers) PickPeer(key string) (peer ProtoGetter, ok bool) { return }
 func (NoPeers) GetAll() []ProtoGetter                           { return []ProtoGetter{} }
 
+// peerHopsKey is the context key under which the number of peer hops
+// of an incoming peer request is stored.
+type peerHopsKey struct{}
+
+// withPeerHops returns a copy of ctx recording that the request has
+// already been forwarded between peers hops times.
+func withPeerHops(ctx context.Context, hops int) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, peerHopsKey{}, hops)
+}
+
+// peerHops returns the number of peer hops recorded in ctx, or 0 if the
+// request did not originate from a peer.
+func peerHops(ctx context.Context) int {
+	if ctx == nil {
+		return 0
+	}
+	hops, _ := ctx.Value(peerHopsKey{}).(int)
+	return hops
+}
+
+// replicaReadKey is the context key marking a request as a read
+// routed to a replica of the key by GroupOptions.ReadReplicas.
+type replicaReadKey struct{}
+
+// withReplicaRead returns a copy of ctx marking, or unmarking, the
+// requests made with it as replica reads.
+func withReplicaRead(ctx context.Context, on bool) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, replicaReadKey{}, on)
+}
+
+// replicaRead reports whether ctx is marked as a replica read.
+func replicaRead(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	on, _ := ctx.Value(replicaReadKey{}).(bool)
+	return on
+}
+
+// ownerFetchKey is the context key marking a request as made by an
+// owner of the key to another owner under GroupOptions.Replication.
+type ownerFetchKey struct{}
+
+// withOwnerFetch returns a copy of ctx marking the requests made with
+// it as owner fetches.
+func withOwnerFetch(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, ownerFetchKey{}, true)
+}
+
+// ownerFetch reports whether ctx is marked as an owner fetch.
+func ownerFetch(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	on, _ := ctx.Value(ownerFetchKey{}).(bool)
+	return on
+}
+
 var (
 	portPicker func(groupName string) PeerPicker
 )
@@ -0,0 +1,85 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/melojustme/groupcache/groupcachepb"
+)
+
+// PrefetchOptions are the options of Group.Prefetch.
+type PrefetchOptions struct {
+	// Concurrency is the number of keys loaded at once.
+	// If zero, it defaults to 1.
+	Concurrency int
+
+	// QPS limits the keys whose loads Prefetch starts per second, with
+	// bursts of up to Burst keys. If zero, the rate is not limited.
+	QPS float64
+
+	// Burst is the number of keys whose loads Prefetch may start at
+	// once under QPS. If zero, it defaults to QPS rounded up.
+	Burst int
+
+	// Progress, if non-nil, is called as by Group.WarmWithProgress.
+	Progress func(done, total int)
+}
+
+// Prefetch loads each of keys into the cache of the peer owning it,
+// ahead of the traffic for it: for example, keys read from an access
+// log, before a new cluster starts serving. Unlike Warm, which gets
+// each key, Prefetch asks the owners of remote keys to load them
+// without sending the values back, so that neither the network nor
+// this process's hot cache carries them. Keys this process owns are
+// loaded as Get loads them.
+//
+// Prefetch stops starting new loads once ctx is done and then returns
+// ctx.Err(). Otherwise, if any keys fail to load, it returns a
+// *WarmError describing every failure. opts may be nil.
+func (g *Group) Prefetch(ctx context.Context, keys []string, opts *PrefetchOptions) error {
+	if opts == nil {
+		opts = &PrefetchOptions{}
+	}
+	var limiter *rateLimiter
+	if opts.QPS > 0 {
+		limiter = newRateLimiter(opts.QPS, opts.Burst)
+	}
+	return g.forKeys(ctx, keys, opts.Concurrency, limiter, opts.Progress, g.prefetch)
+}
+
+// prefetch loads key into its owner's cache.
+func (g *Group) prefetch(ctx context.Context, key string) error {
+	g.peersOnce.Do(g.initPeers)
+	owner, ok := g.pickPeer(key)
+	if !ok {
+		var value ByteView
+		return g.Get(ctx, key, ByteViewSink(&value), nil)
+	}
+	req := &pb.GetRequest{
+		Group:      &g.name,
+		Key:        &key,
+		Generation: g.peerGeneration(),
+		Populate:   proto.Bool(true),
+	}
+	g.Stats.PeerPopulates.Add(1)
+	if err := owner.Get(ctx, req, &pb.GetResponse{}); err != nil {
+		return &PeerError{Peer: owner, Err: err}
+	}
+	return nil
+}
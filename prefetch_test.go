@@ -0,0 +1,104 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrefetch(t *testing.T) {
+	var ownerLoads, clientLoads AtomicInt
+	owner := newGroup("TestPrefetch-owner", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		ownerLoads.Add(1)
+		if key == "remote-fail" {
+			return errors.New("failed load")
+		}
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", nil)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	peer := &renamingGetter{ProtoGetter: &httpGetter{baseURL: ts.URL + defaultBasePath, codec: ProtoCodec{}}, group: owner.Name()}
+	client := newGroup("TestPrefetch-client", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		clientLoads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	}), prefixPeers{peer})
+
+	var progress AtomicInt
+	keys := []string{"remote-a", "remote-b", "local-c"}
+	if err := client.Prefetch(context.Background(), keys, &PrefetchOptions{
+		Concurrency: 2,
+		Progress:    func(done, total int) { progress.Add(1) },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ownerLoads.Get() != 2 || clientLoads.Get() != 1 {
+		t.Errorf("owner loaded %d keys, client %d; want 2 and 1", ownerLoads.Get(), clientLoads.Get())
+	}
+	for _, key := range []string{"remote-a", "remote-b"} {
+		if _, ok := owner.Contains(key); !ok {
+			t.Errorf("owner does not hold %q after Prefetch", key)
+		}
+		if _, ok := client.Contains(key); ok {
+			t.Errorf("client holds %q after Prefetch; want it left to the owner", key)
+		}
+	}
+	if _, ok := client.Contains("local-c"); !ok {
+		t.Errorf("client does not hold its own key after Prefetch")
+	}
+	if got := owner.Stats.BytesServedToPeers.Get(); got != 0 {
+		t.Errorf("owner served %d bytes; want none", got)
+	}
+	if got := client.Stats.PeerPopulates.Get(); got != 2 {
+		t.Errorf("PeerPopulates = %d; want 2", got)
+	}
+	if got := progress.Get(); got != 3 {
+		t.Errorf("progress called %d times; want 3", got)
+	}
+
+	err := client.Prefetch(context.Background(), []string{"remote-a", "remote-fail"}, nil)
+	var werr *WarmError
+	if !errors.As(err, &werr) || len(werr.Errors) != 1 || werr.Errors["remote-fail"] == nil {
+		t.Errorf("Prefetch of a failing key = %v; want a WarmError for it", err)
+	}
+}
+
+func TestPrefetchQPS(t *testing.T) {
+	g := newGroup("TestPrefetchQPS-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(key, time.Time{})
+	}), NoPeers{})
+	keys := []string{"a", "b", "c", "d", "e"}
+	start := time.Now()
+	if err := g.Prefetch(context.Background(), keys, &PrefetchOptions{Concurrency: 5, QPS: 100, Burst: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// The first key takes the burst, the next four wait 10ms each.
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("Prefetch of 5 keys at 100 QPS took %v; want about 40ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := g.Prefetch(ctx, []string{"f"}, &PrefetchOptions{QPS: 1}); err != context.Canceled {
+		t.Errorf("Prefetch with a canceled context = %v; want %v", err, context.Canceled)
+	}
+}
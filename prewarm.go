@@ -0,0 +1,171 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/melojustme/groupcache/consistenthash"
+
+	"github.com/sirupsen/logrus"
+)
+
+// prewarmPath is the first path element, in place of a group name, of
+// the requests sent by PrewarmFrom.
+const prewarmPath = "_prewarm"
+
+// defaultMaxPrewarmBytes is the default HTTPPoolOptions.MaxPrewarmBytes.
+const defaultMaxPrewarmBytes = 64 << 20
+
+var errPrewarmTooLarge = errors.New("groupcache: prewarm response exceeds MaxPrewarmBytes")
+
+// PrewarmFrom fills the main cache of each registered group with the
+// keys that peer holds in its main cache and that fall within ranges
+// of the consistent hash, typically the ranges this process is about
+// to take over from peer, as returned by consistenthash.Diff. It is
+// meant to be called by a joining process before it starts serving,
+// so that the keys it takes over are not all loaded again.
+//
+// peer is one of the peers given to Set. At most
+// HTTPPoolOptions.MaxPrewarmBytes of values are transferred for each
+// group: peer leaves out the entries beyond the limit, and PrewarmFrom
+// fails if peer sends more. PrewarmFrom stops once ctx is done.
+func (p *HTTPPool) PrewarmFrom(ctx context.Context, peer string, ranges []consistenthash.RangeMove) error {
+	h := p.current().getters[peer]
+	if h == nil {
+		return fmt.Errorf("groupcache: unknown peer %q", peer)
+	}
+	for _, g := range GetGroups() {
+		if err := p.prewarmGroup(ctx, h, g.Name(), g, ranges); err != nil {
+			return fmt.Errorf("groupcache: prewarming group %q: %w", g.Name(), err)
+		}
+	}
+	return nil
+}
+
+// prewarmGroup fills g with the keys of group remote held by h.
+func (p *HTTPPool) prewarmGroup(ctx context.Context, h *httpGetter, remote string, g *Group, ranges []consistenthash.RangeMove) error {
+	u := h.baseURL + prewarmPath + "/" + url.PathEscape(remote) + "?ranges=" + formatRanges(ranges)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	h.modify(ctx, req)
+	res, err := h.transport(ctx).RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+
+	_, err = p.fillPrewarmed(g, res.Body)
+	return err
+}
+
+// fillPrewarmed fills the main cache of g with the entries of the
+// snapshot read from r, returning how many it stored. It gives up once
+// their values take more than HTTPPoolOptions.MaxPrewarmBytes.
+func (p *HTTPPool) fillPrewarmed(g *Group, r io.Reader) (n int, err error) {
+	var total int64
+	_, err = readSnapshot(r, nil, func(e SnapshotEntry) error {
+		if total += int64(e.Size); total > p.opts.MaxPrewarmBytes {
+			return errPrewarmTooLarge
+		}
+		value := ByteView{b: e.Value, e: e.Expire}
+		if g.cacheLimit() > 0 && !value.expired() {
+			g.populateStorageKey(e.Key, value, &g.mainCache)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// servePrewarm answers a request sent by PrewarmFrom for the keys of
+// groupName.
+func (p *HTTPPool) servePrewarm(w http.ResponseWriter, r *http.Request, groupName string) {
+	group := GetGroup(groupName)
+	if group == nil {
+		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		return
+	}
+	ranges, err := parseRanges(r.URL.Query().Get("ranges"))
+	if err != nil {
+		http.Error(w, "bad ranges: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ring := p.current().ring
+	keep := func(key string) bool {
+		hash := ring.KeyHash(group.routingKey(key))
+		for _, r := range ranges {
+			if r.Contains(hash) {
+				return true
+			}
+		}
+		return false
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	err = group.exportGzip(r.Context(), w, false, keep, p.opts.MaxPrewarmBytes)
+	if log := p.logger(); err != nil && log != nil {
+		log.WithFields(logrus.Fields{
+			"err":      err,
+			"group":    groupName,
+			"category": "groupcache",
+		}).Errorf("error serving prewarm request")
+	}
+}
+
+// formatRanges encodes ranges as comma-separated start-end pairs.
+func formatRanges(ranges []consistenthash.RangeMove) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = strconv.FormatUint(r.Start, 10) + "-" + strconv.FormatUint(r.End, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseRanges(s string) ([]consistenthash.RangeMove, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ranges []consistenthash.RangeMove
+	for _, part := range strings.Split(s, ",") {
+		i := strings.IndexByte(part, '-')
+		if i < 0 {
+			return nil, fmt.Errorf("range %q has no end", part)
+		}
+		start, err := strconv.ParseUint(part[:i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.ParseUint(part[i+1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, consistenthash.RangeMove{Start: start, End: end})
+	}
+	return ranges, nil
+}
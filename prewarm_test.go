@@ -0,0 +1,126 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/melojustme/groupcache/consistenthash"
+)
+
+// prewarmPeers returns an owner group holding n keys, served by an
+// HTTPPool with opts, and the ranges of the ring that a peer named
+// "http://joiner" takes over from it, along with the keys in them.
+func prewarmPeers(t *testing.T, name string, n int, opts *HTTPPoolOptions) (owner *Group, url string, ranges []consistenthash.RangeMove, moved map[string]bool) {
+	owner = newGroup(name+"-owner", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	for i := 0; i < n; i++ {
+		var s string
+		if err := owner.Get(dummyCtx, fmt.Sprint(i), StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(newHTTPPool("http://owner", opts))
+	t.Cleanup(ts.Close)
+
+	before, after := consistenthash.New(defaultReplicas, nil), consistenthash.New(defaultReplicas, nil)
+	before.Add(ts.URL)
+	after.Add(ts.URL, "http://joiner")
+	for _, m := range consistenthash.Diff(before.Snapshot(), after.Snapshot()) {
+		if m.To == "http://joiner" {
+			ranges = append(ranges, m)
+		}
+	}
+	moved = make(map[string]bool)
+	for i := 0; i < n; i++ {
+		if key := fmt.Sprint(i); after.Get(key) == "http://joiner" {
+			moved[key] = true
+		}
+	}
+	if len(moved) == 0 || len(moved) == n {
+		t.Fatalf("joiner takes over %d of %d keys; want some", len(moved), n)
+	}
+	return owner, ts.URL, ranges, moved
+}
+
+func TestPrewarm(t *testing.T) {
+	owner, url, ranges, moved := prewarmPeers(t, "TestPrewarm", 100, nil)
+	joiner := newGroup("TestPrewarm-joiner", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected load")
+	}), NoPeers{})
+	p := newHTTPPool("http://joiner", nil)
+	p.Set("http://joiner", url)
+
+	if err := p.prewarmGroup(context.Background(), p.current().getters[url], owner.Name(), joiner, ranges); err != nil {
+		t.Fatal(err)
+	}
+	if got := joiner.mainCache.items(); got != int64(len(moved)) {
+		t.Errorf("joiner holds %d keys; want the %d it took over", got, len(moved))
+	}
+	for key := range moved {
+		var s string
+		if err := joiner.Get(dummyCtx, key, StringSink(&s), nil); err != nil || s != "value:"+key {
+			t.Errorf("joiner Get(%q) = %q, %v; want the owner's value", key, s, err)
+		}
+	}
+
+	if err := p.PrewarmFrom(context.Background(), "http://stranger", ranges); err == nil {
+		t.Error("PrewarmFrom an unknown peer succeeded")
+	}
+}
+
+func TestPrewarmLimits(t *testing.T) {
+	const valueBytes = len("value:00")
+	owner, url, ranges, moved := prewarmPeers(t, "TestPrewarmLimits", 100, &HTTPPoolOptions{MaxPrewarmBytes: 3 * int64(valueBytes)})
+	joiner := newGroup("TestPrewarmLimits-joiner", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return errors.New("unexpected load")
+	}), NoPeers{})
+	if len(moved) < 4 {
+		t.Fatalf("joiner takes over %d keys; want more than the limit", len(moved))
+	}
+
+	// The owner leaves out the entries beyond its own limit.
+	p := newHTTPPool("http://joiner", nil)
+	p.Set("http://joiner", url)
+	h := p.current().getters[url]
+	if err := p.prewarmGroup(context.Background(), h, owner.Name(), joiner, ranges); err != nil {
+		t.Fatal(err)
+	}
+	if got := joiner.mainCache.items(); got == 0 || got > 3 {
+		t.Errorf("joiner holds %d keys; want 1 to 3", got)
+	}
+
+	// The joiner refuses more than its limit.
+	small := newHTTPPool("http://joiner", &HTTPPoolOptions{MaxPrewarmBytes: int64(valueBytes)})
+	small.Set("http://joiner", url)
+	err := small.prewarmGroup(context.Background(), small.current().getters[url], owner.Name(), joiner, ranges)
+	if err != errPrewarmTooLarge {
+		t.Errorf("prewarm beyond MaxPrewarmBytes error = %v; want %v", err, errPrewarmTooLarge)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.prewarmGroup(ctx, h, owner.Name(), joiner, ranges); !errors.Is(err, context.Canceled) {
+		t.Errorf("prewarm with a cancelled context error = %v; want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// refreshAhead reloads key in the background if value, just served
+// from the main cache, has less than GroupOptions.RefreshAhead of its
+// lifetime left. Hits meanwhile keep being served the current value,
+// and start no other reload.
+func (g *Group) refreshAhead(key string, value ByteView) {
+	if g.opts.RefreshAhead <= 0 || value.e.IsZero() || value.stored == 0 {
+		return
+	}
+	expire := value.e.UnixNano()
+	left := expire - g.clock().UnixNano()
+	if float64(left) >= g.opts.RefreshAhead*float64(expire-value.stored) {
+		return
+	}
+	if _, busy := g.refreshing.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	g.Stats.RefreshAheads.Add(1)
+	go func() {
+		defer g.refreshing.Delete(key)
+		var v ByteView
+		_, _, err := g.load(WithForceRefresh(context.Background()), key, ByteViewSink(&v), nil)
+		if log := g.logger(); err != nil && log != nil {
+			log.WithFields(logrus.Fields{
+				"err":      err,
+				"key":      key,
+				"category": "groupcache",
+			}).Warnf("error refreshing key ahead of its expiry")
+		}
+	}()
+}
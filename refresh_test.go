@@ -0,0 +1,77 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRefreshAhead(t *testing.T) {
+	var loads AtomicInt
+	release := make(chan struct{})
+	g := newGroupOpts("TestRefreshAhead-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		if loads.Add(1); loads.Get() > 1 {
+			<-release
+		}
+		return dest.SetString(fmt.Sprintf("v%d", loads.Get()), time.Now().Add(time.Hour))
+	}), NoPeers{}, &GroupOptions{RefreshAhead: 0.2})
+	start := time.Now()
+	var elapsed AtomicInt
+	g.now = func() time.Time { return start.Add(time.Duration(elapsed.Get())) }
+
+	get := func(want string) {
+		t.Helper()
+		var s string
+		if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil || s != want {
+			t.Fatalf("Get = %q, %v; want %q", s, err, want)
+		}
+	}
+	get("v1")
+	elapsed.Store(int64(30 * time.Minute))
+	get("v1")
+	if got := g.Stats.RefreshAheads.Get(); got != 0 {
+		t.Fatalf("RefreshAheads = %d halfway through the value's lifetime; want 0", got)
+	}
+
+	// Near expiry, hits are served the current value while a single
+	// reload runs.
+	elapsed.Store(int64(50 * time.Minute))
+	get("v1")
+	get("v1")
+	if got := g.Stats.RefreshAheads.Get(); got != 1 {
+		t.Errorf("RefreshAheads = %d; want 1", got)
+	}
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		var s string
+		if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if s == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Get = %q after the reload; want v2", s)
+		}
+	}
+	if got := loads.Get(); got != 2 {
+		t.Errorf("getter loads = %d; want 2", got)
+	}
+}
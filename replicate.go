@@ -0,0 +1,129 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pickOwners returns the owners of key under GroupOptions.Replication,
+// nil standing for this process, and whether this process is one of
+// them. It returns no owners unless keys are replicated.
+func (g *Group) pickOwners(key string) (owners []ProtoGetter, self bool) {
+	if g.opts.Replication <= 1 {
+		return nil, false
+	}
+	op, ok := g.peers.(OwnersPeerPicker)
+	if !ok {
+		return nil, false
+	}
+	owners = op.PickOwners(g.routingKey(g.storageKey(key)), g.opts.Replication)
+	for _, peer := range owners {
+		if peer == nil {
+			self = true
+		}
+	}
+	return owners, self
+}
+
+// loadFromOwners fetches key from its owners, in order. If self is
+// set, this process owns the key too and only asks the others for
+// their cached copy, keeping the one it gets in its main cache.
+// Otherwise it asks them for the key as it would ask the owner of a
+// key that is not replicated, failing if they all fail under
+// GroupOptions.StrictOwnership. done reports whether value was
+// fetched; if neither it nor err is set, the key is to be loaded
+// locally.
+func (g *Group) loadFromOwners(ctx context.Context, key string, owners []ProtoGetter, self bool) (value ByteView, done bool, err error) {
+	fetchCtx := ctx
+	if self {
+		fetchCtx = withOwnerFetch(ctx)
+	}
+	var failed error
+	for _, peer := range owners {
+		if peer == nil {
+			continue
+		}
+		if self {
+			value, err = g.fetchFromPeer(fetchCtx, peer, key)
+		} else {
+			value, err = g.getFromPeer(fetchCtx, peer, key, false)
+		}
+		if err == nil {
+			g.Stats.PeerLoads.Add(1)
+			if self {
+				g.Stats.OwnerLoads.Add(1)
+				g.populateCache(key, value, &g.mainCache)
+			}
+			return value, true, nil
+		}
+		switch {
+		case errors.Is(err, context.Canceled):
+			return ByteView{}, false, err
+		case errors.Is(err, ErrNotFound) && self:
+			// The owner does not hold the key.
+			continue
+		case errors.Is(err, ErrNotFound), errors.Is(err, ErrReadOnly):
+			return ByteView{}, false, err
+		}
+		if log := g.logger(); log != nil {
+			log.WithFields(logrus.Fields{
+				"err":      err,
+				"key":      key,
+				"category": "groupcache",
+			}).Errorf("error retrieving key from owner '%s'", peer.GetURL())
+		}
+		g.Stats.PeerErrors.Add(1)
+		if ctx != nil && ctx.Err() != nil {
+			return ByteView{}, false, err
+		}
+		failed = err
+	}
+	if failed != nil && !self && g.opts.StrictOwnership {
+		g.Stats.PeerFallbackRejects.Add(1)
+		return ByteView{}, false, &ownerUnavailableError{failed}
+	}
+	return ByteView{}, false, nil
+}
+
+// pushToOwners stores value, just loaded from the getter, on the other
+// owners of key in the background.
+func (g *Group) pushToOwners(key string, value ByteView, owners []ProtoGetter) {
+	for _, peer := range owners {
+		if peer == nil {
+			continue
+		}
+		go func(peer ProtoGetter) {
+			err := g.setFromPeer(context.Background(), peer, key, value.ByteSlice(), value.Expire(), value.tags)
+			if err != nil {
+				if log := g.logger(); log != nil {
+					log.WithFields(logrus.Fields{
+						"err":      err,
+						"key":      key,
+						"category": "groupcache",
+					}).Errorf("error storing key on owner '%s'", peer.GetURL())
+				}
+				g.Stats.PeerErrors.Add(1)
+				return
+			}
+			g.Stats.OwnerPushes.Add(1)
+		}(peer)
+	}
+}
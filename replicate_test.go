@@ -0,0 +1,145 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+)
+
+// groupPeer serves the Gets and Sets of a peer with a group of this
+// process, as HTTPPool.ServeHTTP would.
+type groupPeer struct {
+	fakePeer
+	group *Group
+	down  bool
+}
+
+func (p *groupPeer) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	if p.down {
+		return errors.New("peer down")
+	}
+	serveCtx := withPeerHops(context.Background(), peerHops(ctx)+1)
+	if ownerFetch(ctx) {
+		serveCtx = withOwnerFetch(serveCtx)
+	}
+	var v ByteView
+	if err := p.group.Get(serveCtx, in.GetKey(), ByteViewSink(&v), nil); err != nil {
+		return err
+	}
+	out.Value = v.ByteSlice()
+	return nil
+}
+
+func (p *groupPeer) Set(ctx context.Context, in *pb.SetRequest) error {
+	p.group.localSetTagged(in.GetKey(), in.Value, time.Time{}, in.Tags, &p.group.mainCache)
+	return nil
+}
+
+// ownersPeers is an OwnersPeerPicker making its peers own every key,
+// in order, nil standing for the current peer.
+type ownersPeers []ProtoGetter
+
+func (p ownersPeers) PickPeer(key string) (ProtoGetter, bool) { return p[0], p[0] != nil }
+
+func (p ownersPeers) GetAll() []ProtoGetter {
+	var all []ProtoGetter
+	for _, peer := range p {
+		if peer != nil {
+			all = append(all, peer)
+		}
+	}
+	return all
+}
+
+func (p ownersPeers) PickOwners(key string, n int) []ProtoGetter { return p }
+
+func TestReplication(t *testing.T) {
+	var loads int64
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		atomic.AddInt64(&loads, 1)
+		return dest.SetString("value:"+key, time.Time{})
+	})
+	opts := &GroupOptions{Replication: 3}
+	peerA, peerB, peerC := &groupPeer{}, &groupPeer{}, &groupPeer{}
+	peerA.group = newGroupOpts("TestReplication-a", cacheSize, getter, ownersPeers{nil, peerB, peerC}, opts)
+	peerB.group = newGroupOpts("TestReplication-b", cacheSize, getter, ownersPeers{peerA, nil, peerC}, opts)
+	peerC.group = newGroupOpts("TestReplication-c", cacheSize, getter, ownersPeers{peerA, peerB, nil}, opts)
+	owners := ownersPeers{peerA, peerB, peerC}
+
+	get := func(client, key string) *Group {
+		t.Helper()
+		g := newGroupOpts("TestReplication-"+client, cacheSize, getter, owners, opts)
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil || s != "value:"+key {
+			t.Fatalf("Get(%q) from %s = %q, %v; want %q", key, client, s, err, "value:"+key)
+		}
+		return g
+	}
+	waitPushes := func(g *Group, want int64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); g.Stats.OwnerPushes.Get() < want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("OwnerPushes = %d; want %d", g.Stats.OwnerPushes.Get(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	held := func(g *Group, key string) {
+		t.Helper()
+		if which, ok := g.Contains(key); !ok || which != MainCache {
+			t.Errorf("%s: Contains(%q) = %v, %v; want MainCache, true", g.Name(), key, which, ok)
+		}
+	}
+
+	// The first owner loads the key, none of the others holding it,
+	// and stores it on them.
+	get("client1", "key")
+	waitPushes(peerA.group, 2)
+	held(peerB.group, "key")
+	held(peerC.group, "key")
+
+	// Restarted with empty caches, it fetches the key from another
+	// owner rather than loading it again.
+	peerA.group = newGroupOpts("TestReplication-a2", cacheSize, getter, ownersPeers{nil, peerB, peerC}, opts)
+	get("client2", "key")
+	held(peerA.group, "key")
+	if got := peerA.group.Stats.OwnerLoads.Get(); got != 1 {
+		t.Errorf("OwnerLoads = %d; want 1", got)
+	}
+	if got := atomic.LoadInt64(&loads); got != 1 {
+		t.Errorf("getter loads = %d; want 1", got)
+	}
+
+	// With the first owner down, Gets move on to the next one.
+	peerA.down = true
+	client := get("client3", "other")
+	if got := client.Stats.PeerErrors.Get(); got != 1 {
+		t.Errorf("client PeerErrors = %d; want 1", got)
+	}
+	waitPushes(peerB.group, 2)
+	held(peerA.group, "other")
+	held(peerC.group, "other")
+	if got := atomic.LoadInt64(&loads); got != 2 {
+		t.Errorf("getter loads = %d; want 2", got)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures the retries made by a RetryingGetter.
+type RetryPolicy struct {
+	// MaxAttempts specifies the maximum number of calls to the inner
+	// Getter, including the first one.
+	// If zero, it defaults to 3.
+	MaxAttempts int
+
+	// Backoff specifies the delay before retry number attempt, counting
+	// from 1.
+	// If nil, the delay starts at 10ms and doubles with each retry, up
+	// to one second.
+	Backoff func(attempt int) time.Duration
+
+	// Retryable reports whether a call that failed with err should be
+	// retried.
+	// If nil, every error other than ErrNotFound or a context error
+	// is retried.
+	Retryable func(err error) bool
+}
+
+const defaultMaxAttempts = 3
+
+func defaultBackoff(attempt int) time.Duration {
+	d := 10 * time.Millisecond << uint(attempt-1)
+	if d > time.Second || d <= 0 {
+		d = time.Second
+	}
+	return d
+}
+
+func defaultRetryable(err error) bool {
+	return !isContextError(err) && !errors.Is(err, ErrNotFound)
+}
+
+// isContextError reports whether err is, or wraps, the error of a
+// done context.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// RetryingGetter returns a Getter that calls inner, retrying failed
+// calls according to policy. It never waits past the deadline of the
+// context passed to Get: if the context is done, or would be done
+// before the next retry is due, the last error is returned instead.
+func RetryingGetter(inner Getter, policy RetryPolicy) Getter {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultMaxAttempts
+	}
+	if policy.Backoff == nil {
+		policy.Backoff = defaultBackoff
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = defaultRetryable
+	}
+	return GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		var err error
+		for attempt := 1; ; attempt++ {
+			err = inner.Get(ctx, key, dest, fixFunc)
+			if err == nil || attempt >= policy.MaxAttempts || !policy.Retryable(err) {
+				return err
+			}
+			if !waitRetry(ctx, policy.Backoff(attempt)) || ctx.Err() != nil {
+				return err
+			}
+		}
+	})
+}
+
+// waitRetry waits for delay to elapse or ctx, which may be nil, to be
+// done. It returns false without waiting if ctx would be done before
+// delay elapses.
+func waitRetry(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	if ctx == nil {
+		time.Sleep(delay)
+		return true
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+	}
+	return true
+}
+
+// JitteredBackoff returns a backoff for a RetryPolicy or a
+// PeerRetryPolicy whose delay starts at base and doubles with each
+// retry, up to max. Each delay is then cut by up to half at random, so
+// that the retries of loads that failed together spread out.
+func JitteredBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base << uint(attempt-1)
+		if d > max || d <= 0 {
+			d = max
+		}
+		if half := int64(d / 2); half > 0 {
+			d -= time.Duration(rand.Int63n(half + 1))
+		}
+		return d
+	}
+}
+
+// PeerRetryPolicy configures what a load does once fetching a key from
+// the peer owning it failed, as set by GroupOptions.PeerRetry.
+type PeerRetryPolicy struct {
+	// Retries specifies how many backup peers to ask for the key, one
+	// after another, once the owner failed. Backup peers are picked by
+	// the PeerPicker if it is a BackupPeerPicker, such as an HTTPPool
+	// with HTTPPoolOptions.BackupPeers set; the retries end early if
+	// it nominates none.
+	Retries int
+
+	// Backoff specifies the delay before retry number attempt,
+	// counting from 1. A load never waits past the deadline of its
+	// context: it loads the key locally instead.
+	// If nil, it defaults to JitteredBackoff(10ms, time.Second).
+	Backoff func(attempt int) time.Duration
+
+	// NoLocalLoad, if true, makes the load fail with the error of the
+	// last peer asked instead of loading the key from the group's
+	// getter once the retries are exhausted, for origins that must
+	// only be loaded by the owner of a key.
+	NoLocalLoad bool
+}
+
+// defaultPeerRetry is the policy of loads of groups without a
+// GroupOptions.PeerRetry: a backup peer gets a single chance, at once.
+var defaultPeerRetry = PeerRetryPolicy{Retries: 1}
+
+func newPeerRetry(o *PeerRetryPolicy) PeerRetryPolicy {
+	if o == nil {
+		return defaultPeerRetry
+	}
+	policy := *o
+	if policy.Backoff == nil {
+		policy.Backoff = JitteredBackoff(10*time.Millisecond, time.Second)
+	}
+	return policy
+}
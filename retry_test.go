@@ -0,0 +1,269 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// flakyGetter fails the first failures calls, then succeeds.
+type flakyGetter struct {
+	failures int
+	calls    int
+}
+
+var errFlaky = errors.New("flaky origin")
+
+func (g *flakyGetter) Get(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+	g.calls++
+	if g.calls <= g.failures {
+		return errFlaky
+	}
+	return dest.SetString("retried:"+key, time.Time{})
+}
+
+func noBackoff(int) time.Duration { return 0 }
+
+func TestRetryingGetterSucceeds(t *testing.T) {
+	inner := &flakyGetter{failures: 2}
+	getter := RetryingGetter(inner, RetryPolicy{MaxAttempts: 3, Backoff: noBackoff})
+
+	var s string
+	if err := getter.Get(context.Background(), "key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s != "retried:key" {
+		t.Errorf("Get = %q; want %q", s, "retried:key")
+	}
+	if inner.calls != 3 {
+		t.Errorf("inner getter called %d times; want 3", inner.calls)
+	}
+}
+
+func TestRetryingGetterExhausted(t *testing.T) {
+	inner := &flakyGetter{failures: 10}
+	getter := RetryingGetter(inner, RetryPolicy{MaxAttempts: 4, Backoff: noBackoff})
+
+	var s string
+	if err := getter.Get(context.Background(), "key", StringSink(&s), nil); err != errFlaky {
+		t.Errorf("Get error = %v; want %v", err, errFlaky)
+	}
+	if inner.calls != 4 {
+		t.Errorf("inner getter called %d times; want 4", inner.calls)
+	}
+}
+
+func TestRetryingGetterNotRetryable(t *testing.T) {
+	inner := &flakyGetter{failures: 10}
+	getter := RetryingGetter(inner, RetryPolicy{
+		MaxAttempts: 4,
+		Backoff:     noBackoff,
+		Retryable:   func(err error) bool { return err != errFlaky },
+	})
+
+	var s string
+	if err := getter.Get(context.Background(), "key", StringSink(&s), nil); err != errFlaky {
+		t.Errorf("Get error = %v; want %v", err, errFlaky)
+	}
+	if inner.calls != 1 {
+		t.Errorf("inner getter called %d times; want 1", inner.calls)
+	}
+}
+
+func TestRetryingGetterDeadline(t *testing.T) {
+	inner := &flakyGetter{failures: 10}
+	getter := RetryingGetter(inner, RetryPolicy{
+		MaxAttempts: 10,
+		Backoff:     func(int) time.Duration { return time.Second },
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var s string
+	if err := getter.Get(ctx, "key", StringSink(&s), nil); err != errFlaky {
+		t.Errorf("Get error = %v; want %v", err, errFlaky)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Get took %v; want it to give up before the deadline", elapsed)
+	}
+	if inner.calls != 1 {
+		t.Errorf("inner getter called %d times; want 1", inner.calls)
+	}
+}
+
+func TestRetryingGetterWrappedContextError(t *testing.T) {
+	var calls int
+	inner := GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		calls++
+		return fmt.Errorf("fetch: %w", context.DeadlineExceeded)
+	})
+	getter := RetryingGetter(inner, RetryPolicy{MaxAttempts: 4, Backoff: noBackoff})
+
+	var s string
+	if err := getter.Get(context.Background(), "key", StringSink(&s), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get error = %v; want a wrapped %v", err, context.DeadlineExceeded)
+	}
+	if calls != 1 {
+		t.Errorf("inner getter called %d times; want 1", calls)
+	}
+}
+
+// backupChain picks its first peer for every key, and the peer
+// following failed as its backup peer.
+type backupChain []ProtoGetter
+
+func (p backupChain) PickPeer(key string) (ProtoGetter, bool) { return p[0], true }
+func (p backupChain) GetAll() []ProtoGetter                   { return p }
+
+func (p backupChain) PickBackupPeer(key string, failed ProtoGetter) (ProtoGetter, bool) {
+	for i, peer := range p {
+		if peer == failed && i+1 < len(p) {
+			return p[i+1], true
+		}
+	}
+	return nil, false
+}
+
+func TestPeerRetry(t *testing.T) {
+	var localLoads int
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		localLoads++
+		return dest.SetString("local:"+key, time.Time{})
+	})
+	newPeers := func() backupChain {
+		return backupChain{&fakePeer{fail: true}, &fakePeer{fail: true}, &fakePeer{}}
+	}
+	var s string
+
+	// Two retries reach the third replica.
+	g := newGroupOpts("TestPeerRetry-reached", cacheSize, getter, newPeers(), &GroupOptions{
+		PeerRetry: &PeerRetryPolicy{Retries: 2, Backoff: noBackoff},
+	})
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil || s != "got:key" {
+		t.Fatalf("Get = %q, %v; want the third replica's value", s, err)
+	}
+	if r, l, f := g.Stats.PeerRetries.Get(), g.Stats.PeerRetryLoads.Get(), g.Stats.PeerFallbackLoads.Get(); r != 2 || l != 1 || f != 0 {
+		t.Errorf("PeerRetries, PeerRetryLoads, PeerFallbackLoads = %d, %d, %d; want 2, 1, 0", r, l, f)
+	}
+
+	// Without a policy, a single backup peer is asked before loading
+	// locally.
+	g = newGroupOpts("TestPeerRetry-default", cacheSize, getter, newPeers(), &GroupOptions{})
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil || s != "local:key" {
+		t.Fatalf("Get = %q, %v; want the local value", s, err)
+	}
+	if r, f := g.Stats.PeerRetries.Get(), g.Stats.PeerFallbackLoads.Get(); r != 1 || f != 1 || localLoads != 1 {
+		t.Errorf("PeerRetries, PeerFallbackLoads, local loads = %d, %d, %d; want 1, 1, 1", r, f, localLoads)
+	}
+
+	// NoLocalLoad fails the load instead.
+	peers := newPeers()
+	g = newGroupOpts("TestPeerRetry-nolocal", cacheSize, getter, peers, &GroupOptions{
+		PeerRetry: &PeerRetryPolicy{Retries: 1, Backoff: noBackoff, NoLocalLoad: true},
+	})
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); !errors.Is(err, ErrOwnerUnavailable) {
+		t.Fatalf("Get error = %v; want the backup peer's, matching ErrOwnerUnavailable", err)
+	}
+	if got := g.Stats.PeerFallbackRejects.Get(); got != 1 || localLoads != 1 {
+		t.Errorf("PeerFallbackRejects, local loads = %d, %d; want 1, 1", got, localLoads)
+	}
+	if hits := peers[2].(*fakePeer).hits; hits != 0 {
+		t.Errorf("third replica asked %d times; want 0", hits)
+	}
+
+	// A backoff due past the deadline skips to the local load.
+	g = newGroupOpts("TestPeerRetry-deadline", cacheSize, getter, newPeers(), &GroupOptions{
+		PeerRetry: &PeerRetryPolicy{Retries: 2, Backoff: func(int) time.Duration { return time.Hour }},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := g.Get(ctx, "key", StringSink(&s), nil); err != nil || s != "local:key" {
+		t.Fatalf("Get = %q, %v; want the local value", s, err)
+	}
+	if got := g.Stats.PeerRetries.Get(); got != 0 {
+		t.Errorf("PeerRetries = %d; want 0", got)
+	}
+}
+
+func TestStrictOwnership(t *testing.T) {
+	var localLoads int
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		localLoads++
+		return dest.SetString("local:"+key, time.Time{})
+	})
+	var s string
+
+	// Once the owner and its backup fail, the key is not loaded here.
+	peers := backupChain{&fakePeer{fail: true}, &fakePeer{fail: true}}
+	g := newGroupOpts("TestStrictOwnership-down", cacheSize, getter, peers, &GroupOptions{
+		StrictOwnership: true,
+	})
+	err := g.Get(dummyCtx, "key", StringSink(&s), nil)
+	var perr *PeerError
+	if !errors.Is(err, ErrOwnerUnavailable) || !errors.As(err, &perr) || perr.Peer != peers[1] {
+		t.Fatalf("Get error = %v; want the backup peer's PeerError, matching ErrOwnerUnavailable", err)
+	}
+	if got := g.Stats.PeerFallbackRejects.Get(); got != 1 || localLoads != 0 {
+		t.Errorf("PeerFallbackRejects, local loads = %d, %d; want 1, 0", got, localLoads)
+	}
+
+	// Nor are keys owned by another peer when a peer forwards their
+	// Gets here.
+	g = newGroupOpts("TestStrictOwnership-misrouted", cacheSize, getter, prefixPeers{&fakePeer{}}, &GroupOptions{
+		StrictOwnership: true,
+	})
+	if err := g.Get(withPeerHops(context.Background(), 1), "remote-key", StringSink(&s), nil); !errors.Is(err, ErrOwnerUnavailable) {
+		t.Errorf("forwarded Get error = %v; want ErrOwnerUnavailable", err)
+	}
+	if got := g.Stats.MisroutedRejects.Get(); got != 1 || localLoads != 0 {
+		t.Errorf("MisroutedRejects, local loads = %d, %d; want 1, 0", got, localLoads)
+	}
+
+	// Keys owned here are loaded as usual.
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil || s != "local:key" {
+		t.Errorf("Get of an owned key = %q, %v; want the local value", s, err)
+	}
+
+	// Replicated keys whose owners all fail are not loaded here either.
+	g = newGroupOpts("TestStrictOwnership-replicated", cacheSize, getter, ownersPeers{&fakePeer{fail: true}, &fakePeer{fail: true}}, &GroupOptions{
+		Replication:     2,
+		StrictOwnership: true,
+	})
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); !errors.Is(err, ErrOwnerUnavailable) {
+		t.Errorf("Get of a replicated key = %v; want ErrOwnerUnavailable", err)
+	}
+	if localLoads != 1 {
+		t.Errorf("%d local loads; want 1, of the owned key", localLoads)
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	backoff := JitteredBackoff(10*time.Millisecond, 100*time.Millisecond)
+	for attempt, max := range []time.Duration{10, 20, 40, 80, 100, 100} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := backoff(attempt + 1); d < max/2 || d > max {
+				t.Fatalf("backoff(%d) = %v; want within [%v, %v]", attempt+1, d, max/2, max)
+			}
+		}
+	}
+}
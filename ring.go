@@ -0,0 +1,118 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/melojustme/groupcache/consistenthash"
+)
+
+// RingState describes the consistent hash ring of a pool of peers, for
+// checking how evenly it spreads keys over them.
+type RingState struct {
+	Self     string      `json:"self"`
+	Replicas int         `json:"replicas"` // hash points of each peer
+	HashBits int         `json:"hashBits"` // width of the ring's hashes
+	Points   int         `json:"points"`   // hash points of all the peers
+	Peers    []PeerShare `json:"peers"`    // sorted by peer
+}
+
+// A PeerShare is the part of a consistent hash ring a peer owns.
+type PeerShare struct {
+	Peer   string  `json:"peer"`
+	Points int     `json:"points"` // hash points, or virtual nodes, of the peer
+	Share  float64 `json:"share"`  // fraction of the ring's hashes, and so of keys, the peer owns
+}
+
+// ringState returns the RingState of ring, whose hashes are bits wide.
+func ringState(self string, replicas int, bits uint, ring *consistenthash.Map) RingState {
+	snap := ring.Snapshot()
+	s := RingState{Self: self, Replicas: replicas, HashBits: int(bits), Points: len(snap), Peers: []PeerShare{}}
+	for _, ks := range snap.Shares(bits) {
+		s.Peers = append(s.Peers, PeerShare{Peer: ks.Key, Points: ks.Points, Share: ks.Share})
+	}
+	return s
+}
+
+// WhoOwns implements RingPeerPicker, returning the peer owning key on
+// the consistent hash, this one included.
+func (p *HTTPPool) WhoOwns(key string) string {
+	return p.current().ring.Get(key)
+}
+
+// RingState implements RingPeerPicker.
+func (p *HTTPPool) RingState() RingState {
+	bits := uint(32)
+	if p.opts.Use64BitHash || p.opts.HashFn64 != nil {
+		bits = 64
+	}
+	return ringState(p.self, p.opts.Replicas, bits, p.current().ring)
+}
+
+// RingHandler returns a handler that renders the pool's RingState as
+// JSON, along with the peer owning the key given by the "key" query
+// parameter, if any. Like StatsHandler, it is meant for an internal
+// admin endpoint, and is served separately from the peer protocol
+// handled by ServeHTTP.
+func (p *HTTPPool) RingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := ringDocument{RingState: p.RingState()}
+		if key, ok := r.URL.Query()["key"]; ok && len(key) > 0 {
+			res.Key = &key[0]
+			res.Owner = p.WhoOwns(key[0])
+		}
+		body, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+// ringDocument is the JSON document served by HTTPPool.RingHandler.
+type ringDocument struct {
+	RingState
+	Key   *string `json:"key,omitempty"`
+	Owner string  `json:"owner,omitempty"`
+}
+
+// WhoOwns implements RingPeerPicker, returning the address of the peer
+// owning key on the consistent hash, this one included.
+func (p *GRPCPool) WhoOwns(key string) string {
+	return p.current().ring.Get(key)
+}
+
+// RingState implements RingPeerPicker.
+func (p *GRPCPool) RingState() RingState {
+	return ringState(p.self, p.opts.Replicas, 32, p.current().ring)
+}
+
+// WhoOwns returns the peer owning key, as named by the group's
+// PeerPicker, this process included, and true, or false if the picker
+// is not a RingPeerPicker.
+func (g *Group) WhoOwns(key string) (peer string, ok bool) {
+	g.peersOnce.Do(g.initPeers)
+	rp, ok := g.peers.(RingPeerPicker)
+	if !ok {
+		return "", false
+	}
+	return rp.WhoOwns(g.routingKey(g.storageKey(key))), true
+}
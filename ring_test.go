@@ -0,0 +1,110 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestRingState(t *testing.T) {
+	p := newHTTPPool("http://peer-a", nil)
+	p.Set("http://peer-c", "http://peer-a", "http://peer-b")
+	s := p.RingState()
+	if s.Self != "http://peer-a" || s.Replicas != defaultReplicas || s.HashBits != 32 || s.Points != 3*defaultReplicas {
+		t.Errorf("RingState = %+v; want self http://peer-a, %d replicas, 32 bits and %d points", s, defaultReplicas, 3*defaultReplicas)
+	}
+	var total float64
+	for i, ps := range s.Peers {
+		if want := fmt.Sprintf("http://peer-%c", 'a'+i); ps.Peer != want || ps.Points != defaultReplicas {
+			t.Errorf("Peers[%d] = %+v; want %s with %d points", i, ps, want, defaultReplicas)
+		}
+		total += ps.Share
+	}
+	if len(s.Peers) != 3 || math.Abs(total-1) > 1e-9 {
+		t.Errorf("%d peers sharing %v of the ring; want 3 sharing all of it", len(s.Peers), total)
+	}
+	if s := newHTTPPool("http://self", &HTTPPoolOptions{Use64BitHash: true}).RingState(); s.HashBits != 64 || s.Points != 0 || len(s.Peers) != 0 {
+		t.Errorf("RingState of an empty 64-bit ring = %+v", s)
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := p.WhoOwns(key)
+		peer, ok := p.PickPeer(key)
+		if ok != (owner != "http://peer-a") || ok && peer.GetURL() != owner+defaultBasePath {
+			t.Errorf("WhoOwns(%q) = %q, but PickPeer picked %v, %v", key, owner, peer, ok)
+		}
+	}
+
+	g := newGroup("TestRingState", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(key, time.Time{})
+	}), p)
+	if owner, ok := g.WhoOwns("key-1"); !ok || owner != p.WhoOwns("key-1") {
+		t.Errorf("Group.WhoOwns = %q, %v; want %q", owner, ok, p.WhoOwns("key-1"))
+	}
+	if _, ok := newGroup("TestRingState-nopeers", cacheSize, g.getter, NoPeers{}).WhoOwns("key-1"); ok {
+		t.Error("Group.WhoOwns succeeded without a RingPeerPicker")
+	}
+
+	gp := newGRPCPool("127.0.0.1:1", nil)
+	defer gp.Close()
+	gp.Set("127.0.0.1:1")
+	if s := gp.RingState(); s.Points != defaultReplicas || len(s.Peers) != 1 || s.Peers[0].Share != 1 || gp.WhoOwns("key") != "127.0.0.1:1" {
+		t.Errorf("GRPCPool RingState = %+v, WhoOwns = %q", s, gp.WhoOwns("key"))
+	}
+}
+
+func TestRingHandler(t *testing.T) {
+	p := newHTTPPool("http://peer-a", nil)
+	p.Set("http://peer-a", "http://peer-b")
+	for _, tt := range []struct {
+		query string
+		key   *string
+	}{
+		{"", nil},
+		{"?key=key-1", proto.String("key-1")},
+		{"?key=", proto.String("")},
+	} {
+		w := httptest.NewRecorder()
+		p.RingHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ring"+tt.query, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%q: status %d, Content-Type %q", tt.query, w.Code, w.Header().Get("Content-Type"))
+		}
+		var doc ringDocument
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if len(doc.Peers) != 2 || doc.Points != 2*defaultReplicas {
+			t.Errorf("%q: ring %+v; want 2 peers", tt.query, doc.RingState)
+		}
+		switch {
+		case tt.key == nil && (doc.Key != nil || doc.Owner != ""):
+			t.Errorf("%q: got key %v owned by %q; want none", tt.query, doc.Key, doc.Owner)
+		case tt.key != nil && (doc.Key == nil || *doc.Key != *tt.key || doc.Owner != p.WhoOwns(*tt.key)):
+			t.Errorf("%q: got key %v owned by %q; want %q owned by %q", tt.query, doc.Key, doc.Owner, *tt.key, p.WhoOwns(*tt.key))
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import "github.com/melojustme/groupcache/consistenthash"
+
+// A RoutingReport describes how SimulateRouting distributed keys over
+// a set of peers.
+type RoutingReport struct {
+	// Keys is the number of keys routed.
+	Keys int
+
+	// PerPeer holds the number of keys owned by each peer, including
+	// those owning none.
+	PerPeer map[string]int
+
+	// Skew is the number of keys owned by the most loaded peer over
+	// the mean number per peer: 1 for a perfectly even distribution,
+	// and 0 if there are no peers or keys.
+	Skew float64
+
+	replicas int
+	keys     []string
+	owners   []string // owners[i] owns keys[i]
+}
+
+// SimulateRouting reports how an HTTPPool with the given number of
+// replicas and the default hash function would route keys to peers,
+// without touching any pool or group. If replicas is zero, it defaults
+// to the pool's default of 50. Keys are routed as passed, as they are
+// for groups without GroupOptions.MaxKeyLength or a routing key.
+func SimulateRouting(peers []string, replicas int, keys []string) RoutingReport {
+	if replicas == 0 {
+		replicas = defaultReplicas
+	}
+	r := RoutingReport{
+		Keys:     len(keys),
+		PerPeer:  make(map[string]int, len(peers)),
+		replicas: replicas,
+		keys:     keys,
+	}
+	for _, peer := range peers {
+		r.PerPeer[peer] = 0
+	}
+	if len(peers) == 0 {
+		return r
+	}
+	r.owners = routeKeys(peers, replicas, keys)
+	for _, owner := range r.owners {
+		r.PerPeer[owner]++
+	}
+	max := 0
+	for _, n := range r.PerPeer {
+		if n > max {
+			max = n
+		}
+	}
+	if len(keys) > 0 {
+		r.Skew = float64(max) * float64(len(r.PerPeer)) / float64(len(keys))
+	}
+	return r
+}
+
+// MovedFrom returns the fraction of the report's keys that the
+// previous set of peers routes to a different peer, with the same
+// number of replicas: the share of keys whose cached values a switch
+// from previous to the report's peers would invalidate.
+func (r RoutingReport) MovedFrom(previous []string) float64 {
+	if len(r.keys) == 0 {
+		return 0
+	}
+	if len(previous) == 0 || len(r.owners) == 0 {
+		return 1
+	}
+	moved := 0
+	for i, owner := range routeKeys(previous, r.replicas, r.keys) {
+		if owner != r.owners[i] {
+			moved++
+		}
+	}
+	return float64(moved) / float64(len(r.keys))
+}
+
+// routeKeys returns the owner of each of keys on a throwaway ring of
+// peers.
+func routeKeys(peers []string, replicas int, keys []string) []string {
+	ring := consistenthash.New(replicas, nil)
+	ring.Add(peers...)
+	owners := make([]string, len(keys))
+	for i, key := range keys {
+		owners[i] = ring.Get(key)
+	}
+	return owners
+}
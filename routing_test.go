@@ -0,0 +1,99 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func routingKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestSimulateRouting(t *testing.T) {
+	keys := routingKeys(10000)
+	peers := []string{"http://a", "http://b", "http://c", "http://d"}
+
+	r := SimulateRouting(peers, 0, keys)
+	if r.Keys != len(keys) || len(r.PerPeer) != len(peers) {
+		t.Fatalf("report of %d keys over %d peers; want %d over %d", r.Keys, len(r.PerPeer), len(keys), len(peers))
+	}
+	total, max := 0, 0
+	for _, n := range r.PerPeer {
+		total += n
+		if n > max {
+			max = n
+		}
+	}
+	if total != len(keys) {
+		t.Errorf("peers own %d keys; want %d", total, len(keys))
+	}
+	if want := float64(max) * float64(len(peers)) / float64(len(keys)); r.Skew != want {
+		t.Errorf("Skew = %v; want %v", r.Skew, want)
+	}
+	if r.Skew < 1 || r.Skew > 1.3 {
+		t.Errorf("Skew = %v with %d replicas; want within [1, 1.3]", r.Skew, defaultReplicas)
+	}
+	if few := SimulateRouting(peers, 1, keys); few.Skew <= r.Skew {
+		t.Errorf("Skew with 1 replica = %v; want above the %v of %d replicas", few.Skew, r.Skew, defaultReplicas)
+	}
+
+	if one := SimulateRouting(peers[:1], 0, keys); one.Skew != 1 || one.PerPeer[peers[0]] != len(keys) {
+		t.Errorf("single peer report = %+v; want it to own every key with a skew of 1", one.PerPeer)
+	}
+	if none := SimulateRouting(nil, 0, keys); none.Skew != 0 || len(none.PerPeer) != 0 {
+		t.Errorf("report without peers = %+v; want an empty one", none)
+	}
+	if empty := SimulateRouting(peers, 0, nil); empty.Skew != 0 || empty.MovedFrom(peers[:1]) != 0 {
+		t.Errorf("report without keys = %+v; want a skew of 0 and nothing moving", empty)
+	}
+}
+
+func TestSimulateRoutingMovedFrom(t *testing.T) {
+	keys := routingKeys(10000)
+	before := []string{"http://a", "http://b", "http://c", "http://d"}
+	after := append(append([]string(nil), before...), "http://e")
+	r := SimulateRouting(after, 0, keys)
+
+	if moved := r.MovedFrom(after); moved != 0 {
+		t.Errorf("MovedFrom(same peers) = %v; want 0", moved)
+	}
+	if moved := r.MovedFrom([]string{"http://x", "http://y"}); moved != 1 {
+		t.Errorf("MovedFrom(disjoint peers) = %v; want 1", moved)
+	}
+
+	// A joining peer only takes keys over, about a fifth of them,
+	// which is exactly those it owns.
+	moved := r.MovedFrom(before)
+	if want := float64(r.PerPeer["http://e"]) / float64(len(keys)); moved != want {
+		t.Errorf("MovedFrom(before the join) = %v; want %v, the joiner's share", moved, want)
+	}
+	if moved < 0.1 || moved > 0.3 {
+		t.Errorf("MovedFrom(before the join) = %v; want about 0.2", moved)
+	}
+	prev := SimulateRouting(before, 0, keys)
+	for i, owner := range r.owners {
+		if owner != "http://e" && owner != prev.owners[i] {
+			t.Fatalf("key %q moved from %s to %s; want keys to move to the joiner only", keys[i], prev.owners[i], owner)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"sync"
+)
+
+// shardLimiter bounds the concurrent loads of each origin shard for
+// GroupOptions.MaxLoadsPerShard.
+type shardLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	shards map[string]*shardSlots // never shrinks: shards are few
+}
+
+type shardSlots struct {
+	inFlight AtomicInt // first, to be 8-byte aligned on 32-bit platforms
+	slots    chan struct{}
+}
+
+// get returns the slots of shard, creating them on first use.
+func (l *shardLimiter) get(shard string) *shardSlots {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.shards[shard]
+	if s == nil {
+		if l.shards == nil {
+			l.shards = make(map[string]*shardSlots)
+		}
+		s = &shardSlots{slots: make(chan struct{}, l.max)}
+		l.shards[shard] = s
+	}
+	return s
+}
+
+// acquireShardSlot waits for one of the MaxLoadsPerShard slots of the
+// shard of key, if the group limits them, and returns a function
+// releasing it.
+func (g *Group) acquireShardSlot(ctx context.Context, key string) (release func(), err error) {
+	if g.shardLimiter == nil {
+		return func() {}, nil
+	}
+	s := g.shardLimiter.get(g.opts.LoadShardKey(key))
+	if err := acquireSlot(ctx, s.slots, &g.Stats.ShardLoadsQueued); err != nil {
+		return nil, err
+	}
+	s.inFlight.Add(1)
+	return func() {
+		s.inFlight.Add(-1)
+		releaseSlot(s.slots)
+	}, nil
+}
+
+// ShardInFlightLoads returns how many loads from the getter are in
+// progress for each origin shard that GroupOptions.LoadShardKey
+// returned, or nil unless MaxLoadsPerShard is set.
+func (g *Group) ShardInFlightLoads() map[string]int64 {
+	l := g.shardLimiter
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	loads := make(map[string]int64, len(l.shards))
+	for shard, s := range l.shards {
+		loads[shard] = s.inFlight.Get()
+	}
+	return loads
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxLoadsPerShard(t *testing.T) {
+	const (
+		limit    = 2
+		perShard = 5
+	)
+	var (
+		mu           sync.Mutex
+		active, peak = map[string]int{}, map[string]int{}
+		releaseLoads = make(chan bool)
+	)
+	shardOf := func(key string) string { return strings.SplitN(key, "-", 2)[0] }
+	g := newGroupOpts("TestMaxLoadsPerShard-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		shard := shardOf(key)
+		mu.Lock()
+		active[shard]++
+		if active[shard] > peak[shard] {
+			peak[shard] = active[shard]
+		}
+		mu.Unlock()
+		if !strings.HasSuffix(key, "-fast") {
+			<-releaseLoads
+		}
+		mu.Lock()
+		active[shard]--
+		mu.Unlock()
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{LoadShardKey: shardOf, MaxLoadsPerShard: limit})
+
+	errc := make(chan error, 2*perShard)
+	for _, shard := range []string{"a", "b"} {
+		for i := 0; i < perShard; i++ {
+			go func(key string) {
+				var s string
+				errc <- g.Get(dummyCtx, key, StringSink(&s), nil)
+			}(fmt.Sprintf("%s-%d", shard, i))
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for g.Stats.ShardLoadsQueued.Get() != 2*(perShard-limit) {
+		if time.Now().After(deadline) {
+			t.Fatalf("ShardLoadsQueued = %d; want %d", g.Stats.ShardLoadsQueued.Get(), 2*(perShard-limit))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := g.ShardInFlightLoads(), map[string]int64{"a": limit, "b": limit}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ShardInFlightLoads = %v; want %v", got, want)
+	}
+
+	// A load of a full shard gives up at its deadline, while one of
+	// an idle shard proceeds.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var s string
+	if err := g.Get(ctx, "a-queued", StringSink(&s), nil); err != ErrLoadThrottled {
+		t.Errorf("Get of a full shard = %v; want %v", err, ErrLoadThrottled)
+	}
+	if err := g.Get(dummyCtx, "c-fast", StringSink(&s), nil); err != nil {
+		t.Errorf("Get of an idle shard = %v", err)
+	}
+
+	close(releaseLoads)
+	for i := 0; i < 2*perShard; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := map[string]int{"a": limit, "b": limit, "c": 1}; !reflect.DeepEqual(peak, want) {
+		t.Errorf("peak concurrent loads per shard = %v; want %v", peak, want)
+	}
+	if got, want := g.ShardInFlightLoads(), map[string]int64{"a": 0, "b": 0, "c": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ShardInFlightLoads after all loads = %v; want %v", got, want)
+	}
+}
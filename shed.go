@@ -0,0 +1,146 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateBuckets bounds the peers whose request rate a rateLimiter
+// tracks before it forgets those that have not sent requests lately.
+const maxRateBuckets = 1024
+
+// rateLimiter limits the rate of the requests of each peer with a
+// token bucket, as used by HTTPPoolOptions.MaxPeerQPS.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // tokens a bucket holds at most
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens was last refilled
+}
+
+func newRateLimiter(qps float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(qps))
+	}
+	return &rateLimiter{
+		rate:    qps,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from peer's bucket, reporting whether it had one.
+// If not, it returns how long until the bucket holds one again.
+func (l *rateLimiter) allow(peer string) (ok bool, retryAfter time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[peer]
+	if b == nil {
+		if len(l.buckets) >= maxRateBuckets {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[peer] = b
+	}
+	b.tokens = l.refilled(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// refilled returns the tokens b holds at now.
+func (l *rateLimiter) refilled(b *tokenBucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// prune forgets the buckets that are full again, whose peers would be
+// allowed as many requests if they were new.
+func (l *rateLimiter) prune(now time.Time) {
+	for peer, b := range l.buckets {
+		if l.refilled(b, now) >= l.burst {
+			delete(l.buckets, peer)
+		}
+	}
+}
+
+// remotePeerID identifies the peer that sent r by the host of its
+// remote address, as HTTPPoolOptions.PeerID does by default.
+func remotePeerID(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// shed reports whether r, for group, must be rejected to keep the
+// pool within HTTPPoolOptions.MaxConcurrentRequests and MaxPeerQPS,
+// answering it with 429 Too Many Requests if so. Otherwise the caller
+// must call the returned done once it served r.
+func (p *HTTPPool) shed(w http.ResponseWriter, r *http.Request, group *Group) (done func(), shed bool) {
+	if p.limiter != nil {
+		peerID := p.opts.PeerID
+		if peerID == nil {
+			peerID = remotePeerID
+		}
+		if ok, wait := p.limiter.allow(peerID(r)); !ok {
+			group.Stats.ServerRateShed.Add(1)
+			tooManyRequests(w, wait)
+			return nil, true
+		}
+	}
+	if p.inFlight == nil {
+		return func() {}, false
+	}
+	select {
+	case p.inFlight <- struct{}{}:
+		return func() { <-p.inFlight }, false
+	default:
+		group.Stats.ServerConcurrencyShed.Add(1)
+		tooManyRequests(w, time.Second)
+		return nil, true
+	}
+}
+
+// tooManyRequests answers a shed request, asking the peer to retry
+// after wait, rounded up to whole seconds.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	secs := int64(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPPoolMaxConcurrentRequests(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	g := newGroup("TestHTTPPoolMaxConcurrentRequests-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		if key == "slow" {
+			started <- true
+			<-release
+		}
+		return dest.SetString("value", time.Time{})
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{MaxConcurrentRequests: 1})
+	serve := func(key string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", defaultBasePath+g.Name()+"/"+key, nil))
+		return rec
+	}
+
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() { slow <- serve("slow") }()
+	<-started
+	rec := serve("fast")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("request beyond the limit = %d, Retry-After %q; want 429, 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	close(release)
+	if rec := <-slow; rec.Code != http.StatusOK {
+		t.Errorf("request within the limit = %d; want 200", rec.Code)
+	}
+	if rec := serve("fast"); rec.Code != http.StatusOK {
+		t.Errorf("request after the slow one = %d; want 200", rec.Code)
+	}
+	if got := g.Stats.ServerConcurrencyShed.Get(); got != 1 {
+		t.Errorf("ServerConcurrencyShed = %d; want 1", got)
+	}
+}
+
+func TestHTTPPoolMaxPeerQPS(t *testing.T) {
+	g := newGroup("TestHTTPPoolMaxPeerQPS-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("value", time.Time{})
+	}), NoPeers{})
+	p := newHTTPPool("http://127.0.0.1", &HTTPPoolOptions{MaxPeerQPS: 0.5, MaxPeerBurst: 2})
+	now := time.Unix(1000, 0)
+	p.limiter.now = func() time.Time { return now }
+	serve := func(remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", defaultBasePath+g.Name()+"/key", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := serve("10.0.0.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d of the burst = %d; want 200", i, rec.Code)
+		}
+	}
+	rec := serve("10.0.0.1:5678")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("request beyond the burst = %d, Retry-After %q; want 429, 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := serve("10.0.0.2:1234"); rec.Code != http.StatusOK {
+		t.Errorf("request of another peer = %d; want 200", rec.Code)
+	}
+	now = now.Add(2 * time.Second)
+	if rec := serve("10.0.0.1:1234"); rec.Code != http.StatusOK {
+		t.Errorf("request once a token was added = %d; want 200", rec.Code)
+	}
+	if got := g.Stats.ServerRateShed.Get(); got != 1 {
+		t.Errorf("ServerRateShed = %d; want 1", got)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	for i := 0; i < maxRateBuckets; i++ {
+		l.allow(string(rune(i)))
+	}
+	now = now.Add(time.Second)
+	l.allow("new")
+	if len(l.buckets) != 1 {
+		t.Errorf("buckets after prune = %d; want 1", len(l.buckets))
+	}
+}
@@ -19,15 +19,34 @@ limitations under the License.
 package singleflight
 
 import (
+	"context"
 	"fmt"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // call is an in-flight or completed Do call
 type call struct {
-	wg  sync.WaitGroup
-	val interface{}
-	err error
+	done chan struct{} // closed once fn has returned
+	val  interface{}
+	err  error
+
+	// waiters is the number of callers still waiting on the call.
+	// It is guarded by Group.mu.
+	waiters int
+
+	// cancel cancels the context passed to a context-aware fn. It is
+	// nil for calls whose fn does not take a context.
+	cancel context.CancelFunc
+}
+
+// Result holds the results of a call, so they can be passed on a
+// channel.
+type Result struct {
+	Val interface{}
+	Err error
 }
 
 // Group represents a class of work and forms a namespace in which
@@ -35,40 +54,244 @@ type call struct {
 type Group struct {
 	mu sync.Mutex       // protects m
 	m  map[string]*call // lazily initialized
+
+	// OnComplete, if non-nil, is called each time a call finishes,
+	// with the time its fn took to run and the number of callers
+	// that received its results, including the one that started it.
+	// It is called after those callers have been woken up.
+	OnComplete func(key string, d time.Duration, shared int, err error)
 }
 
 // Do executes and returns the results of the given function, making
 // sure that only one execution is in-flight for a given key at a
 // time. If a duplicate comes in, the duplicate caller waits for the
 // original to complete and receives the same results.
+//
+// If fn panics, the panic propagates to the caller that ran it, while
+// duplicates receive a *PanicError.
+//
+// fn does not take a context, so it can never be cancelled and always
+// runs to completion.
 func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	v, err, _ := g.DoEx(key, fn)
+	return v, err
+}
+
+// DoEx is like Do but also reports whether the results are shared:
+// true if the caller joined a call started by another caller, false
+// if it ran fn itself.
+func (g *Group) DoEx(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
 	g.mu.Lock()
 	if g.m == nil {
 		g.m = make(map[string]*call)
 	}
 	if c, ok := g.m[key]; ok {
+		c.waiters++
 		g.mu.Unlock()
-		c.wg.Wait()
-		return c.val, c.err
-	}
-	c := &call{
-		err: fmt.Errorf("singleflight leader panicked"),
+		<-c.done
+		return c.val, c.err, true
 	}
-	c.wg.Add(1)
+	c := newCall()
+	c.waiters++
 	g.m[key] = c
 	g.mu.Unlock()
 
+	g.doCall(c, key, fn)
+	return c.val, c.err, false
+}
+
+// DoNS is like Do but suppresses duplicates only among calls with the
+// same namespace and key, so that one Group can be shared by several
+// domains whose keys may coincide. The namespace is length-prefixed
+// onto the key, so that, say, namespace "a" with key "bc" does not
+// collide with namespace "ab" with key "c". OnComplete receives this
+// compound key. Mixing Do and DoNS calls on one Group may still
+// collide, as a plain key can spell out a compound one.
+//
+// Within groupcache, each Group deduplicates its loads in a
+// singleflight.Group of its own, so its keys never collide with those
+// of another Group. DoNS is for users of this package sharing a
+// Group directly.
+func (g *Group) DoNS(namespace, key string, fn func() (interface{}, error)) (interface{}, error) {
+	return g.Do(nsKey(namespace, key), fn)
+}
+
+// nsKey returns the compound key of key in namespace.
+func nsKey(namespace, key string) string {
+	return strconv.Itoa(len(namespace)) + ":" + namespace + key
+}
+
+// DoChan is like Do but returns a channel that will receive the
+// results when they are ready, so that callers can select on it
+// alongside a context or a timeout. Giving up on the channel does not
+// stop fn, which runs to completion in a goroutine of its own; use
+// DoChanContext to have fn cancelled once nobody waits on it.
+//
+// If fn panics, the panic cannot be recovered by the caller and
+// crashes the program, while duplicates receive a *PanicError.
+//
+// The returned channel will not be closed.
+func (g *Group) DoChan(key string, fn func() (interface{}, error)) <-chan Result {
+	ch := make(chan Result, 1)
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	c, ok := g.m[key]
+	if !ok {
+		c = newCall()
+		g.m[key] = c
+		go g.doCall(c, key, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	go g.wait(context.Background(), c, key, ch)
+	return ch
+}
+
+// DoChanContext is like Do but returns a channel that will receive the
+// results when they are ready, and passes fn a context that is
+// cancelled once every caller waiting on the call has given up.
+//
+// A caller gives up when its ctx is done, at which point its channel
+// receives ctx.Err() instead of the shared result. The context given
+// to fn is not derived from any caller's ctx, so one caller giving up
+// does not affect the others. If a caller using Do or DoChan, which
+// cannot give up, is waiting on the same call, fn is never cancelled.
+// Likewise, if the call was started by Do, its fn does not take a
+// context and runs to completion regardless.
+//
+// If fn panics, the panic cannot be recovered by the caller and
+// crashes the program, while duplicates receive a *PanicError.
+//
+// The returned channel will not be closed.
+func (g *Group) DoChanContext(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) <-chan Result {
+	ch := make(chan Result, 1)
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	c, ok := g.m[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.Background())
+		c = newCall()
+		c.cancel = cancel
+		g.m[key] = c
+		go g.doCall(c, key, func() (interface{}, error) {
+			defer cancel()
+			return fn(fctx)
+		})
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	go g.wait(ctx, c, key, ch)
+	return ch
+}
+
+// DoContext is like DoChanContext but blocks until the results are
+// ready or ctx is done, whichever comes first. A caller whose ctx is
+// done returns ctx.Err() without waiting for fn, which is cancelled
+// once every caller waiting on it has given up.
+//
+// As with DoChanContext, fn runs in a goroutine of its own, so a panic
+// in fn cannot be recovered by the caller and crashes the program,
+// while duplicates receive a *PanicError.
+func (g *Group) DoContext(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	res := <-g.DoChanContext(ctx, key, fn)
+	return res.Val, res.Err
+}
+
+// PanicError is the error received by the callers waiting on a call
+// whose fn panicked. The caller that ran fn does not receive it: the
+// panic keeps propagating in its goroutine, so that the crash and its
+// stack surface where it happened.
+type PanicError struct {
+	Value interface{} // the value passed to panic
+	Stack []byte      // the stack of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("singleflight leader panicked: %v\n\n%s", e.Value, e.Stack)
+}
+
+func newCall() *call {
+	return &call{
+		done: make(chan struct{}),
+		err:  fmt.Errorf("singleflight leader panicked"),
+	}
+}
+
+// doCall runs fn for c and wakes up its waiters. If fn panics, the
+// waiters receive a *PanicError and the panic resumes once they have
+// been woken up.
+func (g *Group) doCall(c *call, key string, fn func() (interface{}, error)) {
+	var start time.Time
+	if g.OnComplete != nil {
+		start = time.Now()
+	}
 	defer func() {
-		c.wg.Done()
+		// Let waiters know what went wrong, then carry on panicking.
+		// A fn that calls runtime.Goexit leaves newCall's error.
+		r := recover()
+		if r != nil {
+			c.val, c.err = nil, &PanicError{Value: r, Stack: debug.Stack()}
+		}
+		close(c.done)
 
 		g.mu.Lock()
-		delete(g.m, key)
+		if g.m[key] == c {
+			delete(g.m, key)
+		}
+		shared := c.waiters
 		g.mu.Unlock()
+
+		if g.OnComplete != nil {
+			g.OnComplete(key, time.Since(start), shared, c.err)
+		}
+		if r != nil {
+			panic(r)
+		}
 	}()
 
 	c.val, c.err = fn()
+}
+
+// wait delivers the results of c on ch, unless ctx is done first.
+func (g *Group) wait(ctx context.Context, c *call, key string, ch chan<- Result) {
+	select {
+	case <-c.done:
+		ch <- Result{Val: c.val, Err: c.err}
+	case <-ctx.Done():
+		g.leave(c, key)
+		ch <- Result{Err: ctx.Err()}
+	}
+}
+
+// leave removes a waiter from c, cancelling the call if it was the
+// last one. A cancelled call is forgotten so that later callers start
+// a fresh one rather than sharing its cancellation error.
+func (g *Group) leave(c *call, key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c.waiters--
+	if c.waiters > 0 || c.cancel == nil {
+		return
+	}
+	if g.m[key] == c {
+		delete(g.m, key)
+	}
+	c.cancel()
+}
 
-	return c.val, c.err
+// Forget tells the Group to forget about key, so that later calls for
+// it run fn afresh instead of joining the call in flight, if any. The
+// callers already waiting on that call still receive its results.
+func (g *Group) Forget(key string) {
+	g.mu.Lock()
+	delete(g.m, key)
+	g.mu.Unlock()
 }
 
 // Lock prevents single flights from occurring for the duration
@@ -17,6 +17,7 @@ limitations under the License.
 package singleflight
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -85,6 +86,86 @@ func TestDoDupSuppress(t *testing.T) {
 	}
 }
 
+func TestDoNS(t *testing.T) {
+	var g Group
+	entered, release := make(chan bool), make(chan bool)
+	done := make(chan interface{})
+	go func() {
+		v, _ := g.DoNS("users", "42", func() (interface{}, error) {
+			entered <- true
+			<-release
+			return "user 42", nil
+		})
+		done <- v
+	}()
+	<-entered
+
+	// The same key in another namespace must not join the blocked call.
+	v, err := g.DoNS("orders", "42", func() (interface{}, error) {
+		return "order 42", nil
+	})
+	if err != nil || v != "order 42" {
+		t.Errorf("DoNS(orders, 42) = %v, %v; want order 42", v, err)
+	}
+	close(release)
+	if v := <-done; v != "user 42" {
+		t.Errorf("DoNS(users, 42) = %v; want user 42", v)
+	}
+
+	if nsKey("a", "bc") == nsKey("ab", "c") {
+		t.Errorf("nsKey(a, bc) and nsKey(ab, c) are both %q", nsKey("a", "bc"))
+	}
+}
+
+func TestOnComplete(t *testing.T) {
+	type completion struct {
+		key    string
+		d      time.Duration
+		shared int
+		err    error
+	}
+	completions := make(chan completion, 10)
+	g := Group{OnComplete: func(key string, d time.Duration, shared int, err error) {
+		completions <- completion{key, d, shared, err}
+	}}
+
+	c := make(chan string)
+	fn := func() (interface{}, error) {
+		return <-c, nil
+	}
+	const n = 5
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.Do("key", fn)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond) // let goroutines above block
+	c <- "bar"
+	wg.Wait()
+
+	got := <-completions
+	if got.key != "key" || got.shared != n || got.err != nil {
+		t.Errorf("OnComplete(%q, _, %d, %v); want (%q, _, %d, <nil>)", got.key, got.shared, got.err, "key", n)
+	}
+	if got.d < 100*time.Millisecond || got.d > 10*time.Second {
+		t.Errorf("OnComplete duration = %v; want about 100ms", got.d)
+	}
+
+	errLeader := errors.New("leader failed")
+	g.Do("other", func() (interface{}, error) { return nil, errLeader })
+	if got := <-completions; got.key != "other" || got.shared != 1 || got.err != errLeader {
+		t.Errorf("OnComplete(%q, _, %d, %v); want (%q, _, 1, %v)", got.key, got.shared, got.err, "other", errLeader)
+	}
+	select {
+	case got := <-completions:
+		t.Errorf("unexpected extra OnComplete(%q)", got.key)
+	default:
+	}
+}
+
 func TestDoPanic(t *testing.T) {
 	var g Group
 	var err error
@@ -149,3 +230,285 @@ func TestDoConcurrentPanic(t *testing.T) {
 		t.Errorf("number of calls = %d; want 1", got)
 	}
 }
+
+func TestDoPanicPropagates(t *testing.T) {
+	var g Group
+	started, release := make(chan struct{}), make(chan struct{})
+	leaderPanic := make(chan interface{}, 1)
+	go func() {
+		defer func() { leaderPanic <- recover() }()
+		g.Do("key", func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := g.Do("key", func() (interface{}, error) {
+			return nil, nil
+		})
+		waiter <- err
+	}()
+	time.Sleep(100 * time.Millisecond) // let the waiter block
+	close(release)
+
+	if got := <-leaderPanic; got != "boom" {
+		t.Errorf("leader recovered %v; want the panic to propagate as %q", got, "boom")
+	}
+	err := <-waiter
+	perr, ok := err.(*PanicError)
+	if !ok {
+		t.Fatalf("waiter error = %v (%T); want *PanicError", err, err)
+	}
+	if perr.Value != "boom" {
+		t.Errorf("PanicError.Value = %v; want %q", perr.Value, "boom")
+	}
+	if !strings.Contains(string(perr.Stack), "TestDoPanicPropagates") {
+		t.Errorf("PanicError.Stack does not show where fn panicked:\n%s", perr.Stack)
+	}
+}
+
+func TestDoChanContextCancelWhenAbandoned(t *testing.T) {
+	var g Group
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	ch1 := g.DoChanContext(ctx1, "key", fn)
+	<-started
+	ch2 := g.DoChanContext(ctx2, "key", fn)
+
+	cancel1()
+	if res := <-ch1; res.Err != context.Canceled {
+		t.Errorf("first waiter error = %v; want %v", res.Err, context.Canceled)
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("call cancelled while a waiter remained")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel2()
+	if res := <-ch2; res.Err != context.Canceled {
+		t.Errorf("second waiter error = %v; want %v", res.Err, context.Canceled)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not cancelled after all waiters left")
+	}
+
+	// A new caller starts a fresh call rather than joining the
+	// cancelled one.
+	res := <-g.DoChanContext(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		return "bar", nil
+	})
+	if res.Err != nil || res.Val != "bar" {
+		t.Errorf("DoChanContext = %v, %v; want bar, nil", res.Val, res.Err)
+	}
+}
+
+func TestDoChanContextShared(t *testing.T) {
+	var g Group
+	c := make(chan string)
+	var calls int32
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return <-c, nil
+	}
+
+	ch1 := g.DoChanContext(context.Background(), "key", fn)
+	ch2 := g.DoChanContext(context.Background(), "key", fn)
+	c <- "bar"
+	for _, ch := range []<-chan Result{ch1, ch2} {
+		if res := <-ch; res.Err != nil || res.Val != "bar" {
+			t.Errorf("DoChanContext = %v, %v; want bar, nil", res.Val, res.Err)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("number of calls = %d; want 1", got)
+	}
+}
+
+func TestDoChan(t *testing.T) {
+	var g Group
+	c := make(chan string)
+	var calls int32
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return <-c, nil
+	}
+
+	ch := g.DoChan("key", fn)
+	select {
+	case res := <-ch:
+		t.Fatalf("DoChan delivered %v before fn returned", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Do and DoChan callers share the in-flight call.
+	done := make(chan interface{})
+	go func() {
+		v, _ := g.Do("key", fn)
+		done <- v
+	}()
+	ch2 := g.DoChan("key", fn)
+	time.Sleep(50 * time.Millisecond) // let Do above block
+	c <- "bar"
+	for _, ch := range []<-chan Result{ch, ch2} {
+		if res := <-ch; res.Err != nil || res.Val != "bar" {
+			t.Errorf("DoChan = %v, %v; want bar, nil", res.Val, res.Err)
+		}
+	}
+	if v := <-done; v != "bar" {
+		t.Errorf("Do = %v; want bar", v)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("number of calls = %d; want 1", got)
+	}
+}
+
+func TestForget(t *testing.T) {
+	var g Group
+	entered, release := make(chan bool), make(chan bool)
+	first := g.DoChan("key", func() (interface{}, error) {
+		entered <- true
+		<-release
+		return "stuck", nil
+	})
+	<-entered
+
+	g.Forget("key")
+	v, err := g.Do("key", func() (interface{}, error) {
+		return "fresh", nil
+	})
+	if err != nil || v != "fresh" {
+		t.Errorf("Do after Forget = %v, %v; want fresh, nil", v, err)
+	}
+
+	// The forgotten call still completes for its callers, and does not
+	// forget a newer call for the key when it does.
+	releaseSecond := make(chan bool)
+	second := g.DoChan("key", func() (interface{}, error) {
+		entered <- true
+		<-releaseSecond
+		return "second", nil
+	})
+	<-entered
+	release <- true
+	if res := <-first; res.Val != "stuck" {
+		t.Errorf("forgotten call = %v; want stuck", res.Val)
+	}
+	joined := g.DoChan("key", func() (interface{}, error) {
+		return "unexpected", nil
+	})
+	close(releaseSecond)
+	for _, ch := range []<-chan Result{second, joined} {
+		if res := <-ch; res.Val != "second" {
+			t.Errorf("DoChan = %v; want second", res.Val)
+		}
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	var g Group
+	started, release := make(chan struct{}), make(chan struct{})
+	var fnErr error
+	fnDone := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			fnErr = ctx.Err()
+		}
+		close(fnDone)
+		return "bar", nil
+	}
+
+	leader, cancelLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() {
+		_, err := g.DoContext(leader, "key", fn)
+		leaderDone <- err
+	}()
+	<-started
+
+	// A waiter whose deadline passes gives up alone.
+	waiter, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.DoContext(waiter, "key", fn); err != context.DeadlineExceeded {
+		t.Errorf("DoContext of an expired waiter error = %v; want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-fnDone:
+		t.Fatal("fn cancelled while the leader still waited")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once the leader gives up too, nobody waits and fn is cancelled.
+	cancelLeader()
+	if err := <-leaderDone; err != context.Canceled {
+		t.Errorf("DoContext of the leader error = %v; want %v", err, context.Canceled)
+	}
+	select {
+	case <-fnDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fn not cancelled after all callers left")
+	}
+	if fnErr != context.Canceled {
+		t.Errorf("fn context error = %v; want %v", fnErr, context.Canceled)
+	}
+
+	v, err := g.DoContext(context.Background(), "key", func(context.Context) (interface{}, error) {
+		return "fresh", nil
+	})
+	if err != nil || v != "fresh" {
+		t.Errorf("DoContext = %v, %v; want fresh, nil", v, err)
+	}
+}
+
+func TestDoEx(t *testing.T) {
+	var g Group
+	entered, release := make(chan bool), make(chan bool)
+	type result struct {
+		v      interface{}
+		shared bool
+	}
+	leader := make(chan result)
+	go func() {
+		v, _, shared := g.DoEx("key", func() (interface{}, error) {
+			entered <- true
+			<-release
+			return "bar", nil
+		})
+		leader <- result{v, shared}
+	}()
+	<-entered
+
+	joined := make(chan result)
+	go func() {
+		v, _, shared := g.DoEx("key", func() (interface{}, error) {
+			return "unexpected", nil
+		})
+		joined <- result{v, shared}
+	}()
+	time.Sleep(50 * time.Millisecond) // let DoEx above block
+	close(release)
+	if r := <-leader; r.v != "bar" || r.shared {
+		t.Errorf("DoEx of the caller running fn = %v, shared %v; want bar, false", r.v, r.shared)
+	}
+	if r := <-joined; r.v != "bar" || !r.shared {
+		t.Errorf("DoEx of a duplicate caller = %v, shared %v; want bar, true", r.v, r.shared)
+	}
+}
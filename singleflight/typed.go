@@ -0,0 +1,111 @@
+//go:build go1.18
+
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package singleflight
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync"
+)
+
+// errGoexit is the error of a typed call whose fn called
+// runtime.Goexit.
+var errGoexit = errors.New("singleflight leader panicked")
+
+// typedCall is an in-flight or completed TypedGroup.Do call.
+type typedCall[V any] struct {
+	done chan struct{} // closed once fn has returned
+	val  V
+	err  error
+}
+
+// TypedGroup is like Group for calls keyed by K that return V, so that
+// neither the keys nor the results are boxed in interface values and
+// callers need no type assertions. The zero value is ready to use.
+type TypedGroup[K comparable, V any] struct {
+	mu sync.Mutex          // protects m
+	m  map[K]*typedCall[V] // lazily initialized
+}
+
+// Do executes and returns the results of the given function, making
+// sure that only one execution is in-flight for a given key at a
+// time, as Group.Do does.
+//
+// If fn panics, the panic propagates to the caller that ran it, while
+// duplicates receive a *PanicError.
+func (g *TypedGroup[K, V]) Do(key K, fn func() (V, error)) (V, error) {
+	v, err, _ := g.DoEx(key, fn)
+	return v, err
+}
+
+// DoEx is like Do but also reports whether the results are shared:
+// true if the caller joined a call started by another caller, false
+// if it ran fn itself.
+func (g *TypedGroup[K, V]) DoEx(key K, fn func() (V, error)) (v V, err error, shared bool) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[K]*typedCall[V])
+	}
+	if c, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.val, c.err, true
+	}
+	c := &typedCall[V]{done: make(chan struct{}), err: errGoexit}
+	g.m[key] = c
+	g.mu.Unlock()
+
+	g.doCall(c, key, fn)
+	return c.val, c.err, false
+}
+
+// doCall runs fn for c and wakes up its waiters. If fn panics, the
+// waiters receive a *PanicError and the panic resumes once they have
+// been woken up.
+func (g *TypedGroup[K, V]) doCall(c *typedCall[V], key K, fn func() (V, error)) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			var zero V
+			c.val, c.err = zero, &PanicError{Value: r, Stack: debug.Stack()}
+		}
+		close(c.done)
+
+		g.mu.Lock()
+		if g.m[key] == c {
+			delete(g.m, key)
+		}
+		g.mu.Unlock()
+
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	c.val, c.err = fn()
+}
+
+// Forget tells the TypedGroup to forget about key, so that later calls
+// for it run fn afresh instead of joining the call in flight, if any.
+// The callers already waiting on that call still receive its results.
+func (g *TypedGroup[K, V]) Forget(key K) {
+	g.mu.Lock()
+	delete(g.m, key)
+	g.mu.Unlock()
+}
@@ -0,0 +1,126 @@
+//go:build go1.18
+
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package singleflight
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type typedKey struct {
+	shard int
+	name  string
+}
+
+func TestTypedDoDupSuppress(t *testing.T) {
+	var g TypedGroup[typedKey, int]
+	c := make(chan int)
+	var calls int32
+	fn := func() (int, error) {
+		atomic.AddInt32(&calls, 1)
+		return <-c, nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	var shared int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, dup := g.DoEx(typedKey{1, "key"}, fn)
+			if err != nil || v != 42 {
+				t.Errorf("DoEx = %d, %v; want 42, nil", v, err)
+			}
+			if dup {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond) // let the goroutines join the call
+	c <- 42
+	wg.Wait()
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("fn called %d times; want 1", got)
+	}
+	if got := atomic.LoadInt32(&shared); got != n-1 {
+		t.Errorf("%d calls shared the results; want %d", got, n-1)
+	}
+
+	// A completed call is not remembered.
+	if v, err := g.Do(typedKey{1, "key"}, func() (int, error) { return 7, nil }); err != nil || v != 7 {
+		t.Errorf("Do after the call = %d, %v; want 7, nil", v, err)
+	}
+}
+
+func TestTypedDoPanic(t *testing.T) {
+	var g TypedGroup[string, string]
+	started, release := make(chan bool), make(chan bool)
+	leaderPanic := make(chan interface{})
+	go func() {
+		defer func() { leaderPanic <- recover() }()
+		g.Do("key", func() (string, error) {
+			started <- true
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	dup := make(chan error)
+	go func() {
+		_, err := g.Do("key", func() (string, error) { return "", nil })
+		dup <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // let the duplicate join the call
+	close(release)
+
+	if r := <-leaderPanic; r != "boom" {
+		t.Errorf("leader recovered %v; want boom", r)
+	}
+	var pe *PanicError
+	if err := <-dup; !errors.As(err, &pe) || pe.Value != "boom" {
+		t.Errorf("duplicate got %v; want a *PanicError of boom", err)
+	}
+}
+
+func TestTypedForget(t *testing.T) {
+	var g TypedGroup[string, int]
+	started, release := make(chan bool), make(chan bool)
+	done := make(chan int)
+	go func() {
+		v, _ := g.Do("key", func() (int, error) {
+			started <- true
+			<-release
+			return 1, nil
+		})
+		done <- v
+	}()
+	<-started
+	g.Forget("key")
+	if v, _ := g.Do("key", func() (int, error) { return 2, nil }); v != 2 {
+		t.Errorf("Do after Forget = %d; want 2", v)
+	}
+	close(release)
+	if v := <-done; v != 1 {
+		t.Errorf("forgotten call = %d; want 1", v)
+	}
+}
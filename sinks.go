@@ -18,6 +18,8 @@ package groupcache
 
 import (
 	"errors"
+	"hash"
+	"io"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -28,11 +30,18 @@ var _ Sink = &allocBytesSink{}
 var _ Sink = &protoSink{}
 var _ Sink = &truncBytesSink{}
 var _ Sink = &byteViewSink{}
+var _ Sink = &readerSink{}
+var _ Sink = &checksumSink{}
+var _ Sink = &ttlSink{}
 
 // A Sink receives data from a Get call.
 //
 // Implementation of Getter must call exactly one of the Set methods
 // on success.
+//
+// A Sink may be reused for sequential Get calls, which reset it
+// first, but not for concurrent ones: it is not safe for concurrent
+// use.
 type Sink interface {
 	// SetString sets the value to s.
 	SetString(s string, e time.Time) error
@@ -45,6 +54,12 @@ type Sink interface {
 	// The caller retains ownership of m.
 	SetProto(m proto.Message, e time.Time) error
 
+	// Reset discards the value last set, as if none had been. The
+	// destination of the sink keeps the value, except for those of a
+	// ByteViewSink and a ReaderSink, which are cleared, and that of a
+	// TruncatingByteSliceSink, which regains its original length.
+	Reset()
+
 	// view returns a frozen view of the bytes for caching.
 	view() (ByteView, error)
 }
@@ -59,7 +74,9 @@ func setSinkView(s Sink, v ByteView) error {
 	// A viewSetter is a Sink that can also receive its value from
 	// a ByteView. This is a fast path to minimize copies when the
 	// item was already cached locally in memory (where it's
-	// cached as a ByteView)
+	// cached as a ByteView). Such views are immutable, so setView
+	// may keep v without copying it; views over bytes that anyone
+	// may still modify must not be passed to setSinkView.
 	type viewSetter interface {
 		setView(v ByteView) error
 	}
@@ -83,6 +100,10 @@ type stringSink struct {
 	// TODO(bradfitz): track whether any Sets were called.
 }
 
+func (s *stringSink) Reset() {
+	s.v = ByteView{}
+}
+
 func (s *stringSink) view() (ByteView, error) {
 	// TODO(bradfitz): return an error if no Set was called
 	return s.v, nil
@@ -132,6 +153,10 @@ type byteViewSink struct {
 	// using a Sink), it's okay to re-use the same one.
 }
 
+func (s *byteViewSink) Reset() {
+	*s.dst = ByteView{}
+}
+
 func (s *byteViewSink) setView(v ByteView) error {
 	*s.dst = v
 	return nil
@@ -174,6 +199,10 @@ type protoSink struct {
 	v ByteView // encoded
 }
 
+func (s *protoSink) Reset() {
+	s.v = ByteView{}
+}
+
 func (s *protoSink) view() (ByteView, error) {
 	return s.v, nil
 }
@@ -181,7 +210,7 @@ func (s *protoSink) view() (ByteView, error) {
 func (s *protoSink) SetBytes(b []byte, e time.Time) error {
 	err := proto.Unmarshal(b, s.dst)
 	if err != nil {
-		return err
+		return &DecodeError{What: "proto value", Err: err}
 	}
 	s.v.b = cloneBytes(b)
 	s.v.s = ""
@@ -193,7 +222,7 @@ func (s *protoSink) SetString(v string, e time.Time) error {
 	b := []byte(v)
 	err := proto.Unmarshal(b, s.dst)
 	if err != nil {
-		return err
+		return &DecodeError{What: "proto value", Err: err}
 	}
 	s.v.b = b
 	s.v.s = ""
@@ -212,7 +241,7 @@ func (s *protoSink) SetProto(m proto.Message, e time.Time) error {
 	// here. This works for now:
 	err = proto.Unmarshal(b, s.dst)
 	if err != nil {
-		return err
+		return &DecodeError{What: "proto value", Err: err}
 	}
 	s.v.b = b
 	s.v.s = ""
@@ -232,6 +261,10 @@ type allocBytesSink struct {
 	v   ByteView
 }
 
+func (s *allocBytesSink) Reset() {
+	s.v = ByteView{}
+}
+
 func (s *allocBytesSink) view() (ByteView, error) {
 	return s.v, nil
 }
@@ -285,14 +318,26 @@ func (s *allocBytesSink) SetString(v string, e time.Time) error {
 // truncated. If fewer bytes are available than len(*dst), *dst
 // is shrunk to fit the number of bytes available.
 func TruncatingByteSliceSink(dst *[]byte) Sink {
-	return &truncBytesSink{dst: dst}
+	s := &truncBytesSink{dst: dst}
+	if dst != nil {
+		s.n = len(*dst)
+	}
+	return s
 }
 
 type truncBytesSink struct {
 	dst *[]byte
+	n   int // original length of *dst
 	v   ByteView
 }
 
+func (s *truncBytesSink) Reset() {
+	s.v = ByteView{}
+	if s.dst != nil && cap(*s.dst) >= s.n {
+		*s.dst = (*s.dst)[:s.n]
+	}
+}
+
 func (s *truncBytesSink) view() (ByteView, error) {
 	return s.v, nil
 }
@@ -336,3 +381,154 @@ func (s *truncBytesSink) SetString(v string, e time.Time) error {
 	s.v.e = e
 	return nil
 }
+
+// ReaderSink returns a Sink that sets *dst to a reader over the value
+// it receives, for callers streaming large values on. Values served
+// from the cache, or fetched from a peer, are read in place rather
+// than copied into a buffer of the caller's. The reader also
+// implements io.Seeker, io.ReaderAt and io.WriterTo.
+func ReaderSink(dst *io.Reader) Sink {
+	if dst == nil {
+		panic("nil dst")
+	}
+	return &readerSink{dst: dst}
+}
+
+type readerSink struct {
+	dst *io.Reader
+	v   ByteView
+}
+
+func (s *readerSink) Reset() {
+	s.v = ByteView{}
+	*s.dst = nil
+}
+
+func (s *readerSink) setView(v ByteView) error {
+	s.v = v
+	*s.dst = v.Reader()
+	return nil
+}
+
+func (s *readerSink) view() (ByteView, error) {
+	return s.v, nil
+}
+
+func (s *readerSink) SetProto(m proto.Message, e time.Time) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setView(ByteView{b: b, e: e})
+}
+
+func (s *readerSink) SetBytes(b []byte, e time.Time) error {
+	return s.setView(ByteView{b: cloneBytes(b), e: e})
+}
+
+func (s *readerSink) SetString(v string, e time.Time) error {
+	return s.setView(ByteView{s: v, e: e})
+}
+
+// A SummingSink is a Sink that also hashes the value it receives.
+type SummingSink interface {
+	Sink
+
+	// Sum returns the hash of the value last set, or of no bytes if
+	// none was.
+	Sum() []byte
+}
+
+// ChecksumSink returns a Sink that passes the value it receives on to
+// inner and feeds it through h as it does, so that once the Get
+// returns, Sum reports the value's hash without another pass over it.
+// h is reset on every Set.
+func ChecksumSink(inner Sink, h hash.Hash) SummingSink {
+	return &checksumSink{inner: inner, h: h}
+}
+
+type checksumSink struct {
+	inner Sink
+	h     hash.Hash
+}
+
+func (s *checksumSink) Sum() []byte {
+	return s.h.Sum(nil)
+}
+
+func (s *checksumSink) Reset() {
+	s.inner.Reset()
+	s.h.Reset()
+}
+
+func (s *checksumSink) view() (ByteView, error) {
+	return s.inner.view()
+}
+
+func (s *checksumSink) setView(v ByteView) error {
+	if err := setSinkView(s.inner, v); err != nil {
+		return err
+	}
+	s.h.Reset()
+	v.WriteTo(s.h)
+	return nil
+}
+
+func (s *checksumSink) SetString(v string, e time.Time) error {
+	if err := s.inner.SetString(v, e); err != nil {
+		return err
+	}
+	s.h.Reset()
+	io.WriteString(s.h, v)
+	return nil
+}
+
+func (s *checksumSink) SetBytes(v []byte, e time.Time) error {
+	if err := s.inner.SetBytes(v, e); err != nil {
+		return err
+	}
+	s.h.Reset()
+	s.h.Write(v)
+	return nil
+}
+
+func (s *checksumSink) SetProto(m proto.Message, e time.Time) error {
+	if err := s.inner.SetProto(m, e); err != nil {
+		return err
+	}
+	// Hash the encoding the inner sink holds, rather than marshaling
+	// m a second time.
+	v, err := s.inner.view()
+	if err != nil {
+		return err
+	}
+	s.h.Reset()
+	v.WriteTo(s.h)
+	return nil
+}
+
+// ttlSink sets the values without an expire time to expire ttl from
+// when they are set, for GroupOptions.DefaultTTL.
+type ttlSink struct {
+	Sink
+	ttl time.Duration
+}
+
+func (s *ttlSink) expire(e time.Time) time.Time {
+	if e.IsZero() {
+		return time.Now().Add(s.ttl)
+	}
+	return e
+}
+
+func (s *ttlSink) SetString(v string, e time.Time) error {
+	return s.Sink.SetString(v, s.expire(e))
+}
+
+func (s *ttlSink) SetBytes(v []byte, e time.Time) error {
+	return s.Sink.SetBytes(v, s.expire(e))
+}
+
+func (s *ttlSink) SetProto(m proto.Message, e time.Time) error {
+	return s.Sink.SetProto(m, s.expire(e))
+}
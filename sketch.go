@@ -0,0 +1,101 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	sketchDepth = 4
+	sketchWidth = 1024 // must be a power of two
+)
+
+// freqSketch is a count-min sketch estimating how often each key has
+// been seen within the current window. Estimates never undercount,
+// but may overcount when keys collide. All counts are reset when the
+// window elapses.
+type freqSketch struct {
+	mu     sync.Mutex
+	window time.Duration
+	start  time.Time
+	counts [sketchDepth][sketchWidth]uint32 // saturating at math.MaxInt32
+	now    func() time.Time                 // for testing; time.Now if nil
+}
+
+func newFreqSketch(window time.Duration) *freqSketch {
+	return &freqSketch{window: window}
+}
+
+// increment records an occurrence of key and returns its estimated
+// number of occurrences within the current window, including this one.
+func (s *freqSketch) increment(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	if t := now(); t.Sub(s.start) >= s.window {
+		s.counts = [sketchDepth][sketchWidth]uint32{}
+		s.start = t
+	}
+
+	min := uint32(math.MaxInt32)
+	for i := range s.counts {
+		c := &s.counts[i][(h1+uint32(i)*h2)&(sketchWidth-1)]
+		if *c < math.MaxInt32 {
+			*c++
+		}
+		if *c < min {
+			min = *c
+		}
+	}
+	return int(min)
+}
+
+// frequencyPromotion is the PromotionPolicy returned by
+// NewFrequencyPromotion.
+type frequencyPromotion struct {
+	sketch     *freqSketch
+	minFetches int
+}
+
+// NewFrequencyPromotion returns a PromotionPolicy mirroring a value in
+// the hot cache once its key has been fetched from a peer minFetches
+// times within window, as GroupOptions.HotCacheMinPeerFetches does.
+// Fetches are counted in a small count-min sketch, which may overcount
+// keys that collide in it but never undercounts. If window is zero,
+// it defaults to one minute.
+func NewFrequencyPromotion(minFetches int, window time.Duration) PromotionPolicy {
+	if window == 0 {
+		window = defaultHotCacheWindow
+	}
+	return &frequencyPromotion{sketch: newFreqSketch(window), minFetches: minFetches}
+}
+
+func (p *frequencyPromotion) Promote(key string, value ByteView) bool {
+	return p.sketch.increment(key) >= p.minFetches
+}
@@ -0,0 +1,317 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Snapshot format, after gzip decompression:
+//
+//	magic "GCSNAP", version byte, flags byte, uvarint-prefixed group name
+//	per entry: snapshotEntry byte, uvarint-prefixed key, uvarint size,
+//	    8-byte big-endian expiry in Unix nanoseconds (0 if none),
+//	    then size value bytes if snapshotValues is set
+//	snapshotEnd byte
+const (
+	snapshotMagic   = "GCSNAP"
+	snapshotVersion = 1
+
+	snapshotValues = 1 << 0 // flag: entries carry their values
+
+	snapshotEnd   = 0
+	snapshotEntry = 1
+)
+
+var (
+	errSnapshotMagic   = errors.New("groupcache: not a snapshot")
+	errSnapshotCorrupt = errors.New("groupcache: corrupt snapshot")
+
+	errSnapshotSizesOnly = errors.New("groupcache: snapshot has no values")
+)
+
+// A Snapshot is the contents of a Group's main cache, as exported by
+// ExportGzip.
+type Snapshot struct {
+	Group     string
+	HasValues bool // false if the snapshot only records sizes
+	Entries   []SnapshotEntry
+}
+
+// A SnapshotEntry is a cache entry recorded in a Snapshot.
+type SnapshotEntry struct {
+	Key    string
+	Size   int       // length of the value in bytes
+	Expire time.Time // zero if the value does not expire
+	Value  []byte    // nil unless Snapshot.HasValues
+}
+
+// ExportGzip writes a gzip-compressed snapshot of the keys in the main
+// cache, with the size and expiry of their values, to w. The values
+// themselves are included unless sizesOnly is true. The snapshot can
+// be read back with ReadSnapshot.
+//
+// The snapshot is a copy of the cache taken at one point in time; the
+// cache is not locked while it is being written. Keys stored by Append
+// are not included.
+func (g *Group) ExportGzip(w io.Writer, sizesOnly bool) error {
+	return g.exportGzip(context.Background(), w, sizesOnly, nil, 0)
+}
+
+// SaveSnapshot writes the keys in the main cache, with their values
+// and expiry, to w, for a later run of the process to restore with
+// LoadSnapshot or GroupOptions.RestoreSnapshot. It is ExportGzip
+// including the values.
+func (g *Group) SaveSnapshot(w io.Writer) error {
+	return g.ExportGzip(w, false)
+}
+
+// LoadSnapshot fills the main cache with the entries of a snapshot of
+// the group written by SaveSnapshot, leaving out those that have
+// expired. The entries read before an error are kept.
+func (g *Group) LoadSnapshot(r io.Reader) error {
+	_, err := g.loadSnapshot(r)
+	return err
+}
+
+// loadSnapshot is LoadSnapshot, also returning the number of entries
+// added to the cache.
+func (g *Group) loadSnapshot(r io.Reader) (n int, err error) {
+	check := func(snap *Snapshot) error {
+		if snap.Group != g.name {
+			return fmt.Errorf("groupcache: snapshot of group %q, not %q", snap.Group, g.name)
+		}
+		if !snap.HasValues {
+			return errSnapshotSizesOnly
+		}
+		return nil
+	}
+	_, err = readSnapshot(r, check, func(e SnapshotEntry) error {
+		value := ByteView{b: e.Value, e: e.Expire}
+		if g.cacheLimit() > 0 && !g.mainCache.expired(value) {
+			g.populateStorageKey(e.Key, value, &g.mainCache)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// restoreSnapshot loads the snapshot of GroupOptions.RestoreSnapshot,
+// logging rather than returning its errors.
+func (g *Group) restoreSnapshot(r io.Reader) {
+	n, err := g.loadSnapshot(r)
+	log := g.logger()
+	if log == nil {
+		return
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":      err,
+			"group":    g.name,
+			"category": "groupcache",
+		}).Errorf("error restoring snapshot")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"group":    g.name,
+		"entries":  n,
+		"category": "groupcache",
+	}).Infof("restored snapshot")
+}
+
+// exportGzip is like ExportGzip but only exports the keys for which
+// keep, if non-nil, returns true, and leaves out the remaining entries
+// once their values would take the total above maxBytes, if positive.
+// It gives up with ctx's error once ctx is done.
+func (g *Group) exportGzip(ctx context.Context, w io.Writer, sizesOnly bool, keep func(key string) bool, maxBytes int64) error {
+	var keys []string
+	var values []ByteView
+	mains, _ := g.allCaches()
+	for _, main := range mains {
+		k, v := main.entries()
+		keys, values = append(keys, k...), append(values, v...)
+	}
+
+	zw := gzip.NewWriter(w)
+	var flags byte
+	if !sizesOnly {
+		flags |= snapshotValues
+	}
+	hdr := append([]byte(snapshotMagic), snapshotVersion, flags)
+	if _, err := zw.Write(appendString(hdr, g.name)); err != nil {
+		return err
+	}
+	var buf []byte
+	var total int64
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if keep != nil && !keep(key) {
+			continue
+		}
+		value := values[i]
+		if value.compressed {
+			var err error
+			if value, err = decompressView(value); err != nil {
+				return err
+			}
+		}
+		if maxBytes > 0 {
+			if total += int64(value.Len()); total > maxBytes {
+				break
+			}
+		}
+		var expire uint64
+		if e := value.Expire(); !e.IsZero() {
+			expire = uint64(e.UnixNano())
+		}
+		buf = appendString(append(buf[:0], snapshotEntry), key)
+		buf = appendUint64(appendUvarint(buf, uint64(value.Len())), expire)
+		if _, err := zw.Write(buf); err != nil {
+			return err
+		}
+		if !sizesOnly {
+			if _, err := value.WriteTo(zw); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := zw.Write([]byte{snapshotEnd}); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadSnapshot reads a snapshot written by Group.ExportGzip from r.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var entries []SnapshotEntry
+	snap, err := readSnapshot(r, nil, func(e SnapshotEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	snap.Entries = entries
+	return snap, nil
+}
+
+// readSnapshot reads a snapshot from r, passing each of its entries to
+// fn as it is read rather than collecting them in Snapshot.Entries.
+// If header is non-nil, it is first given the snapshot's group and
+// flags. readSnapshot stops with the error header or fn returns, if any.
+func readSnapshot(r io.Reader, header func(*Snapshot) error, fn func(SnapshotEntry) error) (*Snapshot, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+
+	magic := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errSnapshotMagic
+	}
+	if v := magic[len(snapshotMagic)]; v != snapshotVersion {
+		return nil, fmt.Errorf("groupcache: unsupported snapshot version %d", v)
+	}
+	snap := &Snapshot{HasValues: magic[len(snapshotMagic)+1]&snapshotValues != 0}
+	if snap.Group, err = readSnapshotString(br); err != nil {
+		return nil, err
+	}
+	if header != nil {
+		if err := header(snap); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		kind, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case snapshotEnd:
+			return snap, nil
+		case snapshotEntry:
+		default:
+			return nil, fmt.Errorf("groupcache: unexpected snapshot record %d", kind)
+		}
+
+		var e SnapshotEntry
+		if e.Key, err = readSnapshotString(br); err != nil {
+			return nil, err
+		}
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		e.Size = int(size)
+		var expire [8]byte
+		if _, err := io.ReadFull(br, expire[:]); err != nil {
+			return nil, err
+		}
+		if ns := int64(binary.BigEndian.Uint64(expire[:])); ns != 0 {
+			e.Expire = time.Unix(0, ns)
+		}
+		if snap.HasValues {
+			if e.Value, err = readSnapshotBytes(br, size); err != nil {
+				return nil, err
+			}
+		}
+		if err := fn(e); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readSnapshotString(br *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	b, err := readSnapshotBytes(br, n)
+	return string(b), err
+}
+
+// readSnapshotBytes reads n bytes from br. The buffer grows as data
+// arrives, so a corrupt length cannot cause a huge allocation.
+func readSnapshotBytes(br *bufio.Reader, n uint64) ([]byte, error) {
+	if int64(n) < 0 {
+		return nil, errSnapshotCorrupt
+	}
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, br, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExportGzip(t *testing.T) {
+	expire := time.Now().Add(time.Hour).Truncate(time.Microsecond)
+	g := newGroup("TestExportGzip-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		if key == "expiring" {
+			return dest.SetString("soon", expire)
+		}
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{})
+	for _, key := range []string{"a", "expiring", "b"} {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []SnapshotEntry{
+		{Key: "b", Size: len("value:b"), Value: []byte("value:b")},
+		{Key: "expiring", Size: len("soon"), Expire: expire, Value: []byte("soon")},
+		{Key: "a", Size: len("value:a"), Value: []byte("value:a")},
+	}
+	for _, sizesOnly := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := g.ExportGzip(&buf, sizesOnly); err != nil {
+			t.Fatal(err)
+		}
+		snap, err := ReadSnapshot(&buf)
+		if err != nil {
+			t.Fatalf("ReadSnapshot(sizesOnly=%v): %v", sizesOnly, err)
+		}
+		if snap.Group != g.Name() || snap.HasValues == sizesOnly {
+			t.Errorf("snapshot of group %q, HasValues %v; want %q, %v", snap.Group, snap.HasValues, g.Name(), !sizesOnly)
+		}
+		if len(snap.Entries) != len(want) {
+			t.Fatalf("snapshot has %d entries; want %d", len(snap.Entries), len(want))
+		}
+		for i, got := range snap.Entries {
+			w := want[i]
+			if sizesOnly {
+				w.Value = nil
+			}
+			if got.Key != w.Key || got.Size != w.Size || !got.Expire.Equal(w.Expire) || !bytes.Equal(got.Value, w.Value) {
+				t.Errorf("entry %d = %+v; want %+v", i, got, w)
+			}
+		}
+	}
+}
+
+func TestReadSnapshotCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("GCSNAP\x01\x01\x04name\x01\x03key\x05"))
+	zw.Close()
+	if _, err := ReadSnapshot(&buf); err == nil {
+		t.Error("ReadSnapshot of a truncated snapshot succeeded")
+	}
+
+	buf.Reset()
+	zw = gzip.NewWriter(&buf)
+	zw.Write([]byte("not a snapshot"))
+	zw.Close()
+	if _, err := ReadSnapshot(&buf); err != errSnapshotMagic {
+		t.Errorf("ReadSnapshot of foreign data error = %v; want %v", err, errSnapshotMagic)
+	}
+}
+
+func TestExportGzipCompressInMemory(t *testing.T) {
+	g := newGroupOpts("TestExportGzipCompressInMemory-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString(compressibleValue(key), time.Time{})
+	}), NoPeers{}, &GroupOptions{CompressInMemory: true})
+	var s string
+	if err := g.Get(dummyCtx, "key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := g.ExportGzip(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := compressibleValue("key")
+	if len(snap.Entries) != 1 || snap.Entries[0].Size != len(want) || string(snap.Entries[0].Value) != want {
+		t.Errorf("snapshot entries = %+v; want the decompressed value", snap.Entries)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	const name = "TestRestoreSnapshot-group"
+	now := time.Now()
+	clock := func() time.Time { return now }
+	var loads int
+	getter := GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads++
+		if key == "expiring" {
+			return dest.SetString("soon", now.Add(time.Minute))
+		}
+		return dest.SetString("value:"+key, now.Add(time.Hour))
+	})
+	g := newGroupOpts(name, cacheSize, getter, NoPeers{}, &GroupOptions{Clock: clock})
+	for _, key := range []string{"a", "b", "expiring"} {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := g.SaveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.Bytes()
+
+	// Restart the group after the expiring value has expired.
+	DeregisterGroup(name)
+	now = now.Add(2 * time.Minute)
+	loads = 0
+	g = newGroupOpts(name, cacheSize, getter, NoPeers{}, &GroupOptions{Clock: clock, RestoreSnapshot: bytes.NewReader(saved)})
+	defer DeregisterGroup(name)
+	if n := g.CacheStats(MainCache).Items; n != 2 {
+		t.Errorf("restored %d items; want 2", n)
+	}
+	for _, key := range []string{"a", "b"} {
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil {
+			t.Fatal(err)
+		}
+		if s != "value:"+key {
+			t.Errorf("Get(%q) = %q; want %q", key, s, "value:"+key)
+		}
+	}
+	if loads != 0 {
+		t.Errorf("restored keys loaded %d times; want 0", loads)
+	}
+	var s string
+	if err := g.Get(dummyCtx, "expiring", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 1 {
+		t.Errorf("expired key loaded %d times; want 1", loads)
+	}
+
+	// Snapshots of another group or without values are refused.
+	other := newGroupOpts(name+"-other", cacheSize, getter, NoPeers{}, &GroupOptions{Clock: clock})
+	if err := other.LoadSnapshot(bytes.NewReader(saved)); err == nil {
+		t.Error("LoadSnapshot of another group's snapshot succeeded")
+	}
+	buf.Reset()
+	if err := g.ExportGzip(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.LoadSnapshot(&buf); err != errSnapshotSizesOnly {
+		t.Errorf("LoadSnapshot of a sizes-only snapshot = %v; want %v", err, errSnapshotSizesOnly)
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/melojustme/groupcache/lru"
+	"github.com/sirupsen/logrus"
+)
+
+// A SpillStore keeps the values evicted from a group's main cache,
+// typically on local disk, for GroupOptions.SpillStore. The group
+// encodes each value, with its expire time and metadata, into an
+// opaque record stored under the key as the cache stores it. Its
+// methods may be called concurrently.
+type SpillStore interface {
+	// Put stores record under key, replacing any record stored
+	// before. The store may drop records, for example to stay within
+	// its capacity.
+	Put(key string, record []byte) error
+
+	// Get returns the record stored under key, or nil if there is
+	// none.
+	Get(key string) ([]byte, error)
+
+	// Remove forgets the record stored under key, if any.
+	Remove(key string) error
+}
+
+// spillVersion is the first byte of spill records.
+const spillVersion = 1
+
+var errSpillRecord = errors.New("groupcache: corrupt spill record")
+
+// encodeSpill returns the spill record of value, stored under the
+// given generation.
+func encodeSpill(value ByteView, gen uint64) []byte {
+	var expire uint64
+	if !value.e.IsZero() {
+		expire = uint64(value.e.UnixNano())
+	}
+	b := make([]byte, 0, 1+8+8+len(value.meta)+1+value.Len())
+	b = append(b, spillVersion)
+	b = appendUint64(b, gen)
+	b = appendUint64(b, expire)
+	b = appendString(b, string(value.meta))
+	if value.b != nil {
+		return append(b, value.b...)
+	}
+	return append(b, value.s...)
+}
+
+// decodeSpill returns the value held by the spill record b and the
+// generation it was stored under.
+func decodeSpill(b []byte) (value ByteView, gen uint64, err error) {
+	d := rawDecoder{b: b}
+	if d.byte() != spillVersion && d.err == nil {
+		return ByteView{}, 0, errSpillRecord
+	}
+	gen = d.uint64()
+	expire := d.uint64()
+	meta := d.string()
+	if d.err != nil {
+		return ByteView{}, 0, errSpillRecord
+	}
+	value.b = d.b
+	if expire != 0 {
+		value.e = time.Unix(0, int64(expire))
+	}
+	if meta != "" {
+		value.meta = []byte(meta)
+	}
+	return value, gen, nil
+}
+
+// spillEvicted stores the values evicted from the main cache in the
+// GroupOptions.SpillStore, then hands them to OnEvicted, if set.
+// Values removed, of an older generation, expired or tagged are not
+// spilled: they are no longer current, or InvalidateTag could not
+// reach them.
+func (g *Group) spillEvicted(entries []evictedEntry) {
+	gen := atomic.LoadUint64(&g.generation)
+	now := g.clock()
+	for _, e := range entries {
+		stored := e.value
+		if e.removed || stored.gen < gen || len(stored.tags) > 0 || !stored.e.IsZero() && !stored.e.After(now) {
+			continue
+		}
+		value, ok := g.cachedView(e.key, stored)
+		if !ok {
+			continue
+		}
+		if err := g.opts.SpillStore.Put(e.key, encodeSpill(value, stored.gen)); err != nil {
+			g.logSpillError(e.key, err, "error spilling evicted value")
+			continue
+		}
+		g.Stats.Spills.Add(1)
+	}
+	if g.opts.OnEvicted != nil {
+		g.dispatchEvicted(entries)
+	}
+}
+
+// loadSpilled returns the value of key kept by the
+// GroupOptions.SpillStore, moving it back into the main cache.
+func (g *Group) loadSpilled(key string) (ByteView, bool) {
+	if g.opts.SpillStore == nil || g.cacheLimit() <= 0 {
+		return ByteView{}, false
+	}
+	sk := g.storageKey(key)
+	record, err := g.opts.SpillStore.Get(sk)
+	if err != nil {
+		g.logSpillError(key, err, "error reading spilled value")
+		return ByteView{}, false
+	}
+	if record == nil {
+		return ByteView{}, false
+	}
+	value, gen, err := decodeSpill(record)
+	if err == nil && gen >= atomic.LoadUint64(&g.generation) && (value.e.IsZero() || value.e.After(g.clock())) {
+		g.Stats.SpillHits.Add(1)
+		g.populateStorageKey(sk, value, &g.mainCache)
+		return value, true
+	}
+	if err != nil {
+		g.logSpillError(key, err, "error decoding spilled value")
+	}
+	g.forgetSpilled(key)
+	return ByteView{}, false
+}
+
+// forgetSpilled removes any value of key from the
+// GroupOptions.SpillStore, as a value was stored or removed for it.
+func (g *Group) forgetSpilled(key string) {
+	if g.opts.SpillStore == nil {
+		return
+	}
+	if err := g.opts.SpillStore.Remove(g.storageKey(key)); err != nil {
+		g.logSpillError(key, err, "error removing spilled value")
+	}
+}
+
+func (g *Group) logSpillError(key string, err error, msg string) {
+	if log := g.logger(); log != nil {
+		log.WithFields(logrus.Fields{
+			"err":      err,
+			"key":      key,
+			"category": "groupcache",
+		}).Error(msg)
+	}
+}
+
+// FileSpillStore is a SpillStore keeping each record in a file of its
+// own in a directory, such as one on a local SSD. It deletes the least
+// recently used records to keep their total size within a limit.
+// Records left in the directory by an earlier FileSpillStore are used
+// too, so the spilled values survive restarts.
+type FileSpillStore struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	files *lru.Cache // of int64 file size, by file name
+	bytes int64
+}
+
+// NewFileSpillStore returns a FileSpillStore keeping records in dir,
+// which is created if needed, and deleting the least recently used
+// ones while they take more than maxBytes. If maxBytes is zero, the
+// records are not limited in size.
+func NewFileSpillStore(dir string, maxBytes int64) (*FileSpillStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileSpillStore{dir: dir, maxBytes: maxBytes, files: lru.New(0)}
+	s.files.OnEvictedReason = func(key lru.Key, value interface{}, info lru.EvictionInfo) {
+		s.bytes -= value.(int64)
+		if info.Reason == lru.EvictedCapacity {
+			os.Remove(filepath.Join(s.dir, key.(string)))
+		}
+	}
+	// The oldest files are the least recently used.
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Name(), "tmp-") {
+			// Left by a Put interrupted by a crash.
+			os.Remove(filepath.Join(dir, fi.Name()))
+			continue
+		}
+		if fi.Mode().IsRegular() && len(fi.Name()) == 2*sha256.Size {
+			s.files.Add(fi.Name(), fi.Size(), time.Time{})
+			s.bytes += fi.Size()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trimLocked()
+	return s, nil
+}
+
+// name returns the name of the file holding key's record.
+func (s *FileSpillStore) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Put writes record to the file of key, through a temporary file so
+// that readers never see a partial record.
+func (s *FileSpillStore) Put(key string, record []byte) error {
+	b := appendString(nil, key)
+	b = append(b, record...)
+	tmp, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	name := s.name(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.files.Remove(name)
+	s.files.Add(name, int64(len(b)), time.Time{})
+	s.bytes += int64(len(b))
+	s.trimLocked()
+	return nil
+}
+
+// Get reads the record in the file of key.
+func (s *FileSpillStore) Get(key string) ([]byte, error) {
+	name := s.name(key)
+	s.mu.Lock()
+	_, ok := s.files.Get(name)
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := rawDecoder{b: b}
+	if d.string() != key || d.err != nil {
+		// Another key hashing alike, or a damaged file.
+		return nil, nil
+	}
+	return d.b, nil
+}
+
+// Remove deletes the file of key.
+func (s *FileSpillStore) Remove(key string) error {
+	name := s.name(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files.Peek(name); !ok {
+		return nil
+	}
+	s.files.Remove(name)
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// trimLocked deletes the least recently used files while the records
+// take more than maxBytes.
+func (s *FileSpillStore) trimLocked() {
+	for s.maxBytes > 0 && s.bytes > s.maxBytes && s.files.Len() > 0 {
+		s.files.RemoveOldest()
+	}
+}
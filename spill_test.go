@@ -0,0 +1,127 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpillStore(t *testing.T) {
+	store, err := NewFileSpillStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loads AtomicInt
+	g := newGroupOpts("TestSpillStore-group", 100, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("value:"+key, time.Time{})
+	}), NoPeers{}, &GroupOptions{SpillStore: store})
+	get := func(key string) {
+		t.Helper()
+		var s string
+		if err := g.Get(dummyCtx, key, StringSink(&s), nil); err != nil || s != "value:"+key {
+			t.Fatalf("Get(%q) = %q, %v", key, s, err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		get(fmt.Sprintf("key-%d", i))
+	}
+	if _, ok := g.Contains("key-0"); ok {
+		t.Fatal("key-0 still cached in memory; want it evicted")
+	}
+	if g.Stats.Spills.Get() == 0 {
+		t.Fatal("no evicted value was spilled")
+	}
+
+	// Spilled values come back without a load.
+	loads.Store(0)
+	get("key-0")
+	if loads.Get() != 0 || g.Stats.SpillHits.Get() != 1 {
+		t.Errorf("loads, SpillHits = %d, %d; want 0, 1", loads.Get(), g.Stats.SpillHits.Get())
+	}
+	if _, ok := g.Contains("key-0"); !ok {
+		t.Error("spilled value not moved back into the main cache")
+	}
+
+	// Removed keys and older generations are not served from the store.
+	if err := g.Remove(dummyCtx, "key-1"); err != nil {
+		t.Fatal(err)
+	}
+	get("key-1")
+	if loads.Get() != 1 {
+		t.Errorf("loads after Remove = %d; want 1", loads.Get())
+	}
+	g.SetGeneration(1)
+	get("key-2")
+	if loads.Get() != 2 {
+		t.Errorf("loads after SetGeneration = %d; want 2", loads.Get())
+	}
+}
+
+func TestFileSpillStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileSpillStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(s *FileSpillStore, key string) string {
+		t.Helper()
+		b, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.Put(key, []byte(strings.Repeat(key, 20))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := get(s, "a"); got != strings.Repeat("a", 20) {
+		t.Errorf("Get(a) = %q", got)
+	}
+	if err := s.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(s, "b"); got != "" {
+		t.Errorf("Get of a removed key = %q; want nothing", got)
+	}
+
+	// The records survive a restart, within the size limit: each
+	// takes 22 bytes with its key.
+	s, err = NewFileSpillStore(dir, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get(s, "c"); got != strings.Repeat("c", 20) {
+		t.Errorf("Get(c) after reopening = %q", got)
+	}
+	if err := s.Put("d", []byte(strings.Repeat("d", 20))); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(s, "a"); got != "" {
+		t.Errorf("Get of the least recently used key beyond the limit = %q; want nothing", got)
+	}
+	if got := get(s, "d"); got != strings.Repeat("d", 20) {
+		t.Errorf("Get(d) = %q", got)
+	}
+}
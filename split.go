@@ -0,0 +1,136 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Defaults for the GroupOptions.AdaptiveCacheSplit settings.
+const (
+	defaultAdaptiveSplitInterval = 1000
+	defaultAdaptiveSplitStep     = 1.0 / 32
+	defaultAdaptiveSplitMinHot   = 1.0 / 64
+	defaultAdaptiveSplitMaxHot   = 1.0 / 2
+)
+
+// cacheSplit tracks how many of a group's cache bytes the hot cache
+// may hold when GroupOptions.AdaptiveCacheSplit is set.
+//
+// Every interval gets, it compares the hits each cache served since
+// the previous adjustment per byte it holds, and moves the hot cache's
+// limit one step towards the cache with the higher density, within
+// [min, max]. The limit thus climbs towards the split at which a byte
+// is worth as much in either cache.
+type cacheSplit struct {
+	// gets and hotLimit come first so that they are 8-byte aligned
+	// for atomic operations on 32-bit platforms too.
+	gets     int64
+	hotLimit int64
+
+	interval       int64
+	step, min, max int64 // in bytes
+
+	mu           sync.Mutex
+	lastMainHits int64
+	lastHotHits  int64
+}
+
+func newCacheSplit(cacheBytes int64, o *GroupOptions) *cacheSplit {
+	frac := func(f float64) int64 { return int64(f * float64(cacheBytes)) }
+	s := &cacheSplit{
+		// Start where the static split settles, with the hot cache
+		// an eighth the size of the main cache.
+		hotLimit: cacheBytes / 9,
+		interval: int64(o.AdaptiveSplitInterval),
+		step:     frac(o.AdaptiveSplitStep),
+		min:      frac(o.AdaptiveSplitMinHot),
+		max:      frac(o.AdaptiveSplitMaxHot),
+	}
+	if s.step < 1 {
+		s.step = 1
+	}
+	s.hotLimit = s.clamp(s.hotLimit)
+	return s
+}
+
+func (s *cacheSplit) clamp(limit int64) int64 {
+	if limit < s.min {
+		return s.min
+	}
+	if limit > s.max {
+		return s.max
+	}
+	return limit
+}
+
+// limit returns how many bytes the hot cache may currently hold.
+func (s *cacheSplit) limit() int64 {
+	return atomic.LoadInt64(&s.hotLimit)
+}
+
+// observeGet counts a Get, rebalancing the caches every interval gets.
+func (g *Group) observeGet() {
+	s := g.split
+	if s == nil || atomic.AddInt64(&s.gets, 1)%s.interval != 0 {
+		return
+	}
+	g.rebalanceCaches()
+}
+
+// rebalanceCaches moves the hot cache's limit one step towards the
+// cache that served more hits per byte since the last call.
+func (g *Group) rebalanceCaches() {
+	s := g.split
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	main, hot := g.mainCache.stats(), g.hotCache.stats()
+	mainHits, hotHits := main.Hits-s.lastMainHits, hot.Hits-s.lastHotHits
+	s.lastMainHits, s.lastHotHits = main.Hits, hot.Hits
+
+	density := func(hits, bytes int64) float64 {
+		if bytes <= 0 {
+			bytes = 1
+		}
+		return float64(hits) / float64(bytes)
+	}
+	mainDensity, hotDensity := density(mainHits, main.Bytes), density(hotHits, hot.Bytes)
+
+	limit := s.limit()
+	switch {
+	case hotDensity > mainDensity:
+		limit += s.step
+	case hotDensity < mainDensity:
+		limit -= s.step
+	default:
+		return
+	}
+	atomic.StoreInt64(&s.hotLimit, s.clamp(limit))
+}
+
+// HotCacheLimit returns how many bytes of the group's cache the hot
+// cache may hold when GroupOptions.AdaptiveCacheSplit is set, or -1
+// if the split is static. The limit only applies once the caches are
+// full: until then the hot cache may use any bytes left free.
+func (g *Group) HotCacheLimit() int64 {
+	if g.split == nil {
+		return -1
+	}
+	return g.split.limit()
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/melojustme/groupcache/groupcachepb"
+)
+
+// SetWithTags is like Set, but also associates value with tags, so
+// that InvalidateTag can later remove it along with every other value
+// sharing one of them. The tags are stored with the value by the
+// key's owner, and sent along with it to the peers mirroring it in
+// their hot caches. The caller retains ownership of tags.
+//
+// Tags are counted towards the cache size like the value. Each cache
+// also indexes its keys by tag, which costs a map entry per tag of
+// each tagged entry, not counted towards the cache size; an entry
+// leaves the index when it is evicted, removed, replaced or expires.
+func (g *Group) SetWithTags(ctx context.Context, key string, value []byte, expire time.Time, hotCache bool, tags []string) error {
+	return g.set(ctx, key, value, expire, hotCache, append([]string(nil), tags...))
+}
+
+// InvalidateTag removes from this process's caches all the values
+// stored with tag by SetWithTags, then asks every peer to do the same.
+// It returns the error of one of the peers that failed, if any.
+func (g *Group) InvalidateTag(ctx context.Context, tag string) error {
+	g.peersOnce.Do(g.initPeers)
+	if tag == "" {
+		return errors.New("empty InvalidateTag() tag not allowed")
+	}
+	g.localRemoveTag(tag)
+
+	peers := g.peers.GetAll()
+	errs := make(chan error, len(peers))
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer ProtoGetter) {
+			defer wg.Done()
+			req := &pb.GetRequest{
+				Group: &g.name,
+				Key:   &tag,
+			}
+			if err := peer.RemoveTag(ctx, req); err != nil {
+				errs <- &PeerError{Peer: peer, Err: err}
+			}
+		}(peer)
+	}
+	wg.Wait()
+	close(errs)
+	var err error
+	for e := range errs {
+		err = e
+	}
+	return err
+}
+
+// localRemoveTag removes the values stored with tag from this
+// process's caches.
+func (g *Group) localRemoveTag(tag string) {
+	if g.cacheLimit() <= 0 {
+		return
+	}
+	mains, hots := g.allCaches()
+	// Ensure no requests are in flight
+	g.loadGroup.Lock(func() {
+		for _, c := range append(mains, hots...) {
+			for _, key := range c.taggedKeys(tag) {
+				c.remove(key)
+				g.Stats.TagInvalidations.Add(1)
+			}
+		}
+	})
+}
+
+// tagLocked indexes key under each of tags.
+func (c *cache) tagLocked(key string, tags []string) {
+	for _, tag := range tags {
+		if c.tagged == nil {
+			c.tagged = make(map[string]map[string]struct{})
+		}
+		keys := c.tagged[tag]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			c.tagged[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// untagLocked removes key from the index of each of tags, dropping
+// the tags no other key has.
+func (c *cache) untagLocked(key string, tags []string) {
+	for _, tag := range tags {
+		keys := c.tagged[tag]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(c.tagged, tag)
+		}
+	}
+}
+
+// taggedKeys returns the keys of the entries stored with tag.
+func (c *cache) taggedKeys(tag string) []string {
+	if c.shards != nil {
+		var keys []string
+		for _, s := range c.shards {
+			keys = append(keys, s.taggedKeys(tag)...)
+		}
+		return keys
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.tagged[tag]))
+	for key := range c.tagged[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// taggedLen returns the number of tags indexed by the cache, counting
+// a tag once for each shard indexing it.
+func (c *cache) taggedLen() int {
+	if c.shards != nil {
+		n := 0
+		for _, s := range c.shards {
+			n += s.taggedLen()
+		}
+		return n
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.tagged)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidateTag(t *testing.T) {
+	var loads AtomicInt
+	peer := &fakePeer{}
+	g := newGroup("TestInvalidateTag-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		loads.Add(1)
+		return dest.SetString("loaded:"+key, time.Time{})
+	}), keyPeers{"remote": peer})
+
+	ctx := context.Background()
+	for key, tags := range map[string][]string{"a": {"user:1"}, "b": {"user:1", "user:2"}, "c": {"user:2"}} {
+		if err := g.SetWithTags(ctx, key, []byte("set:"+key), time.Time{}, false, tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Set(ctx, "d", []byte("set:d"), time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	hits := peer.hits
+	if err := g.InvalidateTag(ctx, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if peer.hits != hits+1 {
+		t.Errorf("InvalidateTag asked %d peers; want 1", peer.hits-hits)
+	}
+	for key, want := range map[string]bool{"a": false, "b": false, "c": true, "d": true} {
+		if _, ok := g.Contains(key); ok != want {
+			t.Errorf("after InvalidateTag, Contains(%s) = %v; want %v", key, ok, want)
+		}
+	}
+	if got := g.Stats.TagInvalidations.Get(); got != 2 {
+		t.Errorf("TagInvalidations = %d; want 2", got)
+	}
+	// b left the index of its other tag too.
+	if got := g.mainCache.taggedKeys("user:2"); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("keys tagged user:2 = %v; want [c]", got)
+	}
+
+	// Retagging a key replaces its tags.
+	if err := g.SetWithTags(ctx, "c", []byte("set:c"), time.Time{}, false, []string{"user:3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.mainCache.taggedKeys("user:2"); len(got) != 0 {
+		t.Errorf("keys tagged user:2 after retagging c = %v; want none", got)
+	}
+	if err := g.InvalidateTag(ctx, "user:3"); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := g.Get(ctx, "c", StringSink(&s), nil); err != nil || s != "loaded:c" {
+		t.Errorf("Get(c) after InvalidateTag = %q, %v; want it loaded again", s, err)
+	}
+	if got := g.mainCache.taggedLen(); got != 0 {
+		t.Errorf("%d tags left indexed; want 0", got)
+	}
+
+	peer.fail = true
+	if err := g.InvalidateTag(ctx, "user:2"); err == nil {
+		t.Error("InvalidateTag with a failing peer succeeded")
+	}
+}
+
+func TestTagIndexEviction(t *testing.T) {
+	const value = 100
+	g := newGroup("TestTagIndexEviction-group", 3*value, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		return dest.SetString("unused", time.Time{})
+	}), NoPeers{})
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := g.SetWithTags(ctx, key, []byte(strings.Repeat("x", value)), time.Time{}, false, []string{"tag-" + key, "shared"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items := int(g.CacheStats(MainCache).Items)
+	if items == 0 || items == 10 {
+		t.Fatalf("cache holds %d of the 10 keys; want some evicted", items)
+	}
+	if got := g.mainCache.taggedLen(); got != items+1 {
+		t.Errorf("%d tags indexed; want %d, those of the %d cached keys and shared", got, items+1, items)
+	}
+	shared := g.mainCache.taggedKeys("shared")
+	sort.Strings(shared)
+	var want []string
+	for i := 10 - items; i < 10; i++ {
+		want = append(want, fmt.Sprintf("key-%d", i))
+	}
+	if !reflect.DeepEqual(shared, want) {
+		t.Errorf("keys tagged shared = %v; want the cached %v", shared, want)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import "sort"
+
+// tenantCache holds the keys of a tenant given its own byte budget by
+// GroupOptions.TenantBudgets.
+type tenantCache struct {
+	main, hot cache
+	budget    int64 // limit for sum of main and hot size
+}
+
+// initTenants creates the partitions of the tenants in
+// GroupOptions.TenantBudgets.
+func (g *Group) initTenants() {
+	if g.opts.KeyTenant == nil || len(g.opts.TenantBudgets) == 0 {
+		return
+	}
+	g.tenants = make(map[string]*tenantCache, len(g.opts.TenantBudgets))
+	for tenant, budget := range g.opts.TenantBudgets {
+		t := &tenantCache{budget: budget}
+		g.initCaches(&t.main, &t.hot)
+		g.tenants[tenant] = t
+		g.tenantBytes += budget
+	}
+}
+
+// sharedBytes returns the bytes of the cache size left to the group's
+// own caches by the tenants in GroupOptions.TenantBudgets.
+func (g *Group) sharedBytes() int64 {
+	if n := g.cacheLimit() - g.tenantBytes; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// caches returns the main and hot caches holding key, a storage key,
+// and the number of bytes they may hold together: those of key's
+// tenant if it has a budget, and the group's own caches otherwise.
+func (g *Group) caches(key string) (main, hot *cache, limit int64) {
+	if g.tenants != nil {
+		if t := g.tenants[g.opts.KeyTenant(key)]; t != nil {
+			return &t.main, &t.hot, t.budget
+		}
+	}
+	return &g.mainCache, &g.hotCache, g.sharedBytes()
+}
+
+// allCaches returns each main cache of the group with the hot cache
+// sharing its budget: the group's own, then those of the tenants in
+// GroupOptions.TenantBudgets sorted by name.
+func (g *Group) allCaches() (mains, hots []*cache) {
+	mains, hots = []*cache{&g.mainCache}, []*cache{&g.hotCache}
+	names := make([]string, 0, len(g.tenants))
+	for tenant := range g.tenants {
+		names = append(names, tenant)
+	}
+	sort.Strings(names)
+	for _, tenant := range names {
+		t := g.tenants[tenant]
+		mains, hots = append(mains, &t.main), append(hots, &t.hot)
+	}
+	return mains, hots
+}
+
+// TenantCacheStats returns stats about the provided cache of tenant's
+// partition. It returns zero stats unless tenant has a budget in
+// GroupOptions.TenantBudgets.
+func (g *Group) TenantCacheStats(tenant string, which CacheType) CacheStats {
+	t := g.tenants[tenant]
+	if t == nil {
+		return CacheStats{}
+	}
+	switch which {
+	case MainCache:
+		return t.main.stats()
+	case HotCache:
+		return t.hot.stats()
+	default:
+		return CacheStats{}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults for the GroupOptions.ThrashThreshold settings.
+const (
+	defaultThrashWindow   = 1000
+	defaultThrashCooldown = 10 * time.Second
+)
+
+// thrashGuard measures, over windows of values loaded into the main
+// cache, how many entries each of them evicted and how many hits the
+// cache served meanwhile, to stop caching loaded values for a while
+// once the cache thrashes.
+type thrashGuard struct {
+	window int64
+
+	mu        sync.Mutex
+	adds      int64     // values cached in the current window
+	evictions int64     // entries they evicted
+	hits      int64     // main cache hits when the window started
+	until     time.Time // of the current episode
+}
+
+// admitting reports whether loaded values may be cached at now, that
+// is unless a thrash episode is under way. A nil guard always admits.
+func (t *thrashGuard) admitting(now time.Time) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !now.Before(t.until)
+}
+
+// observeAdd records a loaded value cached in the main cache, which
+// evicted evicted entries, starting a thrash episode if the window it
+// completes shows the cache thrashing.
+func (g *Group) observeAdd(evicted int) {
+	t := g.thrash
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.adds++
+	t.evictions += int64(evicted)
+	if t.adds < t.window {
+		return
+	}
+	hits := g.CacheStats(MainCache).Hits
+	ratio := float64(t.evictions) / float64(t.adds)
+	thrashing := ratio >= g.opts.ThrashThreshold && hits-t.hits < t.adds
+	t.adds, t.evictions, t.hits = 0, 0, hits
+	if !thrashing {
+		return
+	}
+	t.until = g.clock().Add(g.opts.ThrashCooldown)
+	g.Stats.ThrashEpisodes.Add(1)
+	if log := g.logger(); log != nil {
+		log.WithFields(logrus.Fields{
+			"group":           g.name,
+			"evictionsPerAdd": ratio,
+			"cooldown":        g.opts.ThrashCooldown,
+			"category":        "groupcache",
+		}).Warnf("main cache is thrashing; not caching loaded values for a while")
+	}
+}
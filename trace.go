@@ -0,0 +1,84 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import "context"
+
+// A Tracer starts the spans of the Gets of a group, for
+// GroupOptions.Tracer, such as an adapter over an OpenTelemetry
+// tracer. Each Get records a "groupcache.Get" span, with these spans
+// as its children:
+//
+//   - "groupcache.lookupCache", the lookup of the main and hot caches,
+//     with a "groupcache.cache" attribute naming the cache hit, if any;
+//   - "groupcache.getFromPeer", each fetch of the key from a peer, with
+//     a "groupcache.peer" attribute holding the peer's URL;
+//   - "groupcache.getter", the call of the getter loading the key.
+//
+// Every span also has "groupcache.group" and "groupcache.key"
+// attributes. Peer fetches receive the context of their span, so that
+// HTTPPoolOptions.RequestModifier can inject it into the request
+// headers, and HTTPPoolOptions.Context extract it on the peer.
+type Tracer interface {
+	// Start starts a span named name, as a child of the span of ctx
+	// if any, and returns a copy of ctx carrying it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute of the span.
+	SetAttribute(key, value string)
+
+	// End ends the span, which failed with err if non-nil.
+	End(err error)
+}
+
+// startSpan starts a span named name for key with the group's Tracer.
+// It returns ctx and a nil span if the group has no Tracer.
+func (g *Group) startSpan(ctx context.Context, name, key string) (context.Context, Span) {
+	t := g.opts.Tracer
+	if t == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := t.Start(ctx, name)
+	span.SetAttribute("groupcache.group", g.name)
+	span.SetAttribute("groupcache.key", key)
+	return ctx, span
+}
+
+// endSpan ends span, if non-nil.
+func endSpan(span Span, err error) {
+	if span != nil {
+		span.End(err)
+	}
+}
+
+// spanCacheName returns the "groupcache.cache" attribute of a lookup
+// finding key in which.
+func spanCacheName(which CacheType) string {
+	switch which {
+	case MainCache:
+		return "main"
+	case HotCache:
+		return "hot"
+	}
+	return ""
+}
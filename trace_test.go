@@ -0,0 +1,122 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTracer records the spans it starts, as "parent/name" paths.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	path  string
+	attrs map[string]string
+	ended bool
+	err   error
+}
+
+type spanKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	path := name
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		path = parent.path + "/" + name
+	}
+	s := &recordedSpan{path: path, attrs: map[string]string{}}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *recordedSpan) SetAttribute(key, value string) { s.attrs[key] = value }
+func (s *recordedSpan) End(err error)                  { s.ended, s.err = true, err }
+
+// take returns the spans recorded since the last call.
+func (t *recordingTracer) take() []*recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := t.spans
+	t.spans = nil
+	return spans
+}
+
+func spanPaths(spans []*recordedSpan) []string {
+	var paths []string
+	for _, s := range spans {
+		paths = append(paths, s.path)
+	}
+	return paths
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	peer := &fakePeer{}
+	g := newGroupOpts("TestTracer-group", cacheSize, GetterFunc(func(_ context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		if key == "failing" {
+			return errors.New("origin down")
+		}
+		return dest.SetString("value:"+key, time.Time{})
+	}), prefixPeers{peer}, &GroupOptions{Tracer: tracer})
+
+	var s string
+	if err := g.Get(dummyCtx, "local", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	spans := tracer.take()
+	if got, want := spanPaths(spans), []string{"groupcache.Get", "groupcache.Get/groupcache.lookupCache", "groupcache.Get/groupcache.getter"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("spans of a load = %v; want %v", got, want)
+	}
+	for _, span := range spans {
+		if !span.ended || span.attrs["groupcache.group"] != g.Name() || span.attrs["groupcache.key"] != "local" {
+			t.Errorf("span %s: ended %v, attributes %v; want ended with the group and key", span.path, span.ended, span.attrs)
+		}
+	}
+
+	if err := g.Get(dummyCtx, "local", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	spans = tracer.take()
+	if len(spans) != 2 || spans[1].attrs["groupcache.cache"] != "main" {
+		t.Errorf("spans of a cache hit = %v; want the lookup hitting the main cache", spanPaths(spans))
+	}
+
+	if err := g.Get(dummyCtx, "remote-key", StringSink(&s), nil); err != nil {
+		t.Fatal(err)
+	}
+	spans = tracer.take()
+	if got, want := spanPaths(spans), []string{"groupcache.Get", "groupcache.Get/groupcache.lookupCache", "groupcache.Get/groupcache.getFromPeer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("spans of a peer fetch = %v; want %v", got, want)
+	}
+
+	if err := g.Get(dummyCtx, "failing", StringSink(&s), nil); err == nil {
+		t.Fatal("Get of a failing key succeeded")
+	}
+	spans = tracer.take()
+	if len(spans) != 3 || spans[0].err == nil || spans[2].err == nil {
+		t.Errorf("spans of a failed load = %v; want the Get and getter spans ended with the error", spanPaths(spans))
+	}
+}
@@ -0,0 +1,84 @@
+//go:build go1.18
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"time"
+)
+
+// A ValueCodec converts values of type T to and from the bytes stored
+// in a Group.
+type ValueCodec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte, v *T) error
+}
+
+// A TypedGroup is a Group holding values of type T. It marshals the
+// values returned by its loader into the underlying Group, and
+// unmarshals them on every Get, so peers, caches and duplicate
+// suppression work exactly as they do for the Group.
+type TypedGroup[T any] struct {
+	group *Group
+	codec ValueCodec[T]
+}
+
+// NewTypedGroup creates a TypedGroup and its underlying Group, as
+// NewGroup does, loading missing values with load.
+func NewTypedGroup[T any](name string, cacheBytes int64, codec ValueCodec[T], load func(ctx context.Context, key string) (T, error)) *TypedGroup[T] {
+	return newTypedGroup(name, cacheBytes, codec, load, nil)
+}
+
+func newTypedGroup[T any](name string, cacheBytes int64, codec ValueCodec[T], load func(ctx context.Context, key string) (T, error), peers PeerPicker) *TypedGroup[T] {
+	getter := GetterFunc(func(ctx context.Context, key string, dest Sink, fixFunc func() interface{}) error {
+		v, err := load(ctx, key)
+		if err != nil {
+			return err
+		}
+		b, err := codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return dest.SetBytes(b, time.Time{})
+	})
+	return &TypedGroup[T]{
+		group: newGroup(name, cacheBytes, getter, peers),
+		codec: codec,
+	}
+}
+
+// Group returns the underlying Group.
+func (g *TypedGroup[T]) Group() *Group {
+	return g.group
+}
+
+// Get returns the value of key, loading it if needed.
+func (g *TypedGroup[T]) Get(ctx context.Context, key string) (T, error) {
+	var (
+		view ByteView
+		v    T
+	)
+	if err := g.group.Get(ctx, key, ByteViewSink(&view), nil); err != nil {
+		return v, err
+	}
+	if err := g.codec.Unmarshal(view.ByteSlice(), &v); err != nil {
+		return v, &DecodeError{What: "typed value", Err: err}
+	}
+	return v, nil
+}
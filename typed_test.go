@@ -0,0 +1,71 @@
+//go:build go1.18
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) Marshal(v T) ([]byte, error)       { return json.Marshal(v) }
+func (jsonCodec[T]) Unmarshal(data []byte, v *T) error { return json.Unmarshal(data, v) }
+
+type typedUser struct {
+	ID    string
+	Name  string
+	Roles []string
+}
+
+func TestTypedGroup(t *testing.T) {
+	var loads int
+	errMissing := errors.New("no such user")
+	g := newTypedGroup("TestTypedGroup-group", cacheSize, jsonCodec[typedUser]{}, func(_ context.Context, key string) (typedUser, error) {
+		loads++
+		if key == "missing" {
+			return typedUser{}, errMissing
+		}
+		return typedUser{ID: key, Name: "user " + key, Roles: []string{"reader"}}, nil
+	}, NoPeers{})
+
+	want := typedUser{ID: "42", Name: "user 42", Roles: []string{"reader"}}
+	for i := 0; i < 2; i++ {
+		got, err := g.Get(dummyCtx, "42")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Get = %+v; want %+v", got, want)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loader called %d times; want 1", loads)
+	}
+	if _, ok := g.Group().Contains("42"); !ok {
+		t.Error("value not cached in the underlying group")
+	}
+
+	if _, err := g.Get(dummyCtx, "missing"); !errors.Is(err, errMissing) {
+		t.Errorf("Get(missing) error = %v; want %v", err, errMissing)
+	}
+}
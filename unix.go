@@ -0,0 +1,72 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// unixScheme prefixes the names of peers served on a Unix domain
+// socket, followed by the path of the socket.
+const unixScheme = "unix://"
+
+// unixHost is the host of the URLs requested from peers served on a
+// Unix domain socket, which their transport ignores.
+const unixHost = "http://unix"
+
+// unixSocket returns the path of the socket peer is served on, or ""
+// unless it is named by a unix:// URL.
+func unixSocket(peer string) string {
+	if !strings.HasPrefix(peer, unixScheme) {
+		return ""
+	}
+	return peer[len(unixScheme):]
+}
+
+// peerBaseURL returns the base URL of the requests made to peer under
+// basePath.
+func peerBaseURL(peer, basePath string) string {
+	if unixSocket(peer) != "" {
+		return unixHost + basePath
+	}
+	return peer + basePath
+}
+
+// unixTransport returns the transport of the requests made to the peer
+// served on socket, dialing it with HTTPPoolOptions.DialContext.
+func (p *HTTPPool) unixTransport(socket string) http.RoundTripper {
+	dial := p.opts.DialContext
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx, "unix", socket)
+	}
+	return tr
+}
+
+// Serve serves the pool's peers on l, for example a listener on the
+// Unix domain socket of a peer named "unix:///var/run/groupcache.sock",
+// until l fails. It always returns a non-nil error, like http.Serve.
+func (p *HTTPPool) Serve(l net.Listener) error {
+	return http.Serve(l, p)
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A PeerWatcher reports the peers of a pool as a discovery system, such
+// as DNS, etcd or Consul, sees them join and leave, for WatchPeers.
+//
+// A watcher for a system that pushes changes, such as an etcd watch on
+// the keys under a prefix, lists the peers once, then calls update
+// again on each change. PollWatcher covers systems that can only be
+// listed.
+type PeerWatcher interface {
+	// Watch calls update with the full list of peers every time it
+	// may have changed, until ctx is done or the watch fails, and
+	// returns the error that ended it.
+	Watch(ctx context.Context, update func(peers []string)) error
+}
+
+// A PeerSetter is a pool of peers that can be replaced, such as
+// HTTPPool and GRPCPool.
+type PeerSetter interface {
+	Set(peers ...string)
+}
+
+// WatchPeers sets the peers of pool to those reported by w, until ctx is
+// done or the watch fails, and returns the error that ended it. Lists
+// equal to the previous one, in any order, leave pool untouched. The
+// pool's own peer must be among the peers reported, as with Set.
+// WatchPeers is meant to run on a goroutine of its own.
+func WatchPeers(ctx context.Context, pool PeerSetter, w PeerWatcher) error {
+	var last []string
+	return w.Watch(ctx, func(peers []string) {
+		peers = append([]string(nil), peers...)
+		sort.Strings(peers)
+		if last != nil && equalStrings(peers, last) {
+			return
+		}
+		last = peers
+		pool.Set(peers...)
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultPollInterval is the default PollWatcher.Interval.
+const defaultPollInterval = 10 * time.Second
+
+// PollWatcher is a PeerWatcher listing the peers every Interval.
+// A failed listing is logged and leaves the peers as they were.
+type PollWatcher struct {
+	// List returns the current peers.
+	List func(ctx context.Context) ([]string, error)
+
+	// Interval is the time between listings.
+	// If zero, it defaults to 10 seconds.
+	Interval time.Duration
+}
+
+// Watch implements PeerWatcher. It lists the peers right away, then
+// every Interval, and returns ctx.Err() once ctx is done.
+func (w *PollWatcher) Watch(ctx context.Context, update func(peers []string)) error {
+	interval := w.Interval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		peers, err := w.List(ctx)
+		if err == nil {
+			update(peers)
+		} else if logger != nil && ctx.Err() == nil {
+			logger.WithFields(logrus.Fields{
+				"err":      err,
+				"category": "groupcache",
+			}).Errorf("error listing peers")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// lookupSRV is net.DefaultResolver.LookupSRV, replaced by tests.
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// NewDNSSRVWatcher returns a watcher listing the peers in the SRV
+// records of _service._proto.name every interval, as net.LookupSRV
+// does. Each peer is the target and port of a record, prefixed with
+// scheme and "://" if scheme is not empty: "http" suits HTTPPool, and
+// an empty scheme GRPCPool.
+// If interval is zero, it defaults to 10 seconds.
+func NewDNSSRVWatcher(service, proto, name, scheme string, interval time.Duration) *PollWatcher {
+	return &PollWatcher{
+		Interval: interval,
+		List: func(ctx context.Context) ([]string, error) {
+			_, addrs, err := lookupSRV(ctx, service, proto, name)
+			if err != nil {
+				return nil, err
+			}
+			peers := make([]string, 0, len(addrs))
+			for _, addr := range addrs {
+				peer := net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port)))
+				if scheme != "" {
+					peer = scheme + "://" + peer
+				}
+				peers = append(peers, peer)
+			}
+			return peers, nil
+		},
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package groupcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listWatcher reports each of its lists in turn, then ends the watch.
+type listWatcher [][]string
+
+func (w listWatcher) Watch(ctx context.Context, update func(peers []string)) error {
+	for _, peers := range w {
+		update(peers)
+	}
+	return errors.New("watch ended")
+}
+
+// recordingPool records the peers it is set to.
+type recordingPool struct {
+	mu   sync.Mutex
+	sets [][]string
+}
+
+func (p *recordingPool) Set(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sets = append(p.sets, peers)
+}
+
+func (p *recordingPool) calls() [][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]string(nil), p.sets...)
+}
+
+func TestWatchPeers(t *testing.T) {
+	var pool recordingPool
+	w := listWatcher{
+		{"http://a", "http://b"},
+		{"http://b", "http://a"}, // unchanged
+		{"http://a", "http://b", "http://c"},
+		{"http://c"},
+	}
+	if err := WatchPeers(context.Background(), &pool, w); err == nil || err.Error() != "watch ended" {
+		t.Errorf("WatchPeers = %v; want the error ending the watch", err)
+	}
+	want := [][]string{{"http://a", "http://b"}, {"http://a", "http://b", "http://c"}, {"http://c"}}
+	if got := pool.calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("peers set = %v; want %v", got, want)
+	}
+}
+
+func TestDNSSRVWatcher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		records = []*net.SRV{{Target: "a.example.net.", Port: 8000}, {Target: "b.example.net.", Port: 8001}}
+		fail    bool
+	)
+	defer func(old func(context.Context, string, string, string) (string, []*net.SRV, error)) { lookupSRV = old }(lookupSRV)
+	lookupSRV = func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if service != "groupcache" || proto != "tcp" || name != "example.net" {
+			t.Errorf("LookupSRV(%q, %q, %q); want groupcache, tcp, example.net", service, proto, name)
+		}
+		if fail {
+			return "", nil, errors.New("lookup failed")
+		}
+		return "_groupcache._tcp.example.net.", records, nil
+	}
+
+	pool := newHTTPPool("http://a.example.net:8000", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- WatchPeers(ctx, pool, NewDNSSRVWatcher("groupcache", "tcp", "example.net", "http", time.Millisecond))
+	}()
+	waitPeers := func(want ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var got []string
+			for _, h := range pool.GetAll() {
+				got = append(got, h.GetURL())
+			}
+			sort.Strings(got)
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("peers = %v; want %v", got, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitPeers("http://a.example.net:8000"+defaultBasePath, "http://b.example.net:8001"+defaultBasePath)
+
+	// A failed lookup keeps the peers; the next one updates them.
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	waitPeers("http://a.example.net:8000"+defaultBasePath, "http://b.example.net:8001"+defaultBasePath)
+	mu.Lock()
+	fail = false
+	records = records[:1]
+	mu.Unlock()
+	waitPeers("http://a.example.net:8000" + defaultBasePath)
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("WatchPeers after cancel = %v; want context.Canceled", err)
+	}
+}